@@ -0,0 +1,276 @@
+package meta
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// Bandwidth caps the rates, in bytes per second, at which the connections
+// of a listener are read and written. Zero leaves a rate unlimited.
+type Bandwidth struct {
+	// ConnRead and ConnWrite cap each connection.
+	ConnRead  int64
+	ConnWrite int64
+	// ListenerRead and ListenerWrite cap the connections of the listener
+	// together, sharing the rate between them.
+	ListenerRead  int64
+	ListenerWrite int64
+}
+
+// bandwidthGroup holds the limits of one listener ID and the limiters its
+// connections share.
+type bandwidthGroup struct {
+	mu    sync.Mutex
+	limit Bandwidth
+	read  *rateLimiter
+	write *rateLimiter
+}
+
+// SetBandwidth shapes the connections accepted from the listener with the
+// specified ID, which need not be added yet, so bandwidth can be shared
+// fairly between transports below the application: a Tor listener can be
+// kept from starving clearnet clients, for example. Connections accepted
+// afterwards are shaped; changes to the listener-wide rates also apply to
+// connections already open. The zero Bandwidth lifts the listener-wide
+// rates and the shaping of later connections.
+func (ml *MetaListener) SetBandwidth(id string, bw Bandwidth) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	if bw == (Bandwidth{}) {
+		if group, ok := ml.bandwidth[id]; ok {
+			group.set(bw)
+			delete(ml.bandwidth, id)
+		}
+		return
+	}
+	if ml.bandwidth == nil {
+		ml.bandwidth = make(map[string]*bandwidthGroup)
+	}
+	group, ok := ml.bandwidth[id]
+	if !ok {
+		group = &bandwidthGroup{read: &rateLimiter{}, write: &rateLimiter{}}
+		ml.bandwidth[id] = group
+	}
+	group.set(bw)
+}
+
+// set changes the limits of the group.
+func (g *bandwidthGroup) set(bw Bandwidth) {
+	g.mu.Lock()
+	g.limit = bw
+	g.mu.Unlock()
+	g.read.setRate(bw.ListenerRead)
+	g.write.setRate(bw.ListenerWrite)
+}
+
+// shape wraps conn, accepted from listener id, in the bandwidth limits set
+// for id, or returns it as is when there are none.
+func (ml *MetaListener) shape(id string, conn net.Conn) net.Conn {
+	ml.mu.RLock()
+	group := ml.bandwidth[id]
+	ml.mu.RUnlock()
+	if group == nil {
+		return conn
+	}
+	return group.shape(conn)
+}
+
+// Shaper applies a Bandwidth to connections that do not come from one
+// MetaListener listener, such as those a proxy accepts from several
+// listeners for the same service. Its listener-wide rates are shared by
+// every connection it shaped.
+type Shaper struct {
+	group *bandwidthGroup
+}
+
+// NewShaper returns a Shaper holding connections to bw.
+func NewShaper(bw Bandwidth) *Shaper {
+	s := &Shaper{group: &bandwidthGroup{read: &rateLimiter{}, write: &rateLimiter{}}}
+	s.group.set(bw)
+	return s
+}
+
+// Set changes the limits like SetBandwidth: connections shaped afterwards
+// get the new per-connection rates, and the shared rates change for
+// connections already open.
+func (s *Shaper) Set(bw Bandwidth) {
+	s.group.set(bw)
+}
+
+// Shape wraps conn in the Shaper's limits, or returns it as is when the
+// Shaper's Bandwidth is zero.
+func (s *Shaper) Shape(conn net.Conn) net.Conn {
+	s.group.mu.Lock()
+	unlimited := s.group.limit == (Bandwidth{})
+	s.group.mu.Unlock()
+	if unlimited {
+		return conn
+	}
+	return s.group.shape(conn)
+}
+
+// shape wraps conn in the limits of the group.
+func (g *bandwidthGroup) shape(conn net.Conn) net.Conn {
+	g.mu.Lock()
+	limit := g.limit
+	g.mu.Unlock()
+	return &shapedConn{
+		Conn:       conn,
+		connRead:   newRateLimiter(limit.ConnRead),
+		connWrite:  newRateLimiter(limit.ConnWrite),
+		groupRead:  g.read,
+		groupWrite: g.write,
+	}
+}
+
+// shapedConn is a connection whose reads and writes are held to the rates
+// of its own limiters and its listener's.
+type shapedConn struct {
+	net.Conn
+	connRead, connWrite   *rateLimiter
+	groupRead, groupWrite *rateLimiter
+}
+
+// Read reads, then waits until the bytes read fit the read rates.
+func (c *shapedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		time.Sleep(max(c.connRead.reserve(n), c.groupRead.reserve(n)))
+	}
+	return n, err
+}
+
+// Write writes b in pieces of at most a second's worth of the write rates,
+// waiting before each until it fits them.
+func (c *shapedConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		chunk := min(len(b)-written, c.connWrite.burst(), c.groupWrite.burst())
+		time.Sleep(max(c.connWrite.reserve(chunk), c.groupWrite.reserve(chunk)))
+		n, err := c.Conn.Write(b[written : written+chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Transport returns the transport the underlying connection reports.
+func (c *shapedConn) Transport() string {
+	if tc, ok := c.Conn.(transportConn); ok {
+		return tc.Transport()
+	}
+	return ""
+}
+
+// PeerID returns the peer identity the underlying connection reports.
+func (c *shapedConn) PeerID() string {
+	if tc, ok := c.Conn.(transportConn); ok {
+		return tc.PeerID()
+	}
+	return ""
+}
+
+// NegotiatedProtocol returns the ALPN protocol the underlying connection
+// reports.
+func (c *shapedConn) NegotiatedProtocol() string {
+	if pc, ok := c.Conn.(protocolConn); ok {
+		return pc.NegotiatedProtocol()
+	}
+	return ""
+}
+
+// ClientCertificate returns the verified client certificate the underlying
+// connection reports.
+func (c *shapedConn) ClientCertificate() *x509.Certificate {
+	if cc, ok := c.Conn.(clientCertConn); ok {
+		return cc.ClientCertificate()
+	}
+	return nil
+}
+
+// ConnectionState returns the TLS state of the underlying connection.
+func (c *shapedConn) ConnectionState() tls.ConnectionState {
+	return connectionState(c.Conn)
+}
+
+// CloseWrite shuts down the writing side of the underlying connection, or
+// closes it if it cannot be half-closed.
+func (c *shapedConn) CloseWrite() error {
+	return CloseWrite(c.Conn, c.Close)
+}
+
+// CloseRead shuts down the reading side of the underlying connection where
+// supported.
+func (c *shapedConn) CloseRead() error {
+	return CloseRead(c.Conn)
+}
+
+// rateLimiter is a token bucket holding up to a second's worth of bytes.
+// A nil rateLimiter or a zero rate does not limit.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter of rate bytes per second, or nil for a
+// zero rate.
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	rl := &rateLimiter{}
+	rl.setRate(rate)
+	return rl
+}
+
+// setRate changes the rate, starting from a full bucket.
+func (rl *rateLimiter) setRate(rate int64) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.rate = float64(max(rate, 0))
+	rl.tokens = rl.rate
+	rl.last = time.Now()
+}
+
+// burst returns the most bytes reserve may take at once without waiting.
+func (rl *rateLimiter) burst() int {
+	if rl == nil {
+		return math.MaxInt
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.rate == 0 {
+		return math.MaxInt
+	}
+	return max(int(rl.rate), 1)
+}
+
+// reserve takes n bytes from the bucket, going into debt if it holds
+// fewer, and returns how long to wait before they fit the rate.
+func (rl *rateLimiter) reserve(n int) time.Duration {
+	if rl == nil {
+		return 0
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.rate == 0 {
+		return 0
+	}
+	now := time.Now()
+	rl.tokens = min(rl.tokens+now.Sub(rl.last).Seconds()*rl.rate, rl.rate)
+	rl.last = now
+	rl.tokens -= float64(n)
+	if rl.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-rl.tokens / rl.rate * float64(time.Second))
+}
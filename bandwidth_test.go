@@ -0,0 +1,126 @@
+package meta
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// transportPipe is a connection reporting its transport.
+type transportPipe struct{ net.Conn }
+
+func (transportPipe) Transport() string { return "tls" }
+func (transportPipe) PeerID() string    { return "" }
+
+// TestBandwidth verifies that connections of a shaped listener are held to
+// their rate and keep reporting their transport.
+func TestBandwidth(t *testing.T) {
+	ml := NewMetaListener()
+	defer ml.Close()
+	ml.SetBandwidth("shaped", Bandwidth{ConnWrite: 1000})
+	listener := newMockListener("shaped")
+	if err := ml.AddListener("shaped", listener); err != nil {
+		t.Fatal(err)
+	}
+
+	server, client := net.Pipe()
+	defer client.Close()
+	listener.connCh <- transportPipe{server}
+	conn, err := ml.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if transport := conn.(ConnResult).Transport(); transport != "tls" {
+		t.Errorf("Transport = %q through the shaping, want tls", transport)
+	}
+
+	go io.Copy(io.Discard, client)
+	start := time.Now()
+	// A second's worth goes out at once, the rest at the rate
+	if _, err := conn.Write(make([]byte, 1500)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Writing 1500 bytes at 1000 B/s took %v, want about 500ms", elapsed)
+	}
+}
+
+// TestBandwidthGroup verifies that the connections of a listener share its
+// listener-wide rate.
+func TestBandwidthGroup(t *testing.T) {
+	ml := NewMetaListener()
+	defer ml.Close()
+	ml.SetBandwidth("shared", Bandwidth{ListenerRead: 1000})
+	listener := newMockListener("shared")
+	if err := ml.AddListener("shared", listener); err != nil {
+		t.Fatal(err)
+	}
+
+	var conns, clients []net.Conn
+	for range 2 {
+		server, client := net.Pipe()
+		defer client.Close()
+		listener.connCh <- server
+		conn, err := ml.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns, clients = append(conns, conn), append(clients, client)
+		go client.Write(make([]byte, 750))
+	}
+
+	start := time.Now()
+	done := make(chan struct{})
+	for _, conn := range conns {
+		go func() {
+			io.ReadFull(conn, make([]byte, 750))
+			done <- struct{}{}
+		}()
+	}
+	<-done
+	<-done
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("Reading 1500 bytes over two connections sharing 1000 B/s took %v, want about 500ms", elapsed)
+	}
+
+	// Lifting the limit applies to open connections
+	ml.SetBandwidth("shared", Bandwidth{})
+	go clients[0].Write(make([]byte, 3000))
+	start = time.Now()
+	if _, err := io.ReadFull(conns[0], make([]byte, 3000)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Reading after lifting the limit took %v", elapsed)
+	}
+}
+
+// TestShaper verifies that a Shaper leaves connections alone until it has
+// limits, and shapes those accepted afterwards.
+func TestShaper(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	shaper := NewShaper(Bandwidth{})
+	if conn := shaper.Shape(server); conn != server {
+		t.Errorf("Unlimited Shaper wrapped the connection in %T", conn)
+	}
+	shaper.Set(Bandwidth{ConnWrite: 1000})
+	conn := shaper.Shape(server)
+	if _, ok := conn.(*shapedConn); !ok {
+		t.Fatalf("Shape returned %T, want a shaped connection", conn)
+	}
+
+	go io.Copy(io.Discard, client)
+	start := time.Now()
+	if _, err := conn.Write(make([]byte, 1500)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("Writing 1500 bytes at 1000 B/s took %v, want about 500ms", elapsed)
+	}
+}
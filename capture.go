@@ -0,0 +1,349 @@
+package meta
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultCaptureLimit is how much of a connection is recorded when
+	// CapturePolicy.Limit is zero.
+	defaultCaptureLimit = 16 << 20
+	// defaultCaptureFiles is how many capture files are kept when
+	// CapturePolicy.MaxFiles is zero.
+	defaultCaptureFiles = 100
+	// captureExt ends the names of capture files; other files in the
+	// directory are left alone.
+	captureExt = ".cap"
+)
+
+// CapturePolicy selects the connections a Capture records and how much of
+// them it keeps.
+type CapturePolicy struct {
+	// Dir is the directory the capture files are written to, created if
+	// it does not exist.
+	Dir string
+	// Listeners are path.Match patterns of the listener IDs whose
+	// connections are recorded, such as "tls-*" or "onion-*". Empty records
+	// the connections of every listener.
+	Listeners []string
+	// Identities are path.Match patterns of the remote identities, as
+	// returned by ConnIdentity, whose connections are recorded, such as
+	// "203.0.113.7" or "*.b32.i2p". Empty records every client, including
+	// onion clients, which have no identity. A connection must match both
+	// lists to be recorded.
+	Identities []string
+	// Limit is how many bytes of each connection are recorded, both
+	// directions together; the rest of the connection is not. Zero
+	// records up to 16 MiB, the whole of most streams.
+	Limit int64
+	// MaxFiles is how many capture files are kept in Dir, one per
+	// connection; the oldest are removed as new ones are written. Zero
+	// keeps 100.
+	MaxFiles int
+}
+
+// limit returns the bytes recorded of each connection.
+func (p CapturePolicy) limit() int64 {
+	if p.Limit > 0 {
+		return p.Limit
+	}
+	return defaultCaptureLimit
+}
+
+// maxFiles returns how many capture files are kept.
+func (p CapturePolicy) maxFiles() int {
+	if p.MaxFiles > 0 {
+		return p.MaxFiles
+	}
+	return defaultCaptureFiles
+}
+
+// Capture records the streams of selected connections to files, after TLS
+// is terminated and from inside the Tor and I2P tunnels, where packet
+// capture tools cannot see them. It is meant for diagnosing protocol
+// problems of particular clients: the files hold what clients send in the
+// clear, credentials included, so they are written readable by the owner
+// only. One Capture can be shared by several MetaListeners, which then
+// rotate the same files.
+//
+// Each file starts with comment lines naming the listener, the client, and
+// the start time, followed by a record for every read and write:
+//
+//	< 2024-05-01T12:00:00.123456789Z 78
+//	GET / HTTP/1.1 ...
+//
+// The header line gives the direction, "<" for data from the client and
+// ">" for data to it, the time, and the number of bytes following it; a
+// newline ends each record.
+type Capture struct {
+	policy CapturePolicy
+	mu     sync.Mutex
+	// files are the capture files kept in the directory, oldest first
+	files []string
+	seq   uint64
+}
+
+// NewCapture returns a Capture applying policy, creating its directory.
+// Capture files already in the directory count towards MaxFiles.
+func NewCapture(policy CapturePolicy) (*Capture, error) {
+	if policy.Dir == "" {
+		return nil, fmt.Errorf("capture directory is empty")
+	}
+	for _, pattern := range append(append([]string(nil), policy.Listeners...), policy.Identities...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid capture pattern %q: %w", pattern, err)
+		}
+	}
+	if err := os.MkdirAll(policy.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create capture directory: %w", err)
+	}
+	files, err := filepath.Glob(filepath.Join(policy.Dir, "*"+captureExt))
+	if err != nil {
+		return nil, err
+	}
+	// The names start with the time the files were created
+	sort.Strings(files)
+	c := &Capture{policy: policy, files: files}
+	c.mu.Lock()
+	c.rotate()
+	c.mu.Unlock()
+	return c, nil
+}
+
+// Match reports whether the connections of identity accepted on listener
+// are recorded.
+func (c *Capture) Match(listener, identity string) bool {
+	return captureMatch(c.policy.Listeners, listener) && captureMatch(c.policy.Identities, identity)
+}
+
+// captureMatch reports whether s matches one of patterns, or patterns is
+// empty.
+func captureMatch(patterns []string, s string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// wrap returns conn recording its streams to a new capture file if its
+// listener and identity are selected, or conn itself otherwise or when the
+// file cannot be created.
+func (c *Capture) wrap(listener string, conn net.Conn) net.Conn {
+	identity := ConnIdentity(conn)
+	if !c.Match(listener, identity) {
+		return conn
+	}
+	file, err := c.create(listener)
+	if err != nil {
+		log.Printf("Not capturing connection from %s: %v", conn.RemoteAddr(), err)
+		return conn
+	}
+	fmt.Fprintf(file, "# listener: %s\n# identity: %s\n# remote: %s\n# started: %s\n",
+		listener, identity, conn.RemoteAddr(), time.Now().UTC().Format(time.RFC3339Nano))
+	log.Printf("Capturing connection from %s on %s to %s", conn.RemoteAddr(), listener, file.Name())
+	return &captureConn{Conn: conn, file: file, left: c.policy.limit()}
+}
+
+// create opens a new capture file for a connection of listener, removing
+// the oldest files beyond MaxFiles.
+func (c *Capture) create(listener string) (*os.File, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	name := fmt.Sprintf("%s-%06d-%s%s", time.Now().UTC().Format("20060102T150405.000000000Z"), c.seq%1000000, captureFileName(listener), captureExt)
+	name = filepath.Join(c.policy.Dir, name)
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	c.files = append(c.files, name)
+	c.rotate()
+	return file, nil
+}
+
+// rotate removes the oldest capture files beyond MaxFiles. The caller
+// holds c.mu.
+func (c *Capture) rotate() {
+	for len(c.files) > c.policy.maxFiles() {
+		if err := os.Remove(c.files[0]); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove capture file %s: %v", c.files[0], err)
+		}
+		c.files = c.files[1:]
+	}
+}
+
+// captureFileName replaces the characters of a listener ID that do not
+// belong in a file name, such as the colon of an address.
+func captureFileName(listener string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, listener)
+}
+
+// SetCapture makes the listeners of the MetaListener, and of its
+// namespaces, record the connections c selects. A nil c stops recording
+// new connections; those already recorded are until they close or reach
+// the limit.
+func (ml *MetaListener) SetCapture(c *Capture) {
+	ml.capture.Store(c)
+}
+
+// recordConn wraps conn, accepted on the listener id, in the Capture set
+// with SetCapture, if any.
+func (ml *MetaListener) recordConn(id string, conn net.Conn) net.Conn {
+	c := ml.capture.Load()
+	if c == nil {
+		return conn
+	}
+	return c.wrap(id, conn)
+}
+
+// captureConn is a connection whose reads and writes are recorded to a
+// capture file until its limit is reached.
+type captureConn struct {
+	net.Conn
+	mu   sync.Mutex
+	file *os.File
+	// left is how many more bytes are recorded
+	left   int64
+	closed atomic.Bool
+}
+
+// Read reads from the connection and records the data read.
+func (c *captureConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.record('<', b[:n])
+	}
+	return n, err
+}
+
+// Write writes to the connection and records the data written.
+func (c *captureConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.record('>', b[:n])
+	}
+	return n, err
+}
+
+// Close closes the connection and its capture file.
+func (c *captureConn) Close() error {
+	if c.closed.CompareAndSwap(false, true) {
+		c.mu.Lock()
+		c.finish("# closed\n")
+		c.mu.Unlock()
+	}
+	return c.Conn.Close()
+}
+
+// record appends data, read or written as dir says, to the capture file,
+// cut to the bytes left, and closes the file when none are.
+func (c *captureConn) record(dir byte, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file == nil {
+		return
+	}
+	truncated := int64(len(data)) > c.left
+	if truncated {
+		data = data[:c.left]
+	}
+	c.left -= int64(len(data))
+	if len(data) > 0 {
+		fmt.Fprintf(c.file, "%c %s %d\n", dir, time.Now().UTC().Format(time.RFC3339Nano), len(data))
+		c.file.Write(data)
+		if _, err := c.file.Write([]byte{'\n'}); err != nil {
+			log.Printf("Error writing capture file %s, no longer capturing: %v", c.file.Name(), err)
+			c.finish("")
+			return
+		}
+	}
+	if truncated || c.left == 0 {
+		c.finish("# limit reached\n")
+	}
+}
+
+// finish writes trailer to the capture file and closes it. The caller
+// holds c.mu.
+func (c *captureConn) finish(trailer string) {
+	if c.file == nil {
+		return
+	}
+	if trailer != "" {
+		c.file.WriteString(trailer)
+	}
+	c.file.Close()
+	c.file = nil
+}
+
+// Transport returns the transport the underlying connection reports.
+func (c *captureConn) Transport() string {
+	if tc, ok := c.Conn.(transportConn); ok {
+		return tc.Transport()
+	}
+	return ""
+}
+
+// PeerID returns the peer identity the underlying connection reports.
+func (c *captureConn) PeerID() string {
+	if tc, ok := c.Conn.(transportConn); ok {
+		return tc.PeerID()
+	}
+	return ""
+}
+
+// NegotiatedProtocol returns the ALPN protocol the underlying connection
+// reports.
+func (c *captureConn) NegotiatedProtocol() string {
+	if pc, ok := c.Conn.(protocolConn); ok {
+		return pc.NegotiatedProtocol()
+	}
+	return ""
+}
+
+// ClientCertificate returns the verified client certificate the underlying
+// connection reports.
+func (c *captureConn) ClientCertificate() *x509.Certificate {
+	if cc, ok := c.Conn.(clientCertConn); ok {
+		return cc.ClientCertificate()
+	}
+	return nil
+}
+
+// ConnectionState returns the TLS state of the underlying connection.
+func (c *captureConn) ConnectionState() tls.ConnectionState {
+	return connectionState(c.Conn)
+}
+
+// CloseWrite shuts down the writing side of the underlying connection, or
+// closes it if it cannot be half-closed.
+func (c *captureConn) CloseWrite() error {
+	return CloseWrite(c.Conn, c.Close)
+}
+
+// CloseRead shuts down the reading side of the underlying connection where
+// supported.
+func (c *captureConn) CloseRead() error {
+	return CloseRead(c.Conn)
+}
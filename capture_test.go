@@ -0,0 +1,82 @@
+package meta
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCapture verifies that the connections of selected listeners are
+// recorded in both directions up to the limit, and that old capture files
+// are removed.
+func TestCapture(t *testing.T) {
+	dir := t.TempDir()
+	capture, err := NewCapture(CapturePolicy{Dir: dir, Listeners: []string{"tcp-*"}, Identities: []string{"127.0.0.*"}, Limit: 12, MaxFiles: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ml := NewMetaListener()
+	defer ml.Close()
+	ml.SetCapture(capture)
+	addrs := make(map[string]string)
+	for _, id := range []string{"tcp-captured", "other"} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ml.AddListener(id, listener); err != nil {
+			t.Fatal(err)
+		}
+		addrs[id] = listener.Addr().String()
+	}
+
+	exchange := func(id string) {
+		t.Helper()
+		client, err := net.Dial("tcp", addrs[id])
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		conn := acceptWithin(t, ml, 5*time.Second)
+		if conn == nil {
+			t.Fatal("Connection not accepted")
+		}
+		client.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("pong, and more"))
+		conn.Close()
+	}
+	exchange("other")
+	exchange("tcp-captured")
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.cap"))
+	if len(files) != 1 || !strings.HasSuffix(files[0], "-tcp-captured.cap") {
+		t.Fatalf("Capture files %v, want one of tcp-captured", files)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"# listener: tcp-captured\n", "# identity: 127.0.0.1\n", " 4\nping\n", " 8\npong, an\n# limit reached\n"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("Capture file lacks %q:\n%s", want, data)
+		}
+	}
+
+	exchange("tcp-captured")
+	exchange("tcp-captured")
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.cap")); len(files) != 2 {
+		t.Errorf("%d capture files kept, want 2", len(files))
+	}
+
+	if _, err := NewCapture(CapturePolicy{Dir: dir, Identities: []string{"["}}); err == nil {
+		t.Error("Invalid pattern accepted")
+	}
+}
@@ -0,0 +1,141 @@
+package meta
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/go-i2p/go-meta-listener/tcp"
+)
+
+// ErrNoDialer is returned when no dialer is configured for the network an
+// address requires.
+var ErrNoDialer = errors.New("no dialer for network")
+
+// Network identifies the network an address is reached through.
+type Network string
+
+const (
+	// NetworkClearnet is the regular internet, dialed over TCP.
+	NetworkClearnet Network = "clearnet"
+	// NetworkTor reaches .onion addresses, and clearnet hosts through exits.
+	NetworkTor Network = "tor"
+	// NetworkI2P reaches .i2p and .b32.i2p addresses, and clearnet hosts
+	// through an outproxy.
+	NetworkI2P Network = "i2p"
+)
+
+// AddressNetwork returns the network that can reach address, a host or
+// host:port: NetworkTor for .onion names, NetworkI2P for .i2p names, and
+// NetworkClearnet for everything else.
+func AddressNetwork(address string) Network {
+	host := address
+	if h, _, err := net.SplitHostPort(address); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	switch {
+	case strings.HasSuffix(host, ".onion"):
+		return NetworkTor
+	case strings.HasSuffix(host, ".i2p"):
+		return NetworkI2P
+	default:
+		return NetworkClearnet
+	}
+}
+
+// DialFunc connects to address on the named network, like net.Dialer.DialContext.
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// MetaDialer is the outbound counterpart of MetaListener. It dials .onion
+// addresses through Tor, .i2p addresses through I2P, and everything else
+// over hardened TCP, so services reachable on several networks can call
+// peers on any of them through one net.Dialer-like value.
+//
+// Clearnet addresses can fall back to other networks: with
+// SetFallback(NetworkClearnet, NetworkTor), a host that cannot be reached
+// directly is retried through a Tor exit.
+type MetaDialer struct {
+	// mu protects dialers and fallback
+	mu sync.RWMutex
+	// dialers holds the dial function of each configured network
+	dialers map[Network]DialFunc
+	// fallback is the order in which networks are tried for clearnet addresses
+	fallback []Network
+}
+
+// NewMetaDialer creates a MetaDialer that dials clearnet addresses with
+// tcp.DialContext. Tor and I2P are unavailable until set with SetDialer.
+func NewMetaDialer() *MetaDialer {
+	return &MetaDialer{
+		dialers:  map[Network]DialFunc{NetworkClearnet: tcp.DialContext},
+		fallback: []Network{NetworkClearnet},
+	}
+}
+
+// SetDialer sets the dial function used for network. A nil dial removes it.
+func (md *MetaDialer) SetDialer(network Network, dial DialFunc) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	if dial == nil {
+		delete(md.dialers, network)
+		return
+	}
+	md.dialers[network] = dial
+}
+
+// SetFallback sets the networks tried, in order, for clearnet addresses.
+// Networks without a dialer are skipped. Onion and I2P addresses are always
+// dialed on their own network only.
+func (md *MetaDialer) SetFallback(order ...Network) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	md.fallback = append([]Network(nil), order...)
+}
+
+// Dial connects to address using DialContext with a background context.
+func (md *MetaDialer) Dial(network, address string) (net.Conn, error) {
+	return md.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to address on the network it belongs to. For
+// clearnet addresses each fallback network is tried in turn until one
+// succeeds or ctx is done; the returned error then joins every attempt's error.
+func (md *MetaDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	target := AddressNetwork(address)
+	order := []Network{target}
+	md.mu.RLock()
+	if target == NetworkClearnet {
+		order = md.fallback
+	}
+	dialers := make([]DialFunc, len(order))
+	for i, n := range order {
+		dialers[i] = md.dialers[n]
+	}
+	md.mu.RUnlock()
+
+	var errs []error
+	for i, dial := range dialers {
+		if dial == nil {
+			continue
+		}
+		conn, err := dial(ctx, network, address)
+		if err == nil {
+			return conn, nil
+		}
+		log.Printf("Dialing %s over %s failed: %v", address, order[i], err)
+		errs = append(errs, fmt.Errorf("%s: %w", order[i], err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("%w %s (address %s)", ErrNoDialer, target, address)
+	}
+	return nil, errors.Join(errs...)
+}
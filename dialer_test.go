@@ -0,0 +1,83 @@
+package meta
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+// TestAddressNetwork verifies classification of hidden and clearnet addresses.
+func TestAddressNetwork(t *testing.T) {
+	for address, want := range map[string]Network{
+		"example.org:443":        NetworkClearnet,
+		"127.0.0.1:80":           NetworkClearnet,
+		"[::1]:80":               NetworkClearnet,
+		"abcdef.onion:80":        NetworkTor,
+		"ABCDEF.ONION.":          NetworkTor,
+		"example.i2p:80":         NetworkI2P,
+		"abcdefghijk.b32.i2p:80": NetworkI2P,
+	} {
+		if got := AddressNetwork(address); got != want {
+			t.Errorf("AddressNetwork(%q) = %s, want %s", address, got, want)
+		}
+	}
+}
+
+// TestMetaDialerRouting verifies that hidden addresses use their own network
+// and clearnet addresses follow the fallback order.
+func TestMetaDialerRouting(t *testing.T) {
+	var calls []Network
+	dialer := NewMetaDialer()
+	record := func(network Network, fail bool) DialFunc {
+		return func(ctx context.Context, n, address string) (net.Conn, error) {
+			calls = append(calls, network)
+			if fail {
+				return nil, errors.New("unreachable")
+			}
+			client, server := net.Pipe()
+			server.Close()
+			return client, nil
+		}
+	}
+	dialer.SetDialer(NetworkClearnet, record(NetworkClearnet, true))
+	dialer.SetDialer(NetworkTor, record(NetworkTor, false))
+	dialer.SetFallback(NetworkClearnet, NetworkI2P, NetworkTor)
+
+	conn, err := dialer.Dial("tcp", "example.org:80")
+	if err != nil {
+		t.Fatalf("Dial with fallback failed: %v", err)
+	}
+	conn.Close()
+	if len(calls) != 2 || calls[0] != NetworkClearnet || calls[1] != NetworkTor {
+		t.Errorf("Expected clearnet then tor, got %v", calls)
+	}
+
+	calls = nil
+	if _, err := dialer.Dial("tcp", "peer.b32.i2p:80"); !errors.Is(err, ErrNoDialer) {
+		t.Errorf("Expected ErrNoDialer for I2P address, got %v", err)
+	}
+	if len(calls) != 0 {
+		t.Errorf("Expected no fallback for I2P address, got %v", calls)
+	}
+
+	dialer.SetDialer(NetworkTor, nil)
+	if _, err := dialer.Dial("tcp", "abcdef.onion:80"); !errors.Is(err, ErrNoDialer) {
+		t.Errorf("Expected ErrNoDialer after removing Tor dialer, got %v", err)
+	}
+}
+
+// TestMetaDialerClearnet verifies the default hardened TCP dialer.
+func TestMetaDialerClearnet(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	conn, err := NewMetaDialer().Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	conn.Close()
+}
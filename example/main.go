@@ -71,15 +71,12 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	// Shut down the HTTP server
-	if err := server.Shutdown(ctx); err != nil {
+	// Stop accepting, let active requests finish, then close the listeners
+	report, err := metaListener.ShutdownHTTP(ctx, server)
+	if err != nil {
 		log.Printf("Server shutdown error: %v", err)
 	}
-
-	// Wait for all listener goroutines to exit
-	if err := metaListener.WaitForShutdown(ctx); err != nil {
-		log.Printf("Timed out waiting for listener shutdown: %v", err)
-	}
+	log.Printf("Closed %d listeners, dropped %d unserved connections", len(report.Listeners), report.Dropped)
 
 	log.Println("Server stopped")
 }
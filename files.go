@@ -0,0 +1,44 @@
+package meta
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// filer is implemented by listeners backed by a file descriptor, such as
+// *net.TCPListener and *net.UnixListener. Wrappers that implement it for
+// whatever they wrap return errors.ErrUnsupported when it has none.
+type filer interface {
+	File() (*os.File, error)
+}
+
+// Files returns, by listener ID, duplicates of the file descriptors of the
+// file-backed listeners, so an external supervisor or a replacement process
+// can take over their sockets. Listeners without a file descriptor, such as
+// those of Tor or I2P, are left out. The files are the caller's to close;
+// closing them or the MetaListener does not affect the other.
+func (ml *MetaListener) Files() (map[string]*os.File, error) {
+	ml.mu.RLock()
+	defer ml.mu.RUnlock()
+
+	files := make(map[string]*os.File, len(ml.listeners))
+	for id, listener := range ml.listeners {
+		f, ok := listener.(filer)
+		if !ok {
+			continue
+		}
+		file, err := f.File()
+		if errors.Is(err, errors.ErrUnsupported) {
+			continue
+		}
+		if err != nil {
+			for _, file := range files {
+				file.Close()
+			}
+			return nil, fmt.Errorf("duplicating %s listener: %w", id, err)
+		}
+		files[id] = file
+	}
+	return files, nil
+}
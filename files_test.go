@@ -0,0 +1,82 @@
+package meta
+
+import (
+	"net"
+	"testing"
+
+	"github.com/go-i2p/go-meta-listener/tcp"
+)
+
+// TestFiles verifies that file-backed listeners are returned as files that
+// keep accepting after the MetaListener is closed, and that other
+// listeners are left out.
+func TestFiles(t *testing.T) {
+	ml := NewMetaListener()
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ml.AddListener("tcp", tcp); err != nil {
+		t.Fatal(err)
+	}
+	if err := ml.AddListener("mock", newMockListener("mock")); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := ml.Files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files["tcp"] == nil {
+		t.Fatalf("Files() = %v, want only the tcp listener", files)
+	}
+	defer files["tcp"].Close()
+	ml.Close()
+
+	taken, err := net.FileListener(files["tcp"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	client, err := net.Dial("tcp", taken.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := taken.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+// TestFilesHardened verifies that listeners of the tcp package, which wrap
+// their *net.TCPListener, are returned as files too.
+func TestFilesHardened(t *testing.T) {
+	ml := NewMetaListener()
+	defer ml.Close()
+	listener, err := tcp.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ml.AddListener("tcp", listener); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := ml.Files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files["tcp"] == nil {
+		t.Fatalf("Files() = %v, want the tcp listener", files)
+	}
+	defer files["tcp"].Close()
+	taken, err := net.FileListener(files["tcp"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	if taken.Addr().String() != listener.Addr().String() {
+		t.Errorf("File listens on %s, want %s", taken.Addr(), listener.Addr())
+	}
+}
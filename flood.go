@@ -0,0 +1,328 @@
+package meta
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// defaultFloodDecay is how long an identity must go without a ban for one
+// offense to be forgiven, unless FloodPolicy.Decay says otherwise.
+const defaultFloodDecay = time.Hour
+
+// FloodPolicy says how fast one remote identity may open connections
+// before it is banned. A zero Rate disables the policy.
+type FloodPolicy struct {
+	// Rate is the connections per second an identity may sustain.
+	Rate float64
+	// Burst is the connections an identity may open at once beyond Rate.
+	// Zero allows Rate rounded up, and at least one.
+	Burst int
+	// Ban is how long an identity going over the rate is refused on its
+	// first offense; the ban doubles with every repeat offense. Zero only
+	// refuses the connections over the rate.
+	Ban time.Duration
+	// MaxBan caps the doubled bans. Zero keeps every ban at Ban.
+	MaxBan time.Duration
+	// Decay is how long an identity must go without a ban for one of its
+	// offenses to be forgiven, so bans shrink again for reformed clients.
+	// Zero means an hour.
+	Decay time.Duration
+}
+
+// burst returns the bucket size of p.
+func (p FloodPolicy) burst() float64 {
+	if p.Burst > 0 {
+		return float64(p.Burst)
+	}
+	return max(1, float64(int(p.Rate+0.999)))
+}
+
+// ban returns how long the offenses-th ban lasts.
+func (p FloodPolicy) ban(offenses int) time.Duration {
+	ban := p.Ban
+	for i := 1; i < offenses && ban < p.MaxBan; i++ {
+		ban *= 2
+	}
+	if p.MaxBan > p.Ban && ban > p.MaxBan {
+		ban = p.MaxBan
+	}
+	return ban
+}
+
+// decay returns the forgiveness period of p.
+func (p FloodPolicy) decay() time.Duration {
+	if p.Decay > 0 {
+		return p.Decay
+	}
+	return defaultFloodDecay
+}
+
+// BanEventType identifies what happened to a ban.
+type BanEventType int
+
+const (
+	// BanStarted means an identity was banned for flooding.
+	BanStarted BanEventType = iota
+	// BanExpired means a ban ran out.
+	BanExpired
+	// BanLifted means a ban was lifted early with Unban.
+	BanLifted
+)
+
+// String returns the lowercase name of the event type.
+func (t BanEventType) String() string {
+	switch t {
+	case BanStarted:
+		return "ban"
+	case BanExpired:
+		return "expire"
+	case BanLifted:
+		return "unban"
+	default:
+		return "unknown"
+	}
+}
+
+// BanEvent reports that a remote identity was banned or that its ban
+// ended.
+type BanEvent struct {
+	Type BanEventType
+	// Identity is the client concerned, as returned by ConnIdentity.
+	Identity string
+	// Listener is, for BanStarted, the ID of the listener the offending
+	// connection came from; the ban applies to every listener sharing the
+	// FloodGuard.
+	Listener string
+	// Until is when the ban ends, or ended.
+	Until time.Time
+	// Offenses is the number of bans the identity has not been forgiven,
+	// the one concerned included.
+	Offenses int
+}
+
+// floodState is what a FloodGuard knows about one identity.
+type floodState struct {
+	tokens      float64
+	refilled    time.Time
+	bannedUntil time.Time
+	lastBan     time.Time
+	offenses    int
+	// banned is set from a ban until its end is reported
+	banned bool
+}
+
+// FloodGuard detects connection floods per remote identity and bans the
+// identities causing them. One guard can be shared by several
+// MetaListeners, including those of a mirror.Mirror, so a client flooding
+// one listener is refused on all of them.
+type FloodGuard struct {
+	mu      sync.Mutex
+	policy  FloodPolicy
+	onBan   func(BanEvent)
+	clients map[string]*floodState
+	checks  int
+	now     func() time.Time
+}
+
+// NewFloodGuard returns a FloodGuard applying policy. onBan, if not nil,
+// is called when a ban starts and when it expires or is lifted, for example
+// to block clients at the firewall with BanLog, and must not block.
+func NewFloodGuard(policy FloodPolicy, onBan func(BanEvent)) *FloodGuard {
+	return &FloodGuard{
+		policy:  policy,
+		onBan:   onBan,
+		clients: make(map[string]*floodState),
+		now:     time.Now,
+	}
+}
+
+// SetPolicy changes the policy. Current bans run out as they were given.
+func (g *FloodGuard) SetPolicy(policy FloodPolicy) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.policy = policy
+}
+
+// Allow records a connection of identity from listener and reports
+// whether it may be accepted. Connections without an identity are always
+// allowed.
+func (g *FloodGuard) Allow(identity, listener string) bool {
+	if g == nil || identity == "" {
+		return true
+	}
+	g.mu.Lock()
+	p := g.policy
+	if p.Rate <= 0 {
+		g.mu.Unlock()
+		return true
+	}
+	now := g.now()
+	g.checks++
+	if g.checks%256 == 0 {
+		g.sweep(now)
+	}
+
+	c := g.clients[identity]
+	if c == nil {
+		c = &floodState{tokens: p.burst(), refilled: now}
+		g.clients[identity] = c
+	}
+	if now.Before(c.bannedUntil) {
+		g.mu.Unlock()
+		return false
+	}
+	c.tokens = min(p.burst(), c.tokens+now.Sub(c.refilled).Seconds()*p.Rate)
+	c.refilled = now
+	if c.tokens >= 1 {
+		c.tokens--
+		g.mu.Unlock()
+		return true
+	}
+	if p.Ban <= 0 {
+		g.mu.Unlock()
+		return false
+	}
+
+	if c.offenses > 0 {
+		c.offenses = max(0, c.offenses-int(now.Sub(c.lastBan)/p.decay()))
+	}
+	c.offenses++
+	c.lastBan = now
+	c.bannedUntil = now.Add(p.ban(c.offenses))
+	c.banned = true
+	event := BanEvent{Type: BanStarted, Identity: identity, Listener: listener, Until: c.bannedUntil, Offenses: c.offenses}
+	g.mu.Unlock()
+
+	log.Printf("Banned %s until %s for flooding listener %s (offense %d)", identity, event.Until.Format(time.RFC3339), listener, event.Offenses)
+	time.AfterFunc(event.Until.Sub(now), func() { g.expire(identity, event.Until) })
+	g.emit(event)
+	return false
+}
+
+// expire reports the end of the ban of identity until until, unless it was
+// lifted before.
+func (g *FloodGuard) expire(identity string, until time.Time) {
+	g.mu.Lock()
+	c := g.clients[identity]
+	if c == nil || !c.banned || !c.bannedUntil.Equal(until) {
+		g.mu.Unlock()
+		return
+	}
+	c.banned = false
+	event := BanEvent{Type: BanExpired, Identity: identity, Until: until, Offenses: c.offenses}
+	g.mu.Unlock()
+
+	log.Printf("Ban of %s expired", identity)
+	g.emit(event)
+}
+
+// emit passes event to the guard's handler, if any.
+func (g *FloodGuard) emit(event BanEvent) {
+	if g.onBan != nil {
+		g.onBan(event)
+	}
+}
+
+// Bans returns the identities currently banned and when their bans end.
+func (g *FloodGuard) Bans() map[string]time.Time {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	bans := make(map[string]time.Time)
+	for id, c := range g.clients {
+		if now.Before(c.bannedUntil) {
+			bans[id] = c.bannedUntil
+		}
+	}
+	return bans
+}
+
+// Unban lifts the ban of identity and forgives its offenses, reporting
+// whether it was banned.
+func (g *FloodGuard) Unban(identity string) bool {
+	g.mu.Lock()
+	c, ok := g.clients[identity]
+	if !ok {
+		g.mu.Unlock()
+		return false
+	}
+	delete(g.clients, identity)
+	g.mu.Unlock()
+
+	if !c.banned {
+		return false
+	}
+	log.Printf("Lifted the ban of %s", identity)
+	g.emit(BanEvent{Type: BanLifted, Identity: identity, Until: c.bannedUntil, Offenses: c.offenses})
+	return true
+}
+
+// sweep forgets identities with a full bucket and no ban or offense left,
+// so the table does not grow with every client ever seen. g.mu must be
+// held.
+func (g *FloodGuard) sweep(now time.Time) {
+	refill := time.Duration(g.policy.burst() / g.policy.Rate * float64(time.Second))
+	for id, c := range g.clients {
+		forgiven := c.offenses == 0 || now.Sub(c.lastBan) >= time.Duration(c.offenses)*g.policy.decay()
+		if forgiven && !c.banned && now.Sub(c.refilled) >= refill {
+			delete(g.clients, id)
+		}
+	}
+}
+
+// BanLog returns a ban event handler writing a line to w for every ban
+// of an IP address and for its end, in a format fail2ban and scripts
+// maintaining nftables sets can match, such as
+//
+//	2024-05-01T12:00:00Z meta-listener: ban 203.0.113.7 until=2024-05-01T12:10:00Z listener=tls offenses=1
+//	2024-05-01T12:10:00Z meta-listener: expire 203.0.113.7 until=2024-05-01T12:10:00Z listener= offenses=1
+//
+// A fail2ban filter can use "^\S+ meta-listener: ban <HOST> " as failregex
+// with maxretry = 1. Identities that are not IP addresses, such as I2P
+// destinations, cannot be blocked at a firewall and are left out.
+func BanLog(w io.Writer) func(BanEvent) {
+	var mu sync.Mutex
+	return func(e BanEvent) {
+		if net.ParseIP(e.Identity) == nil {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintf(w, "%s meta-listener: %s %s until=%s listener=%s offenses=%d\n",
+			time.Now().UTC().Format(time.RFC3339), e.Type, e.Identity, e.Until.UTC().Format(time.RFC3339), e.Listener, e.Offenses)
+	}
+}
+
+// SetFloodGuard makes the listeners of the MetaListener, and of its
+// namespaces, close the connections of identities g refuses right after
+// accepting them, counting them in Stats.Refused. A nil g turns flood
+// detection off.
+func (ml *MetaListener) SetFloodGuard(g *FloodGuard) {
+	ml.flood.Store(g)
+}
+
+// ConnIdentity returns the remote identity flood detection tracks for
+// conn: the peer identity the connection reports, such as the .b32.i2p
+// address of I2P clients, or else the IP address of its remote end. Onion
+// service clients have no identity, since Tor relays them all from the
+// same local address, and get "".
+func ConnIdentity(conn net.Conn) string {
+	if tc, ok := conn.(transportConn); ok {
+		if id := tc.PeerID(); id != "" {
+			return id
+		}
+		// mirror.TransportOnion
+		if tc.Transport() == "onion" {
+			return ""
+		}
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
@@ -0,0 +1,156 @@
+package meta
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestFloodGuard verifies bursts, escalating bans, their decay, and Unban.
+func TestFloodGuard(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	var events []BanEvent
+	g := NewFloodGuard(FloodPolicy{Rate: 1, Burst: 2, Ban: time.Minute, MaxBan: 3 * time.Minute, Decay: time.Hour},
+		func(e BanEvent) { events = append(events, e) })
+	g.now = func() time.Time { return now }
+
+	if !g.Allow("a", "tcp") || !g.Allow("a", "tcp") {
+		t.Fatal("Burst refused")
+	}
+	if g.Allow("a", "tcp") {
+		t.Fatal("Connection over the burst allowed")
+	}
+	if !g.Allow("b", "tcp") || !g.Allow("", "tcp") {
+		t.Error("Other identities refused")
+	}
+	if len(events) != 1 || events[0].Identity != "a" || events[0].Listener != "tcp" || events[0].Offenses != 1 || !events[0].Until.Equal(now.Add(time.Minute)) {
+		t.Fatalf("Ban events = %+v", events)
+	}
+	now = now.Add(30 * time.Second)
+	if g.Allow("a", "i2p") {
+		t.Error("Banned identity allowed on another listener")
+	}
+	if bans := g.Bans(); len(bans) != 1 || !bans["a"].Equal(events[0].Until) {
+		t.Errorf("Bans = %v", bans)
+	}
+
+	// Repeat offenses double the ban up to MaxBan
+	for i, want := range []time.Duration{2 * time.Minute, 3 * time.Minute} {
+		now = events[len(events)-1].Until
+		for g.Allow("a", "tcp") {
+		}
+		if got := events[len(events)-1]; got.Offenses != i+2 || got.Until.Sub(now) != want {
+			t.Errorf("Offense %d banned for %v, want %v", got.Offenses, got.Until.Sub(now), want)
+		}
+	}
+
+	// Two hours without a ban forgive two of the three offenses
+	now = now.Add(2 * time.Hour)
+	for g.Allow("a", "tcp") {
+	}
+	if got := events[len(events)-1]; got.Offenses != 2 || got.Until.Sub(now) != 2*time.Minute {
+		t.Errorf("After decay banned as offense %d for %v", got.Offenses, got.Until.Sub(now))
+	}
+
+	if !g.Unban("a") || !g.Allow("a", "tcp") {
+		t.Error("Unban did not lift the ban")
+	}
+	if g.Unban("c") {
+		t.Error("Unban of an unknown identity reported a ban")
+	}
+}
+
+// TestSetFloodGuard verifies that a MetaListener closes the connections of
+// banned identities and counts them.
+func TestSetFloodGuard(t *testing.T) {
+	ml := NewMetaListener()
+	defer ml.Close()
+	g := NewFloodGuard(FloodPolicy{Rate: 0.001, Burst: 1, Ban: time.Hour}, nil)
+	ml.SetFloodGuard(g)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ml.AddListener("tcp", listener); err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2 {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+	conn := acceptWithin(t, ml, 5*time.Second)
+	if conn == nil {
+		t.Fatal("First connection not accepted")
+	}
+	conn.Close()
+	if conn := acceptWithin(t, ml, 200*time.Millisecond); conn != nil {
+		t.Error("Connection of a banned identity accepted")
+	}
+	if stats := ml.Stats(); stats.Refused != 1 {
+		t.Errorf("Stats.Refused = %d, want 1", stats.Refused)
+	}
+	if _, banned := g.Bans()["127.0.0.1"]; !banned {
+		t.Error("127.0.0.1 not banned")
+	}
+	if got := ConnIdentity(conn); got != "127.0.0.1" {
+		t.Errorf("ConnIdentity = %q, want 127.0.0.1", got)
+	}
+}
+
+// TestBanEvents verifies that the end of bans is reported, whether they
+// expire or are lifted, and the lines BanLog writes for them.
+func TestBanEvents(t *testing.T) {
+	var log strings.Builder
+	events := make(chan BanEvent, 10)
+	writeLog := BanLog(&log)
+	g := NewFloodGuard(FloodPolicy{Rate: 0.001, Burst: 1, Ban: 50 * time.Millisecond}, func(e BanEvent) {
+		writeLog(e)
+		events <- e
+	})
+
+	for _, id := range []string{"203.0.113.7", "abc.b32.i2p"} {
+		g.Allow(id, "tls")
+		g.Allow(id, "tls")
+		if e := <-events; e.Type != BanStarted || e.Identity != id {
+			t.Errorf("First event %+v, want %s banned", e, id)
+		}
+	}
+	for range 2 {
+		select {
+		case e := <-events:
+			if e.Type != BanExpired {
+				t.Errorf("Event %+v, want an expiry", e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expiry not reported")
+		}
+	}
+
+	g.SetPolicy(FloodPolicy{Rate: 0.001, Burst: 1, Ban: time.Hour})
+	if g.Allow("203.0.113.7", "tls") {
+		t.Fatal("Connection with an empty bucket allowed")
+	}
+	<-events
+	if !g.Unban("203.0.113.7") {
+		t.Fatal("Unban found no ban")
+	}
+	if e := <-events; e.Type != BanLifted || e.Identity != "203.0.113.7" {
+		t.Errorf("Event %+v, want the ban lifted", e)
+	}
+
+	lines := strings.Split(strings.TrimSpace(log.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("BanLog wrote %q, want 4 lines for the IP address only", log.String())
+	}
+	for i, action := range []string{"ban", "expire", "ban", "unban"} {
+		fields := strings.Fields(lines[i])
+		if len(fields) != 7 || fields[1] != "meta-listener:" || fields[2] != action || fields[3] != "203.0.113.7" {
+			t.Errorf("Line %q, want a %s of 203.0.113.7", lines[i], action)
+		}
+	}
+}
@@ -3,24 +3,37 @@ module github.com/go-i2p/go-meta-listener
 go 1.23.5
 
 require (
+	github.com/BurntSushi/toml v1.5.0
+	github.com/caddyserver/certmagic v0.21.4
+	github.com/cretz/bine v0.2.0
+	github.com/go-i2p/i2pkeys v0.33.92
 	github.com/go-i2p/logger v0.0.0-20241123010126-3050657e5d0c
 	github.com/go-i2p/onramp v0.33.92
+	github.com/go-i2p/sam3 v0.33.92
+	github.com/mholt/acmez/v2 v2.0.3
 	github.com/opd-ai/wileedot v0.0.0-20241217172720-521d4175e624
 	github.com/samber/oops v1.19.0
+	github.com/sirupsen/logrus v1.9.3
+	golang.org/x/crypto v0.40.0
+	golang.org/x/net v0.42.0
+	golang.org/x/sys v0.34.0
 )
 
 require (
-	github.com/cretz/bine v0.2.0 // indirect
-	github.com/go-i2p/i2pkeys v0.33.92 // indirect
-	github.com/go-i2p/sam3 v0.33.92 // indirect
+	github.com/caddyserver/zerossl v0.1.3 // indirect
+	github.com/klauspost/cpuid/v2 v2.2.8 // indirect
+	github.com/libdns/libdns v0.2.2 // indirect
+	github.com/miekg/dns v1.1.62 // indirect
 	github.com/oklog/ulid/v2 v2.1.1 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/samber/lo v1.51.0 // indirect
-	github.com/sirupsen/logrus v1.9.3 // indirect
+	github.com/zeebo/blake3 v0.2.4 // indirect
 	go.opentelemetry.io/otel v1.37.0 // indirect
 	go.opentelemetry.io/otel/trace v1.37.0 // indirect
-	golang.org/x/crypto v0.40.0 // indirect
-	golang.org/x/net v0.42.0 // indirect
-	golang.org/x/sys v0.34.0 // indirect
+	go.uber.org/multierr v1.11.0 // indirect
+	go.uber.org/zap v1.27.0 // indirect
+	golang.org/x/mod v0.25.0 // indirect
+	golang.org/x/sync v0.16.0 // indirect
 	golang.org/x/text v0.27.0 // indirect
+	golang.org/x/tools v0.34.0 // indirect
 )
@@ -1,6 +1,7 @@
 package meta
 
 import (
+	"context"
 	"net"
 	"strings"
 	"sync/atomic"
@@ -8,9 +9,13 @@ import (
 )
 
 // handleListener runs in a separate goroutine for each added listener
-// and forwards accepted connections to the connCh channel.
-func (ml *MetaListener) handleListener(id string, listener net.Listener) {
+// and forwards accepted connections to the connCh channel, or to ns when
+// the listener belongs to a namespace. The connections get a context
+// derived from ctx, cancelled when the listener stops.
+func (ml *MetaListener) handleListener(ctx context.Context, id string, listener net.Listener, ns *Namespace) {
 	defer ml.recoverAndCleanup(id)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
 	for {
 		if ml.shouldStopListener(id) {
@@ -21,14 +26,24 @@ func (ml *MetaListener) handleListener(id string, listener net.Listener) {
 
 		conn, err := listener.Accept()
 		if err != nil {
-			if ml.handleAcceptError(id, err) {
+			if ml.handleAcceptError(id, listener, err) {
 				continue
 			}
 			return
 		}
 
 		log.Printf("Listener %s accepted connection from %s", id, conn.RemoteAddr())
-		ml.forwardConnection(id, conn)
+		if !ml.flood.Load().Allow(ConnIdentity(conn), id) {
+			ml.refuse(conn, ns)
+			continue
+		}
+		conn = ml.shape(id, conn)
+		conn = ml.recordConn(id, conn)
+		if ns != nil {
+			ns.forwardConnection(ctx, id, conn)
+			continue
+		}
+		ml.forwardConnection(ctx, id, conn)
 	}
 }
 
@@ -61,7 +76,7 @@ func (ml *MetaListener) setAcceptDeadline(listener net.Listener) {
 
 // handleAcceptError processes errors from listener.Accept() and determines if processing should continue.
 // Returns true if the listener should continue processing, false if it should stop.
-func (ml *MetaListener) handleAcceptError(id string, err error) bool {
+func (ml *MetaListener) handleAcceptError(id string, listener net.Listener, err error) bool {
 	// Check if this is a timeout error (which we expect due to our deadline)
 	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 		return true
@@ -82,11 +97,32 @@ func (ml *MetaListener) handleAcceptError(id string, err error) bool {
 		return false
 	}
 
+	// Listeners closed by RemoveListener or ShutdownHTTP are already gone,
+	// and those WatchInterfaces closed may have been replaced under their ID
+	ml.mu.RLock()
+	registered := ml.listeners[id] == listener
+	ml.mu.RUnlock()
+	if !registered {
+		log.Printf("Listener %s closed after removal", id)
+		return false
+	}
+
 	log.Printf("Permanent error in %s listener: %v, stopping", id, err)
 	ml.signalListenerRemoval(id)
 	return false
 }
 
+// refuse closes conn, accepted from a flooding or banned identity,
+// counting it for the MetaListener and ns, if the listener belongs to one.
+func (ml *MetaListener) refuse(conn net.Conn, ns *Namespace) {
+	log.Printf("Refusing connection from %s", conn.RemoteAddr())
+	ml.refused.Add(1)
+	if ns != nil {
+		ns.refused.Add(1)
+	}
+	conn.Close()
+}
+
 // signalListenerRemoval attempts to signal that a listener should be removed.
 func (ml *MetaListener) signalListenerRemoval(id string) {
 	select {
@@ -98,16 +134,22 @@ func (ml *MetaListener) signalListenerRemoval(id string) {
 }
 
 // forwardConnection attempts to forward a connection through the connection channel.
-func (ml *MetaListener) forwardConnection(id string, conn net.Conn) {
+func (ml *MetaListener) forwardConnection(ctx context.Context, id string, conn net.Conn) {
+	ml.addPending(id, 1)
 	select {
-	case ml.connCh <- ConnResult{Conn: conn, src: id}:
+	case ml.connCh <- ConnResult{Conn: conn, src: id, ctx: ctx}:
+		ml.accepted.Add(1)
 		log.Printf("Connection from %s successfully forwarded via %s", conn.RemoteAddr(), id)
 	case <-ml.closeCh:
 		log.Printf("MetaListener closing while forwarding connection, closing connection")
+		ml.addPending(id, -1)
+		ml.dropped.Add(1)
 		conn.Close()
 	case <-time.After(5 * time.Second):
 		// If we can't forward within 5 seconds, something is seriously wrong
 		log.Printf("WARNING: Connection forwarding timed out, closing connection from %s", conn.RemoteAddr())
+		ml.addPending(id, -1)
+		ml.dropped.Add(1)
 		conn.Close()
 	}
 }
@@ -18,8 +18,29 @@ func (ml *MetaListener) Accept() (net.Conn, error) {
 	return ml.waitForConnection()
 }
 
+// noListenersPoll is how often Accept checks whether listeners remain when
+// it fails right away without them.
+const noListenersPoll = 100 * time.Millisecond
+
+// SetNoListenersTimeout makes Accept return ErrNoListeners when no listeners
+// are registered, instead of blocking until one is added, so a server
+// started without any is noticed rather than left hanging. With a timeout
+// of zero, Accept fails as soon as it finds no listeners; with a positive
+// one, once there have been none for about that long. A negative timeout
+// restores the default of blocking. Listeners added through a Namespace do
+// not count, since Accept never returns their connections.
+//
+// Connections already accepted from removed listeners are returned first.
+func (ml *MetaListener) SetNoListenersTimeout(timeout time.Duration) {
+	ml.noListenersTimeout.Store(int64(timeout))
+	ml.failWithoutListeners.Store(timeout >= 0)
+}
+
 // waitForConnection waits for the next available connection from any managed listener.
 func (ml *MetaListener) waitForConnection() (net.Conn, error) {
+	if ml.failWithoutListeners.Load() {
+		return ml.waitForConnectionOrListeners(time.Duration(ml.noListenersTimeout.Load()))
+	}
 	for {
 		select {
 		case result, ok := <-ml.connCh:
@@ -27,7 +48,7 @@ func (ml *MetaListener) waitForConnection() (net.Conn, error) {
 				return nil, ErrListenerClosed
 			}
 			// Access RemoteAddr() directly on the connection
-			return result, nil
+			return ml.taken(result), nil
 		case <-ml.closeCh:
 			// Double-check the closed state using atomic operation
 			if atomic.LoadInt64(&ml.isClosed) != 0 {
@@ -38,6 +59,56 @@ func (ml *MetaListener) waitForConnection() (net.Conn, error) {
 	}
 }
 
+// waitForConnectionOrListeners is waitForConnection, returning
+// ErrNoListeners once there have been no listeners of its own for timeout.
+func (ml *MetaListener) waitForConnectionOrListeners(timeout time.Duration) (net.Conn, error) {
+	var emptySince time.Time
+	if ml.ownCount() == 0 {
+		if timeout == 0 {
+			select {
+			case result, ok := <-ml.connCh:
+				if ok {
+					return ml.taken(result), nil
+				}
+			default:
+			}
+			return nil, ErrNoListeners
+		}
+		emptySince = time.Now()
+	}
+
+	interval := timeout
+	if interval == 0 {
+		interval = noListenersPoll
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case result, ok := <-ml.connCh:
+			if !ok {
+				return nil, ErrListenerClosed
+			}
+			return ml.taken(result), nil
+		case <-ml.closeCh:
+			if atomic.LoadInt64(&ml.isClosed) != 0 {
+				return nil, ErrListenerClosed
+			}
+		case now := <-ticker.C:
+			if ml.ownCount() > 0 {
+				emptySince = time.Time{}
+				continue
+			}
+			if emptySince.IsZero() {
+				emptySince = now
+			}
+			if now.Sub(emptySince) >= timeout {
+				return nil, ErrNoListeners
+			}
+		}
+	}
+}
+
 // Close implements the net.Listener Close method.
 // It closes all managed listeners and releases resources.
 func (ml *MetaListener) Close() error {
@@ -51,12 +122,20 @@ func (ml *MetaListener) Close() error {
 
 	// Signal all goroutines to stop first, before clearing listeners map
 	close(ml.closeCh)
+	ml.cancel()
 
 	// Close all listeners and collect any errors
 	errs := ml.closeAllListeners()
 
 	// Clear the listeners map since they're all closed
 	ml.listeners = make(map[string]net.Listener)
+	for id := range ml.ttls {
+		ml.stopTTLLocked(id)
+	}
+	for _, unpublish := range ml.unpublish {
+		unpublish()
+	}
+	ml.unpublish = nil
 	ml.mu.Unlock()
 
 	// Wait for all listener goroutines to exit gracefully
@@ -2,11 +2,16 @@ package meta
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"net"
+	"runtime/pprof"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/samber/oops"
 )
@@ -29,20 +34,267 @@ type MetaListener struct {
 	connCh chan ConnResult
 	// closeCh signals all goroutines to stop
 	closeCh chan struct{}
+	// ctx is the parent of the contexts of accepted connections, cancelled
+	// by Close
+	ctx    context.Context
+	cancel context.CancelFunc
 	// removeListenerCh is used to signal listener removal from handlers
 	removeListenerCh chan string
 	// isClosed indicates whether the meta listener has been closed (atomic)
 	isClosed int64
 	// isShuttingDown indicates whether WaitForShutdown has been called (atomic)
 	isShuttingDown int64
+	// accepted and dropped count the connections handed to Accept and
+	// those closed because they could not be
+	accepted atomic.Uint64
+	dropped  atomic.Uint64
+	// factories re-create the listeners added with AddListenerFactory,
+	// keyed by ID, when WatchInterfaces finds them gone
+	factories map[string]ListenerFactory
+	// watching is set once WatchInterfaces started
+	watching atomic.Bool
+	// resolveInterval is set by SetResolveInterval
+	resolveInterval atomic.Int64
+	// namespaces are the tenants created by Namespace, keyed by name
+	namespaces map[string]*Namespace
+	// bandwidth holds the limits set by SetBandwidth, keyed by listener ID
+	bandwidth map[string]*bandwidthGroup
+	// failWithoutListeners and noListenersTimeout are set by
+	// SetNoListenersTimeout
+	failWithoutListeners atomic.Bool
+	noListenersTimeout   atomic.Int64
+	// pending counts the connections of each listener not yet returned by
+	// Accept, and queueThreshold, queueAfter, and queueWarn are set by
+	// SetQueueWarning; queueMu protects them
+	pending        map[string]int
+	queueThreshold int
+	queueAfter     time.Duration
+	queueWarn      func(QueueStats)
+	queueMu        sync.Mutex
+	// queueWatching is set once the queue watcher started
+	queueWatching atomic.Bool
+	// flood is the FloodGuard set with SetFloodGuard
+	flood atomic.Pointer[FloodGuard]
+	// capture is the Capture set with SetCapture
+	capture atomic.Pointer[Capture]
+	// refused counts connections closed for their identity being refused
+	refused atomic.Uint64
+	// ttls are the timers of the listeners given a TTL by SetListenerTTL,
+	// keyed by listener ID
+	ttls map[string]*listenerTTL
+	// unpublish unbinds the expvar variables published by PublishExpvar
+	unpublish []func()
 	// mu protects concurrent access to the listener's state
 	mu sync.RWMutex
 }
 
+// PprofListenerLabel is the pprof label carrying the listener ID on the
+// goroutine accepting from each listener, so CPU and goroutine profiles
+// attribute work to transports.
+const PprofListenerLabel = "listener"
+
 // ConnResult represents a connection received from a listener
 type ConnResult struct {
 	net.Conn
 	src string // source listener ID
+	// ctx is cancelled when the source listener or the MetaListener closes
+	ctx context.Context
+	// release, if set, frees the connection's slot in its namespace
+	release *connRelease
+}
+
+// connRelease runs fn once, when the first copy of a ConnResult is closed.
+type connRelease struct {
+	once sync.Once
+	fn   func()
+}
+
+// Close closes the connection, freeing its slot in the namespace limit.
+func (c ConnResult) Close() error {
+	if c.release != nil {
+		c.release.once.Do(c.release.fn)
+	}
+	return c.Conn.Close()
+}
+
+// HalfCloser is implemented by the connections returned by Accept, so
+// protocols that signal the end of a stream by shutting down one direction,
+// and proxies relaying such streams, work through the MetaListener as they
+// do on a *net.TCPConn:
+//
+//	if hc, ok := conn.(meta.HalfCloser); ok {
+//		hc.CloseWrite()
+//	}
+type HalfCloser interface {
+	// CloseWrite shuts down the writing side of the connection. A
+	// connection that cannot be half-closed is closed instead, so the peer
+	// still sees the end of the stream.
+	CloseWrite() error
+	// CloseRead shuts down the reading side of the connection where the
+	// underlying connection supports it, and does nothing otherwise.
+	CloseRead() error
+}
+
+var _ HalfCloser = ConnResult{}
+
+// CloseWrite shuts down the writing side of the connection, or closes it,
+// freeing its slot in the namespace limit, if it cannot be half-closed.
+func (c ConnResult) CloseWrite() error {
+	return CloseWrite(c.Conn, c.Close)
+}
+
+// CloseRead shuts down the reading side of the connection where supported.
+func (c ConnResult) CloseRead() error {
+	return CloseRead(c.Conn)
+}
+
+// CloseWrite shuts down the writing side of conn, or calls closeConn if conn
+// cannot be half-closed. A wrapper implementing HalfCloser passes the
+// connection it wraps and its own Close; other callers pass conn.Close.
+func CloseWrite(conn net.Conn, closeConn func() error) error {
+	if hc, ok := conn.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return closeConn()
+}
+
+// CloseRead shuts down the reading side of conn where supported, and does
+// nothing otherwise.
+func CloseRead(conn net.Conn) error {
+	if hc, ok := conn.(interface{ CloseRead() error }); ok {
+		return hc.CloseRead()
+	}
+	return nil
+}
+
+// TLSStateConn is implemented by the connections returned by Accept, so
+// handlers can see the server name, ALPN protocol and client certificates of
+// TLS connections through the wrappers the MetaListener and mirror.Mirror
+// put around them:
+//
+//	if sc, ok := conn.(meta.TLSStateConn); ok && sc.ConnectionState().HandshakeComplete {
+//		log.Printf("TLS client for %s", sc.ConnectionState().ServerName)
+//	}
+type TLSStateConn interface {
+	// ConnectionState returns the state of the TLS connection underneath
+	// the wrappers without completing its handshake, so it never blocks on
+	// the client: HandshakeComplete is false until the handshake is done,
+	// and for connections that are not TLS, which get the zero state.
+	ConnectionState() tls.ConnectionState
+}
+
+var _ TLSStateConn = ConnResult{}
+
+// ConnectionState returns the TLS state of the underlying connection.
+func (c ConnResult) ConnectionState() tls.ConnectionState {
+	return connectionState(c.Conn)
+}
+
+// connectionState returns the TLS state of conn, the connection a wrapper
+// wraps, as far as its handshake has come, or the zero state if it is not
+// TLS.
+func connectionState(conn net.Conn) tls.ConnectionState {
+	if tc, ok := conn.(*tls.Conn); ok {
+		return tc.ConnectionState()
+	}
+	if sc, ok := conn.(TLSStateConn); ok {
+		return sc.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
+
+// transportConn is implemented by connections that tell which network they
+// arrived on, such as those accepted from the listeners of a mirror.Mirror.
+type transportConn interface {
+	Transport() string
+	PeerID() string
+}
+
+// protocolConn is implemented by TLS connections that tell the protocol
+// their client negotiated with ALPN, such as those of a mirror.Mirror.
+type protocolConn interface {
+	NegotiatedProtocol() string
+}
+
+// clientCertConn is implemented by TLS connections that tell the verified
+// certificate of their client, such as those of a mirror.Mirror.
+type clientCertConn interface {
+	ClientCertificate() *x509.Certificate
+}
+
+// ContextConn is implemented by the connections returned by Accept. Their
+// context is cancelled when the listener they came from or the MetaListener
+// is closed, so handlers can tie the work of a connection to listener
+// shutdown:
+//
+//	if cc, ok := conn.(meta.ContextConn); ok {
+//		ctx = cc.Context()
+//	}
+type ContextConn interface {
+	Context() context.Context
+}
+
+// Context returns the context of the connection, cancelled when its source
+// listener or the MetaListener is closed.
+func (c ConnResult) Context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// ConnContext returns ctx, cancelled as well when the context of conn is,
+// if conn is a ContextConn. It fits http.Server.ConnContext, making the
+// contexts of requests end when their connection's listener is closed.
+func ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	cc, ok := conn.(ContextConn)
+	if !ok {
+		return ctx
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	context.AfterFunc(cc.Context(), func() { cancel(context.Cause(cc.Context())) })
+	return ctx
+}
+
+// Source returns the ID of the listener the connection was accepted from,
+// as given to AddListener.
+func (c ConnResult) Source() string {
+	return c.src
+}
+
+// Transport returns the transport the underlying connection reports, or ""
+// if it reports none, so wrapping by Accept keeps it visible to handlers.
+func (c ConnResult) Transport() string {
+	if tc, ok := c.Conn.(transportConn); ok {
+		return tc.Transport()
+	}
+	return ""
+}
+
+// PeerID returns the peer identity the underlying connection reports, or "".
+func (c ConnResult) PeerID() string {
+	if tc, ok := c.Conn.(transportConn); ok {
+		return tc.PeerID()
+	}
+	return ""
+}
+
+// NegotiatedProtocol returns the ALPN protocol the underlying connection
+// reports, or "" if it reports none.
+func (c ConnResult) NegotiatedProtocol() string {
+	if pc, ok := c.Conn.(protocolConn); ok {
+		return pc.NegotiatedProtocol()
+	}
+	return ""
+}
+
+// ClientCertificate returns the verified client certificate the underlying
+// connection reports, or nil if it reports none.
+func (c ConnResult) ClientCertificate() *x509.Certificate {
+	if cc, ok := c.Conn.(clientCertConn); ok {
+		return cc.ClientCertificate()
+	}
+	return nil
 }
 
 // NewMetaListener creates a new MetaListener instance ready to manage multiple listeners.
@@ -53,6 +305,7 @@ func NewMetaListener() *MetaListener {
 		closeCh:          make(chan struct{}),
 		removeListenerCh: make(chan string, 10), // Buffer for listener removal signals
 	}
+	ml.ctx, ml.cancel = context.WithCancel(context.Background())
 
 	// Start the listener management goroutine and track it
 	ml.listenerWg.Add(1)
@@ -65,6 +318,12 @@ func NewMetaListener() *MetaListener {
 // Returns an error if a listener with the same ID already exists or if the
 // provided listener is nil.
 func (ml *MetaListener) AddListener(id string, listener net.Listener) error {
+	return ml.addListener(id, listener, nil)
+}
+
+// addListener adds listener, forwarding its connections to ns, or to
+// Accept when ns is nil.
+func (ml *MetaListener) addListener(id string, listener net.Listener, ns *Namespace) error {
 	if listener == nil {
 		return errors.New("cannot add nil listener")
 	}
@@ -72,7 +331,7 @@ func (ml *MetaListener) AddListener(id string, listener net.Listener) error {
 	ml.mu.Lock()
 	defer ml.mu.Unlock()
 
-	if atomic.LoadInt64(&ml.isClosed) != 0 {
+	if atomic.LoadInt64(&ml.isClosed) != 0 || (ns != nil && ns.isClosed()) {
 		return ErrListenerClosed
 	}
 
@@ -89,7 +348,9 @@ func (ml *MetaListener) AddListener(id string, listener net.Listener) error {
 
 	// Add to WaitGroup immediately before starting goroutine to prevent race
 	ml.listenerWg.Add(1)
-	go ml.handleListener(id, listener)
+	go pprof.Do(ml.ctx, pprof.Labels(PprofListenerLabel, id), func(ctx context.Context) {
+		ml.handleListener(ctx, id, listener, ns)
+	})
 
 	return nil
 }
@@ -102,16 +363,65 @@ func (ml *MetaListener) RemoveListener(id string) error {
 
 	listener, exists := ml.listeners[id]
 	if !exists {
+		if _, pending := ml.factories[id]; pending {
+			// Waiting for WatchInterfaces to re-create it
+			delete(ml.factories, id)
+			ml.stopTTLLocked(id)
+			return nil
+		}
 		return fmt.Errorf("no listener with ID '%s' exists", id)
 	}
+	ml.stopTTLLocked(id)
 
 	// Close the specific listener
 	err := listener.Close()
 	delete(ml.listeners, id)
+	delete(ml.factories, id)
 
 	return err
 }
 
+// RemoveListenersMatching stops and removes every listener whose ID match
+// accepts, including those waiting for WatchInterfaces to re-create them,
+// so a family of generated IDs can be torn down at once. Matching no
+// listener is not an error; close errors are joined.
+func (ml *MetaListener) RemoveListenersMatching(match func(id string) bool) error {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	return ml.removeListenersLocked(match)
+}
+
+// RemoveListenersByPrefix stops and removes every listener whose ID starts
+// with prefix, such as "onion-".
+func (ml *MetaListener) RemoveListenersByPrefix(prefix string) error {
+	return ml.RemoveListenersMatching(func(id string) bool { return strings.HasPrefix(id, prefix) })
+}
+
+// removeListenersLocked closes and forgets the listeners and pending
+// factories whose IDs match accepts. ml.mu must be held.
+func (ml *MetaListener) removeListenersLocked(match func(id string) bool) error {
+	var errs []error
+	for id, listener := range ml.listeners {
+		if !match(id) {
+			continue
+		}
+		if err := listener.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("closing %s listener: %w", id, err))
+		}
+		delete(ml.listeners, id)
+		delete(ml.factories, id)
+		ml.stopTTLLocked(id)
+	}
+	for id := range ml.factories {
+		if match(id) {
+			delete(ml.factories, id)
+			ml.stopTTLLocked(id)
+		}
+	}
+	return errors.Join(errs...)
+}
+
 // ListenerIDs returns the IDs of all active listeners.
 func (ml *MetaListener) ListenerIDs() []string {
 	ml.mu.RLock()
@@ -170,6 +480,9 @@ func (ml *MetaListener) manageListeners() {
 			if listener, exists := ml.listeners[id]; exists {
 				listener.Close()
 				delete(ml.listeners, id)
+				if _, recreated := ml.factories[id]; !recreated {
+					ml.stopTTLLocked(id)
+				}
 				log.Printf("Listener %s removed due to permanent error", id)
 			}
 			ml.mu.Unlock()
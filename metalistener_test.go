@@ -2,9 +2,19 @@ package meta
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"expvar"
 	"fmt"
 	"io"
+	"math/big"
 	"net"
+	"runtime/pprof"
+	"slices"
 	"strings"
 	"sync"
 	"testing"
@@ -115,6 +125,55 @@ func TestListenerRemovalRace(t *testing.T) {
 	}
 }
 
+// TestRemoveListenersMatching verifies that families of listeners are
+// removed by pattern and prefix, within a namespace too, and that the
+// others keep running.
+func TestRemoveListenersMatching(t *testing.T) {
+	ml := NewMetaListener()
+	defer ml.Close()
+
+	listeners := make(map[string]*mockListener)
+	for _, id := range []string{"onion-a", "onion-b", "garlic-a", "tls-a", "tcp-a"} {
+		listeners[id] = newMockListener(id)
+		if err := ml.AddListener(id, listeners[id]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ns, _ := ml.Namespace("svc")
+	for _, id := range []string{"onion-a", "tls-a"} {
+		if err := ns.AddListener(id, newMockListener(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ml.RemoveListenersByPrefix("onion-"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ml.RemoveListenersMatching(func(id string) bool { return strings.HasSuffix(id, "-a") && strings.HasPrefix(id, "garlic") }); err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.RemoveListenersMatching(func(id string) bool { return strings.HasPrefix(id, "tls-") }); err != nil {
+		t.Fatal(err)
+	}
+	if err := ml.RemoveListenersByPrefix("i2p-"); err != nil {
+		t.Errorf("removing no listener: %v", err)
+	}
+
+	ids := ml.ListenerIDs()
+	slices.Sort(ids)
+	if want := []string{"svc/onion-a", "tcp-a", "tls-a"}; !slices.Equal(ids, want) {
+		t.Errorf("ListenerIDs() = %v, want %v", ids, want)
+	}
+	for id, listener := range listeners {
+		listener.mu.Lock()
+		closed := listener.closed
+		listener.mu.Unlock()
+		if want := !slices.Contains(ids, id); closed != want {
+			t.Errorf("%s: closed = %t, want %t", id, closed, want)
+		}
+	}
+}
+
 // TestConcurrentListenerAccess tests concurrent access to listener map
 func TestConcurrentListenerAccess(t *testing.T) {
 	ml := NewMetaListener()
@@ -349,3 +408,349 @@ func (m *mockConn) RemoteAddr() net.Addr {
 func (m *mockConn) SetDeadline(t time.Time) error      { return nil }
 func (m *mockConn) SetReadDeadline(t time.Time) error  { return nil }
 func (m *mockConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// transportTestConn reports a transport like the connections of a Mirror.
+type transportTestConn struct {
+	net.Conn
+}
+
+func (transportTestConn) Transport() string { return "onion" }
+func (transportTestConn) PeerID() string    { return "peer" }
+
+// TestConnResultTransport verifies that accepted connections keep the
+// transport identity of the connection they wrap, and name their listener.
+func TestConnResultTransport(t *testing.T) {
+	ml := NewMetaListener()
+	defer ml.Close()
+	listener := newMockListener("onion")
+	if err := ml.AddListener("onion-3000", listener); err != nil {
+		t.Fatal(err)
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	listener.connCh <- transportTestConn{server}
+
+	conn, err := ml.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	result, ok := conn.(ConnResult)
+	if !ok {
+		t.Fatalf("Accept returned %T, want ConnResult", conn)
+	}
+	if result.Source() != "onion-3000" {
+		t.Errorf("Source() = %q, want onion-3000", result.Source())
+	}
+	if result.Transport() != "onion" || result.PeerID() != "peer" {
+		t.Errorf("Transport(), PeerID() = %q, %q, want onion, peer", result.Transport(), result.PeerID())
+	}
+
+	plain := ConnResult{Conn: client}
+	if plain.Transport() != "" || plain.PeerID() != "" {
+		t.Errorf("Connection without a transport reported %q, %q", plain.Transport(), plain.PeerID())
+	}
+}
+
+// TestStatsExpvar verifies the counters and their expvar publication.
+func TestStatsExpvar(t *testing.T) {
+	ml := NewMetaListener()
+	defer ml.Close()
+	listener := newMockListener("stats")
+	if err := ml.AddListener("stats", listener); err != nil {
+		t.Fatal(err)
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	listener.connCh <- server
+	conn, err := ml.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	want := Stats{Listeners: 1, Accepted: 1}
+	if got := ml.Stats(); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+
+	if err := ml.PublishExpvar("meta_test_stats"); err != nil {
+		t.Fatalf("PublishExpvar: %v", err)
+	}
+	var published Stats
+	if err := json.Unmarshal([]byte(expvar.Get("meta_test_stats").String()), &published); err != nil {
+		t.Fatal(err)
+	}
+	if published != want {
+		t.Errorf("published %+v, want %+v", published, want)
+	}
+	if err := ml.PublishExpvar("meta_test_stats"); err == nil {
+		t.Error("Publishing a name twice succeeded")
+	}
+
+	// Closing unbinds the name for a listener created later
+	ml.Close()
+	if got := expvar.Get("meta_test_stats").String(); got != "null" {
+		t.Errorf("closed listener still published %s", got)
+	}
+	next := NewMetaListener()
+	defer next.Close()
+	if err := next.PublishExpvar("meta_test_stats"); err != nil {
+		t.Fatalf("PublishExpvar after Close: %v", err)
+	}
+	if err := json.Unmarshal([]byte(expvar.Get("meta_test_stats").String()), &published); err != nil {
+		t.Fatal(err)
+	}
+	if published != (Stats{}) {
+		t.Errorf("published %+v for the new listener, want zero counters", published)
+	}
+}
+
+// TestListenerPprofLabel verifies that the goroutine accepting from a
+// listener carries its ID as a pprof label.
+func TestListenerPprofLabel(t *testing.T) {
+	ml := NewMetaListener()
+	defer ml.Close()
+	if err := ml.AddListener("pprof-test", newMockListener("pprof")); err != nil {
+		t.Fatal(err)
+	}
+
+	want := fmt.Sprintf("%q:%q", PprofListenerLabel, "pprof-test")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var profile strings.Builder
+		pprof.Lookup("goroutine").WriteTo(&profile, 1)
+		if strings.Contains(profile.String(), want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("No goroutine labeled %s in:\n%s", want, profile.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestNoListenersTimeout verifies that Accept reports ErrNoListeners when
+// configured to, right away or after the timeout, and still returns
+// connections while listeners are registered.
+func TestNoListenersTimeout(t *testing.T) {
+	ml := NewMetaListener()
+	defer ml.Close()
+
+	ml.SetNoListenersTimeout(0)
+	if _, err := ml.Accept(); err == nil || err.Error() != ErrNoListeners.Error() {
+		t.Errorf("Accept without listeners returned %v, want ErrNoListeners", err)
+	}
+
+	ml.SetNoListenersTimeout(50 * time.Millisecond)
+	start := time.Now()
+	if _, err := ml.Accept(); err == nil || err.Error() != ErrNoListeners.Error() {
+		t.Errorf("Accept without listeners returned %v, want ErrNoListeners", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Accept failed after %v, before the timeout", elapsed)
+	}
+
+	listener := newMockListener("timeout")
+	if err := ml.AddListener("timeout", listener); err != nil {
+		t.Fatal(err)
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		listener.connCh <- server
+	}()
+	conn, err := ml.Accept()
+	if err != nil {
+		t.Fatalf("Accept with a listener returned %v", err)
+	}
+	conn.Close()
+
+	// Removing the last listener ends a pending Accept
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := ml.Accept()
+		errCh <- err
+	}()
+	ml.RemoveListener("timeout")
+	select {
+	case err := <-errCh:
+		if err == nil || err.Error() != ErrNoListeners.Error() {
+			t.Errorf("Accept returned %v, want ErrNoListeners", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept still blocked after the last listener was removed")
+	}
+
+	ml.SetNoListenersTimeout(-1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		ml.Close()
+	}()
+	if _, err := ml.Accept(); err == nil || err.Error() != ErrListenerClosed.Error() {
+		t.Errorf("Blocking Accept returned %v, want ErrListenerClosed", err)
+	}
+}
+
+// TestConnContext verifies that the context of a connection is cancelled
+// when its listener is removed, and the others' when the MetaListener is
+// closed.
+func TestConnContext(t *testing.T) {
+	ml := NewMetaListener()
+	defer ml.Close()
+	removed, kept := newMockListener("removed"), newMockListener("kept")
+	ml.AddListener("removed", removed)
+	ml.AddListener("kept", kept)
+
+	accept := func(listener *mockListener) context.Context {
+		t.Helper()
+		listener.connCh <- &mockConn{}
+		conn, err := ml.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn.(ContextConn).Context()
+	}
+	removedCtx := accept(removed)
+	keptCtx := accept(kept)
+	serverCtx := ConnContext(context.Background(), ConnResult{ctx: keptCtx})
+	if removedCtx.Err() != nil || keptCtx.Err() != nil {
+		t.Fatal("Context cancelled while its listener is open")
+	}
+
+	ml.RemoveListener("removed")
+	select {
+	case <-removedCtx.Done():
+	case <-time.After(5 * time.Second):
+		t.Error("Context not cancelled after its listener was removed")
+	}
+	if keptCtx.Err() != nil {
+		t.Error("Context cancelled by the removal of another listener")
+	}
+
+	ml.Close()
+	select {
+	case <-serverCtx.Done():
+	case <-time.After(5 * time.Second):
+		t.Error("ConnContext not cancelled after the MetaListener was closed")
+	}
+}
+
+// TestHalfClose verifies that accepted connections, shaped or not,
+// half-close the underlying connection, so the client sees the end of the
+// stream while it can still send.
+func TestHalfClose(t *testing.T) {
+	for _, shaped := range []bool{false, true} {
+		ml := NewMetaListener()
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if shaped {
+			ml.SetBandwidth("tcp", Bandwidth{ConnWrite: 1 << 20})
+		}
+		if err := ml.AddListener("tcp", listener); err != nil {
+			t.Fatal(err)
+		}
+
+		client, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		conn, err := ml.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hc, ok := conn.(HalfCloser)
+		if !ok {
+			t.Fatalf("shaped %t: %T is not a HalfCloser", shaped, conn)
+		}
+		if err := hc.CloseWrite(); err != nil {
+			t.Errorf("shaped %t: CloseWrite: %v", shaped, err)
+		}
+		if n, err := client.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+			t.Errorf("shaped %t: client read %d, %v after CloseWrite, want EOF", shaped, n, err)
+		}
+		client.Write([]byte("pong"))
+		client.Close()
+		if data, err := io.ReadAll(conn); err != nil || string(data) != "pong" {
+			t.Errorf("shaped %t: read %q, %v after CloseWrite", shaped, data, err)
+		}
+		conn.Close()
+		ml.Close()
+	}
+}
+
+// TestConnectionState verifies that connections accepted from a TLS listener
+// report its state through the MetaListener's wrappers.
+func TestConnectionState(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{"h2"},
+	}
+
+	for _, shaped := range []bool{false, true} {
+		ml := NewMetaListener()
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if shaped {
+			ml.SetBandwidth("tls", Bandwidth{ConnWrite: 1 << 20})
+		}
+		if err := ml.AddListener("tls", tls.NewListener(listener, config)); err != nil {
+			t.Fatal(err)
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			client, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+				ServerName:         "example.com",
+				NextProtos:         []string{"h2"},
+				InsecureSkipVerify: true,
+			})
+			if err == nil {
+				client.Close()
+			}
+			done <- err
+		}()
+		conn, err := ml.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc, ok := conn.(TLSStateConn)
+		if !ok {
+			t.Fatalf("shaped %t: %T is not a TLSStateConn", shaped, conn)
+		}
+		// The state does not wait for the handshake, which the first Read
+		// completes
+		if sc.ConnectionState().HandshakeComplete {
+			t.Errorf("shaped %t: handshake complete before it ran", shaped)
+		}
+		conn.Read(make([]byte, 1))
+		state := sc.ConnectionState()
+		if !state.HandshakeComplete || state.ServerName != "example.com" || state.NegotiatedProtocol != "h2" {
+			t.Errorf("shaped %t: state has handshake %t, server name %q, protocol %q", shaped, state.HandshakeComplete, state.ServerName, state.NegotiatedProtocol)
+		}
+		if err := <-done; err != nil {
+			t.Errorf("shaped %t: client: %v", shaped, err)
+		}
+		conn.Close()
+		ml.Close()
+	}
+}
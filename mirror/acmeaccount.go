@@ -0,0 +1,90 @@
+package mirror
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// accountKeyMu serializes the creation of account key files, so services
+// starting together register a single ACME account.
+var accountKeyMu sync.Mutex
+
+// loadAccountKey returns the ACME account key stored in path, creating a
+// P-256 key there if the file does not exist yet.
+func loadAccountKey(path string) (crypto.Signer, error) {
+	accountKeyMu.Lock()
+	defer accountKeyMu.Unlock()
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return createAccountKey(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ACME account key: %w", err)
+	}
+	key, err := parseAccountKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ACME account key %s: %w", path, err)
+	}
+	return key, nil
+}
+
+// createAccountKey generates an account key and writes it to path, readable
+// only by the owner.
+func createAccountKey(path string) (crypto.Signer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create ACME account key directory: %w", err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return nil, fmt.Errorf("failed to write ACME account key: %w", err)
+	}
+	log.Printf("Created ACME account key %s\n", path)
+	return key, nil
+}
+
+// parseAccountKey decodes a PEM-encoded EC, RSA, or PKCS #8 private key, as
+// written by autocert, OpenSSL, or certbot.
+func parseAccountKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data")
+	}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch key := key.(type) {
+		case *ecdsa.PrivateKey:
+			return key, nil
+		case *rsa.PrivateKey:
+			return key, nil
+		}
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+}
@@ -0,0 +1,55 @@
+package mirror
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/acme"
+)
+
+// TestAccountKeyFile verifies that ACMEProvider creates its account key file
+// once and reuses it, and registers with the external account binding.
+func TestAccountKeyFile(t *testing.T) {
+	t.Setenv("CERT_DIR", t.TempDir())
+	path := filepath.Join(t.TempDir(), "account", "key.pem")
+	eab := &acme.ExternalAccountBinding{KID: "kid", Key: []byte("hmac")}
+
+	listen := func() *acmeListener {
+		inner, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		provider := &ACMEProvider{Listener: inner, AccountKeyFile: path, ExternalAccountBinding: eab}
+		listener, err := provider.Listen(context.Background(), ServiceConfig{Name: "example.com"})
+		if err != nil {
+			t.Fatalf("Listen: %v", err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		return listener.(*acmeListener)
+	}
+	first := listen()
+	if first.manager.ExternalAccountBinding != eab {
+		t.Error("External account binding not passed to the ACME manager")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Account key not created: %v", err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("Account key mode = %v, want 0600", info.Mode().Perm())
+	}
+	second := listen()
+	key := first.manager.Client.Key.(*ecdsa.PrivateKey)
+	if !key.Equal(second.manager.Client.Key) {
+		t.Error("Account key not reused from its file")
+	}
+
+	os.WriteFile(path, []byte("not a key"), 0o600)
+	if _, err := loadAccountKey(path); err == nil {
+		t.Error("Loaded an invalid account key file")
+	}
+}
@@ -0,0 +1,109 @@
+package mirror
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/cretz/bine/control"
+	"github.com/cretz/bine/tor"
+	"github.com/cretz/bine/torutil/ed25519"
+)
+
+// OnionPoW enables Tor's proof-of-work defense for onion services. Under
+// attack, clients must then solve a puzzle before introducing themselves,
+// with an effort Tor raises and lowers with the load, and introductions are
+// served in order of effort, so cheap floods queue behind honest clients.
+type OnionPoW struct {
+	// QueueRate is the introduction requests per second Tor serves from
+	// the queue ordered by effort. Zero keeps Tor's default of 250.
+	QueueRate int
+	// QueueBurst is the requests Tor may serve at once beyond QueueRate.
+	// Zero keeps Tor's default of 2500.
+	QueueBurst int
+}
+
+// listenOnion publishes an onion service on t like t.Listen, with the
+// proof-of-work parameters of pow and the authorized clients, which
+// tor.ListenConf cannot carry. Unlike t.Listen it returns without waiting
+// for the service descriptor to be published.
+func listenOnion(t *tor.Tor, conf *tor.ListenConf, pow *OnionPoW, clients []string) (*tor.OnionService, error) {
+	keys, ok := conf.Key.(ed25519.KeyPair)
+	if !ok {
+		return nil, fmt.Errorf("unsupported onion service key %T", conf.Key)
+	}
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	svc := &tor.OnionService{
+		Key:                       keys,
+		Version3:                  true,
+		LocalListener:             local,
+		RemotePorts:               slices.Clone(conf.RemotePorts),
+		CloseLocalListenerOnClose: true,
+		Tor:                       t,
+	}
+	if len(svc.RemotePorts) == 0 {
+		svc.RemotePorts = []int{local.Addr().(*net.TCPAddr).Port}
+	}
+	if err := publishOnion(svc, conf, pow, clients); err != nil {
+		local.Close()
+		return nil, err
+	}
+	return svc, nil
+}
+
+// publishOnion creates the onion service svc describes on its Tor, setting
+// svc.ID. An existing svc is republished by deleting it first.
+func publishOnion(svc *tor.OnionService, conf *tor.ListenConf, pow *OnionPoW, clients []string) error {
+	key := &control.ED25519Key{KeyPair: svc.Key.(ed25519.KeyPair)}
+	cmd := addOnionCommand(key, conf, svc.RemotePorts, svc.LocalListener.Addr().String(), pow, clients)
+	resp, err := svc.Tor.Control.SendRequest("%s", cmd)
+	if err != nil {
+		return fmt.Errorf("failed to create onion service: %w", err)
+	}
+	svc.ID = ""
+	for _, data := range resp.Data {
+		if id, ok := strings.CutPrefix(data, "ServiceID="); ok {
+			svc.ID = id
+		}
+	}
+	if svc.ID == "" {
+		return fmt.Errorf("Tor returned no onion service ID")
+	}
+	return nil
+}
+
+// addOnionCommand returns the ADD_ONION command publishing key on
+// remotePorts, forwarded to localAddr, with the stream limits of conf, the
+// proof-of-work parameters of pow, if any, and the base32 x25519 public
+// keys of the authorized clients.
+func addOnionCommand(key control.Key, conf *tor.ListenConf, remotePorts []int, localAddr string, pow *OnionPoW, clients []string) string {
+	var cmd strings.Builder
+	cmd.WriteString("ADD_ONION " + string(key.Type()) + ":" + key.Blob())
+	if conf.MaxStreamsCloseCircuit {
+		cmd.WriteString(" Flags=MaxStreamsCloseCircuit")
+	}
+	if conf.MaxStreams > 0 {
+		cmd.WriteString(" MaxStreams=" + strconv.Itoa(conf.MaxStreams))
+	}
+	if pow != nil {
+		cmd.WriteString(" PoWDefensesEnabled=1")
+		if pow.QueueRate > 0 {
+			cmd.WriteString(" PoWQueueRate=" + strconv.Itoa(pow.QueueRate))
+		}
+		if pow.QueueBurst > 0 {
+			cmd.WriteString(" PoWQueueBurst=" + strconv.Itoa(pow.QueueBurst))
+		}
+	}
+	for _, port := range remotePorts {
+		cmd.WriteString(" Port=" + strconv.Itoa(port) + "," + localAddr)
+	}
+	for _, client := range clients {
+		cmd.WriteString(" ClientAuthV3=" + client)
+	}
+	return cmd.String()
+}
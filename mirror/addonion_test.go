@@ -0,0 +1,106 @@
+package mirror
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/cretz/bine/tor"
+	"github.com/cretz/bine/torutil/ed25519"
+)
+
+// fakeOnionControl serves a Tor control port with null authentication that
+// creates onion services, sending each ADD_ONION and DEL_ONION command it
+// gets to the returned channel, and returns a Tor attached to it.
+func fakeOnionControl(t *testing.T) (*tor.Tor, <-chan string) {
+	t.Helper()
+	return fakeOnionControlFailing(t, nil)
+}
+
+// fakeOnionControlFailing is fakeOnionControl refusing the ADD_ONION
+// commands for which fail, given their count starting at 1, returns true.
+func fakeOnionControlFailing(t *testing.T, fail func(add int) bool) (*tor.Tor, <-chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	commands := make(chan string, 10)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		adds := 0
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch {
+			case strings.HasPrefix(line, "PROTOCOLINFO"):
+				fmt.Fprint(conn, "250-PROTOCOLINFO 1\r\n250-AUTH METHODS=NULL\r\n250-VERSION Tor=\"0.4.8.0\"\r\n250 OK\r\n")
+			case strings.HasPrefix(line, "ADD_ONION"):
+				commands <- strings.TrimSpace(line)
+				if adds++; fail != nil && fail(adds) {
+					fmt.Fprint(conn, "551 Failed to add onion service\r\n")
+					continue
+				}
+				fmt.Fprint(conn, "250-ServiceID=onionid\r\n250 OK\r\n")
+			case strings.HasPrefix(line, "DEL_ONION"):
+				commands <- strings.TrimSpace(line)
+				fmt.Fprint(conn, "250 OK\r\n")
+			default:
+				fmt.Fprint(conn, "250 OK\r\n")
+			}
+		}
+	}()
+	tr, err := attachTor(context.Background(), listener.Addr().String(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tr.Close() })
+	return tr, commands
+}
+
+// TestListenOnion verifies that onion services are created with the
+// proof-of-work parameters, the stream limits, and the authorized clients.
+func TestListenOnion(t *testing.T) {
+	tr, commands := fakeOnionControl(t)
+	keys, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := (&OnionOptions{MaxStreams: 4, MaxStreamsCloseCircuit: true, Ports: []int{80}}).listenConf(keys)
+	svc, err := listenOnion(tr, conf, &OnionPoW{QueueRate: 50, QueueBurst: 100}, []string{"CLIENTKEY"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+	if svc.ID != "onionid" || svc.RemotePorts[0] != 80 {
+		t.Errorf("service %s on %v, want onionid on 80", svc.ID, svc.RemotePorts)
+	}
+	cmd := <-commands
+	for _, want := range []string{
+		"ADD_ONION ED25519-V3:",
+		" Flags=MaxStreamsCloseCircuit",
+		" MaxStreams=4",
+		" PoWDefensesEnabled=1",
+		" PoWQueueRate=50",
+		" PoWQueueBurst=100",
+		" Port=80," + svc.LocalListener.Addr().String(),
+		" ClientAuthV3=CLIENTKEY",
+	} {
+		if !strings.Contains(cmd, want) {
+			t.Errorf("%q lacks %q", cmd, want)
+		}
+	}
+}
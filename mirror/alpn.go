@@ -0,0 +1,206 @@
+package mirror
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-i2p/go-meta-listener"
+	"golang.org/x/net/http2"
+)
+
+// Common ALPN protocol names for ServiceConfig.ALPN.
+const (
+	ProtoHTTP2 = "h2"
+	ProtoHTTP1 = "http/1.1"
+)
+
+// alpnKey is the context key of WithALPN.
+type alpnKey struct{}
+
+// WithALPN returns a copy of ctx telling TransportProvider.ListenTLS which
+// ALPN protocols to offer, in order of preference. The Mirror passes
+// ServiceConfig.ALPN this way; transports building their own tls.Config
+// read it with ALPNFromContext.
+func WithALPN(ctx context.Context, protos []string) context.Context {
+	return context.WithValue(ctx, alpnKey{}, protos)
+}
+
+// ALPNFromContext returns the protocols set by WithALPN, or nil.
+func ALPNFromContext(ctx context.Context) []string {
+	protos, _ := ctx.Value(alpnKey{}).([]string)
+	return protos
+}
+
+// hiddenTLSConfig returns the server configuration of a hidden service TLS
+// listener presenting cert, offering the protocols of ctx, restricted by its
+// TLSSettings, and requiring client certificates if it has a ClientAuth.
+func hiddenTLSConfig(ctx context.Context, cert tls.Certificate) *tls.Config {
+	config := TLSSettingsFromContext(ctx).apply(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   ALPNFromContext(ctx),
+	})
+	if ca := ClientAuthFromContext(ctx); ca != nil {
+		return ca.serverConfig(config)
+	}
+	return config
+}
+
+// listenTLSWithConfig is the ListenTLS of onramp, configured by ctx as
+// hiddenTLSConfig describes, which onramp's own is not.
+func listenTLSWithConfig(ctx context.Context, keys func() (tls.Certificate, error), listen func(...string) (net.Listener, error)) (net.Listener, error) {
+	cert, err := keys()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS keys: %w", err)
+	}
+	listener, err := listen()
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(listener, hiddenTLSConfig(ctx, cert)), nil
+}
+
+// ProtocolConn is implemented by the connections of Mirror listeners. It
+// tells which protocol TLS clients negotiated with ALPN, so a handler can
+// serve HTTP/2 to those that chose ProtoHTTP2.
+type ProtocolConn interface {
+	// NegotiatedProtocol completes the TLS handshake if needed and returns
+	// the protocol the client chose, or "" for plaintext connections and
+	// clients that did not use ALPN.
+	NegotiatedProtocol() string
+}
+
+// negotiatedProtocol returns the protocol conn negotiated, completing its
+// handshake within timeout, or "" if conn does not tell.
+func negotiatedProtocol(conn net.Conn, timeout time.Duration) string {
+	if pc, ok := conn.(ProtocolConn); ok {
+		conn.SetDeadline(time.Now().Add(timeout))
+		defer conn.SetDeadline(time.Time{})
+		return pc.NegotiatedProtocol()
+	}
+	return ""
+}
+
+// connProtocol returns the protocol negotiated by conn, if it is a TLS
+// connection, completing its handshake first.
+func connProtocol(conn net.Conn) string {
+	return connState(conn).NegotiatedProtocol
+}
+
+// connState returns the state of conn, if it is a TLS connection,
+// completing its handshake first, or of the TLS connection it wraps, or the
+// zero state. The handshake is given httpReadHeaderTimeout, as in Accept,
+// so a client stalling mid-handshake cannot block the caller.
+func connState(conn net.Conn) tls.ConnectionState {
+	if stater, ok := conn.(tlsConnectionStater); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), httpReadHeaderTimeout)
+		defer cancel()
+		if err := stater.HandshakeContext(ctx); err != nil {
+			return tls.ConnectionState{}
+		}
+		return stater.ConnectionState()
+	}
+	return tlsState(conn)
+}
+
+// tlsState returns the state of conn, if it is a TLS connection or wraps
+// one, without completing its handshake, or the zero state. It is what
+// the connection wrappers report as meta.TLSStateConn.
+func tlsState(conn net.Conn) tls.ConnectionState {
+	if stater, ok := conn.(tlsConnectionStater); ok {
+		return stater.ConnectionState()
+	}
+	if sc, ok := conn.(meta.TLSStateConn); ok {
+		return sc.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
+
+// ServeHTTP serves HTTP on listener with server, answering the clients that
+// negotiated ProtoHTTP2 with HTTP/2 and the others with server.Serve, like
+// http.Server.ServeTLS does for its own TLS listeners. It returns when
+// server.Serve does; http.Server.Shutdown stops both.
+//
+// Connections of Mirror listeners are wrapped, so http.Server does not
+// recognize them as TLS and would never speak HTTP/2 to them on its own.
+func ServeHTTP(server *http.Server, listener net.Listener) error {
+	h2 := &http2.Server{}
+	if err := http2.ConfigureServer(server, h2); err != nil {
+		return err
+	}
+	pl := &protocolListener{
+		Listener: listener,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+		h2: func(conn net.Conn) {
+			h2.ServeConn(conn, &http2.ServeConnOpts{BaseConfig: server, Handler: server.Handler})
+		},
+	}
+	go pl.acceptLoop()
+	return server.Serve(pl)
+}
+
+// protocolListener hands the connections negotiating ProtoHTTP2 to h2 and
+// returns the others from Accept. Handshakes run concurrently, so a slow
+// client does not hold up the others.
+type protocolListener struct {
+	net.Listener
+	h2 func(net.Conn)
+
+	conns     chan net.Conn
+	closeOnce sync.Once
+	done      chan struct{}
+	err       error
+}
+
+func (pl *protocolListener) acceptLoop() {
+	for {
+		conn, err := pl.Listener.Accept()
+		if err != nil {
+			pl.shutdown(err)
+			return
+		}
+		go pl.dispatch(conn)
+	}
+}
+
+// dispatch serves conn with HTTP/2 if it negotiated it, and hands it to
+// Accept otherwise.
+func (pl *protocolListener) dispatch(conn net.Conn) {
+	if negotiatedProtocol(conn, httpReadHeaderTimeout) == ProtoHTTP2 {
+		pl.h2(conn)
+		return
+	}
+	select {
+	case pl.conns <- conn:
+	case <-pl.done:
+		conn.Close()
+	}
+}
+
+// Accept returns the next connection not served with HTTP/2.
+func (pl *protocolListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-pl.conns:
+		return conn, nil
+	case <-pl.done:
+		return nil, pl.err
+	}
+}
+
+// Close stops accepting and closes the underlying listener.
+func (pl *protocolListener) Close() error {
+	pl.shutdown(net.ErrClosed)
+	return pl.Listener.Close()
+}
+
+func (pl *protocolListener) shutdown(err error) {
+	pl.closeOnce.Do(func() {
+		pl.err = err
+		close(pl.done)
+	})
+}
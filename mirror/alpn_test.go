@@ -0,0 +1,98 @@
+package mirror
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	meta "github.com/go-i2p/go-meta-listener"
+	"golang.org/x/net/http2"
+)
+
+// TestServeHTTP verifies that ServeHTTP answers clients negotiating h2
+// with HTTP/2 through a Mirror, and the others with HTTP/1.1 requests
+// that still get the Mirror's headers.
+func TestServeHTTP(t *testing.T) {
+	config := testTLSConfig(t)
+	config.NextProtos = []string{ProtoHTTP2, ProtoHTTP1}
+	inner, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ml := &Mirror{MetaListener: meta.NewMetaListener(), config: &MirrorConfig{}}
+	defer ml.Close()
+	counted := &countingListener{Listener: inner, transport: TransportTLS, counters: &transportCounters{}}
+	if err := ml.AddListener("tls", counted); err != nil {
+		t.Fatal(err)
+	}
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto+" "+r.Header.Get("X-Forwarded-Proto"))
+	})}
+	defer server.Close()
+	go ServeHTTP(server, ml)
+
+	url := "https://" + inner.Addr().String() + "/"
+	get := func(client *http.Client) string {
+		t.Helper()
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatalf("GET: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	h2 := &http.Client{Transport: &http2.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	if got := get(h2); got != "HTTP/2.0 " {
+		t.Errorf("HTTP/2 client got %q, want HTTP/2.0 without added headers", got)
+	}
+	h1 := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		TLSNextProto:    map[string]func(string, *tls.Conn) http.RoundTripper{},
+	}}
+	if got := get(h1); got != "HTTP/1.1 http" {
+		t.Errorf("HTTP/1.1 client got %q, want HTTP/1.1 with added headers", got)
+	}
+}
+
+// TestNegotiatedProtocol verifies that the negotiated protocol is visible
+// through the connection wrappers.
+func TestNegotiatedProtocol(t *testing.T) {
+	config := testTLSConfig(t)
+	config.NextProtos = []string{"custom/1"}
+	server, client := net.Pipe()
+	defer client.Close()
+	go tls.Client(client, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"custom/1"}}).Handshake()
+
+	conn := &countingConn{Conn: tls.Server(server, config), counters: &transportCounters{}}
+	wrapped := &readWriteConn{conn: conn}
+	if got := negotiatedProtocol(wrapped, defaultSNIHandshakeTimeout); got != "custom/1" {
+		t.Errorf("NegotiatedProtocol = %q, want custom/1", got)
+	}
+	plain := &countingConn{Conn: server, counters: &transportCounters{}}
+	if got := plain.NegotiatedProtocol(); got != "" {
+		t.Errorf("Plaintext NegotiatedProtocol = %q", got)
+	}
+}
+
+// TestALPNContext verifies that WithALPN reaches hidden TLS configurations.
+func TestALPNContext(t *testing.T) {
+	ctx := WithALPN(context.Background(), []string{ProtoHTTP2})
+	config := hiddenTLSConfig(ctx, tls.Certificate{})
+	if len(config.NextProtos) != 1 || config.NextProtos[0] != ProtoHTTP2 {
+		t.Errorf("NextProtos = %v", config.NextProtos)
+	}
+	if protos := ALPNFromContext(context.Background()); protos != nil {
+		t.Errorf("ALPNFromContext without WithALPN = %v", protos)
+	}
+
+	_, err := WileedotProvider{}.Listen(context.Background(), ServiceConfig{Name: "example.com", ALPN: []string{ProtoHTTP2}})
+	if err == nil {
+		t.Errorf("WileedotProvider accepted ALPN, got %v", err)
+	}
+}
@@ -0,0 +1,174 @@
+package mirror
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+
+	"github.com/go-i2p/go-meta-listener"
+)
+
+// BackendConn is implemented by the connections accepted from the listener
+// of a service with ServiceConfig.Backends, or from a BackendListener. It
+// tells an application forwarding connections where each one goes, chosen
+// by the transport it arrived on:
+//
+//	if bc, ok := conn.(mirror.BackendConn); ok {
+//		target = bc.Backend()
+//	}
+type BackendConn interface {
+	net.Conn
+	// Backend returns the backend of the connection's transport, or the
+	// default backend if its transport has none.
+	Backend() string
+}
+
+// BackendListener returns l with the connections it accepts routed by
+// transport, as the listener of a service with ServiceConfig.Backends is:
+// each is a BackendConn reporting the backend backends maps its transport
+// to. Connections whose transport has no backend, when backends has no
+// default, are passed on as they are. It lets listeners a Mirror does not
+// manage share a service's routes.
+func BackendListener(l net.Listener, backends map[string]string) net.Listener {
+	return &backendListener{Listener: l, backends: backends}
+}
+
+// validBackends checks that every key of backends is the empty key or a
+// transport a service can be published on.
+func validBackends(backends map[string]string) error {
+	for transport := range backends {
+		switch transport {
+		case "", TransportTCP, TransportTLS:
+		default:
+			if _, ok := transportFactory(transport); !ok {
+				return fmt.Errorf("backend for unknown transport %q", transport)
+			}
+		}
+	}
+	return nil
+}
+
+// backendFor returns the backend of transport in backends: its own, or the
+// default under the empty key.
+func backendFor(backends map[string]string, transport string) (string, bool) {
+	if backend, ok := backends[transport]; ok && transport != "" {
+		return backend, true
+	}
+	backend, ok := backends[""]
+	return backend, ok
+}
+
+// backendListener resolves the backend of every connection it accepts.
+type backendListener struct {
+	net.Listener
+	backends map[string]string
+}
+
+// Accept waits for the next connection and attaches the backend of its
+// transport to it.
+func (bl *backendListener) Accept() (net.Conn, error) {
+	conn, err := bl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	var transport string
+	if tc, ok := conn.(interface{ Transport() string }); ok {
+		transport = tc.Transport()
+	}
+	backend, ok := backendFor(bl.backends, transport)
+	if !ok {
+		return conn, nil
+	}
+	return &backendConn{Conn: conn, backend: backend}, nil
+}
+
+// backendConn is a connection carrying the backend resolved when it was
+// accepted. It passes on what the connection it wraps tells about itself.
+type backendConn struct {
+	net.Conn
+	backend string
+}
+
+var (
+	_ BackendConn      = &backendConn{}
+	_ TransportConn    = &backendConn{}
+	_ ProtocolConn     = &backendConn{}
+	_ ClientCertConn   = &backendConn{}
+	_ meta.ContextConn = &backendConn{}
+	_ meta.HalfCloser  = &backendConn{}
+)
+
+// Backend returns the backend resolved for the connection.
+func (bc *backendConn) Backend() string {
+	return bc.backend
+}
+
+// Transport returns the transport of the original connection.
+func (bc *backendConn) Transport() string {
+	if tc, ok := bc.Conn.(interface{ Transport() string }); ok {
+		return tc.Transport()
+	}
+	return ""
+}
+
+// PeerID returns the peer identity of the original connection.
+func (bc *backendConn) PeerID() string {
+	if tc, ok := bc.Conn.(interface{ PeerID() string }); ok {
+		return tc.PeerID()
+	}
+	return ""
+}
+
+// Source returns the ID of the listener the original connection was
+// accepted from, where it tells.
+func (bc *backendConn) Source() string {
+	if src, ok := bc.Conn.(interface{ Source() string }); ok {
+		return src.Source()
+	}
+	return ""
+}
+
+// NegotiatedProtocol returns the ALPN protocol of the original connection.
+func (bc *backendConn) NegotiatedProtocol() string {
+	if pc, ok := bc.Conn.(ProtocolConn); ok {
+		return pc.NegotiatedProtocol()
+	}
+	return ""
+}
+
+// ConnectionState returns the TLS state of the original connection.
+func (bc *backendConn) ConnectionState() tls.ConnectionState {
+	return tlsState(bc.Conn)
+}
+
+// ClientCertificate returns the verified client certificate of the original
+// connection.
+func (bc *backendConn) ClientCertificate() *x509.Certificate {
+	if cc, ok := bc.Conn.(ClientCertConn); ok {
+		return cc.ClientCertificate()
+	}
+	return nil
+}
+
+// Context returns the context of the original connection, cancelled when
+// its listener is closed.
+func (bc *backendConn) Context() context.Context {
+	if cc, ok := bc.Conn.(meta.ContextConn); ok {
+		return cc.Context()
+	}
+	return context.Background()
+}
+
+// CloseWrite shuts down the writing side of the original connection, or
+// closes it if it cannot be half-closed.
+func (bc *backendConn) CloseWrite() error {
+	return meta.CloseWrite(bc.Conn, bc.Close)
+}
+
+// CloseRead shuts down the reading side of the original connection where
+// supported.
+func (bc *backendConn) CloseRead() error {
+	return meta.CloseRead(bc.Conn)
+}
@@ -0,0 +1,275 @@
+package mirror
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	// certCheckInterval is how often certificate files are re-read.
+	certCheckInterval = time.Hour
+	// certFailureInterval limits failure events to one per domain per interval.
+	certFailureInterval = 10 * time.Minute
+	// defaultCertExpiryWarning is used when MirrorConfig.CertExpiryWarning is zero.
+	defaultCertExpiryWarning = 14 * 24 * time.Hour
+)
+
+// CertEventType identifies what happened to a certificate.
+type CertEventType int
+
+const (
+	// CertIssued means a certificate was obtained for a domain that had none.
+	CertIssued CertEventType = iota
+	// CertRenewed means a certificate was replaced by one expiring later.
+	CertRenewed
+	// CertFailed means obtaining or renewing a certificate failed.
+	CertFailed
+	// CertExpiring means the current certificate expires within
+	// MirrorConfig.CertExpiryWarning and has not been renewed yet.
+	CertExpiring
+	// CertMigrating means Mirror.MigrateDomain moved a service to Domain
+	// and serves From alongside it until the overlap ends.
+	CertMigrating
+	// CertMigrated means the overlap ended and From is no longer served.
+	CertMigrated
+)
+
+// String returns the lowercase name of the event type.
+func (t CertEventType) String() string {
+	switch t {
+	case CertIssued:
+		return "issued"
+	case CertRenewed:
+		return "renewed"
+	case CertFailed:
+		return "failed"
+	case CertExpiring:
+		return "expiring"
+	case CertMigrating:
+		return "migrating"
+	case CertMigrated:
+		return "migrated"
+	default:
+		return "unknown"
+	}
+}
+
+// CertEvent describes a change in the certificate of a clearnet domain.
+type CertEvent struct {
+	Type   CertEventType
+	Domain string
+	// NotAfter is the expiry of the certificate concerned. For CertFailed it
+	// is the expiry of the certificate still in use, if any.
+	NotAfter time.Time
+	// Err is set for CertFailed.
+	Err error
+	// From is the domain being retired, for CertMigrating, CertMigrated,
+	// and a CertFailed reporting that it could not be retired.
+	From string
+}
+
+// certTracker turns certificate observations into CertEvents, deduplicating
+// reports that arrive from both the ACME client and the file monitor.
+type certTracker struct {
+	handler func(CertEvent)
+	warning time.Duration
+
+	mu       sync.Mutex
+	notAfter map[string]time.Time
+	warned   map[string]time.Time
+	failed   map[string]time.Time
+}
+
+func newCertTracker(handler func(CertEvent), warning time.Duration) *certTracker {
+	if warning <= 0 {
+		warning = defaultCertExpiryWarning
+	}
+	return &certTracker{
+		handler:  handler,
+		warning:  warning,
+		notAfter: make(map[string]time.Time),
+		warned:   make(map[string]time.Time),
+		failed:   make(map[string]time.Time),
+	}
+}
+
+// baseline records the certificate found at startup without emitting an
+// issuance event, so restarts do not report every certificate as new.
+func (ct *certTracker) baseline(domain string, notAfter time.Time) {
+	ct.mu.Lock()
+	if _, seen := ct.notAfter[domain]; !seen {
+		ct.notAfter[domain] = notAfter
+	}
+	ct.mu.Unlock()
+	if !notAfter.IsZero() {
+		ct.observe(domain, notAfter)
+	}
+}
+
+// observe records the current certificate expiry for domain. A zero
+// notAfter means no certificate is present.
+func (ct *certTracker) observe(domain string, notAfter time.Time) {
+	if notAfter.IsZero() {
+		ct.mu.Lock()
+		if _, seen := ct.notAfter[domain]; !seen {
+			ct.notAfter[domain] = time.Time{}
+		}
+		ct.mu.Unlock()
+		return
+	}
+
+	var events []CertEvent
+	ct.mu.Lock()
+	previous, seen := ct.notAfter[domain]
+	switch {
+	case !seen || previous.IsZero():
+		events = append(events, CertEvent{Type: CertIssued, Domain: domain, NotAfter: notAfter})
+	case notAfter.After(previous):
+		events = append(events, CertEvent{Type: CertRenewed, Domain: domain, NotAfter: notAfter})
+	}
+	ct.notAfter[domain] = notAfter
+	if time.Until(notAfter) < ct.warning && !ct.warned[domain].Equal(notAfter) {
+		ct.warned[domain] = notAfter
+		events = append(events, CertEvent{Type: CertExpiring, Domain: domain, NotAfter: notAfter})
+	}
+	ct.mu.Unlock()
+
+	for _, event := range events {
+		ct.emit(event)
+	}
+}
+
+// fail reports a failure to obtain a certificate, at most once per
+// certFailureInterval per domain.
+func (ct *certTracker) fail(domain string, err error) {
+	ct.mu.Lock()
+	if last, ok := ct.failed[domain]; ok && time.Since(last) < certFailureInterval {
+		ct.mu.Unlock()
+		return
+	}
+	ct.failed[domain] = time.Now()
+	notAfter := ct.notAfter[domain]
+	ct.mu.Unlock()
+
+	ct.emit(CertEvent{Type: CertFailed, Domain: domain, NotAfter: notAfter, Err: err})
+}
+
+// migrate reports a step of moving a service from one domain to another,
+// with the expiry of the new domain's certificate, if known.
+func (ct *certTracker) migrate(typ CertEventType, domain, from string) {
+	ct.mu.Lock()
+	notAfter := ct.notAfter[domain]
+	ct.mu.Unlock()
+
+	ct.emit(CertEvent{Type: typ, Domain: domain, NotAfter: notAfter, From: from})
+}
+
+func (ct *certTracker) emit(event CertEvent) {
+	if event.From != "" {
+		log.Printf("Certificate %s from %s to %s", event.Type, event.From, event.Domain)
+	} else {
+		log.Printf("Certificate %s for %s (expires %s)", event.Type, event.Domain, event.NotAfter.Format(time.RFC3339))
+	}
+	if ct.handler != nil {
+		ct.handler(event)
+	}
+}
+
+// watch records the current certificates of domains in store and then
+// re-reads them in the background until stop is closed, reporting issuance,
+// renewal, and upcoming expiry.
+func (ct *certTracker) watch(store CertStore, domains []string, stop <-chan struct{}) {
+	for _, domain := range domains {
+		ct.baseline(domain, readCertExpiry(store, domain))
+	}
+	go ct.poll(store, domains, stop)
+}
+
+func (ct *certTracker) poll(store CertStore, domains []string, stop <-chan struct{}) {
+	ticker := time.NewTicker(certCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			for _, domain := range domains {
+				ct.observe(domain, readCertExpiry(store, domain))
+			}
+		}
+	}
+}
+
+// readCertExpiry returns the expiry of the certificate stored for domain in
+// store, using the autocert cache layout, or the zero time if there is none.
+func readCertExpiry(store CertStore, domain string) time.Time {
+	for _, name := range []string{domain, domain + "+rsa"} {
+		data, err := store.Get(context.Background(), name)
+		if err != nil {
+			continue
+		}
+		if notAfter, ok := certExpiry(data); ok {
+			return notAfter
+		}
+	}
+	return time.Time{}
+}
+
+// certExpiry returns the NotAfter of the first certificate in PEM data.
+func certExpiry(data []byte) (time.Time, bool) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return time.Time{}, false
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return cert.NotAfter, true
+	}
+}
+
+// eventCache wraps an autocert.Cache and reports certificates as they are
+// stored, so issuance and renewal events fire immediately.
+type eventCache struct {
+	autocert.Cache
+	tracker *certTracker
+	domains map[string]bool
+}
+
+// Put stores data and reports it if it is a certificate for a known domain.
+func (ec *eventCache) Put(ctx context.Context, key string, data []byte) error {
+	if err := ec.Cache.Put(ctx, key, data); err != nil {
+		return err
+	}
+	domain, _ := strings.CutSuffix(key, "+rsa")
+	if ec.domains[domain] {
+		if notAfter, ok := certExpiry(data); ok {
+			ec.tracker.observe(domain, notAfter)
+		}
+	}
+	return nil
+}
+
+// certTracker returns the Mirror's certificate tracker, creating it on first use.
+func (ml *Mirror) certTracker() *certTracker {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	if ml.certs == nil {
+		cfg := ml.cfg()
+		ml.certs = newCertTracker(cfg.OnCertEvent, cfg.CertExpiryWarning)
+	}
+	return ml.certs
+}
@@ -0,0 +1,73 @@
+package mirror
+
+import (
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestCertTrackerEvents verifies that startup certificates are not reported
+// as issued, and that issuance, renewal, expiry, and failure are reported once.
+func TestCertTrackerEvents(t *testing.T) {
+	var events []CertEvent
+	ct := newCertTracker(func(e CertEvent) { events = append(events, e) }, 24*time.Hour)
+
+	later := time.Now().Add(30 * 24 * time.Hour)
+	ct.baseline("a.example", later)
+	ct.baseline("b.example", time.Time{})
+	if len(events) != 0 {
+		t.Fatalf("Expected no events for baseline certificates, got %v", events)
+	}
+
+	ct.observe("a.example", later)
+	ct.observe("b.example", later)
+	ct.observe("b.example", later)
+	ct.observe("a.example", later.Add(time.Hour))
+	soon := time.Now().Add(time.Hour)
+	ct.observe("c.example", soon)
+	ct.observe("c.example", soon)
+	ct.fail("a.example", errors.New("rate limited"))
+	ct.fail("a.example", errors.New("rate limited"))
+
+	want := []struct {
+		typ    CertEventType
+		domain string
+	}{
+		{CertIssued, "b.example"},
+		{CertRenewed, "a.example"},
+		{CertIssued, "c.example"},
+		{CertExpiring, "c.example"},
+		{CertFailed, "a.example"},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("Expected %d events, got %v", len(want), events)
+	}
+	for i, w := range want {
+		if events[i].Type != w.typ || events[i].Domain != w.domain {
+			t.Errorf("Event %d: expected %s for %s, got %s for %s", i, w.typ, w.domain, events[i].Type, events[i].Domain)
+		}
+	}
+}
+
+// TestReadCertExpiry verifies that expiry is read from the autocert cache
+// layout, where the key precedes the certificate chain.
+func TestReadCertExpiry(t *testing.T) {
+	dir := t.TempDir()
+	cert := testTLSConfig(t).Certificates[0]
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: []byte("key")})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})...)
+	if err := os.WriteFile(filepath.Join(dir, "a.example+rsa"), data, 0o600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+
+	notAfter := readCertExpiry(DirCertStore(dir), "a.example")
+	if notAfter.IsZero() || notAfter.Before(time.Now()) {
+		t.Errorf("Expected a future expiry, got %v", notAfter)
+	}
+	if got := readCertExpiry(DirCertStore(dir), "missing.example"); !got.IsZero() {
+		t.Errorf("Expected zero expiry for a missing certificate, got %v", got)
+	}
+}
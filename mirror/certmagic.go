@@ -0,0 +1,241 @@
+//go:build certmagic
+
+package mirror
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/caddyserver/certmagic"
+	acmez "github.com/mholt/acmez/v2/acme"
+	"golang.org/x/crypto/acme"
+)
+
+// CertMagicProvider obtains certificates with certmagic, the ACME client of
+// the Caddy web server. It needs the certmagic build tag, so programs that
+// do not use it do not compile certmagic and its dependencies. Over
+// ACMEProvider it adds:
+//
+//   - on-demand TLS, obtaining the certificate of a name at its first
+//     handshake, for names not known in advance;
+//   - certmagic.Storage, whose implementations for Redis, Consul, S3 and
+//     other backends also lock issuance, so the nodes of a cluster share
+//     certificates and only one of them requests each;
+//   - renewal certmagic schedules from each certificate's lifetime and the
+//     CA's renewal information, with OCSP stapling.
+//
+// Challenges are answered like ACMEProvider's: TLS-ALPN-01 on the TLS
+// listener and HTTP-01 on the companion HTTP listener when
+// ServiceConfig.HTTPAddr is set.
+type CertMagicProvider struct {
+	// Addr is the address the TLS listener binds when the service has no
+	// ServiceConfig.TLSAddr. Defaults to ":443".
+	Addr string
+	// DirectoryURL is the ACME directory. Defaults to Let's Encrypt.
+	DirectoryURL string
+	// DisableTLSALPN stops the TLS listener from answering TLS-ALPN-01
+	// challenges.
+	DisableTLSALPN bool
+	// DisableHTTPChallenge stops certmagic from answering HTTP-01
+	// challenges, on the companion HTTP listener or on port 80.
+	DisableHTTPChallenge bool
+	// Listener, if set, is used instead of binding Addr. It is closed with
+	// the service, so a provider with a Listener serves a single service.
+	Listener net.Listener
+	// ExternalAccountBinding registers the ACME account with credentials
+	// issued by a CA that requires them. HMACKey holds the decoded key.
+	ExternalAccountBinding *acme.ExternalAccountBinding
+	// Storage keeps the certificates, keys, and ACME account. Defaults to
+	// a certmagic.FileStorage in CERT_DIR.
+	Storage certmagic.Storage
+	// OnDemand obtains certificates at the first handshake naming them
+	// rather than when the listener is created, for the service's domains
+	// and for the names OnDemandAllow admits.
+	OnDemand bool
+	// OnDemandAllow decides whether an on-demand certificate may be
+	// obtained for name, which is not a domain of the service, returning
+	// an error to refuse it. It guards the CA's rate limits against
+	// clients sending arbitrary names. Nil refuses every such name.
+	OnDemandAllow func(ctx context.Context, name string) error
+	// RenewalWindowRatio is the fraction of a certificate's lifetime left
+	// when it is renewed. Zero uses certmagic's default of one third.
+	RenewalWindowRatio float64
+}
+
+var _ CertProvider = &CertMagicProvider{}
+
+// Listen binds the TLS listener and has certmagic manage the certificates
+// of the service's domains, obtaining them in the background unless
+// OnDemand defers each to its first handshake. With cfg.ClientAuth, clients
+// must present a certificate during a handshake completed before Accept
+// returns them.
+func (p *CertMagicProvider) Listen(ctx context.Context, cfg ServiceConfig) (net.Listener, error) {
+	storage := p.Storage
+	if storage == nil {
+		storage = &certmagic.FileStorage{Path: certDir()}
+	}
+	domains := make(map[string]bool)
+	for _, domain := range cfg.tlsDomains() {
+		domains[domain] = true
+	}
+
+	var config *certmagic.Config
+	cache := certmagic.NewCache(certmagic.CacheOptions{
+		GetConfigForCert: func(certmagic.Certificate) (*certmagic.Config, error) { return config, nil },
+	})
+	config = certmagic.New(cache, certmagic.Config{
+		Storage:            storage,
+		RenewalWindowRatio: p.RenewalWindowRatio,
+		OnEvent:            certmagicEvents(storage, cfg.certs),
+	})
+	if p.OnDemand {
+		config.OnDemand = &certmagic.OnDemandConfig{
+			DecisionFunc: func(ctx context.Context, name string) error {
+				if domains[name] {
+					return nil
+				}
+				if p.OnDemandAllow == nil {
+					return fmt.Errorf("%s is not a domain of the service", name)
+				}
+				return p.OnDemandAllow(ctx, name)
+			},
+		}
+	}
+	issuer := certmagic.NewACMEIssuer(config, certmagic.ACMEIssuer{
+		CA:                      p.DirectoryURL,
+		Email:                   cfg.Email,
+		Agreed:                  true,
+		DisableHTTPChallenge:    p.DisableHTTPChallenge,
+		DisableTLSALPNChallenge: p.DisableTLSALPN,
+		ExternalAccount:         externalAccount(p.ExternalAccountBinding),
+	})
+	config.Issuers = []certmagic.Issuer{issuer}
+
+	listener, err := listenACME(ctx, p.Listener, cfg.TLSAddr, p.Addr)
+	if err != nil {
+		cache.Stop()
+		return nil, err
+	}
+	if !p.OnDemand {
+		if err := config.ManageAsync(context.Background(), cfg.tlsDomains()); err != nil {
+			cache.Stop()
+			listener.Close()
+			return nil, fmt.Errorf("failed to manage certificates of %v: %w", cfg.tlsDomains(), err)
+		}
+	}
+
+	tlsConfig := TLSSettingsFromContext(ctx).apply(acmeTLSConfig(config.GetCertificate, cfg.certs, domains, cfg.ALPN, !p.DisableTLSALPN))
+	if cfg.ClientAuth == nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	} else {
+		listener = newVerifiedListener(tls.NewListener(listener, cfg.ClientAuth.serverConfig(tlsConfig)), cfg.ClientAuth.HandshakeTimeout)
+	}
+	return &certmagicListener{Listener: listener, config: config, issuer: issuer, cache: cache, storage: storage}, nil
+}
+
+// externalAccount converts an External Account Binding to certmagic's form,
+// which holds the key base64url-encoded.
+func externalAccount(eab *acme.ExternalAccountBinding) *acmez.EAB {
+	if eab == nil {
+		return nil
+	}
+	return &acmez.EAB{KeyID: eab.KID, MACKey: base64.RawURLEncoding.EncodeToString(eab.Key)}
+}
+
+// certmagicEvents returns the certmagic event handler reporting issuance,
+// renewal, and failures to certs, or nil when certs is nil.
+func certmagicEvents(storage certmagic.Storage, certs *certTracker) func(context.Context, string, map[string]any) error {
+	if certs == nil {
+		return nil
+	}
+	return func(ctx context.Context, event string, data map[string]any) error {
+		domain, _ := data["identifier"].(string)
+		switch event {
+		case "cert_obtained":
+			path, _ := data["certificate_path"].(string)
+			if pem, err := storage.Load(ctx, path); err == nil {
+				if notAfter, ok := certExpiry(pem); ok {
+					certs.observe(domain, notAfter)
+				}
+			}
+		case "cert_failed":
+			err, _ := data["error"].(error)
+			if err == nil {
+				err = errors.New("certmagic failed to obtain the certificate")
+			}
+			certs.fail(domain, err)
+		}
+		return nil
+	}
+}
+
+// certmagicListener is the TLS listener created by CertMagicProvider.
+type certmagicListener struct {
+	net.Listener
+	config    *certmagic.Config
+	issuer    *certmagic.ACMEIssuer
+	cache     *certmagic.Cache
+	storage   certmagic.Storage
+	closeOnce sync.Once
+}
+
+// Close closes the listener and stops renewing its certificates.
+func (cl *certmagicListener) Close() error {
+	err := cl.Listener.Close()
+	cl.closeOnce.Do(cl.cache.Stop)
+	return err
+}
+
+// CertStore returns the certificates of the listener as a CertStore, for
+// the certificate events of the Mirror.
+func (cl *certmagicListener) CertStore() CertStore {
+	return certmagicStore{storage: cl.storage, issuerKey: cl.issuer.IssuerKey()}
+}
+
+// Issue obtains the certificate for domain, if it is not stored yet, and
+// keeps it renewed.
+func (cl *certmagicListener) Issue(ctx context.Context, domain string) error {
+	return cl.config.ManageSync(ctx, []string{domain})
+}
+
+// HTTPHandler answers HTTP-01 challenges and passes other requests to fallback.
+func (cl *certmagicListener) HTTPHandler(fallback http.Handler) http.Handler {
+	return cl.issuer.HTTPChallengeHandler(fallback)
+}
+
+// certmagicStore presents the site certificates of an issuer in a
+// certmagic.Storage as a CertStore keyed by domain.
+type certmagicStore struct {
+	storage   certmagic.Storage
+	issuerKey string
+}
+
+// Get returns the PEM certificate chain stored for domain.
+func (s certmagicStore) Get(ctx context.Context, domain string) ([]byte, error) {
+	data, err := s.storage.Load(ctx, certmagic.StorageKeys.SiteCert(s.issuerKey, domain))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrCertNotFound
+	}
+	return data, err
+}
+
+// Put stores the certificate chain of domain.
+func (s certmagicStore) Put(ctx context.Context, domain string, data []byte) error {
+	return s.storage.Store(ctx, certmagic.StorageKeys.SiteCert(s.issuerKey, domain), data)
+}
+
+// Delete removes the certificate chain of domain.
+func (s certmagicStore) Delete(ctx context.Context, domain string) error {
+	err := s.storage.Delete(ctx, certmagic.StorageKeys.SiteCert(s.issuerKey, domain))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
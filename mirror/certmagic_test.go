@@ -0,0 +1,49 @@
+//go:build certmagic
+
+package mirror
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/caddyserver/certmagic"
+	"golang.org/x/crypto/acme"
+)
+
+// TestCertMagicStore verifies that site certificates are found where
+// certmagic stores them, and that a missing one is ErrCertNotFound.
+func TestCertMagicStore(t *testing.T) {
+	ctx := context.Background()
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	store := certmagicStore{storage: storage, issuerKey: "acme-v02.api.letsencrypt.org-directory"}
+
+	if _, err := store.Get(ctx, "example.com"); !errors.Is(err, ErrCertNotFound) {
+		t.Fatalf("Get of a missing certificate: %v, want ErrCertNotFound", err)
+	}
+	if err := storage.Store(ctx, certmagic.StorageKeys.SiteCert(store.issuerKey, "example.com"), []byte("chain")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := store.Get(ctx, "example.com"); err != nil || string(data) != "chain" {
+		t.Errorf("Get = %q, %v", data, err)
+	}
+	if err := store.Delete(ctx, "example.com"); err != nil {
+		t.Errorf("Delete: %v", err)
+	}
+	if err := store.Delete(ctx, "example.com"); err != nil {
+		t.Errorf("Delete of a missing certificate: %v", err)
+	}
+}
+
+// TestCertMagicExternalAccount verifies that the decoded HMAC key is handed
+// to certmagic base64url-encoded.
+func TestCertMagicExternalAccount(t *testing.T) {
+	if externalAccount(nil) != nil {
+		t.Error("no binding converted to one")
+	}
+	eab := externalAccount(&acme.ExternalAccountBinding{KID: "kid", Key: []byte{0xfb, 0xff}})
+	if eab.KeyID != "kid" || eab.MACKey != base64.RawURLEncoding.EncodeToString([]byte{0xfb, 0xff}) {
+		t.Errorf("binding %+v", eab)
+	}
+}
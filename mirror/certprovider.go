@@ -0,0 +1,270 @@
+package mirror
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+
+	wileedot "github.com/opd-ai/wileedot"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// CertProvider creates the clearnet TLS listener of a service and manages
+// its certificates. MirrorConfig.CertProvider selects the implementation.
+type CertProvider interface {
+	// Listen returns a listener whose accepted connections are TLS
+	// connections for cfg.Name and cfg.Domains.
+	Listen(ctx context.Context, cfg ServiceConfig) (net.Listener, error)
+}
+
+// httpChallengeResponder is implemented by listeners whose provider can
+// answer ACME HTTP-01 challenges on the companion HTTP listener.
+type httpChallengeResponder interface {
+	HTTPHandler(fallback http.Handler) http.Handler
+}
+
+// WileedotProvider obtains certificates from Let's Encrypt using wileedot.
+// It is the default provider.
+type WileedotProvider struct{}
+
+// Listen creates a wileedot listener storing certificates in CERT_DIR,
+// bound to cfg.TLSAddr when it is set.
+func (WileedotProvider) Listen(ctx context.Context, cfg ServiceConfig) (net.Listener, error) {
+	if cfg.ClientAuth != nil {
+		return nil, errors.New("WileedotProvider cannot verify client certificates; use ACMEProvider")
+	}
+	if len(cfg.ALPN) > 0 {
+		return nil, errors.New("WileedotProvider cannot offer ALPN protocols; use ACMEProvider")
+	}
+	if TLSSettingsFromContext(ctx) != nil {
+		return nil, errors.New("WileedotProvider cannot apply TLS settings; use ACMEProvider")
+	}
+	domains := cfg.tlsDomains()
+	wcfg := wileedot.Config{
+		Domain:         domains[0],
+		AllowedDomains: domains[1:],
+		CertDir:        certDir(),
+		Email:          cfg.Email,
+	}
+	if cfg.TLSAddr != "" {
+		var lc net.ListenConfig
+		base, err := lc.Listen(ctx, "tcp", cfg.TLSAddr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create TLS listener on %s: %w", cfg.TLSAddr, err)
+		}
+		wcfg.BaseListener = base
+	}
+	listener, err := listenContext(ctx, func() (net.Listener, error) { return wileedot.New(wcfg) })
+	if err != nil && wcfg.BaseListener != nil {
+		wcfg.BaseListener.Close()
+	}
+	return listener, err
+}
+
+// defaultACMEAddr is where ACMEProvider listens when Addr is empty.
+const defaultACMEAddr = ":443"
+
+// ACMEProvider obtains certificates with the ACME client built into the
+// package (golang.org/x/crypto/acme/autocert), caching them in CERT_DIR.
+// Unlike WileedotProvider, the Mirror owns the ACME state, so challenges can
+// be answered on the Mirror's own listeners: TLS-ALPN-01 on the TLS listener
+// itself, which needs no port 80 at all, and HTTP-01 on the companion HTTP
+// listener when ServiceConfig.HTTPAddr is set.
+type ACMEProvider struct {
+	// Addr is the address the TLS listener binds when the service has no
+	// ServiceConfig.TLSAddr. Defaults to ":443".
+	// TLS-ALPN-01 validation requires it to be reachable on public port 443.
+	Addr string
+	// DirectoryURL is the ACME directory. Defaults to Let's Encrypt.
+	DirectoryURL string
+	// DisableTLSALPN stops the TLS listener from answering TLS-ALPN-01
+	// challenges, for deployments where port 443 is terminated elsewhere.
+	// Issuance then requires HTTP-01 through ServiceConfig.HTTPAddr.
+	DisableTLSALPN bool
+	// Listener, if set, is used instead of binding Addr, for example a
+	// socket passed by systemd socket activation. It is closed with the
+	// service, so a provider with a Listener serves a single service.
+	Listener net.Listener
+	// ExternalAccountBinding registers the ACME account with credentials
+	// issued by a CA that requires them, such as ZeroSSL or an enterprise
+	// ACME server. HMACKey holds the decoded key, not its base64url form.
+	ExternalAccountBinding *acme.ExternalAccountBinding
+	// AccountKeyFile is a PEM file holding the ACME account key, created
+	// with a new P-256 key if it does not exist. Keeping it outside
+	// CERT_DIR lets the account survive the certificate directory being
+	// moved or wiped. Empty stores the key in Store.
+	AccountKeyFile string
+	// Store keeps the certificates and keys, such as an SQLCertStore shared
+	// by the nodes of a cluster. Defaults to DirCertStore(CERT_DIR).
+	Store CertStore
+}
+
+// Listen binds the TLS listener and issues certificates on demand for the
+// service's domains. With cfg.ClientAuth, clients must present a certificate
+// during a handshake completed before Accept returns them.
+func (p *ACMEProvider) Listen(ctx context.Context, cfg ServiceConfig) (net.Listener, error) {
+	store := p.Store
+	if store == nil {
+		store = DirCertStore(certDir())
+	}
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      store,
+		HostPolicy: autocert.HostWhitelist(cfg.tlsDomains()...),
+		Email:      cfg.Email,
+
+		ExternalAccountBinding: p.ExternalAccountBinding,
+	}
+	if p.DirectoryURL != "" || p.AccountKeyFile != "" {
+		manager.Client = &acme.Client{DirectoryURL: p.DirectoryURL}
+	}
+	if p.AccountKeyFile != "" {
+		key, err := loadAccountKey(p.AccountKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		manager.Client.Key = key
+	}
+	domains := make(map[string]bool)
+	for _, domain := range cfg.tlsDomains() {
+		domains[domain] = true
+	}
+	if cfg.certs != nil {
+		manager.Cache = &eventCache{Cache: manager.Cache, tracker: cfg.certs, domains: domains}
+	}
+
+	listener, err := listenACME(ctx, p.Listener, cfg.TLSAddr, p.Addr)
+	if err != nil {
+		return nil, err
+	}
+	config := TLSSettingsFromContext(ctx).apply(p.tlsConfig(manager, cfg.certs, domains, cfg.ALPN))
+	if cfg.ClientAuth == nil {
+		return &acmeListener{Listener: tls.NewListener(listener, config), manager: manager, store: store}, nil
+	}
+	listener = newVerifiedListener(tls.NewListener(listener, cfg.ClientAuth.serverConfig(config)), cfg.ClientAuth.HandshakeTimeout)
+	return &acmeListener{Listener: listener, manager: manager, store: store}, nil
+}
+
+// listenACME returns listener if it is set, and otherwise binds tlsAddr,
+// falling back to addr and then defaultACMEAddr.
+func listenACME(ctx context.Context, listener net.Listener, tlsAddr, addr string) (net.Listener, error) {
+	if listener != nil {
+		return listener, nil
+	}
+	if tlsAddr != "" {
+		addr = tlsAddr
+	}
+	if addr == "" {
+		addr = defaultACMEAddr
+	}
+	var lc net.ListenConfig
+	listener, err := lc.Listen(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ACME TLS listener on %s: %w", addr, err)
+	}
+	return listener, nil
+}
+
+// tlsConfig returns the server configuration for the TLS listener of
+// manager, see acmeTLSConfig.
+func (p *ACMEProvider) tlsConfig(manager *autocert.Manager, certs *certTracker, domains map[string]bool, protos []string) *tls.Config {
+	return acmeTLSConfig(manager.GetCertificate, certs, domains, protos, !p.DisableTLSALPN)
+}
+
+// acmeTLSConfig returns the server configuration for a TLS listener serving
+// the certificates of getCertificate, offering protos, or HTTP/1.1 when
+// there are none. Offering the acme-tls/1 protocol, with tlsALPN, lets
+// getCertificate answer TLS-ALPN-01 challenges during the handshake.
+// Failures to obtain a certificate for one of domains are reported to certs
+// when it is non-nil.
+func acmeTLSConfig(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error), certs *certTracker, domains map[string]bool, protos []string, tlsALPN bool) *tls.Config {
+	if certs != nil {
+		get := getCertificate
+		getCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, err := get(hello)
+			if err != nil && domains[hello.ServerName] {
+				certs.fail(hello.ServerName, err)
+			}
+			return cert, err
+		}
+	}
+	config := &tls.Config{
+		GetCertificate: getCertificate,
+		NextProtos:     slices.Clone(protos),
+	}
+	if len(protos) == 0 {
+		config.NextProtos = []string{ProtoHTTP1}
+	}
+	if tlsALPN {
+		config.NextProtos = append(config.NextProtos, acme.ALPNProto)
+	}
+	return config
+}
+
+// acmeListener is the TLS listener created by ACMEProvider.
+type acmeListener struct {
+	net.Listener
+	manager *autocert.Manager
+	store   CertStore
+}
+
+// CertStore returns the store the listener's certificates are kept in.
+func (al *acmeListener) CertStore() CertStore {
+	return al.store
+}
+
+// Issue obtains the certificate for domain, if it is not cached yet, as the
+// first handshake naming it would.
+func (al *acmeListener) Issue(ctx context.Context, domain string) error {
+	// An ECDSA-capable ClientHello, so the certificate matches what
+	// current clients are served
+	hello := &tls.ClientHelloInfo{
+		ServerName:        domain,
+		CipherSuites:      []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedCurves:   []tls.CurveID{tls.CurveP256},
+		SupportedVersions: []uint16{tls.VersionTLS13, tls.VersionTLS12},
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := al.manager.GetCertificate(hello)
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// HTTPHandler answers HTTP-01 challenges and passes other requests to fallback.
+func (al *acmeListener) HTTPHandler(fallback http.Handler) http.Handler {
+	return al.manager.HTTPHandler(fallback)
+}
+
+// certProvider returns the configured provider, defaulting to wileedot.
+func (ml *Mirror) certProvider() CertProvider {
+	if provider := ml.cfg().CertProvider; provider != nil {
+		return provider
+	}
+	return WileedotProvider{}
+}
+
+// tlsDomains returns the bare host names the service's certificate covers.
+func (cfg ServiceConfig) tlsDomains() []string {
+	domains := make([]string, 0, len(cfg.Domains)+len(cfg.retiring)+1)
+	names := append([]string{cfg.Name}, cfg.Domains...)
+	for _, name := range append(names, cfg.retiring...) {
+		if host, _, err := net.SplitHostPort(name); err == nil {
+			name = host
+		}
+		domains = append(domains, name)
+	}
+	return domains
+}
@@ -0,0 +1,77 @@
+package mirror
+
+import (
+	"context"
+	"net"
+	"slices"
+	"testing"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TestACMEProviderTLSALPN verifies that the ACME provider offers the
+// acme-tls/1 protocol unless TLS-ALPN-01 is disabled.
+func TestACMEProviderTLSALPN(t *testing.T) {
+	manager := &autocert.Manager{}
+
+	config := (&ACMEProvider{}).tlsConfig(manager, nil, nil, nil)
+	if !slices.Contains(config.NextProtos, acme.ALPNProto) {
+		t.Errorf("Expected %s in NextProtos, got %v", acme.ALPNProto, config.NextProtos)
+	}
+	if !slices.Contains(config.NextProtos, "http/1.1") {
+		t.Errorf("Expected http/1.1 in NextProtos, got %v", config.NextProtos)
+	}
+
+	config = (&ACMEProvider{DisableTLSALPN: true}).tlsConfig(manager, nil, nil, nil)
+	if slices.Contains(config.NextProtos, acme.ALPNProto) {
+		t.Errorf("Did not expect %s in NextProtos, got %v", acme.ALPNProto, config.NextProtos)
+	}
+
+	config = (&ACMEProvider{}).tlsConfig(manager, nil, nil, []string{ProtoHTTP2, ProtoHTTP1})
+	if want := []string{ProtoHTTP2, ProtoHTTP1, acme.ALPNProto}; !slices.Equal(config.NextProtos, want) {
+		t.Errorf("NextProtos = %v, want %v", config.NextProtos, want)
+	}
+}
+
+// TestACMEProviderListener verifies that a provided listener is used
+// instead of binding Addr.
+func TestACMEProviderListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &ACMEProvider{Addr: "invalid address", Listener: inner}
+	listener, err := provider.Listen(context.Background(), ServiceConfig{Name: "example.com"})
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer listener.Close()
+	if listener.Addr().String() != inner.Addr().String() {
+		t.Errorf("listening on %s, want %s", listener.Addr(), inner.Addr())
+	}
+}
+
+// TestProviderTLSAddr verifies that both providers bind the service's
+// TLSAddr rather than their default address.
+func TestProviderTLSAddr(t *testing.T) {
+	t.Setenv("CERT_DIR", t.TempDir())
+	providers := map[string]CertProvider{
+		"wileedot": WileedotProvider{},
+		"acme":     &ACMEProvider{Addr: "invalid address"},
+	}
+	for name, provider := range providers {
+		t.Run(name, func(t *testing.T) {
+			cfg := ServiceConfig{Name: "example.com:3002", TLSAddr: "127.0.0.1:0"}
+			listener, err := provider.Listen(context.Background(), cfg)
+			if err != nil {
+				t.Fatalf("Listen: %v", err)
+			}
+			defer listener.Close()
+			host, _, err := net.SplitHostPort(listener.Addr().String())
+			if err != nil || host != "127.0.0.1" {
+				t.Errorf("listening on %s, want 127.0.0.1", listener.Addr())
+			}
+		})
+	}
+}
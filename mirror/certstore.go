@@ -0,0 +1,114 @@
+package mirror
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// CertStore holds the certificates, private keys, and ACME account key of
+// ACMEProvider, by name. Its methods are those of autocert.Cache, so any
+// autocert cache can be used as a CertStore. Giving every node of a cluster
+// the same shared store lets them serve the certificates one of them
+// obtained, instead of each requesting its own from the CA.
+type CertStore interface {
+	// Get returns the data stored under key, or ErrCertNotFound.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Put stores data under key, replacing what was there.
+	Put(ctx context.Context, key string, data []byte) error
+	// Delete removes key. Deleting a missing key is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// ErrCertNotFound is returned by CertStore.Get for keys that are not
+// stored.
+var ErrCertNotFound = autocert.ErrCacheMiss
+
+// DirCertStore returns a CertStore keeping each key in a file of dir. It is
+// the default store, in CERT_DIR.
+func DirCertStore(dir string) CertStore {
+	return autocert.DirCache(dir)
+}
+
+// defaultCertTable is the table SQLCertStore uses when Table is empty.
+const defaultCertTable = "mirror_certs"
+
+// SQLCertStore is a CertStore in a database table, for clusters of Mirrors
+// sharing a database. The table must exist with a text primary key column
+// named name and a binary column named data, for example:
+//
+//	CREATE TABLE mirror_certs (name VARCHAR(255) PRIMARY KEY, data BLOB NOT NULL)
+//
+// using BYTEA for data on PostgreSQL. Put stores a key with a single upsert,
+// so nodes writing the same key at once do not conflict: the last write
+// wins.
+type SQLCertStore struct {
+	// DB is the database holding the table.
+	DB *sql.DB
+	// Table is the name of the table. Defaults to "mirror_certs".
+	Table string
+	// Placeholder returns the query placeholder of the nth argument,
+	// counting from 1. Defaults to "?"; PostgreSQL needs "$1", "$2", and so
+	// on.
+	Placeholder func(n int) string
+	// Upsert is the statement Put runs, inserting or replacing the row of
+	// its first argument, the key, with its second, the data. Empty uses
+	// INSERT ... ON CONFLICT (name) DO UPDATE, which PostgreSQL and SQLite
+	// support; MySQL needs, for the default table:
+	//
+	//	INSERT INTO mirror_certs (name, data) VALUES (?, ?) ON DUPLICATE KEY UPDATE data = VALUES(data)
+	Upsert string
+}
+
+var _ CertStore = &SQLCertStore{}
+
+// Get returns the data stored under key.
+func (s *SQLCertStore) Get(ctx context.Context, key string) ([]byte, error) {
+	var data []byte
+	err := s.DB.QueryRowContext(ctx, fmt.Sprintf("SELECT data FROM %s WHERE name = %s", s.table(), s.placeholder(1)), key).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrCertNotFound
+	}
+	return data, err
+}
+
+// Put stores data under key, replacing what is stored there, in one
+// statement, so concurrent writers from other nodes leave one complete
+// value without conflicting on the primary key.
+func (s *SQLCertStore) Put(ctx context.Context, key string, data []byte) error {
+	query := s.Upsert
+	if query == "" {
+		query = fmt.Sprintf("INSERT INTO %s (name, data) VALUES (%s, %s) ON CONFLICT (name) DO UPDATE SET data = excluded.data", s.table(), s.placeholder(1), s.placeholder(2))
+	}
+	_, err := s.DB.ExecContext(ctx, query, key, data)
+	return err
+}
+
+// Delete removes key.
+func (s *SQLCertStore) Delete(ctx context.Context, key string) error {
+	_, err := s.DB.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE name = %s", s.table(), s.placeholder(1)), key)
+	return err
+}
+
+func (s *SQLCertStore) table() string {
+	if s.Table == "" {
+		return defaultCertTable
+	}
+	return s.Table
+}
+
+func (s *SQLCertStore) placeholder(n int) string {
+	if s.Placeholder == nil {
+		return "?"
+	}
+	return s.Placeholder(n)
+}
+
+// certStorer is implemented by listeners whose certificates are kept in a
+// CertStore rather than in CERT_DIR.
+type certStorer interface {
+	CertStore() CertStore
+}
@@ -0,0 +1,159 @@
+package mirror
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryDriver is a database/sql driver understanding the statements of
+// SQLCertStore, over one table kept in memory.
+type memoryDriver struct {
+	mu      sync.Mutex
+	rows    map[string][]byte
+	queries []string
+}
+
+func (d *memoryDriver) Open(string) (driver.Conn, error) { return memoryConn{d}, nil }
+
+type memoryConn struct{ d *memoryDriver }
+
+func (c memoryConn) Prepare(query string) (driver.Stmt, error) {
+	c.d.mu.Lock()
+	c.d.queries = append(c.d.queries, query)
+	c.d.mu.Unlock()
+	return memoryStmt{c.d, query}, nil
+}
+func (c memoryConn) Close() error              { return nil }
+func (c memoryConn) Begin() (driver.Tx, error) { return c, nil }
+func (c memoryConn) Commit() error             { return nil }
+func (c memoryConn) Rollback() error           { return nil }
+
+type memoryStmt struct {
+	d     *memoryDriver
+	query string
+}
+
+func (s memoryStmt) Close() error  { return nil }
+func (s memoryStmt) NumInput() int { return -1 }
+
+func (s memoryStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	switch {
+	case strings.HasPrefix(s.query, "DELETE"):
+		delete(s.d.rows, args[0].(string))
+	case strings.HasPrefix(s.query, "INSERT"):
+		if _, ok := s.d.rows[args[0].(string)]; ok && !strings.Contains(s.query, " ON CONFLICT (name) DO UPDATE SET data = excluded.data") {
+			return nil, errors.New("duplicate key")
+		}
+		s.d.rows[args[0].(string)] = args[1].([]byte)
+	default:
+		return nil, fmt.Errorf("unexpected statement %q", s.query)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s memoryStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	data, ok := s.d.rows[args[0].(string)]
+	return &memoryRows{data: data, found: ok}, nil
+}
+
+type memoryRows struct {
+	data  []byte
+	found bool
+}
+
+func (r *memoryRows) Columns() []string { return []string{"data"} }
+func (r *memoryRows) Close() error      { return nil }
+func (r *memoryRows) Next(dest []driver.Value) error {
+	if !r.found {
+		return io.EOF
+	}
+	r.found = false
+	dest[0] = r.data
+	return nil
+}
+
+var testDriver = &memoryDriver{rows: make(map[string][]byte)}
+
+func init() {
+	sql.Register("mirror-memory", testDriver)
+}
+
+// TestSQLCertStore verifies that SQLCertStore stores, replaces with an
+// upsert, and deletes data, and that certificate expiry is read from it.
+func TestSQLCertStore(t *testing.T) {
+	db, err := sql.Open("mirror-memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store := &SQLCertStore{DB: db, Table: "certs", Placeholder: func(n int) string { return fmt.Sprintf("$%d", n) }}
+	ctx := context.Background()
+
+	if _, err := store.Get(ctx, "a.example"); err != ErrCertNotFound {
+		t.Errorf("Get of a missing key returned %v, want ErrCertNotFound", err)
+	}
+	if err := store.Put(ctx, "a.example", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	cert := testTLSConfig(t).Certificates[0]
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	if err := store.Put(ctx, "a.example", data); err != nil {
+		t.Fatalf("Put replacing a key: %v", err)
+	}
+	testDriver.mu.Lock()
+	if last := testDriver.queries[len(testDriver.queries)-1]; !strings.Contains(last, "ON CONFLICT") {
+		t.Errorf("Put ran %q, want a single upsert", last)
+	}
+	testDriver.mu.Unlock()
+	if notAfter := readCertExpiry(store, "a.example"); notAfter.Before(time.Now()) {
+		t.Errorf("Expected a future expiry, got %v", notAfter)
+	}
+	if err := store.Delete(ctx, "a.example"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ctx, "a.example"); err != ErrCertNotFound {
+		t.Errorf("Get after Delete returned %v", err)
+	}
+
+	testDriver.mu.Lock()
+	defer testDriver.mu.Unlock()
+	for _, query := range testDriver.queries {
+		if !strings.Contains(query, " certs ") || !strings.Contains(query, "$1") {
+			t.Errorf("Query %q does not use the table and placeholders", query)
+		}
+	}
+}
+
+// TestACMEProviderStore verifies that ACMEProvider keeps its certificates in
+// its Store, where the Mirror watches them.
+func TestACMEProviderStore(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := DirCertStore(t.TempDir())
+	provider := &ACMEProvider{Listener: inner, Store: store}
+	listener, err := provider.Listen(context.Background(), ServiceConfig{Name: "example.com"})
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer listener.Close()
+	storer, ok := listener.(certStorer)
+	if !ok || storer.CertStore() != store {
+		t.Error("Listener does not report the provider's store")
+	}
+}
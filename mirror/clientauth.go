@@ -0,0 +1,199 @@
+package mirror
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// defaultClientAuthTimeout bounds the handshake of a client that must
+// present a certificate.
+const defaultClientAuthTimeout = 10 * time.Second
+
+// ClientAuth makes a TLS listener of a service require client certificates
+// (mutual TLS), for mirrors only some clients may reach. ServiceConfig.ClientAuth
+// applies to the clearnet listener and ServiceConfig.TransportClientAuth to
+// the hidden TLS listeners of each transport.
+type ClientAuth struct {
+	// CAs are the authorities client certificates must chain to.
+	CAs *x509.CertPool
+	// Verify, if set, is called with the verified chains of each client
+	// certificate, leaf first, after they chain to CAs. Returning an error
+	// rejects the client, for example because the certificate is revoked.
+	Verify func(chains [][]*x509.Certificate) error
+	// HandshakeTimeout bounds each client's handshake. Defaults to 10
+	// seconds.
+	HandshakeTimeout time.Duration
+}
+
+// clientAuthKey is the context key of WithClientAuth.
+type clientAuthKey struct{}
+
+// WithClientAuth returns a copy of ctx telling TransportProvider.ListenTLS
+// to require client certificates. The Mirror passes the transport's entry of
+// ServiceConfig.TransportClientAuth this way, and completes the handshake of
+// each connection before Accept returns it, rejecting clients without a
+// verified certificate.
+func WithClientAuth(ctx context.Context, ca *ClientAuth) context.Context {
+	return context.WithValue(ctx, clientAuthKey{}, ca)
+}
+
+// ClientAuthFromContext returns the ClientAuth set by WithClientAuth, or nil.
+func ClientAuthFromContext(ctx context.Context) *ClientAuth {
+	ca, _ := ctx.Value(clientAuthKey{}).(*ClientAuth)
+	return ca
+}
+
+// ClientCertConn is implemented by the connections of Mirror listeners. It
+// gives handlers the identity of clients that authenticated with a
+// certificate, so a service can be gated on certificates over any transport.
+type ClientCertConn interface {
+	// ClientCertificate completes the TLS handshake if needed and returns
+	// the client's verified leaf certificate, or nil for plaintext
+	// connections and clients that did not present a verified certificate.
+	ClientCertificate() *x509.Certificate
+}
+
+// clientCertificate returns the verified leaf certificate of the client of
+// conn, if it is a TLS connection, completing its handshake first.
+func clientCertificate(conn net.Conn) *x509.Certificate {
+	chains := connState(conn).VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return nil
+	}
+	return chains[0][0]
+}
+
+// serverConfig returns config requiring client certificates. Handshakes
+// offering only the acme-tls/1 protocol are TLS-ALPN-01 challenges, which
+// the ACME server makes without a certificate; they complete with config
+// itself, and verifiedListener closes them instead of returning them.
+func (ca *ClientAuth) serverConfig(config *tls.Config) *tls.Config {
+	verify := config.Clone()
+	verify.ClientAuth = tls.RequireAndVerifyClientCert
+	verify.ClientCAs = ca.CAs
+	verify.NextProtos = slices.DeleteFunc(slices.Clone(config.NextProtos), func(proto string) bool {
+		return proto == acme.ALPNProto
+	})
+	if ca.Verify != nil {
+		verify.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+			return ca.Verify(chains)
+		}
+	}
+
+	base := config.Clone()
+	base.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if slices.Contains(config.NextProtos, acme.ALPNProto) && slices.Equal(hello.SupportedProtos, []string{acme.ALPNProto}) {
+			return nil, nil
+		}
+		return verify, nil
+	}
+	return base
+}
+
+// verifiedListener completes the handshake of each connection of a TLS
+// listener requiring client certificates, so Accept only returns clients
+// whose certificate was accepted. Handshakes run concurrently, so a slow
+// client does not hold up the others.
+type verifiedListener struct {
+	net.Listener
+	timeout time.Duration
+
+	conns     chan net.Conn
+	closeOnce sync.Once
+	done      chan struct{}
+	err       error
+}
+
+// newVerifiedListener starts verifying the connections of listener, whose
+// connections must be TLS connections.
+func newVerifiedListener(listener net.Listener, timeout time.Duration) *verifiedListener {
+	if timeout <= 0 {
+		timeout = defaultClientAuthTimeout
+	}
+	vl := &verifiedListener{
+		Listener: listener,
+		timeout:  timeout,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go vl.acceptLoop()
+	return vl
+}
+
+func (vl *verifiedListener) acceptLoop() {
+	for {
+		conn, err := vl.Listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
+			vl.shutdown(err)
+			return
+		}
+		go vl.verify(conn)
+	}
+}
+
+// verify completes the handshake of conn and hands it to Accept.
+func (vl *verifiedListener) verify(conn net.Conn) {
+	tlsConn, ok := conn.(tlsConnectionStater)
+	if !ok {
+		conn.Close()
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), vl.timeout)
+	err := tlsConn.HandshakeContext(ctx)
+	cancel()
+	if err != nil {
+		log.Printf("Client certificate check of %s failed: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	state := tlsConn.ConnectionState()
+	if state.NegotiatedProtocol == acme.ALPNProto {
+		// A TLS-ALPN-01 challenge, answered by the handshake
+		conn.Close()
+		return
+	}
+	if len(state.VerifiedChains) == 0 {
+		// A transport that ignored WithClientAuth
+		log.Printf("Client %s presented no verified certificate", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	select {
+	case vl.conns <- conn:
+	case <-vl.done:
+		conn.Close()
+	}
+}
+
+// Accept returns the next client whose certificate was accepted.
+func (vl *verifiedListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-vl.conns:
+		return conn, nil
+	case <-vl.done:
+		return nil, vl.err
+	}
+}
+
+// Close stops accepting and closes the underlying listener.
+func (vl *verifiedListener) Close() error {
+	vl.shutdown(net.ErrClosed)
+	return vl.Listener.Close()
+}
+
+func (vl *verifiedListener) shutdown(err error) {
+	vl.closeOnce.Do(func() {
+		vl.err = err
+		close(vl.done)
+	})
+}
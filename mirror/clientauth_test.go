@@ -0,0 +1,220 @@
+package mirror
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// testCertificate issues a certificate for name, signed by parent and
+// parentKey, or self-signed when parent is nil.
+func testCertificate(t *testing.T, name string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+// TestClientAuth verifies that only clients presenting an accepted
+// certificate are returned by Accept, and that TLS-ALPN-01 challenges
+// complete their handshake without reaching it.
+func TestClientAuth(t *testing.T) {
+	caPair, ca := testCertificate(t, "test CA", true, nil, nil)
+	caKey := caPair.PrivateKey.(*ecdsa.PrivateKey)
+	good, _ := testCertificate(t, "good", false, ca, caKey)
+	revoked, _ := testCertificate(t, "revoked", false, ca, caKey)
+	rogue, _ := testCertificate(t, "rogue", false, nil, nil)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	auth := &ClientAuth{
+		CAs: pool,
+		Verify: func(chains [][]*x509.Certificate) error {
+			if chains[0][0].Subject.CommonName == "revoked" {
+				return errors.New("revoked")
+			}
+			return nil
+		},
+		HandshakeTimeout: time.Second,
+	}
+	config := testTLSConfig(t)
+	config.NextProtos = []string{"http/1.1", acme.ALPNProto}
+	inner, err := tls.Listen("tcp", "127.0.0.1:0", auth.serverConfig(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := newVerifiedListener(inner, auth.HandshakeTimeout)
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 5)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	dial := func(cert *tls.Certificate, protos ...string) {
+		clientConfig := &tls.Config{InsecureSkipVerify: true, NextProtos: protos}
+		if cert != nil {
+			clientConfig.Certificates = []tls.Certificate{*cert}
+		}
+		conn, err := tls.Dial("tcp", inner.Addr().String(), clientConfig)
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+		// TLS 1.3 clients finish before the server checks their certificate
+		conn.Write([]byte("x"))
+	}
+	dial(nil)
+	dial(&rogue)
+	dial(&revoked)
+	dial(nil, acme.ALPNProto)
+	dial(&good, "http/1.1")
+
+	select {
+	case conn := <-accepted:
+		state := conn.(*tls.Conn).ConnectionState()
+		if len(state.PeerCertificates) == 0 || state.PeerCertificates[0].Subject.CommonName != "good" {
+			t.Errorf("Accepted a client without the good certificate: %+v", state.PeerCertificates)
+		}
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client with a valid certificate was not accepted")
+	}
+	select {
+	case conn := <-accepted:
+		t.Errorf("Accepted another client, with certificates %v", conn.(*tls.Conn).ConnectionState().PeerCertificates)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	listener.Close()
+	if _, err := listener.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept after Close returned %v, want net.ErrClosed", err)
+	}
+}
+
+// TestWileedotProviderClientAuth verifies that WileedotProvider refuses
+// services it cannot verify clients of.
+func TestWileedotProviderClientAuth(t *testing.T) {
+	_, err := WileedotProvider{}.Listen(context.Background(), ServiceConfig{Name: "example.com", ClientAuth: &ClientAuth{}})
+	if err == nil {
+		t.Fatal("Expected an error for ClientAuth")
+	}
+}
+
+// acceptWithin returns the next connection of l, or nil after timeout.
+func acceptWithin(t *testing.T, l net.Listener, timeout time.Duration) net.Conn {
+	t.Helper()
+	result := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		result <- conn
+	}()
+	select {
+	case conn := <-result:
+		return conn
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+// TestTransportClientAuth verifies that hidden TLS listeners require the
+// client certificates of their context, that the client's identity is
+// visible through the connection wrappers, and that listeners of transports
+// ignoring the context reject every client.
+func TestTransportClientAuth(t *testing.T) {
+	caPair, ca := testCertificate(t, "test CA", true, nil, nil)
+	good, _ := testCertificate(t, "good", false, ca, caPair.PrivateKey.(*ecdsa.PrivateKey))
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	auth := &ClientAuth{CAs: pool, HandshakeTimeout: time.Second}
+	cert := testTLSConfig(t).Certificates[0]
+
+	listen := func(ctx context.Context) net.Listener {
+		inner, err := listenTLSWithConfig(ctx,
+			func() (tls.Certificate, error) { return cert, nil },
+			func(...string) (net.Listener, error) { return net.Listen("tcp", "127.0.0.1:0") })
+		if err != nil {
+			t.Fatal(err)
+		}
+		listener := newVerifiedListener(inner, auth.HandshakeTimeout)
+		t.Cleanup(func() { listener.Close() })
+		return listener
+	}
+	dial := func(listener net.Listener, cert *tls.Certificate) {
+		clientConfig := &tls.Config{InsecureSkipVerify: true}
+		if cert != nil {
+			clientConfig.Certificates = []tls.Certificate{*cert}
+		}
+		conn, err := tls.Dial("tcp", listener.Addr().String(), clientConfig)
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.Write([]byte("x"))
+	}
+
+	listener := listen(WithClientAuth(context.Background(), auth))
+	dial(listener, nil)
+	dial(listener, &good)
+	conn := acceptWithin(t, listener, 5*time.Second)
+	if conn == nil {
+		t.Fatal("Client with a valid certificate was not accepted")
+	}
+	defer conn.Close()
+	wrapped := &readWriteConn{conn: &countingConn{Conn: conn, counters: &transportCounters{}}}
+	if leaf := wrapped.ClientCertificate(); leaf == nil || leaf.Subject.CommonName != "good" {
+		t.Errorf("ClientCertificate = %v, want the good certificate", leaf)
+	}
+	if conn := acceptWithin(t, listener, 200*time.Millisecond); conn != nil {
+		t.Error("Accepted a client without a certificate")
+		conn.Close()
+	}
+
+	ignoring := listen(context.Background())
+	dial(ignoring, &good)
+	if conn := acceptWithin(t, ignoring, 500*time.Millisecond); conn != nil {
+		t.Error("Accepted a client whose certificate was never requested")
+		conn.Close()
+	}
+}
@@ -0,0 +1,138 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// defaultCloseTimeout bounds Close and CloseService.
+const defaultCloseTimeout = 5 * time.Second
+
+// CloseFailure records one part of a Mirror that failed to close.
+type CloseFailure struct {
+	// Component is "listener" for the Mirror's own listener, "http" for a
+	// companion HTTP listener, "health" for the HealthAddr listener, "service" for a service listener, or the
+	// name of a transport such as TransportOnion.
+	Component string
+	// Port is the service port, or "" for Mirror-wide parts: its own
+	// listener, the Tors managed for MirrorConfig.Tor and ServiceConfig.Tor,
+	// and the I2P primary session of MirrorConfig.SharedI2P.
+	Port string
+	// Err is the error closing the component, or ctx.Err() if CloseContext
+	// stopped waiting for it.
+	Err error
+}
+
+// CloseError is returned by CloseContext and Close when some part of the
+// Mirror failed to close. Everything else was still closed.
+type CloseError struct {
+	Failures []CloseFailure
+}
+
+func (e *CloseError) Error() string {
+	parts := make([]string, len(e.Failures))
+	for i, f := range e.Failures {
+		if f.Port == "" {
+			parts[i] = fmt.Sprintf("%s: %v", f.Component, f.Err)
+		} else {
+			parts[i] = fmt.Sprintf("%s on port %s: %v", f.Component, f.Port, f.Err)
+		}
+	}
+	return "failed to close mirror: " + strings.Join(parts, "; ")
+}
+
+// Unwrap returns the error of every failure, for errors.Is and errors.As.
+func (e *CloseError) Unwrap() []error {
+	errs := make([]error, len(e.Failures))
+	for i, f := range e.Failures {
+		errs[i] = f.Err
+	}
+	return errs
+}
+
+// Failed reports whether the component, on any port, failed to close.
+func (e *CloseError) Failed(component string) bool {
+	for _, f := range e.Failures {
+		if f.Component == component {
+			return true
+		}
+	}
+	return false
+}
+
+// CloseContext shuts the Mirror down in order: it stops accepting
+// connections, gracefully shuts down companion HTTP listeners, closes every
+// service listener and I2P datagram session, and finally tears down the Tor, I2P, and other transport
+// sessions, waiting for them until ctx is done. If anything fails to close,
+// or is still closing when ctx is done, the returned error is a *CloseError
+// listing each failure.
+func (ml *Mirror) CloseContext(ctx context.Context) error {
+	log.Println("Closing Mirror")
+	ml.stopOnce.Do(func() {
+		if ml.stopCh != nil {
+			close(ml.stopCh)
+		}
+	})
+
+	var failures []CloseFailure
+	if err := ml.MetaListener.Close(); err != nil {
+		log.Println("Error closing MetaListener:", err)
+		failures = append(failures, CloseFailure{"listener", "", err})
+	} else {
+		log.Println("MetaListener closed")
+	}
+
+	ml.mu.Lock()
+	servers := ml.httpServers
+	health := ml.healthServer
+	ml.healthServer = nil
+	children := ml.children
+	packetConns := ml.packetConns
+	ml.httpServers = nil
+	ml.children = nil
+	ml.packetConns = nil
+	closers := ml.detachTransports()
+	ml.mu.Unlock()
+	closers = append(closers, ml.detachTor()...)
+	closers = append(closers, ml.detachPrimary()...)
+
+	for port, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Println("Error closing HTTP listener:", err)
+			server.Close()
+			failures = append(failures, CloseFailure{"http", port, err})
+		}
+	}
+	if health != nil {
+		if err := health.Shutdown(ctx); err != nil {
+			log.Println("Error closing health listener:", err)
+			health.Close()
+			failures = append(failures, CloseFailure{"health", "", err})
+		}
+	}
+	for port, child := range children {
+		if err := child.Close(); err != nil {
+			log.Printf("Error closing service on port %s: %v\n", port, err)
+			failures = append(failures, CloseFailure{"service", port, err})
+		}
+	}
+	for port, packetConn := range packetConns {
+		if err := packetConn.Close(); err != nil {
+			log.Printf("Error closing datagram session on port %s: %v\n", port, err)
+			failures = append(failures, CloseFailure{TransportGarlicDatagram, port, err})
+		}
+	}
+	failures = append(failures, closeTransports(ctx, closers)...)
+	ml.status.markAllDown()
+	if ml.unpublishExpvar != nil {
+		ml.unpublishExpvar()
+	}
+
+	if len(failures) > 0 {
+		return &CloseError{Failures: failures}
+	}
+	log.Println("Mirror closed")
+	return nil
+}
@@ -0,0 +1,82 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// stuckTransport is a loopbackTransport whose Close blocks until released.
+type stuckTransport struct {
+	loopbackTransport
+	release chan struct{}
+}
+
+func (st *stuckTransport) Close() error {
+	<-st.release
+	return nil
+}
+
+// brokenTransport is a loopbackTransport whose Close always fails.
+type brokenTransport struct {
+	loopbackTransport
+}
+
+var errBrokenClose = errors.New("broken close")
+
+func (bt *brokenTransport) Close() error { return errBrokenClose }
+
+// TestCloseContextReportsTransports verifies that CloseContext reports a
+// transport failing to close and gives up on one still closing at the deadline.
+func TestCloseContextReportsTransports(t *testing.T) {
+	os.Setenv("DISABLE_TOR", "true")
+	os.Setenv("DISABLE_I2P", "true")
+	defer func() {
+		os.Unsetenv("DISABLE_TOR")
+		os.Unsetenv("DISABLE_I2P")
+	}()
+
+	stuck := &stuckTransport{release: make(chan struct{})}
+	defer close(stuck.release)
+	registerTestTransport(t, "stuck", func() TransportProvider { return stuck })
+	registerTestTransport(t, "broken", func() TransportProvider { return &brokenTransport{} })
+
+	cfg := DefaultMirrorConfig()
+	cfg.EnableLocalTCP = false
+	mirror, err := NewMirrorWithConfig(context.Background(), "test-close:3016", cfg)
+	if err != nil {
+		t.Fatalf("Failed to create mirror: %v", err)
+	}
+	if _, err := mirror.AddService("3016", ServiceConfig{HiddenTLS: HiddenTLSOff}); err != nil {
+		t.Fatalf("AddService failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = mirror.CloseContext(ctx)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("CloseContext did not respect the deadline, took %v", elapsed)
+	}
+
+	var closeErr *CloseError
+	if !errors.As(err, &closeErr) {
+		t.Fatalf("Expected a *CloseError, got %v", err)
+	}
+	if !closeErr.Failed("stuck") || !closeErr.Failed("broken") {
+		t.Errorf("Expected stuck and broken transports to be reported, got %v", closeErr)
+	}
+	if closeErr.Failed("listener") || closeErr.Failed("service") {
+		t.Errorf("Unexpected failures reported: %v", closeErr)
+	}
+	if !errors.Is(err, errBrokenClose) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the close and deadline errors to be wrapped, got %v", err)
+	}
+	for _, f := range closeErr.Failures {
+		if f.Port != "3016" {
+			t.Errorf("Expected failures on port 3016, got %q", f.Port)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package mirror
+
+import (
+	"time"
+
+	"github.com/go-i2p/go-meta-listener"
+)
+
+// MirrorConfig holds settings that apply to every service of a Mirror.
+// Start from DefaultMirrorConfig and override fields, since the zero value
+// disables features that are on by default.
+type MirrorConfig struct {
+	// EnableLocalTCP controls whether each service gets a plaintext listener
+	// on the local host. Operators who only want a service reachable over
+	// TLS, Tor, and I2P can set it to false, since anything on the host can
+	// connect to the local listener unauthenticated.
+	EnableLocalTCP bool
+	// CertProvider creates the clearnet TLS listeners and manages their
+	// certificates. Nil selects WileedotProvider.
+	CertProvider CertProvider
+	// OnCertEvent, if set, is called when a clearnet certificate is issued,
+	// renewed, about to expire, or fails to be obtained. It is called from
+	// background goroutines and must not block for long.
+	OnCertEvent func(CertEvent)
+	// CertExpiryWarning is how long before expiry a CertExpiring event is
+	// emitted for a certificate that has not been renewed. Defaults to 14 days.
+	CertExpiryWarning time.Duration
+	// MaxConns caps the open connections of each transport, keyed by
+	// transport name, across all services of the Mirror. Connections over
+	// the cap are closed on accept and counted in TransportStats.Shed, so a
+	// flood over one network cannot use up the file descriptors the others
+	// need. Transports without an entry, or with zero, are not limited.
+	MaxConns map[string]int
+	// MaxHeaderConns caps the connections Accept processes at once to add
+	// forwarding headers, each of which holds a goroutine and a pipe for
+	// the life of the connection. Connections over the cap are passed
+	// through without headers, or closed if ShedHeaderOverflow is set, and
+	// counted by HeaderOverflow. Zero means no limit.
+	MaxHeaderConns int
+	// ShedHeaderOverflow closes connections over MaxHeaderConns instead of
+	// passing them through without headers.
+	ShedHeaderOverflow bool
+	// Tor, if set, runs onion services on a Tor the Mirror manages: the
+	// system Tor when reachable, otherwise one it launches. Nil keeps
+	// onramp's default of starting Tor from the PATH with a temporary
+	// data directory.
+	Tor *TorConfig
+	// SharedI2P publishes every service as a subsession of one SAMv3.3
+	// primary session instead of a separate Garlic per port, so the Mirror
+	// has a single I2P destination and uses fewer router tunnels. Services
+	// are then told apart by I2P port: clients must connect to the service
+	// port, for example http://<address>.b32.i2p:3000.
+	SharedI2P bool
+	// SAMAddrs are the SAM bridges of redundant I2P routers, in order of
+	// preference. I2P sessions are created on the first that answers, and
+	// the active bridge is probed every 30 seconds; when it stops
+	// answering, every session is re-created on the next bridge that does,
+	// with the same keys, so the services keep their I2P addresses. The
+	// listeners of services keep running, but their I2P datagram sessions
+	// are replaced and must be fetched again with PacketConn. Empty uses
+	// the local router's bridge, 127.0.0.1:7656, without probing.
+	SAMAddrs []string
+	// KeyDir is where the Tor and I2P keys of the Mirror's sessions are
+	// stored, in onionkeys, i2pkeys, and tlskeys subdirectories. Empty uses
+	// onramp's default directories under the working directory. Give
+	// Mirrors on one host different directories so their keys do not
+	// collide; ServiceConfig.KeyDir overrides it per service.
+	KeyDir string
+	// HealthAddr, if set, starts an HTTP listener on this address serving
+	// HealthHandler's /healthz and /status, for orchestrators and uptime
+	// monitors. Bind it to an internal address such as "127.0.0.1:9090".
+	HealthAddr string
+	// ExpvarName, if set, publishes the Mirror's counters as an expvar
+	// variable of this name, served as JSON by expvar's /debug/vars
+	// handler: the listeners, connections accepted and dropped, header
+	// overflow, and Stats. Each open Mirror needs a name of its own; Close
+	// unbinds it, so a Mirror created later can take it over.
+	ExpvarName string
+	// StatsD, if set, pushes the Mirror's counters to a StatsD server or
+	// Datadog agent: those of Stats by transport, the listeners and
+	// connections of each service, and header overflow.
+	StatsD *StatsDConfig
+	// TLS, if set, restricts the versions, cipher suites, curves, and
+	// session tickets of every TLS listener of the Mirror: the clearnet
+	// listeners of ACMEProvider and the onion and garlic listeners of
+	// services using hidden TLS. WileedotProvider refuses it.
+	TLS *TLSSettings
+	// CheckDNS verifies, before a service's clearnet TLS listener is
+	// created, that each of its domains has A or AAAA records pointing at
+	// this host, failing the TLS transport with an error naming the domain
+	// otherwise, visible as its LastError in Status. Without it,
+	// misconfigured DNS only shows up as certificate failures once ACME
+	// validation times out.
+	CheckDNS bool
+	// PublicIPs are the addresses clients reach the host at, for CheckDNS
+	// on hosts behind NAT. Empty uses the public addresses of the host's
+	// interfaces; when it has none, CheckDNS only requires the domains to
+	// resolve to public addresses.
+	PublicIPs []string
+	// Flood, if set, refuses the connections of clients opening them
+	// faster than its policy allows, on every listener of every service,
+	// and bans them for a while. Clients are told apart by IP address on
+	// clearnet and by destination on I2P; onion clients are anonymous and
+	// exempt. Share the guard with other MetaListeners to ban across them.
+	Flood *meta.FloodGuard
+	// Capture, if set, records the connections it selects on every
+	// listener of every service, after TLS and inside the hidden service
+	// tunnels, for debugging the protocol of particular clients.
+	Capture *meta.Capture
+}
+
+// DefaultMirrorConfig returns the configuration used by NewMirror.
+func DefaultMirrorConfig() MirrorConfig {
+	return MirrorConfig{
+		EnableLocalTCP: true,
+	}
+}
+
+// cfg returns the Mirror's configuration, falling back to the defaults for
+// Mirrors that were not created through a constructor.
+func (ml *Mirror) cfg() MirrorConfig {
+	if ml.config == nil {
+		return DefaultMirrorConfig()
+	}
+	return *ml.config
+}
+
+// TLSPolicy selects whether a service's onion and garlic listeners use TLS.
+type TLSPolicy int
+
+const (
+	// HiddenTLSAuto follows the package-level HIDDEN_TLS default.
+	HiddenTLSAuto TLSPolicy = iota
+	// HiddenTLSOn always wraps hidden service listeners in TLS.
+	HiddenTLSOn
+	// HiddenTLSOff never wraps hidden service listeners in TLS, which is
+	// what non-HTTP services such as SSH usually want.
+	HiddenTLSOff
+)
+
+// String returns the lowercase name of the policy.
+func (p TLSPolicy) String() string {
+	switch p {
+	case HiddenTLSAuto:
+		return "auto"
+	case HiddenTLSOn:
+		return "on"
+	case HiddenTLSOff:
+		return "off"
+	default:
+		return "unknown"
+	}
+}
+
+// enabled resolves the policy to a yes/no decision.
+func (p TLSPolicy) enabled() bool {
+	switch p {
+	case HiddenTLSOn:
+		return true
+	case HiddenTLSOff:
+		return false
+	default:
+		return HIDDEN_TLS
+	}
+}
+
+// I2PMode selects how a service is published on its I2P destination.
+type I2PMode int
+
+const (
+	// I2PStreaming publishes the service as an I2P streaming tunnel, the
+	// I2P counterpart of TCP. It is the default.
+	I2PStreaming I2PMode = iota
+	// I2PDatagram publishes the service as repliable I2P datagrams only,
+	// read and answered through Mirror.PacketConn. It suits UDP-style
+	// services such as DNS.
+	I2PDatagram
+	// I2PStreamingAndDatagram publishes both on the same destination.
+	I2PStreamingAndDatagram
+)
+
+// String returns the lowercase name of the mode.
+func (m I2PMode) String() string {
+	switch m {
+	case I2PStreaming:
+		return "streaming"
+	case I2PDatagram:
+		return "datagram"
+	case I2PStreamingAndDatagram:
+		return "streaming+datagram"
+	default:
+		return "unknown"
+	}
+}
+
+// streaming reports whether the mode includes a streaming listener.
+func (m I2PMode) streaming() bool {
+	return m != I2PDatagram
+}
+
+// datagram reports whether the mode includes a datagram session.
+func (m I2PMode) datagram() bool {
+	return m == I2PDatagram || m == I2PStreamingAndDatagram
+}
@@ -0,0 +1,22 @@
+package mirror
+
+import "testing"
+
+// TestTLSPolicyEnabled verifies that explicit policies override HIDDEN_TLS
+// and that HiddenTLSAuto follows it.
+func TestTLSPolicyEnabled(t *testing.T) {
+	defer func(orig bool) { HIDDEN_TLS = orig }(HIDDEN_TLS)
+
+	for _, global := range []bool{true, false} {
+		HIDDEN_TLS = global
+		if got := HiddenTLSAuto.enabled(); got != global {
+			t.Errorf("auto with HIDDEN_TLS=%t: got %t", global, got)
+		}
+		if !HiddenTLSOn.enabled() {
+			t.Errorf("on with HIDDEN_TLS=%t: got false", global)
+		}
+		if HiddenTLSOff.enabled() {
+			t.Errorf("off with HIDDEN_TLS=%t: got true", global)
+		}
+	}
+}
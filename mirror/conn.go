@@ -0,0 +1,50 @@
+package mirror
+
+import (
+	"net"
+
+	"github.com/go-i2p/go-meta-listener"
+	"github.com/go-i2p/i2pkeys"
+)
+
+// TransportConn is implemented by the connections accepted from Mirror
+// listeners. It tells handlers which network a client came from without
+// guessing from RemoteAddr formats:
+//
+//	if tc, ok := conn.(mirror.TransportConn); ok && tc.Transport() == mirror.TransportGarlic {
+//		log.Printf("I2P client %s", tc.PeerID())
+//	}
+type TransportConn interface {
+	net.Conn
+	// Transport returns TransportTLS, TransportTCP, TransportOnion,
+	// TransportGarlic, or the name of a registered transport.
+	Transport() string
+	// PeerID returns the client's anonymized identity where the network
+	// provides one, the .b32.i2p address of I2P clients, and "" otherwise.
+	// Tor does not reveal anything about the clients of onion services.
+	PeerID() string
+}
+
+var (
+	_ TransportConn  = &countingConn{}
+	_ TransportConn  = &readWriteConn{}
+	_ ProtocolConn   = &countingConn{}
+	_ ProtocolConn   = &readWriteConn{}
+	_ ClientCertConn = &countingConn{}
+	_ ClientCertConn = &readWriteConn{}
+
+	_ meta.ContextConn = &readWriteConn{}
+	_ meta.HalfCloser  = &countingConn{}
+	_ meta.HalfCloser  = &readWriteConn{}
+
+	_ meta.TLSStateConn = &countingConn{}
+	_ meta.TLSStateConn = &readWriteConn{}
+)
+
+// peerID returns the I2P destination hash of addr, or "" for other networks.
+func peerID(addr net.Addr) string {
+	if dest, ok := addr.(i2pkeys.I2PAddr); ok {
+		return dest.Base32()
+	}
+	return ""
+}
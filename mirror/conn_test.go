@@ -0,0 +1,177 @@
+package mirror
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-i2p/go-meta-listener"
+)
+
+// TestTransportConn verifies that connections accepted from a Mirror
+// listener report their transport.
+func TestTransportConn(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	listener := &countingListener{Listener: inner, transport: TransportOnion, counters: &transportCounters{}}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer client.Close()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer conn.Close()
+
+	tc, ok := conn.(TransportConn)
+	if !ok {
+		t.Fatalf("Expected a TransportConn, got %T", conn)
+	}
+	if tc.Transport() != TransportOnion {
+		t.Errorf("Expected transport %s, got %s", TransportOnion, tc.Transport())
+	}
+	if tc.PeerID() != "" {
+		t.Errorf("Expected no peer ID for a TCP peer, got %q", tc.PeerID())
+	}
+}
+
+// TestPeerIDI2P verifies that I2P peers are identified by their b32 address.
+func TestPeerIDI2P(t *testing.T) {
+	keys, _ := testI2PKeys(t)
+	id := peerID(keys.Address)
+	if !strings.HasSuffix(id, ".b32.i2p") || len(id) != 60 {
+		t.Errorf("Expected a .b32.i2p peer ID, got %q", id)
+	}
+}
+
+// TestHalfClose verifies that the connection wrappers half-close the
+// underlying connection, so the client sees the end of the stream while
+// it can still send.
+func TestHalfClose(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	listener := &countingListener{Listener: inner, transport: TransportTCP, counters: &transportCounters{}}
+	defer listener.Close()
+
+	for name, wrap := range map[string]func(net.Conn) net.Conn{
+		"countingConn":  func(conn net.Conn) net.Conn { return conn },
+		"readWriteConn": func(conn net.Conn) net.Conn { return AddHeaders(conn, map[string]string{"X-Test": "1"}) },
+	} {
+		client, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		client.Write([]byte("ping\r\n"))
+		accepted, err := listener.Accept()
+		if err != nil {
+			t.Fatalf("Accept failed: %v", err)
+		}
+		conn := wrap(accepted)
+
+		hc, ok := conn.(meta.HalfCloser)
+		if !ok {
+			t.Fatalf("%s: %T is not a HalfCloser", name, conn)
+		}
+		if err := hc.CloseWrite(); err != nil {
+			t.Errorf("%s: CloseWrite: %v", name, err)
+		}
+		if n, err := client.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+			t.Errorf("%s: client read %d, %v after CloseWrite, want EOF", name, n, err)
+		}
+		client.Write([]byte("pong"))
+		client.(*net.TCPConn).CloseWrite()
+		data, err := io.ReadAll(conn)
+		if err != nil || !strings.HasSuffix(string(data), "pong") {
+			t.Errorf("%s: read %q, %v after CloseWrite", name, data, err)
+		}
+		conn.Close()
+		client.Close()
+	}
+}
+
+// TestConnectionState verifies that the wrappers of TLS connections report
+// the state of the TLS connection they wrap without running its handshake,
+// and that plaintext ones report no handshake.
+func TestConnectionState(t *testing.T) {
+	config := testTLSConfig(t)
+	config.NextProtos = []string{ProtoHTTP2}
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	listener := &countingListener{Listener: tls.NewListener(inner, config), transport: TransportTLS, counters: &transportCounters{}}
+	defer listener.Close()
+
+	for name, wrap := range map[string]func(net.Conn) net.Conn{
+		"countingConn":  func(conn net.Conn) net.Conn { return conn },
+		"readWriteConn": func(conn net.Conn) net.Conn { return AddHeaders(conn, map[string]string{"X-Test": "1"}) },
+	} {
+		done := make(chan error, 1)
+		go func() {
+			client, err := tls.Dial("tcp", inner.Addr().String(), &tls.Config{
+				ServerName:         "example.com",
+				NextProtos:         []string{ProtoHTTP2},
+				InsecureSkipVerify: true,
+			})
+			if err == nil {
+				client.Close()
+			}
+			done <- err
+		}()
+		accepted, err := listener.Accept()
+		if err != nil {
+			t.Fatalf("Accept failed: %v", err)
+		}
+		if accepted.(meta.TLSStateConn).ConnectionState().HandshakeComplete {
+			t.Errorf("%s: handshake complete before it ran", name)
+		}
+		// Complete the handshake as Mirror.Accept does
+		accepted.(ProtocolConn).NegotiatedProtocol()
+		conn := wrap(accepted)
+
+		sc, ok := conn.(meta.TLSStateConn)
+		if !ok {
+			t.Fatalf("%s: %T is not a TLSStateConn", name, conn)
+		}
+		state := sc.ConnectionState()
+		if !state.HandshakeComplete || state.ServerName != "example.com" || state.NegotiatedProtocol != ProtoHTTP2 {
+			t.Errorf("%s: state has handshake %t, server name %q, protocol %q", name, state.HandshakeComplete, state.ServerName, state.NegotiatedProtocol)
+		}
+		if err := <-done; err != nil {
+			t.Errorf("%s: client: %v", name, err)
+		}
+		conn.Close()
+	}
+
+	plain, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	plainListener := &countingListener{Listener: plain, transport: TransportTCP, counters: &transportCounters{}}
+	defer plainListener.Close()
+	client, err := net.Dial("tcp", plain.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer client.Close()
+	conn, err := plainListener.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer conn.Close()
+	if state := conn.(meta.TLSStateConn).ConnectionState(); state.HandshakeComplete {
+		t.Errorf("Plaintext connection reports a TLS handshake: %+v", state)
+	}
+}
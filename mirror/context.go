@@ -0,0 +1,39 @@
+package mirror
+
+import (
+	"context"
+)
+
+// runContext runs fn in its own goroutine and returns its result, or ctx.Err()
+// if ctx is done first. Tor, I2P, and ACME setup calls cannot be interrupted,
+// so when ctx wins the call is left to finish in the background and cleanup
+// is applied to whatever it eventually returns, preventing leaked sessions.
+func runContext[T any](ctx context.Context, fn func() (T, error), cleanup func(T)) (T, error) {
+	var zero T
+	if err := ctx.Err(); err != nil {
+		return zero, err
+	}
+
+	type result struct {
+		value T
+		err   error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		value, err := fn()
+		resultCh <- result{value: value, err: err}
+	}()
+
+	select {
+	case res := <-resultCh:
+		return res.value, res.err
+	case <-ctx.Done():
+		go func() {
+			res := <-resultCh
+			if res.err == nil && cleanup != nil {
+				cleanup(res.value)
+			}
+		}()
+		return zero, ctx.Err()
+	}
+}
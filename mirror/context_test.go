@@ -0,0 +1,68 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestListenContextCanceled verifies that a canceled context aborts setup
+// without leaving the local TCP port bound.
+func TestListenContextCanceled(t *testing.T) {
+	os.Setenv("DISABLE_TOR", "true")
+	os.Setenv("DISABLE_I2P", "true")
+	defer func() {
+		os.Unsetenv("DISABLE_TOR")
+		os.Unsetenv("DISABLE_I2P")
+	}()
+
+	mirror, err := NewMirror("test-context:3011")
+	if err != nil {
+		t.Fatalf("Failed to create mirror: %v", err)
+	}
+	defer mirror.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := mirror.ListenContext(ctx, "test-context:3011", ""); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:3011")
+	if err != nil {
+		t.Fatalf("Port should be free after canceled setup: %v", err)
+	}
+	listener.Close()
+}
+
+// TestRunContextCleansUpLateResult verifies that a result arriving after the
+// context is done is passed to the cleanup function.
+func TestRunContextCleansUpLateResult(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	release := make(chan struct{})
+	cleaned := make(chan int, 1)
+
+	_, err := runContext(ctx, func() (int, error) {
+		<-release
+		return 42, nil
+	}, func(v int) { cleaned <- v })
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+
+	close(release)
+	select {
+	case v := <-cleaned:
+		if v != 42 {
+			t.Errorf("Expected cleanup of 42, got %d", v)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Cleanup was not called for late result")
+	}
+}
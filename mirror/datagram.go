@@ -0,0 +1,61 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// PacketConn returns the I2P datagram session of the service on port, if
+// its I2PMode includes datagrams. Datagrams are repliable: ReadFrom returns
+// the sender's I2P address, which WriteTo accepts for the answer.
+func (ml *Mirror) PacketConn(port string) (net.PacketConn, bool) {
+	ml.mu.RLock()
+	defer ml.mu.RUnlock()
+
+	packetConn, ok := ml.packetConns[port]
+	return packetConn, ok
+}
+
+// I2PMode reports how the service on port is published on I2P.
+func (ml *Mirror) I2PMode(port string) (I2PMode, bool) {
+	ml.mu.RLock()
+	defer ml.mu.RUnlock()
+
+	cfg, ok := ml.services[port]
+	return cfg.I2PMode, ok
+}
+
+// hasPacketConn reports whether the service on port has a datagram session.
+func (ml *Mirror) hasPacketConn(port string) bool {
+	_, ok := ml.PacketConn(port)
+	return ok
+}
+
+// addPacketConn opens a datagram session of the hidden transport set up for
+// port and records it for PacketConn.
+func (ml *Mirror) addPacketConn(ctx context.Context, port, transport string) error {
+	provider, ok := ml.Transport(port, transport)
+	if !ok {
+		return fmt.Errorf("no %s transport found for port %s", transport, port)
+	}
+	packetTransport, ok := provider.(PacketTransport)
+	if !ok {
+		return fmt.Errorf("%s transport does not support datagrams", transport)
+	}
+	packetConn, err := packetTransport.ListenPacket(ctx)
+	if err != nil {
+		return err
+	}
+
+	ml.mu.Lock()
+	if ml.packetConns == nil {
+		ml.packetConns = make(map[string]net.PacketConn)
+	}
+	ml.packetConns[port] = packetConn
+	ml.mu.Unlock()
+
+	ml.status.setUp(TransportGarlicDatagram, port, packetConn.LocalAddr().String(), nil, "")
+	log.Printf("%s datagram session added %s\n", transport, packetConn.LocalAddr())
+	return nil
+}
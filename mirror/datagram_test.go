@@ -0,0 +1,77 @@
+package mirror
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+// udpTransport is a loopbackTransport that also serves loopback UDP datagrams.
+type udpTransport struct {
+	loopbackTransport
+}
+
+func (ut *udpTransport) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	return net.ListenPacket("udp", "127.0.0.1:0")
+}
+
+// TestI2PMode verifies which sessions each mode asks for.
+func TestI2PMode(t *testing.T) {
+	for mode, want := range map[I2PMode][2]bool{
+		I2PStreaming:            {true, false},
+		I2PDatagram:             {false, true},
+		I2PStreamingAndDatagram: {true, true},
+	} {
+		if mode.streaming() != want[0] || mode.datagram() != want[1] {
+			t.Errorf("%s: streaming=%t datagram=%t, want %v", mode, mode.streaming(), mode.datagram(), want)
+		}
+	}
+}
+
+// TestPacketConn verifies that a datagram session is recorded, reported in
+// Status, and closed with its service.
+func TestPacketConn(t *testing.T) {
+	ml := &Mirror{
+		transports: map[string]map[string]TransportProvider{
+			"3017": {"udp-loopback": &udpTransport{}, "loopback": &loopbackTransport{}},
+		},
+	}
+
+	if err := ml.addPacketConn(context.Background(), "3017", "loopback"); err == nil {
+		t.Error("Expected a transport without datagram support to be rejected")
+	}
+	if err := ml.addPacketConn(context.Background(), "3017", "udp-loopback"); err != nil {
+		t.Fatalf("addPacketConn failed: %v", err)
+	}
+	packetConn, ok := ml.PacketConn("3017")
+	if !ok {
+		t.Fatal("Expected a packet conn for port 3017")
+	}
+
+	client, err := net.Dial("udp", packetConn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer client.Close()
+	client.Write([]byte("ping"))
+	buf := make([]byte, 16)
+	n, from, err := packetConn.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("Expected ping, got %q (%v)", buf[:n], err)
+	}
+	if _, err := packetConn.WriteTo([]byte("pong"), from); err != nil {
+		t.Fatalf("Reply failed: %v", err)
+	}
+
+	if status := ml.Status()[statusKey(TransportGarlicDatagram, "3017")]; status.State != TransportUp {
+		t.Errorf("Expected datagram session up, got %s", status.State)
+	}
+
+	ml.CloseService("3017")
+	if _, ok := ml.PacketConn("3017"); ok {
+		t.Error("Expected CloseService to remove the packet conn")
+	}
+	if _, _, err := packetConn.ReadFrom(buf); err == nil {
+		t.Error("Expected the packet conn to be closed")
+	}
+}
@@ -0,0 +1,80 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/go-i2p/go-meta-listener"
+	"github.com/go-i2p/onramp"
+)
+
+// Dialer returns a MetaDialer that reaches .onion and .i2p peers through
+// the Mirror's own Tor and I2P sessions and clearnet hosts over hardened
+// TCP, so services can call back to peers on the networks they are
+// published on. Use SetFallback on the result to retry clearnet hosts
+// through Tor or I2P.
+func (ml *Mirror) Dialer() *meta.MetaDialer {
+	dialer := meta.NewMetaDialer()
+	dialer.SetDialer(meta.NetworkTor, ml.dialOnion)
+	dialer.SetDialer(meta.NetworkI2P, ml.dialGarlic)
+	return dialer
+}
+
+// dialOnion dials address through the Tor managed for MirrorConfig.Tor or
+// one of the Mirror's onion sessions.
+func (ml *Mirror) dialOnion(ctx context.Context, network, address string) (net.Conn, error) {
+	ml.torMu.Lock()
+	t := ml.tor
+	ml.torMu.Unlock()
+	if t != nil {
+		dialer, err := t.Dialer(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	ml.mu.RLock()
+	onion := firstSession(ml.Onions)
+	ml.mu.RUnlock()
+	if onion == nil {
+		return nil, fmt.Errorf("no Tor session available to dial %s", address)
+	}
+	return runContext(ctx, func() (net.Conn, error) {
+		return onion.Dial(network, address)
+	}, func(conn net.Conn) { conn.Close() })
+}
+
+// dialGarlic dials address through the shared primary session or one of the
+// Mirror's I2P sessions.
+func (ml *Mirror) dialGarlic(ctx context.Context, network, address string) (net.Conn, error) {
+	if primary := ml.sharedPrimary(); primary != nil {
+		return runContext(ctx, func() (net.Conn, error) {
+			return primary.Dial(network, address)
+		}, func(conn net.Conn) { conn.Close() })
+	}
+
+	ml.mu.RLock()
+	garlic := firstSession(ml.Garlics)
+	ml.mu.RUnlock()
+	if garlic == nil {
+		return nil, fmt.Errorf("no I2P session available to dial %s", address)
+	}
+	return garlic.DialContext(ctx, network, address)
+}
+
+// firstSession returns the session of the first port in sorted order, or nil
+// if there is none.
+func firstSession[T *onramp.Onion | *onramp.Garlic](sessions map[string]T) T {
+	ports := make([]string, 0, len(sessions))
+	for port := range sessions {
+		ports = append(ports, port)
+	}
+	if len(ports) == 0 {
+		return nil
+	}
+	sort.Strings(ports)
+	return sessions[ports[0]]
+}
@@ -0,0 +1,82 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+)
+
+// Lookups of the DNS check. Tests replace them.
+var (
+	dnsLookup      = net.DefaultResolver.LookupNetIP
+	hostInterfaces = net.InterfaceAddrs
+)
+
+// checkDNS verifies that every domain resolves to an address ACME
+// validation can reach this host at, so misconfigured DNS is reported
+// up front, naming the domain, instead of as an ACME timeout. Domains must
+// resolve to a public address, and to one of publicIPs, or of the host's
+// public interface addresses when publicIPs is empty. Hosts without
+// public interface addresses, usually behind NAT, skip that comparison.
+func checkDNS(ctx context.Context, domains, publicIPs []string) error {
+	host, err := hostPublicAddrs(publicIPs)
+	if err != nil {
+		return err
+	}
+	for _, domain := range domains {
+		addrs, err := dnsLookup(ctx, "ip", domain)
+		if err != nil {
+			return fmt.Errorf("DNS check: %s has no usable A or AAAA records: %w", domain, err)
+		}
+		var public []netip.Addr
+		for _, addr := range addrs {
+			if isPublicAddr(addr.Unmap()) {
+				public = append(public, addr.Unmap())
+			}
+		}
+		if len(public) == 0 {
+			return fmt.Errorf("DNS check: %s resolves only to non-public addresses %v, which the ACME server cannot reach", domain, addrs)
+		}
+		if len(host) > 0 && !slices.ContainsFunc(public, func(addr netip.Addr) bool { return slices.Contains(host, addr) }) {
+			return fmt.Errorf("DNS check: %s resolves to %v, none of which is this host (%v); ACME validation would reach another server", domain, public, host)
+		}
+	}
+	return nil
+}
+
+// hostPublicAddrs returns publicIPs parsed, or the public addresses of the
+// host's interfaces when it is empty.
+func hostPublicAddrs(publicIPs []string) ([]netip.Addr, error) {
+	var addrs []netip.Addr
+	if len(publicIPs) > 0 {
+		for _, ip := range publicIPs {
+			addr, err := netip.ParseAddr(ip)
+			if err != nil {
+				return nil, fmt.Errorf("invalid public IP %q: %w", ip, err)
+			}
+			addrs = append(addrs, addr.Unmap())
+		}
+		return addrs, nil
+	}
+	ifaddrs, err := hostInterfaces()
+	if err != nil {
+		return nil, fmt.Errorf("DNS check: failed to list interface addresses: %w", err)
+	}
+	for _, ifaddr := range ifaddrs {
+		prefix, err := netip.ParsePrefix(ifaddr.String())
+		if err != nil {
+			continue
+		}
+		if addr := prefix.Addr().Unmap(); isPublicAddr(addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, nil
+}
+
+// isPublicAddr reports whether addr is routable on the internet.
+func isPublicAddr(addr netip.Addr) bool {
+	return addr.IsGlobalUnicast() && !addr.IsPrivate()
+}
@@ -0,0 +1,79 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// TestCheckDNS verifies that domains must resolve to a public address of
+// the host, and that hosts without one only need public records.
+func TestCheckDNS(t *testing.T) {
+	records := map[string][]netip.Addr{
+		"good.example":    {netip.MustParseAddr("203.0.113.7")},
+		"private.example": {netip.MustParseAddr("10.0.0.7")},
+		"other.example":   {netip.MustParseAddr("198.51.100.1")},
+	}
+	interfaces := []net.Addr{&net.IPNet{IP: net.ParseIP("203.0.113.7"), Mask: net.CIDRMask(24, 32)}}
+	defer func(lookup func(context.Context, string, string) ([]netip.Addr, error), ifaces func() ([]net.Addr, error)) {
+		dnsLookup, hostInterfaces = lookup, ifaces
+	}(dnsLookup, hostInterfaces)
+	dnsLookup = func(_ context.Context, _, host string) ([]netip.Addr, error) {
+		if addrs, ok := records[host]; ok {
+			return addrs, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	hostInterfaces = func() ([]net.Addr, error) { return interfaces, nil }
+
+	ctx := context.Background()
+	tests := []struct {
+		domain    string
+		publicIPs []string
+		want      string
+	}{
+		{"good.example", nil, ""},
+		{"missing.example", nil, "no usable A or AAAA records"},
+		{"private.example", nil, "non-public addresses"},
+		{"other.example", nil, "none of which is this host"},
+		{"other.example", []string{"198.51.100.1"}, ""},
+	}
+	for _, tt := range tests {
+		err := checkDNS(ctx, []string{tt.domain}, tt.publicIPs)
+		if tt.want == "" && err != nil {
+			t.Errorf("%s: %v", tt.domain, err)
+		}
+		if tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want) || !strings.Contains(err.Error(), tt.domain)) {
+			t.Errorf("%s: got %v, want an error naming it and containing %q", tt.domain, err, tt.want)
+		}
+	}
+
+	// Behind NAT, records only need to be public
+	interfaces = []net.Addr{&net.IPNet{IP: net.ParseIP("192.168.1.2"), Mask: net.CIDRMask(24, 32)}}
+	if err := checkDNS(ctx, []string{"other.example"}, nil); err != nil {
+		t.Errorf("Host without public addresses: %v", err)
+	}
+	if err := checkDNS(ctx, []string{"private.example"}, nil); err == nil {
+		t.Error("Host without public addresses accepted private records")
+	}
+
+	// The failure shows up in the Mirror's status
+	t.Setenv("DISABLE_TOR", "true")
+	t.Setenv("DISABLE_I2P", "true")
+	cfg := DefaultMirrorConfig()
+	cfg.CheckDNS = true
+	m, err := NewMirrorWithConfig(ctx, "", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if _, err := m.AddService("3021", ServiceConfig{Name: "missing.example", Email: "admin@missing.example"}); err == nil {
+		t.Fatal("AddService succeeded with failing DNS")
+	}
+	if status := m.Status()[TransportTLS+":3021"]; !strings.Contains(status.LastError, "missing.example") {
+		t.Errorf("TLS status = %+v, want the DNS error", status)
+	}
+}
@@ -0,0 +1,43 @@
+package mirror
+
+import "github.com/go-i2p/go-meta-listener"
+
+// ExpvarStats is the value a Mirror publishes as MirrorConfig.ExpvarName.
+type ExpvarStats struct {
+	// Listeners, Accepted, and Dropped add up the counters of the Mirror's
+	// MetaListener and those of its services.
+	meta.Stats
+	// HeaderOverflow is the count reported by Mirror.HeaderOverflow.
+	HeaderOverflow uint64 `json:"header_overflow"`
+	// Transports are the counters reported by Mirror.Stats.
+	Transports map[string]TransportStats `json:"transports"`
+}
+
+// expvarStats collects the counters published with MirrorConfig.ExpvarName.
+func (ml *Mirror) expvarStats() ExpvarStats {
+	stats := ExpvarStats{
+		Stats:          ml.MetaListener.Stats(),
+		HeaderOverflow: ml.HeaderOverflow(),
+		Transports:     ml.Stats(),
+	}
+	ml.mu.RLock()
+	defer ml.mu.RUnlock()
+	for _, child := range ml.children {
+		s := child.Stats()
+		stats.Listeners += s.Listeners
+		stats.Accepted += s.Accepted
+		stats.Dropped += s.Dropped
+	}
+	return stats
+}
+
+// publishExpvar publishes the Mirror's counters as the expvar variable
+// name, until Close unbinds it.
+func (ml *Mirror) publishExpvar(name string) error {
+	unpublish, err := meta.PublishExpvarFunc(name, func() any { return ml.expvarStats() })
+	if err != nil {
+		return err
+	}
+	ml.unpublishExpvar = unpublish
+	return nil
+}
@@ -0,0 +1,80 @@
+package mirror
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"net"
+	"os"
+	"testing"
+)
+
+// TestExpvar verifies that a Mirror publishes its counters under
+// MirrorConfig.ExpvarName, that a name cannot be used twice while its
+// Mirror is open, and that Close hands it over to a new Mirror.
+func TestExpvar(t *testing.T) {
+	os.Setenv("DISABLE_TOR", "true")
+	os.Setenv("DISABLE_I2P", "true")
+	defer func() {
+		os.Unsetenv("DISABLE_TOR")
+		os.Unsetenv("DISABLE_I2P")
+	}()
+
+	cfg := DefaultMirrorConfig()
+	cfg.ExpvarName = "mirror_test_expvar"
+	mirror, err := NewMirrorWithConfig(context.Background(), "test-expvar", cfg)
+	if err != nil {
+		t.Fatalf("Failed to create mirror: %v", err)
+	}
+	defer mirror.Close()
+
+	listener, err := mirror.AddService("3019", ServiceConfig{})
+	if err != nil {
+		t.Fatalf("AddService failed: %v", err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", "127.0.0.1:3019")
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer client.Close()
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer server.Close()
+
+	var stats ExpvarStats
+	if err := json.Unmarshal([]byte(expvar.Get(cfg.ExpvarName).String()), &stats); err != nil {
+		t.Fatalf("Failed to decode the published value: %v", err)
+	}
+	if stats.Listeners != 1 || stats.Accepted != 1 || stats.Dropped != 0 {
+		t.Errorf("Expected 1 listener and 1 accepted connection, got %+v", stats.Stats)
+	}
+	if tcp := stats.Transports[TransportTCP]; tcp.Connections != 1 || tcp.Active != 1 {
+		t.Errorf("Expected 1 active local connection, got %+v", tcp)
+	}
+
+	if _, err := NewMirrorWithConfig(context.Background(), "test-expvar-2", cfg); err == nil {
+		t.Error("Expected an error for an expvar name already published")
+	}
+
+	server.Close()
+	listener.Close()
+	mirror.Close()
+	if got := expvar.Get(cfg.ExpvarName).String(); got != "null" {
+		t.Errorf("Closed Mirror still published %s", got)
+	}
+	next, err := NewMirrorWithConfig(context.Background(), "test-expvar-3", cfg)
+	if err != nil {
+		t.Fatalf("Failed to reuse the expvar name after Close: %v", err)
+	}
+	defer next.Close()
+	stats = ExpvarStats{}
+	if err := json.Unmarshal([]byte(expvar.Get(cfg.ExpvarName).String()), &stats); err != nil {
+		t.Fatalf("Failed to decode the published value: %v", err)
+	}
+	if stats.Accepted != 0 {
+		t.Errorf("Expected the new Mirror's counters, got %+v", stats.Stats)
+	}
+}
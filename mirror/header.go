@@ -5,61 +5,121 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"io"
 	"net"
 	"net/http"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/go-i2p/go-meta-listener"
 )
 
-// copyWithContextCancel copies data from src to dst with context cancellation support.
-// Returns when context is cancelled, src is exhausted, or an error occurs.
-func copyWithContextCancel(ctx context.Context, dst io.Writer, src io.Reader) error {
-	buf := make([]byte, 32*1024)
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-		}
+// maxHeaderBytes bounds how much of a connection AddHeaders reads while
+// looking for an HTTP request head.
+const maxHeaderBytes = 64 << 10
 
-		// Set a short read timeout for responsiveness to context cancellation
-		if conn, ok := src.(net.Conn); ok {
-			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
-		}
+// errHeaderTooLarge stops request parsing once maxHeaderBytes have been read.
+var errHeaderTooLarge = errors.New("request head exceeds size limit")
 
-		n, err := src.Read(buf)
-		if n > 0 {
-			if _, writeErr := dst.Write(buf[:n]); writeErr != nil {
-				return writeErr
-			}
-		}
+// headReader records and limits what is read from a connection while the
+// request head is parsed, so the bytes can be replayed if it is not HTTP.
+type headReader struct {
+	r         io.Reader
+	buf       bytes.Buffer
+	recording bool
+}
 
-		if err != nil {
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				continue // Retry on timeout to check context
-			}
-			if err != io.EOF {
-				return err
-			}
-			return nil // EOF reached, copy complete
-		}
+func (hr *headReader) Read(p []byte) (int, error) {
+	if !hr.recording {
+		return hr.r.Read(p)
 	}
+	remaining := maxHeaderBytes - hr.buf.Len()
+	if remaining <= 0 {
+		return 0, errHeaderTooLarge
+	}
+	if len(p) > remaining {
+		p = p[:remaining]
+	}
+	n, err := hr.r.Read(p)
+	hr.buf.Write(p[:n])
+	return n, err
 }
 
 // AddHeaders adds headers to the connection.
 // It takes a net.Conn and a map of headers as input.
 // It only adds headers if the connection is an HTTP connection.
 // It returns a net.Conn with the headers added.
+//
+// At most maxHeaderBytes are read looking for the request head, and the
+// client gets httpReadHeaderTimeout to send it. If the connection is not
+// HTTP, the head is too large, or the client is too slow, the connection is
+// passed through unchanged, including the bytes already read.
 func AddHeaders(conn net.Conn, headers map[string]string) net.Conn {
-	// Create a buffer to store the original request
-	var buf bytes.Buffer
-	teeReader := io.TeeReader(conn, &buf)
+	return addHeaders(conn, headers, nil, func() {})
+}
+
+// AddHeaders is like the package's AddHeaders for a connection of the
+// service on port, and also advertises the service's hidden mirrors in the
+// response to the request: the first final response written to the
+// returned connection gets the headers of AltSvcHeaders for the request,
+// those it already has excepted. Like the request headers, only the first
+// request and response of the connection are modified; a handler wanting
+// every response to carry them uses AltSvcHandler instead.
+func (ml *Mirror) AddHeaders(port string, conn net.Conn, headers map[string]string) net.Conn {
+	return addHeaders(conn, headers, func(r *http.Request) http.Header {
+		return ml.AltSvcHeaders(port, r)
+	}, func() {})
+}
+
+// headerLabels returns the pprof labels of the goroutine processing the
+// headers of conn: the ID of the listener it was accepted from and its
+// transport, where the connection tells them.
+func headerLabels(conn net.Conn) pprof.LabelSet {
+	labels := []string{"mirror", "headers"}
+	if src, ok := conn.(interface{ Source() string }); ok {
+		labels = append(labels, meta.PprofListenerLabel, src.Source())
+	}
+	if tc, ok := conn.(interface{ Transport() string }); ok && tc.Transport() != "" {
+		labels = append(labels, "transport", tc.Transport())
+	}
+	return pprof.Labels(labels...)
+}
 
-	// Try to read the request, but also save it to our buffer
-	req, err := http.ReadRequest(bufio.NewReader(teeReader))
+// addHeaders is AddHeaders, calling done once the connection no longer
+// needs header processing: right away when it is passed through, or when
+// the goroutine copying the modified request exits. If respond is set, the
+// headers it returns for the request are added to the response.
+func addHeaders(conn net.Conn, headers map[string]string, respond func(*http.Request) http.Header, done func()) net.Conn {
+	head := &headReader{r: conn, recording: true}
+	reader := bufio.NewReader(head)
+
+	conn.SetReadDeadline(time.Now().Add(httpReadHeaderTimeout))
+	req, err := http.ReadRequest(reader)
+	conn.SetReadDeadline(time.Time{})
 	if err != nil {
-		// Not an HTTP request or couldn't parse, return original connection
-		return conn
+		// Not an HTTP request or couldn't parse, pass everything through
+		done()
+		return &readWriteConn{
+			Reader: io.MultiReader(bytes.NewReader(head.buf.Bytes()), conn),
+			Writer: conn,
+			conn:   conn,
+		}
+	}
+	head.recording = false
+	head.buf = bytes.Buffer{}
+
+	// Headers for the response are chosen from the request as the client
+	// sent it
+	var writer io.Writer = conn
+	if respond != nil {
+		if header := respond(req); len(header) > 0 {
+			writer = &responseHeaderWriter{w: conn, header: header}
+		}
 	}
 
 	// Add our headers
@@ -70,48 +130,141 @@ func AddHeaders(conn net.Conn, headers map[string]string) net.Conn {
 	// Create a pipe to connect our modified request with the output
 	pr, pw := io.Pipe()
 
-	// Write the modified request to one end of the pipe with timeout protection
-	go func() {
+	// Write the modified request to one end of the pipe, then the rest of
+	// the connection, labeled for profiles with where the connection came
+	// from
+	go pprof.Do(context.Background(), headerLabels(conn), func(context.Context) {
 		defer func() {
 			if r := recover(); r != nil {
 				log.Printf("PANIC in header processing goroutine: %v", r)
 			}
 			pw.Close()
+			done()
 		}()
 
-		// Create context with timeout for the entire operation
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-		defer cancel()
-
-		// Set a deadline for the connection to prevent indefinite blocking
-		if deadline, ok := conn.(interface{ SetDeadline(time.Time) error }); ok {
-			deadline.SetDeadline(time.Now().Add(30 * time.Second))
-		}
-
 		// Write the modified request
 		if err := req.Write(pw); err != nil {
 			log.Printf("Error writing modified request: %v", err)
 			return
 		}
 
-		// Copy remaining data with context-aware copying to prevent goroutine leak
-		err := copyWithContextCancel(ctx, pw, conn)
-		if err != nil && err != context.Canceled && err != context.DeadlineExceeded {
-			log.Printf("Error copying connection data: %v", err)
+		// Forward what was read past the request before copying the rest
+		if buffered, _ := reader.Peek(reader.Buffered()); len(buffered) > 0 {
+			if _, err := pw.Write(buffered); err != nil {
+				return
+			}
 		}
-		if ctx.Err() != nil {
-			log.Printf("Header processing goroutine timed out after 30 seconds")
+
+		// Copy the rest of the connection for as long as it lasts: it ends
+		// when the client closes it or the returned conn is closed, which
+		// closes the pipe
+		if _, err := io.Copy(pw, conn); err != nil && !errors.Is(err, io.ErrClosedPipe) && !errors.Is(err, net.ErrClosed) {
+			log.Printf("Error copying connection data: %v", err)
 		}
-	}()
+	})
 
 	// Return a ReadWriter that reads from our pipe and writes to the original connection
 	return &readWriteConn{
 		Reader: pr,
-		Writer: conn,
+		Writer: writer,
 		conn:   conn,
 	}
 }
 
+// responseHeaderWriter adds header to the first final response written
+// through it, holding back what is written until the response head is
+// complete. Interim responses, such as 100 Continue, pass unchanged, and so
+// does the whole stream if it does not start with an HTTP/1.x response or
+// its head exceeds maxHeaderBytes.
+type responseHeaderWriter struct {
+	w      io.Writer
+	header http.Header
+	// mu guards buf and done against a flush on Close during a Write
+	mu   sync.Mutex
+	buf  []byte
+	done bool
+}
+
+func (rw *responseHeaderWriter) Write(p []byte) (int, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.done {
+		return rw.w.Write(p)
+	}
+	rw.buf = append(rw.buf, p...)
+	var out []byte
+	for !rw.done {
+		if n := min(len(rw.buf), len("HTTP/")); !bytes.HasPrefix(rw.buf, []byte("HTTP/")[:n]) {
+			// Not an HTTP/1.x response
+			rw.done = true
+			break
+		}
+		end := bytes.Index(rw.buf, []byte("\r\n\r\n"))
+		if end < 0 {
+			if len(rw.buf) > maxHeaderBytes {
+				rw.done = true
+				break
+			}
+			// Wait for the rest of the head
+			if len(out) > 0 {
+				if _, err := rw.w.Write(out); err != nil {
+					return 0, err
+				}
+			}
+			return len(p), nil
+		}
+		head := rw.buf[:end+2]
+		rw.buf = rw.buf[end+4:]
+		out = append(out, head...)
+		if status := responseStatus(head); !strings.HasPrefix(status, "1") || status == "101" {
+			out = appendMissingHeaders(out, head, rw.header)
+			rw.done = true
+		}
+		out = append(out, "\r\n"...)
+	}
+	out = append(out, rw.buf...)
+	rw.buf = nil
+	if _, err := rw.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// flush writes what is held back of an unfinished response head, as it
+// is, before the connection is closed.
+func (rw *responseHeaderWriter) flush() {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if !rw.done && len(rw.buf) > 0 {
+		rw.w.Write(rw.buf)
+	}
+	rw.buf, rw.done = nil, true
+}
+
+// responseStatus returns the status code of the response head.
+func responseStatus(head []byte) string {
+	line, _, _ := bytes.Cut(head, []byte("\r\n"))
+	if fields := bytes.Fields(line); len(fields) > 1 {
+		return string(fields[1])
+	}
+	return ""
+}
+
+// appendMissingHeaders appends to out the lines of header whose names are
+// not among the header lines of head.
+func appendMissingHeaders(out, head []byte, header http.Header) []byte {
+	missing := header.Clone()
+	lines := bytes.Split(head, []byte("\r\n"))
+	for _, line := range lines[1:] {
+		if name, _, ok := bytes.Cut(line, []byte(":")); ok {
+			missing.Del(string(bytes.TrimSpace(name)))
+		}
+	}
+	var buf bytes.Buffer
+	missing.Write(&buf)
+	return append(out, buf.Bytes()...)
+}
+
 // readWriteConn implements net.Conn
 type readWriteConn struct {
 	io.Reader
@@ -119,8 +272,85 @@ type readWriteConn struct {
 	conn net.Conn
 }
 
+// Transport returns the transport of the original connection, if known.
+func (rwc *readWriteConn) Transport() string {
+	if tc, ok := rwc.conn.(TransportConn); ok {
+		return tc.Transport()
+	}
+	return ""
+}
+
+// PeerID returns the peer identity of the original connection, if known.
+func (rwc *readWriteConn) PeerID() string {
+	if tc, ok := rwc.conn.(TransportConn); ok {
+		return tc.PeerID()
+	}
+	return peerID(rwc.conn.RemoteAddr())
+}
+
+// NegotiatedProtocol returns the ALPN protocol of the original connection.
+func (rwc *readWriteConn) NegotiatedProtocol() string {
+	if pc, ok := rwc.conn.(ProtocolConn); ok {
+		return pc.NegotiatedProtocol()
+	}
+	return ""
+}
+
+// ConnectionState returns the TLS state of the original connection.
+func (rwc *readWriteConn) ConnectionState() tls.ConnectionState {
+	return tlsState(rwc.conn)
+}
+
+// Context returns the context of the original connection, cancelled when
+// its listener is closed.
+func (rwc *readWriteConn) Context() context.Context {
+	if cc, ok := rwc.conn.(meta.ContextConn); ok {
+		return cc.Context()
+	}
+	return context.Background()
+}
+
+// ClientCertificate returns the verified client certificate of the original
+// connection.
+func (rwc *readWriteConn) ClientCertificate() *x509.Certificate {
+	if cc, ok := rwc.conn.(ClientCertConn); ok {
+		return cc.ClientCertificate()
+	}
+	return nil
+}
+
 // Implement the rest of net.Conn interface by delegating to the original connection
-func (rwc *readWriteConn) Close() error                       { return rwc.conn.Close() }
+// Close closes the original connection, after writing what is held back of
+// a response head, and the pipe of a header processing goroutine so it
+// does not block writing to a closed conn.
+func (rwc *readWriteConn) Close() error {
+	rwc.flush()
+	if pr, ok := rwc.Reader.(*io.PipeReader); ok {
+		pr.Close()
+	}
+	return rwc.conn.Close()
+}
+
+// flush writes what a responseHeaderWriter holds back, if there is one.
+func (rwc *readWriteConn) flush() {
+	if rw, ok := rwc.Writer.(*responseHeaderWriter); ok {
+		rw.flush()
+	}
+}
+
+// CloseWrite shuts down the writing side of the original connection, or
+// closes it if it cannot be half-closed.
+func (rwc *readWriteConn) CloseWrite() error {
+	rwc.flush()
+	return meta.CloseWrite(rwc.conn, rwc.Close)
+}
+
+// CloseRead shuts down the reading side of the original connection where
+// supported, which also ends a header processing goroutine copying from it.
+func (rwc *readWriteConn) CloseRead() error {
+	return meta.CloseRead(rwc.conn)
+}
+
 func (rwc *readWriteConn) LocalAddr() net.Addr                { return rwc.conn.LocalAddr() }
 func (rwc *readWriteConn) RemoteAddr() net.Addr               { return rwc.conn.RemoteAddr() }
 func (rwc *readWriteConn) SetDeadline(t time.Time) error      { return rwc.conn.SetDeadline(t) }
@@ -130,33 +360,126 @@ func (rwc *readWriteConn) SetWriteDeadline(t time.Time) error { return rwc.conn.
 // Accept accepts a connection from the listener.
 // It takes a net.Listener as input and returns a net.Conn with the headers added.
 // It is used to accept connections from the meta listener and add headers to them.
+//
+// Connections are prepared concurrently and returned as they become ready,
+// so a slow client does not hold up the others. When
+// MirrorConfig.MaxHeaderConns connections are already being processed,
+// further connections are passed through without headers, or closed if
+// MirrorConfig.ShedHeaderOverflow is set. Once the Mirror is closed, Accept
+// returns meta.ErrListenerClosed.
 func (ml *Mirror) Accept() (net.Conn, error) {
-	// Accept a connection from the listener
-	conn, err := ml.MetaListener.Accept()
-	if err != nil {
-		log.Println("Error accepting connection:", err)
-		return nil, err
+	ml.acceptOnce.Do(func() {
+		ml.ready = make(chan acceptResult)
+		go ml.acceptLoop()
+	})
+	select {
+	case result := <-ml.ready:
+		return result.conn, result.err
+	case <-ml.stopCh:
+		return nil, meta.ErrListenerClosed
 	}
+}
+
+// acceptState holds the accept plumbing of a Mirror.
+type acceptState struct {
+	// headerConns counts connections in header processing, and
+	// headerOverflow those Accept let past MirrorConfig.MaxHeaderConns
+	headerConns    atomic.Int64
+	headerOverflow atomic.Uint64
+	// ready carries the connections prepared by acceptLoop, which the
+	// first Accept starts, to Accept
+	acceptOnce sync.Once
+	ready      chan acceptResult
+}
+
+// acceptResult is a connection prepared for Accept, or an error of the
+// MetaListener's Accept.
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
 
+// acceptLoop accepts the connections of the MetaListener and prepares each
+// on a goroutine of its own, so a client slow to complete its TLS handshake
+// or send its request head holds up only itself. Errors are handed to
+// Accept in order; the loop ends when the Mirror is closed.
+func (ml *Mirror) acceptLoop() {
+	for {
+		conn, err := ml.MetaListener.Accept()
+		if err != nil {
+			log.Println("Error accepting connection:", err)
+			select {
+			case ml.ready <- acceptResult{err: err}:
+				continue
+			case <-ml.stopCh:
+				return
+			}
+		}
+		go ml.prepare(conn)
+	}
+}
+
+// prepare completes the TLS handshake of conn, if it is a TLS connection,
+// adds headers to its HTTP/1 requests, and hands it to Accept. Connections
+// whose handshake fails are closed.
+func (ml *Mirror) prepare(conn net.Conn) {
 	// Check if the connection is a TLS connection
 	if tlsConn, ok := conn.(*tls.Conn); ok {
 		// If it is a TLS connection, perform the handshake
-		if err := tlsConn.Handshake(); err != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), httpReadHeaderTimeout)
+		err := tlsConn.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
 			log.Println("Error performing TLS handshake:", err)
-			return nil, err
+			conn.Close()
+			return
 		}
-		// If the handshake is successful, get the underlying connection
-		// conn = tlsConn.NetConn()
 	}
 
-	host := map[string]string{
-		"Host":              conn.LocalAddr().String(),
-		"X-Forwarded-For":   conn.RemoteAddr().String(),
-		"X-Forwarded-Proto": "http",
+	// Headers can only be added to HTTP/1 requests
+	if protocol := negotiatedProtocol(conn, httpReadHeaderTimeout); protocol == "" || protocol == ProtoHTTP1 {
+		if release, ok := ml.acquireHeaderSlot(); ok {
+			host := map[string]string{
+				"Host":              conn.LocalAddr().String(),
+				"X-Forwarded-For":   conn.RemoteAddr().String(),
+				"X-Forwarded-Proto": "http",
+			}
+			// Add headers to the connection
+			conn = addHeaders(conn, host, nil, release)
+		} else {
+			ml.headerOverflow.Add(1)
+			if ml.cfg().ShedHeaderOverflow {
+				conn.Close()
+				return
+			}
+		}
 	}
 
-	// Add headers to the connection
-	conn = AddHeaders(conn, host)
+	select {
+	case ml.ready <- acceptResult{conn: conn}:
+	case <-ml.stopCh:
+		conn.Close()
+	}
+}
+
+// acquireHeaderSlot reserves one of the MirrorConfig.MaxHeaderConns header
+// processing slots, returning the function that frees it. It reports false
+// when all slots are in use; without a limit it always succeeds.
+func (ml *Mirror) acquireHeaderSlot() (func(), bool) {
+	limit := int64(ml.cfg().MaxHeaderConns)
+	if limit <= 0 {
+		return func() {}, true
+	}
+	if ml.headerConns.Add(1) > limit {
+		ml.headerConns.Add(-1)
+		return nil, false
+	}
+	var once sync.Once
+	return func() { once.Do(func() { ml.headerConns.Add(-1) }) }, true
+}
 
-	return conn, nil
+// HeaderOverflow returns how many connections Accept passed through without
+// headers or closed because MirrorConfig.MaxHeaderConns was reached.
+func (ml *Mirror) HeaderOverflow() uint64 {
+	return ml.headerOverflow.Load()
 }
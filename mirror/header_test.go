@@ -0,0 +1,343 @@
+package mirror
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"runtime/pprof"
+	"strings"
+	"testing"
+	"time"
+
+	meta "github.com/go-i2p/go-meta-listener"
+)
+
+// sendThroughAddHeaders writes data from a client and returns everything
+// read from the server side of AddHeaders.
+func sendThroughAddHeaders(t *testing.T, data []byte) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		client.Write(data)
+		client.Close()
+	}()
+
+	conn := AddHeaders(server, map[string]string{"X-I2p-Dest-Base32": "example.b32.i2p"})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return got
+}
+
+// TestAddHeaders verifies that headers are added to HTTP requests and that
+// data after the request head is forwarded.
+func TestAddHeaders(t *testing.T) {
+	got := sendThroughAddHeaders(t, []byte("POST / HTTP/1.1\r\nHost: example\r\nContent-Length: 4\r\n\r\nbody"))
+
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(got)))
+	if err != nil {
+		t.Fatalf("ReadRequest: %v", err)
+	}
+	if v := req.Header.Get("X-I2p-Dest-Base32"); v != "example.b32.i2p" {
+		t.Errorf("header = %q, want example.b32.i2p", v)
+	}
+	if body, _ := io.ReadAll(req.Body); string(body) != "body" {
+		t.Errorf("body = %q, want body", body)
+	}
+}
+
+// TestAddHeadersPassthrough verifies that non-HTTP data and oversized
+// request heads are passed through unchanged.
+func TestAddHeadersPassthrough(t *testing.T) {
+	oversized := "GET / HTTP/1.1\r\nX-Big: " + strings.Repeat("a", 2*maxHeaderBytes) + "\r\n\r\n"
+	for name, data := range map[string]string{
+		"not http":  "\x16\x03\x01 binary data\r\n\r\n",
+		"oversized": oversized,
+	} {
+		if got := sendThroughAddHeaders(t, []byte(data)); string(got) != data {
+			t.Errorf("%s: got %d bytes, want %d unchanged", name, len(got), len(data))
+		}
+	}
+}
+
+// TestAddHeadersLongLived verifies that a connection whose request head was
+// rewritten keeps carrying data both ways after sitting idle for longer
+// than the 30 seconds header processing used to allow it.
+func TestAddHeadersLongLived(t *testing.T) {
+	if testing.Short() {
+		t.Skip("idles a connection for over 30 seconds")
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	go client.Write([]byte("GET /events HTTP/1.1\r\nHost: example\r\n\r\n"))
+
+	conn := AddHeaders(server, map[string]string{"X-Forwarded-Proto": "https"})
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	if _, err := http.ReadRequest(reader); err != nil {
+		t.Fatalf("ReadRequest: %v", err)
+	}
+
+	time.Sleep(31 * time.Second)
+
+	go client.Write([]byte("ping"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(reader, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("read after idling = %q, %v; want ping", buf, err)
+	}
+	go conn.Write([]byte("pong"))
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("write after idling = %q, %v; want pong", buf, err)
+	}
+}
+
+// TestMirrorAddHeaders verifies that the first final response to a request
+// for the service's clearnet domain advertises its hidden mirrors, without
+// replacing headers the response already has, and that responses to other
+// hosts are left unchanged.
+func TestMirrorAddHeaders(t *testing.T) {
+	mirror := &Mirror{services: map[string]ServiceConfig{
+		"443": {Name: "example.org", Email: "admin@example.org", HiddenTLS: HiddenTLSOn},
+	}}
+	mirror.status.setUp(TransportOnion, "443", "abcdef.onion:443", nil, "")
+	mirror.status.setUp(TransportGarlic, "443", "ghijkl.b32.i2p", nil, "")
+	responses := []string{
+		"HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 200 OK\r\nX-I2P-Location: https://other.b32.i2p/\r\nContent-",
+		"Length: 2\r\n\r\nok",
+		"HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n",
+	}
+
+	for host, want := range map[string]string{
+		"example.org": "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 200 OK\r\nX-I2P-Location: https://other.b32.i2p/\r\nContent-Length: 2\r\n" +
+			`Alt-Svc: h2="abcdef.onion:443"; ma=86400, http/1.1="abcdef.onion:443"; ma=86400` + "\r\n\r\nok" +
+			"HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n",
+		"abcdef.onion": strings.Join(responses, ""),
+	} {
+		client, server := net.Pipe()
+		go client.Write([]byte("GET /page HTTP/1.1\r\nHost: " + host + "\r\n\r\n"))
+		conn := mirror.AddHeaders("443", server, map[string]string{"X-Forwarded-Proto": "https"})
+		if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+			t.Fatalf("ReadRequest: %v", err)
+		}
+		go func() {
+			for _, response := range responses {
+				conn.Write([]byte(response))
+			}
+			conn.Close()
+		}()
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		got, _ := io.ReadAll(client)
+		if string(got) != want {
+			t.Errorf("Host %s: responses\n%q\nwant\n%q", host, got, want)
+		}
+		client.Close()
+	}
+}
+
+// TestAcceptHeaderLimit verifies that connections over MaxHeaderConns are
+// passed through without headers, or closed when ShedHeaderOverflow is set,
+// and that a slot is freed once its connection is done.
+func TestAcceptHeaderLimit(t *testing.T) {
+	for _, shed := range []bool{false, true} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ml := &Mirror{
+			MetaListener: meta.NewMetaListener(),
+			config:       &MirrorConfig{MaxHeaderConns: 1, ShedHeaderOverflow: shed},
+		}
+		if err := ml.AddListener("tcp", listener); err != nil {
+			t.Fatal(err)
+		}
+
+		request := "GET / HTTP/1.1\r\nHost: example\r\n\r\n"
+		dial := func() net.Conn {
+			c, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.Write([]byte(request))
+			return c
+		}
+
+		first := dial()
+		held, err := ml.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := held.(*readWriteConn); !ok {
+			t.Fatalf("shed=%t: first connection got %T, want header processing", shed, held)
+		}
+
+		second := dial()
+		if !shed {
+			over, err := ml.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := over.(*readWriteConn); ok {
+				t.Errorf("connection over the limit got header processing")
+			}
+			over.Close()
+		} else {
+			accepted := make(chan net.Conn, 1)
+			go func() {
+				conn, _ := ml.Accept()
+				accepted <- conn
+			}()
+			second.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := second.Read(make([]byte, 1)); err == nil {
+				t.Errorf("connection over the limit was not closed")
+			}
+
+			// Accept keeps waiting, and a slot freed by the first
+			// connection goes to the next one.
+			first.Close()
+			held.Close()
+			waitFor(t, func() bool { return ml.headerConns.Load() == 0 })
+			third := dial()
+			conn := <-accepted
+			if _, ok := conn.(*readWriteConn); !ok {
+				t.Errorf("connection after the slot was freed got %T", conn)
+			}
+			conn.Close()
+			third.Close()
+		}
+		if n := ml.HeaderOverflow(); n != 1 {
+			t.Errorf("shed=%t: HeaderOverflow = %d, want 1", shed, n)
+		}
+
+		// Finishing the first connection frees its slot.
+		first.Close()
+		held.Close()
+		waitFor(t, func() bool { return ml.headerConns.Load() == 0 })
+
+		ml.MetaListener.Close()
+		second.Close()
+	}
+}
+
+// waitFor polls cond for up to five seconds.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// labeledConn is a connection telling its listener and transport.
+type labeledConn struct {
+	net.Conn
+	source, transport string
+}
+
+func (c labeledConn) Source() string    { return c.source }
+func (c labeledConn) Transport() string { return c.transport }
+
+// TestHeaderLabels verifies that header goroutines are labelled with the
+// listener and transport of their connection.
+func TestHeaderLabels(t *testing.T) {
+	conn := labeledConn{source: "tls", transport: TransportTLS}
+	pprof.Do(context.Background(), headerLabels(conn), func(ctx context.Context) {
+		for key, want := range map[string]string{"mirror": "headers", meta.PprofListenerLabel: "tls", "transport": TransportTLS} {
+			if got, _ := pprof.Label(ctx, key); got != want {
+				t.Errorf("label %s = %q, want %q", key, got, want)
+			}
+		}
+	})
+	pprof.Do(context.Background(), headerLabels(labeledConn{}), func(ctx context.Context) {
+		if got, ok := pprof.Label(ctx, "transport"); ok {
+			t.Errorf("empty transport labelled %q", got)
+		}
+	})
+}
+
+// TestAcceptSlowClient verifies that a client slow to send its request head
+// does not hold up Accept for the clients after it.
+func TestAcceptSlowClient(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ml := &Mirror{MetaListener: meta.NewMetaListener()}
+	defer ml.MetaListener.Close()
+	if err := ml.AddListener("tcp", listener); err != nil {
+		t.Fatal(err)
+	}
+
+	slow, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	slow.Write([]byte("GET / HTTP/1.1\r\n"))
+	// Let the MetaListener accept the slow client first
+	time.Sleep(100 * time.Millisecond)
+
+	fast, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fast.Close()
+	fast.Write([]byte("GET / HTTP/1.1\r\nHost: example\r\n\r\n"))
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ml.Accept()
+		accepted <- conn
+	}()
+	select {
+	case conn := <-accepted:
+		defer conn.Close()
+		if conn.RemoteAddr().String() != fast.LocalAddr().String() {
+			t.Errorf("Accept returned the connection from %s, want the fast client %s", conn.RemoteAddr(), fast.LocalAddr())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Accept waited for the slow client's request head")
+	}
+}
+
+// TestAcceptClosed verifies that Accept returns ErrListenerClosed promptly
+// when the Mirror is closed while it waits, and when called after Close.
+func TestAcceptClosed(t *testing.T) {
+	ml := &Mirror{MetaListener: meta.NewMetaListener(), stopCh: make(chan struct{})}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := ml.Accept()
+		errs <- err
+	}()
+	// Let Accept start waiting before closing
+	time.Sleep(50 * time.Millisecond)
+	ml.Close()
+
+	for _, when := range []string{"during", "after"} {
+		if when == "after" {
+			go func() {
+				_, err := ml.Accept()
+				errs <- err
+			}()
+		}
+		select {
+		case err := <-errs:
+			if err == nil || err.Error() != meta.ErrListenerClosed.Error() {
+				t.Errorf("Accept %s Close returned %v, want ErrListenerClosed", when, err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Accept %s Close did not return", when)
+		}
+	}
+}
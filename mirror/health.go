@@ -0,0 +1,102 @@
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+)
+
+// HealthReport is the body served at /status by HealthHandler.
+type HealthReport struct {
+	// Healthy is true when every transport of every running service is up.
+	Healthy bool `json:"healthy"`
+	// Unhealthy lists the "<transport>:<port>" keys that are not up.
+	Unhealthy []string `json:"unhealthy,omitempty"`
+	// Transports is the output of Status.
+	Transports map[string]TransportStatus `json:"transports"`
+}
+
+// Health reports whether every transport of every running service is up.
+// Transports of ports without a service, such as closed services or
+// sessions not yet used by AddService, are listed in the report but do not
+// make the Mirror unhealthy.
+func (ml *Mirror) Health() HealthReport {
+	status := ml.Status()
+	ml.mu.RLock()
+	running := make(map[string]bool, len(ml.services))
+	for port := range ml.services {
+		running[port] = true
+	}
+	ml.mu.RUnlock()
+
+	report := HealthReport{Transports: status}
+	for key, s := range status {
+		if running[s.Port] && s.State != TransportUp {
+			report.Unhealthy = append(report.Unhealthy, key)
+		}
+	}
+	sort.Strings(report.Unhealthy)
+	report.Healthy = len(running) > 0 && len(report.Unhealthy) == 0
+	return report
+}
+
+// HealthHandler returns an http.Handler serving /healthz, which answers
+// 200 "ok" when Health reports the Mirror healthy and 503 listing the
+// transports that are not up otherwise, and /status, which serves the full
+// HealthReport as JSON. It is meant for orchestrators and uptime monitors;
+// mount it on an internal address, or set MirrorConfig.HealthAddr.
+func (ml *Mirror) HealthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		report := ml.Health()
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if !report.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, "unhealthy")
+			for _, key := range report.Unhealthy {
+				fmt.Fprintf(w, "%s %s\n", key, report.Transports[key].State)
+			}
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		report := ml.Health()
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if !report.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			log.Printf("Error writing status: %v", err)
+		}
+	})
+	return mux
+}
+
+// startHealthListener serves HealthHandler on addr until the Mirror is closed.
+func (ml *Mirror) startHealthListener(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to create health listener on %s: %w", addr, err)
+	}
+	server := &http.Server{
+		Handler:           ml.HealthHandler(),
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+	}
+
+	ml.mu.Lock()
+	ml.healthServer = server
+	ml.mu.Unlock()
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Health listener on %s stopped: %v", addr, err)
+		}
+	}()
+	log.Printf("Health listener added http://%s\n", listener.Addr())
+	return nil
+}
@@ -0,0 +1,88 @@
+package mirror
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestHealthHandler verifies /healthz and /status through a service's
+// lifecycle.
+func TestHealthHandler(t *testing.T) {
+	os.Setenv("DISABLE_TOR", "true")
+	os.Setenv("DISABLE_I2P", "true")
+	defer func() {
+		os.Unsetenv("DISABLE_TOR")
+		os.Unsetenv("DISABLE_I2P")
+	}()
+
+	mirror, err := NewMirror("test-health:3018")
+	if err != nil {
+		t.Fatalf("Failed to create mirror: %v", err)
+	}
+	defer mirror.Close()
+	handler := mirror.HealthHandler()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	if rec := get("/healthz"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 before any service runs, got %d", rec.Code)
+	}
+
+	listener, err := mirror.AddService("3018", ServiceConfig{})
+	if err != nil {
+		t.Fatalf("AddService failed: %v", err)
+	}
+	if rec := get("/healthz"); rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != "ok" {
+		t.Errorf("Expected 200 ok, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec := get("/status")
+	var report HealthReport
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatalf("Failed to decode status: %v", err)
+	}
+	if !report.Healthy || report.Transports[statusKey(TransportTCP, "3018")].State != TransportUp {
+		t.Errorf("Expected a healthy report with tcp-local up, got %+v", report)
+	}
+
+	listener.Close()
+	rec = get("/healthz")
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "tcp-local:3018 degraded") {
+		t.Errorf("Expected 503 naming the degraded transport, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+// TestHealthAddr verifies the opt-in health listener.
+func TestHealthAddr(t *testing.T) {
+	os.Setenv("DISABLE_TOR", "true")
+	os.Setenv("DISABLE_I2P", "true")
+	defer func() {
+		os.Unsetenv("DISABLE_TOR")
+		os.Unsetenv("DISABLE_I2P")
+	}()
+
+	cfg := DefaultMirrorConfig()
+	cfg.HealthAddr = "127.0.0.1:0"
+	mirror, err := NewMirrorWithConfig(context.Background(), "test-health-addr:3019", cfg)
+	if err != nil {
+		t.Fatalf("Failed to create mirror: %v", err)
+	}
+	if mirror.healthServer == nil {
+		t.Fatal("Expected a health server")
+	}
+	if err := mirror.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	if mirror.healthServer != nil {
+		t.Error("Expected the health server to be shut down with the mirror")
+	}
+}
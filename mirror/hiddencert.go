@@ -0,0 +1,273 @@
+package mirror
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/cretz/bine/torutil"
+	"github.com/go-i2p/onramp"
+)
+
+// defaultHiddenCertValidity is how long hidden TLS certificates are valid
+// when HiddenCertOptions.Validity is zero.
+const defaultHiddenCertValidity = 365 * 24 * time.Hour
+
+// KeyAlgorithm is the key type of generated certificates.
+type KeyAlgorithm int
+
+const (
+	// KeyECDSAP256 is an ECDSA key on the P-256 curve. It is the default.
+	KeyECDSAP256 KeyAlgorithm = iota
+	// KeyECDSAP384 is an ECDSA key on the P-384 curve, the key onramp
+	// generates.
+	KeyECDSAP384
+	// KeyEd25519 is an Ed25519 key. Some TLS clients do not support it.
+	KeyEd25519
+	// KeyRSA2048 is a 2048-bit RSA key, for old clients.
+	KeyRSA2048
+)
+
+// String returns the lowercase name of the algorithm.
+func (k KeyAlgorithm) String() string {
+	switch k {
+	case KeyECDSAP256:
+		return "ecdsa-p256"
+	case KeyECDSAP384:
+		return "ecdsa-p384"
+	case KeyEd25519:
+		return "ed25519"
+	case KeyRSA2048:
+		return "rsa-2048"
+	default:
+		return "unknown"
+	}
+}
+
+// generate creates a key of the algorithm.
+func (k KeyAlgorithm) generate() (crypto.Signer, error) {
+	switch k {
+	case KeyECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	case KeyRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		return nil, fmt.Errorf("unknown key algorithm %d", int(k))
+	}
+}
+
+// matches reports whether pub is a public key of the algorithm.
+func (k KeyAlgorithm) matches(pub any) bool {
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		return (k == KeyECDSAP256 && pub.Curve == elliptic.P256()) || (k == KeyECDSAP384 && pub.Curve == elliptic.P384())
+	case ed25519.PublicKey:
+		return k == KeyEd25519
+	case *rsa.PublicKey:
+		return k == KeyRSA2048 && pub.N.BitLen() == 2048
+	}
+	return false
+}
+
+// HiddenCertOptions sets how the certificates of a service's hidden TLS
+// listeners are generated. Without them, onramp's defaults apply: a
+// self-signed ECDSA P-384 certificate, valid for five years, naming the
+// onion service ID without .onion or the .b32.i2p address.
+//
+// Certificates are stored in the TLS keystore of the service's key
+// directory and reused while they match the options. A certificate with
+// less than a third of its validity left, or generated with other options,
+// is replaced when the listener is created.
+type HiddenCertOptions struct {
+	// Key is the key algorithm. The zero value is KeyECDSAP256.
+	Key KeyAlgorithm
+	// Validity is how long a certificate is valid. Zero is one year.
+	Validity time.Duration
+	// DNSNames are extra subject alternative names, after the onion or
+	// .b32.i2p address of the listener, which is always the first.
+	DNSNames []string
+	// Issuer and IssuerKey, when set, sign the certificates, so clients
+	// trusting one private CA can verify every hidden service. Without
+	// them certificates are self-signed. Both must be set, or neither.
+	Issuer    *x509.Certificate
+	IssuerKey crypto.Signer
+}
+
+// hiddenCertKey is the context key of WithHiddenCert.
+type hiddenCertKey struct{}
+
+// WithHiddenCert returns a copy of ctx telling TransportProvider.ListenTLS
+// how to generate the certificate of a hidden TLS listener. The Mirror
+// passes ServiceConfig.HiddenCert this way; transports read it with
+// HiddenCertFromContext.
+func WithHiddenCert(ctx context.Context, options *HiddenCertOptions) context.Context {
+	return context.WithValue(ctx, hiddenCertKey{}, options)
+}
+
+// HiddenCertFromContext returns the options set by WithHiddenCert, or nil.
+func HiddenCertFromContext(ctx context.Context) *HiddenCertOptions {
+	options, _ := ctx.Value(hiddenCertKey{}).(*HiddenCertOptions)
+	return options
+}
+
+// hiddenKeys returns the certificate of a hidden TLS listener: one for the
+// address host returns, generated as the HiddenCertOptions of ctx say, or
+// onramp's from keys when ctx has none. It must run in the session's key
+// directory.
+func hiddenKeys(ctx context.Context, keys func() (tls.Certificate, error), host func() (string, error)) (tls.Certificate, error) {
+	options := HiddenCertFromContext(ctx)
+	if options == nil {
+		return keys()
+	}
+	name, err := host()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return options.certificate(name)
+}
+
+// onionHost returns the .onion address of onion's service.
+func onionHost(onion *onramp.Onion) (string, error) {
+	keys, err := onion.Keys()
+	if err != nil {
+		return "", err
+	}
+	return torutil.OnionServiceIDFromPrivateKey(keys) + ".onion", nil
+}
+
+// garlicHost returns the .b32.i2p address of garlic's tunnel.
+func garlicHost(garlic *onramp.Garlic) (string, error) {
+	keys, err := garlic.Keys()
+	if err != nil {
+		return "", err
+	}
+	return keys.Addr().Base32(), nil
+}
+
+// validity returns how long the certificates are valid.
+func (o *HiddenCertOptions) validity() time.Duration {
+	if o.Validity > 0 {
+		return o.Validity
+	}
+	return defaultHiddenCertValidity
+}
+
+// names returns the subject alternative names of the certificate for host.
+func (o *HiddenCertOptions) names(host string) []string {
+	names := []string{host}
+	for _, name := range o.DNSNames {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// certificate returns the certificate for host from the TLS keystore,
+// generating and storing a new one if there is none that matches o.
+func (o *HiddenCertOptions) certificate(host string) (tls.Certificate, error) {
+	if (o.Issuer == nil) != (o.IssuerKey == nil) {
+		return tls.Certificate{}, errors.New("hidden certificate options need both Issuer and IssuerKey, or neither")
+	}
+	keystore, err := onramp.TLSKeystorePath()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	path := filepath.Join(keystore, host+".hidden.pem")
+	if data, err := os.ReadFile(path); err == nil {
+		if cert, err := tls.X509KeyPair(data, data); err == nil && o.reusable(cert, host) {
+			return cert, nil
+		}
+	}
+
+	data, err := o.generate(host)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to generate hidden TLS certificate for %s: %w", host, err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to store hidden TLS certificate: %w", err)
+	}
+	log.Printf("Generated %s hidden TLS certificate for %s, valid for %s", o.Key, host, o.validity())
+	return tls.X509KeyPair(data, data)
+}
+
+// reusable reports whether cert, loaded from the keystore, was generated
+// for host with o and is not close to expiring.
+func (o *HiddenCertOptions) reusable(cert tls.Certificate, host string) bool {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return false
+	}
+	if time.Until(leaf.NotAfter) < o.validity()/3 || !slices.Equal(leaf.DNSNames, o.names(host)) || !o.Key.matches(leaf.PublicKey) {
+		return false
+	}
+	if o.Issuer != nil {
+		return leaf.CheckSignatureFrom(o.Issuer) == nil
+	}
+	return leaf.CheckSignature(leaf.SignatureAlgorithm, leaf.RawTBSCertificate, leaf.Signature) == nil
+}
+
+// generate creates a certificate for host and returns it in PEM, followed
+// by its issuer's, if any, and its private key.
+func (o *HiddenCertOptions) generate(host string) ([]byte, error) {
+	key, err := o.Key.generate()
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		// Tolerate clients whose clock is a little behind
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(o.validity()),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:    o.names(host),
+	}
+	if o.Key == KeyRSA2048 {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	parent, signer := template, key
+	if o.Issuer != nil {
+		parent, signer = o.Issuer, o.IssuerKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), signer)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if o.Issuer != nil {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: o.Issuer.Raw})...)
+	}
+	return append(data, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})...), nil
+}
@@ -0,0 +1,106 @@
+package mirror
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// hiddenCert returns the certificate o generates for host in the TLS
+// keystore of dir, and its leaf.
+func hiddenCert(t *testing.T, dir string, o *HiddenCertOptions, host string) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	cert, err := withKeyDir(dir, func() (tls.Certificate, error) { return o.certificate(host) })
+	if err != nil {
+		t.Fatalf("certificate(%s): %v", host, err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, leaf
+}
+
+// TestHiddenCertOptions verifies that hidden TLS certificates follow their
+// options and are reused until the options change.
+func TestHiddenCertOptions(t *testing.T) {
+	dir := t.TempDir()
+	host := "exampleonionaddress.onion"
+	options := &HiddenCertOptions{Validity: 30 * 24 * time.Hour, DNSNames: []string{"mirror.example.com", host}}
+
+	_, leaf := hiddenCert(t, dir, options, host)
+	if want := []string{host, "mirror.example.com"}; !slices.Equal(leaf.DNSNames, want) {
+		t.Errorf("Names %v, want %v", leaf.DNSNames, want)
+	}
+	if pub, ok := leaf.PublicKey.(*ecdsa.PublicKey); !ok || pub.Curve != elliptic.P256() {
+		t.Errorf("Key %T, want ECDSA P-256", leaf.PublicKey)
+	}
+	if got := time.Until(leaf.NotAfter); got < 29*24*time.Hour || got > 30*24*time.Hour {
+		t.Errorf("Valid for %s more, want 30 days", got)
+	}
+	if err := leaf.VerifyHostname(host); err != nil {
+		t.Errorf("VerifyHostname: %v", err)
+	}
+
+	if _, again := hiddenCert(t, dir, options, host); again.SerialNumber.Cmp(leaf.SerialNumber) != 0 {
+		t.Error("Certificate regenerated with the same options")
+	}
+	options.Key = KeyEd25519
+	_, ed := hiddenCert(t, dir, options, host)
+	if _, ok := ed.PublicKey.(ed25519.PublicKey); !ok {
+		t.Errorf("Key %T after switching to Ed25519", ed.PublicKey)
+	}
+
+	caCert, ca := testCertificate(t, "hidden CA", true, nil, nil)
+	issued := &HiddenCertOptions{Issuer: ca, IssuerKey: caCert.PrivateKey.(*ecdsa.PrivateKey)}
+	cert, leaf := hiddenCert(t, dir, issued, "exampleb32address.b32.i2p")
+	if len(cert.Certificate) != 2 {
+		t.Errorf("Chain has %d certificates, want the leaf and the issuer", len(cert.Certificate))
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	// The test CA is restricted to client authentication
+	if !slices.Contains(leaf.ExtKeyUsage, x509.ExtKeyUsageServerAuth) {
+		t.Errorf("Key usages %v, want server authentication", leaf.ExtKeyUsage)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "exampleb32address.b32.i2p", Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+		t.Errorf("Verify against the issuer: %v", err)
+	}
+
+	if _, err := withKeyDir(dir, func() (tls.Certificate, error) {
+		return (&HiddenCertOptions{Issuer: ca}).certificate(host)
+	}); err == nil {
+		t.Error("An issuer without its key was accepted")
+	}
+}
+
+// TestHiddenKeys verifies that onramp's certificate is kept without
+// options, and that the transport's address is only looked up with them.
+func TestHiddenKeys(t *testing.T) {
+	errOnramp := errors.New("onramp keys")
+	keys := func() (tls.Certificate, error) { return tls.Certificate{}, errOnramp }
+	hostCalled := false
+	host := func() (string, error) {
+		hostCalled = true
+		return "exampleonionaddress.onion", nil
+	}
+
+	if _, err := hiddenKeys(context.Background(), keys, host); err != errOnramp || hostCalled {
+		t.Errorf("Without options: %v, host looked up %t", err, hostCalled)
+	}
+	ctx := WithHiddenCert(context.Background(), &HiddenCertOptions{})
+	if !customTLS(ctx) {
+		t.Error("Hidden certificate options do not need a custom TLS listener")
+	}
+	cert, err := withKeyDir(t.TempDir(), func() (tls.Certificate, error) { return hiddenKeys(ctx, keys, host) })
+	if err != nil || !hostCalled || len(cert.Certificate) == 0 {
+		t.Errorf("With options: %v, host looked up %t", err, hostCalled)
+	}
+}
@@ -0,0 +1,194 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// httpReadHeaderTimeout bounds how long the companion HTTP listener waits
+// for request headers.
+const httpReadHeaderTimeout = 10 * time.Second
+
+// startHTTPListener starts the companion plain HTTP listener of a service.
+// It answers ACME HTTP-01 challenges when the TLS listener's provider can,
+// and redirects every other request to HTTPS.
+func (ml *Mirror) startHTTPListener(cfg ServiceConfig, port string, tlsListener net.Listener) error {
+	listener, err := net.Listen("tcp", cfg.HTTPAddr)
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP listener on %s: %w", cfg.HTTPAddr, err)
+	}
+
+	handler := ml.redirectHandler(cfg, port)
+	if responder, ok := tlsListener.(httpChallengeResponder); ok {
+		handler = responder.HTTPHandler(handler)
+	}
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+	}
+
+	ml.mu.Lock()
+	if ml.httpServers == nil {
+		ml.httpServers = make(map[string]*http.Server)
+	}
+	ml.httpServers[port] = server
+	ml.mu.Unlock()
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("HTTP listener on %s stopped: %v", cfg.HTTPAddr, err)
+		}
+	}()
+	log.Printf("HTTP redirect listener added http://%s\n", listener.Addr())
+	return nil
+}
+
+// redirectHandler permanently redirects requests to the HTTPS version of the
+// same URL, advertising the onion mirror when cfg.OnionLocation is set.
+func (ml *Mirror) redirectHandler(cfg ServiceConfig, port string) http.Handler {
+	domains := cfg.tlsDomains()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := domains[0]
+		requested := r.Host
+		if h, _, err := net.SplitHostPort(requested); err == nil {
+			requested = h
+		}
+		for _, domain := range domains {
+			if strings.EqualFold(requested, domain) {
+				host = domain
+				break
+			}
+		}
+
+		if cfg.OnionLocation {
+			ml.setOnionLocation(w, r, port, cfg.HiddenTLS.enabled())
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// OnionLocationHandler wraps next so that responses to requests for the
+// clearnet domains of the service on port carry an Onion-Location header
+// pointing at the same URL on the service's onion address, which lets Tor
+// Browser offer the onion mirror. Requests that arrived over Tor, I2P, or
+// the local listener, whose Host is not one of those domains, pass through
+// unchanged, as do all requests while the onion service is not up.
+func (ml *Mirror) OnionLocationHandler(port string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ml.mu.RLock()
+		cfg, ok := ml.services[port]
+		ml.mu.RUnlock()
+		if ok && cfg.Email != "" && matchesDomain(r.Host, cfg.tlsDomains()) {
+			ml.setOnionLocation(w, r, port, cfg.HiddenTLS.enabled())
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// setOnionLocation sets the Onion-Location header for r if the onion
+// service on port is up.
+func (ml *Mirror) setOnionLocation(w http.ResponseWriter, r *http.Request, port string, useTLS bool) {
+	if onion := ml.hiddenLocation(TransportOnion, port, useTLS); onion != "" {
+		w.Header().Set("Onion-Location", onion+r.URL.RequestURI())
+	}
+}
+
+// matchesDomain reports whether host, with or without a port, is one of domains.
+func matchesDomain(host string, domains []string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, domain := range domains {
+		if strings.EqualFold(host, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// AltSvcHandler wraps next so that responses to requests for the clearnet
+// domains of the service on port advertise its hidden mirrors with the
+// headers of AltSvcHeaders. Like OnionLocationHandler, requests for other
+// hosts pass through unchanged.
+func (ml *Mirror) AltSvcHandler(port string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for key, values := range ml.AltSvcHeaders(port, r) {
+			w.Header()[key] = values
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AltSvcHeaders returns the response headers advertising the onion and I2P
+// addresses of the service on port to a client that requested one of its
+// clearnet domains with r: Alt-Svc names the onion service, which clients
+// such as Tor Browser then use for the same origin, and X-I2P-Location
+// points at the same URL on the .b32.i2p address. Alt-Svc needs the onion
+// service to present the clearnet certificate, so it is only sent with
+// hidden TLS. Transports that are not up are left out, and requests for
+// other hosts get no headers. Code writing responses without an
+// http.Handler, such as a reverse proxy's ModifyResponse, can add these
+// headers itself.
+func (ml *Mirror) AltSvcHeaders(port string, r *http.Request) http.Header {
+	header := make(http.Header)
+	ml.mu.RLock()
+	cfg, ok := ml.services[port]
+	ml.mu.RUnlock()
+	if !ok || cfg.Email == "" || !matchesDomain(r.Host, cfg.tlsDomains()) {
+		return header
+	}
+	useTLS := cfg.HiddenTLS.enabled()
+	if onion := ml.upAddress(TransportOnion, port); onion != "" && useTLS {
+		if _, _, err := net.SplitHostPort(onion); err != nil {
+			onion = net.JoinHostPort(onion, "443")
+		}
+		header.Set("Alt-Svc", fmt.Sprintf("h2=%q; ma=%d, http/1.1=%q; ma=%d", onion, altSvcMaxAge, onion, altSvcMaxAge))
+	}
+	if i2p := ml.hiddenLocation(TransportGarlic, port, useTLS); i2p != "" {
+		header.Set("X-I2P-Location", i2p+r.URL.RequestURI())
+	}
+	return header
+}
+
+// altSvcMaxAge is how long, in seconds, clients may use an advertised
+// alternative service.
+const altSvcMaxAge = 86400
+
+// hiddenLocation returns the base URL of the onion or garlic service for
+// port, or "" if it is not up.
+func (ml *Mirror) hiddenLocation(transport, port string, useTLS bool) string {
+	host := ml.upAddress(transport, port)
+	if host == "" {
+		return ""
+	}
+	scheme, defaultPort := "http", "80"
+	if useTLS {
+		scheme, defaultPort = "https", "443"
+	}
+	if h, p, err := net.SplitHostPort(host); err == nil && p == defaultPort {
+		host = h
+	}
+	return scheme + "://" + host
+}
+
+// upAddress returns the published address of transport for port, or "" if
+// it is not up.
+func (ml *Mirror) upAddress(transport, port string) string {
+	status, ok := ml.Status()[statusKey(transport, port)]
+	if !ok || status.State != TransportUp {
+		return ""
+	}
+	return status.Address
+}
+
+// shutdownHTTPServer gracefully shuts server down, closing it if ctx expires first.
+func shutdownHTTPServer(ctx context.Context, server *http.Server) {
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("Error closing HTTP listener:", err)
+		server.Close()
+	}
+}
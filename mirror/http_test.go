@@ -0,0 +1,105 @@
+package mirror
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestRedirectHandler verifies the HTTPS redirect and Onion-Location header
+// served by the companion HTTP listener.
+func TestRedirectHandler(t *testing.T) {
+	mirror := &Mirror{}
+	mirror.status.setUp(TransportOnion, "443", "abcdef.onion:80", nil, "")
+
+	cfg := ServiceConfig{
+		Name:          "example.org",
+		Domains:       []string{"pages.example.org"},
+		HiddenTLS:     HiddenTLSOff,
+		OnionLocation: true,
+	}
+	handler := mirror.redirectHandler(cfg, "443")
+
+	for _, tc := range []struct {
+		host, target string
+	}{
+		{"pages.example.org", "https://pages.example.org/docs?x=1"},
+		{"PAGES.example.org:80", "https://pages.example.org/docs?x=1"},
+		{"unknown.example", "https://example.org/docs?x=1"},
+	} {
+		req := httptest.NewRequest("GET", "http://"+tc.host+"/docs?x=1", nil)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusMovedPermanently {
+			t.Errorf("Host %s: expected 301, got %d", tc.host, rec.Code)
+		}
+		if got := rec.Header().Get("Location"); got != tc.target {
+			t.Errorf("Host %s: expected Location %s, got %s", tc.host, tc.target, got)
+		}
+		if got := rec.Header().Get("Onion-Location"); got != "http://abcdef.onion/docs?x=1" {
+			t.Errorf("Host %s: unexpected Onion-Location %q", tc.host, got)
+		}
+	}
+}
+
+// TestOnionLocationHandler verifies that only requests for the service's
+// clearnet domains get an Onion-Location header.
+func TestOnionLocationHandler(t *testing.T) {
+	mirror := &Mirror{services: map[string]ServiceConfig{
+		"443": {Name: "example.org", Email: "admin@example.org", HiddenTLS: HiddenTLSOn},
+	}}
+	mirror.status.setUp(TransportOnion, "443", "abcdef.onion:443", nil, "")
+	handler := mirror.OnionLocationHandler("443", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for host, want := range map[string]string{
+		"example.org":     "https://abcdef.onion/page?q=1",
+		"EXAMPLE.org:443": "https://abcdef.onion/page?q=1",
+		"abcdef.onion":    "",
+		"127.0.0.1:443":   "",
+	} {
+		req := httptest.NewRequest("GET", "https://"+host+"/page?q=1", nil)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if got := rec.Header().Get("Onion-Location"); got != want {
+			t.Errorf("Host %s: expected Onion-Location %q, got %q", host, want, got)
+		}
+	}
+}
+
+// TestAltSvcHandler verifies that requests for the service's clearnet
+// domains get Alt-Svc and X-I2P-Location headers for the transports that
+// are up, and that Alt-Svc needs hidden TLS.
+func TestAltSvcHandler(t *testing.T) {
+	mirror := &Mirror{services: map[string]ServiceConfig{
+		"443":  {Name: "example.org", Email: "admin@example.org", HiddenTLS: HiddenTLSOn},
+		"8080": {Name: "example.org", Email: "admin@example.org", HiddenTLS: HiddenTLSOff},
+	}}
+	mirror.status.setUp(TransportOnion, "443", "abcdef.onion:443", nil, "")
+	mirror.status.setUp(TransportGarlic, "443", "ghijkl.b32.i2p", nil, "")
+	mirror.status.setUp(TransportOnion, "8080", "abcdef.onion:8080", nil, "")
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	for _, tc := range []struct {
+		port, host  string
+		altSvc, i2p string
+	}{
+		{"443", "example.org", `h2="abcdef.onion:443"; ma=86400, http/1.1="abcdef.onion:443"; ma=86400`, "https://ghijkl.b32.i2p/page?q=1"},
+		{"443", "abcdef.onion", "", ""},
+		{"8080", "example.org:8080", "", ""},
+	} {
+		req := httptest.NewRequest("GET", "https://"+tc.host+"/page?q=1", nil)
+		rec := httptest.NewRecorder()
+		mirror.AltSvcHandler(tc.port, next).ServeHTTP(rec, req)
+		if got := rec.Header().Get("Alt-Svc"); got != tc.altSvc {
+			t.Errorf("%s on port %s: Alt-Svc %q, want %q", tc.host, tc.port, got, tc.altSvc)
+		}
+		if got := rec.Header().Get("X-I2P-Location"); got != tc.i2p {
+			t.Errorf("%s on port %s: X-I2P-Location %q, want %q", tc.host, tc.port, got, tc.i2p)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package mirror
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-i2p/i2pkeys"
+)
+
+// defaultSAMAddr is the SAM bridge used for I2P sessions and name lookups.
+const defaultSAMAddr = "127.0.0.1:7656"
+
+// i2pBase64 is the base64 alphabet I2P uses for destinations and signatures.
+var i2pBase64 = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-~")
+
+// I2PRegistration is a signed claim of an .i2p hostname by a destination,
+// the "authentication string" that stats.i2p-style registrars and address
+// book subscriptions accept. It proves the registrant holds the
+// destination's signing key.
+type I2PRegistration struct {
+	// Hostname is the requested name, such as "example.i2p".
+	Hostname string
+	// Destination is the full base64 destination the name points to.
+	Destination string
+	// Date is when the registration was signed.
+	Date time.Time
+	// Signature is the I2P base64 signature over the other fields.
+	Signature string
+}
+
+// String returns the authentication string to submit to a registrar, in the
+// form "hostname=destination#!date=...#sig=...".
+func (r I2PRegistration) String() string {
+	return r.signedPart() + "#sig=" + r.Signature
+}
+
+// signedPart returns the portion of the authentication string covered by the signature.
+func (r I2PRegistration) signedPart() string {
+	return r.Hostname + "=" + r.Destination + "#!date=" + strconv.FormatInt(r.Date.Unix(), 10)
+}
+
+// NewI2PRegistration signs a registration of hostname for the destination
+// of keys. Ed25519 and ECDSA destinations are supported; legacy DSA_SHA1
+// destinations are rejected.
+func NewI2PRegistration(keys i2pkeys.I2PKeys, hostname string) (I2PRegistration, error) {
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	if err := validI2PHostname(hostname); err != nil {
+		return I2PRegistration{}, err
+	}
+	signer, err := i2pSigner(keys)
+	if err != nil {
+		return I2PRegistration{}, err
+	}
+
+	reg := I2PRegistration{
+		Hostname:    hostname,
+		Destination: keys.Address.Base64(),
+		Date:        time.Now().Truncate(time.Second),
+	}
+	sig, err := signer([]byte(reg.signedPart()))
+	if err != nil {
+		return I2PRegistration{}, fmt.Errorf("failed to sign registration of %s: %w", hostname, err)
+	}
+	reg.Signature = i2pBase64.EncodeToString(sig)
+	return reg, nil
+}
+
+// RegisterI2PName returns the signed registration of hostname for the I2P
+// destination of the service on port. Submit its String to a registrar to
+// obtain the name; I2PNameRegistered reports when it has propagated to the
+// local router's address book.
+func (ml *Mirror) RegisterI2PName(port, hostname string) (I2PRegistration, error) {
+	keys, err := ml.i2pKeys(port)
+	if err != nil {
+		return I2PRegistration{}, err
+	}
+	return NewI2PRegistration(keys, hostname)
+}
+
+// I2PNameRegistered reports whether the local router resolves hostname to
+// the I2P destination of the service on port.
+func (ml *Mirror) I2PNameRegistered(ctx context.Context, port, hostname string) (bool, error) {
+	keys, err := ml.i2pKeys(port)
+	if err != nil {
+		return false, err
+	}
+	dest, err := LookupI2PName(ctx, ml.samBridge(ctx), hostname)
+	if err != nil {
+		return false, err
+	}
+	return dest == keys.Address.Base64(), nil
+}
+
+// i2pKeys returns the keys of the garlic session of port, which is the
+// shared primary session with MirrorConfig.SharedI2P.
+func (ml *Mirror) i2pKeys(port string) (i2pkeys.I2PKeys, error) {
+	ml.mu.RLock()
+	garlic := ml.Garlics[port]
+	provider := ml.transports[port][TransportGarlic]
+	ml.mu.RUnlock()
+	_, shared := provider.(*sharedGarlicTransport)
+	var keyDir string
+	if gt, ok := provider.(*garlicTransport); ok {
+		keyDir = gt.keyDir
+	}
+	if primary := ml.sharedPrimary(); shared && primary != nil {
+		return primary.Keys(), nil
+	}
+	if garlic == nil {
+		return i2pkeys.I2PKeys{}, fmt.Errorf("no garlic instance found for port %s", port)
+	}
+	keys, err := withKeyDir(keyDir, garlic.Keys)
+	if err != nil {
+		return i2pkeys.I2PKeys{}, err
+	}
+	return *keys, nil
+}
+
+// LookupI2PName resolves hostname to a base64 destination with the SAM
+// NAMING LOOKUP command of the bridge at samAddr.
+func LookupI2PName(ctx context.Context, samAddr, hostname string) (string, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", samAddr)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to SAM bridge %s: %w", samAddr, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	reader := bufio.NewReader(conn)
+	reply, err := samCommand(conn, reader, "HELLO VERSION MIN=3.0 MAX=3.3")
+	if err != nil {
+		return "", err
+	}
+	if reply["RESULT"] != "OK" {
+		return "", fmt.Errorf("SAM handshake failed: %s", reply["RESULT"])
+	}
+
+	reply, err = samCommand(conn, reader, "NAMING LOOKUP NAME="+hostname)
+	if err != nil {
+		return "", err
+	}
+	if reply["RESULT"] != "OK" {
+		return "", fmt.Errorf("SAM lookup of %s failed: %s", hostname, reply["RESULT"])
+	}
+	return reply["VALUE"], nil
+}
+
+// samCommand sends one SAM command and parses the KEY=VALUE pairs of the reply.
+func samCommand(conn net.Conn, reader *bufio.Reader, command string) (map[string]string, error) {
+	if _, err := conn.Write([]byte(command + "\n")); err != nil {
+		return nil, fmt.Errorf("failed to send SAM command: %w", err)
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SAM reply: %w", err)
+	}
+	reply := make(map[string]string)
+	for _, field := range strings.Fields(line) {
+		if key, value, ok := strings.Cut(field, "="); ok {
+			reply[key] = value
+		}
+	}
+	return reply, nil
+}
+
+// validI2PHostname checks hostname against the rules registrars enforce.
+func validI2PHostname(hostname string) error {
+	if !strings.HasSuffix(hostname, ".i2p") || strings.HasSuffix(hostname, ".b32.i2p") {
+		return fmt.Errorf("invalid I2P hostname %q: must end in .i2p and not .b32.i2p", hostname)
+	}
+	if len(hostname) > 67 {
+		return fmt.Errorf("invalid I2P hostname %q: longer than 67 characters", hostname)
+	}
+	for _, label := range strings.Split(hostname, ".") {
+		if label == "" || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return fmt.Errorf("invalid I2P hostname %q: malformed label %q", hostname, label)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return fmt.Errorf("invalid I2P hostname %q: invalid character %q", hostname, c)
+			}
+		}
+	}
+	return nil
+}
+
+// I2P signature types, from the destination's key certificate.
+const (
+	i2pSigDSASHA1     = 0
+	i2pSigECDSASHA256 = 1
+	i2pSigECDSASHA384 = 2
+	i2pSigECDSASHA512 = 3
+	i2pSigEdDSASHA512 = 7
+)
+
+const (
+	// i2pKeyCertificate is the certificate type carrying key types.
+	i2pKeyCertificate = 5
+	// i2pCryptoX25519 is the encryption type with a 32-byte private key.
+	i2pCryptoX25519 = 4
+	// i2pDestinationFixed is the size of the public key fields preceding
+	// the certificate in a destination.
+	i2pDestinationFixed = 384
+)
+
+// i2pSigner returns a function signing messages with the signing private
+// key of keys, producing signatures in I2P's wire format.
+func i2pSigner(keys i2pkeys.I2PKeys) (func([]byte) ([]byte, error), error) {
+	dest, err := i2pBase64.DecodeString(keys.Address.Base64())
+	if err != nil {
+		return nil, fmt.Errorf("invalid I2P destination: %w", err)
+	}
+	both, err := i2pBase64.DecodeString(keys.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid I2P private keys: %w", err)
+	}
+	if len(dest) < i2pDestinationFixed+3 || len(both) < len(dest) {
+		return nil, fmt.Errorf("invalid I2P private keys: too short")
+	}
+
+	sigType, cryptoType := uint16(i2pSigDSASHA1), uint16(0)
+	cert := dest[i2pDestinationFixed:]
+	if cert[0] == i2pKeyCertificate && len(cert) >= 7 {
+		sigType = binary.BigEndian.Uint16(cert[3:5])
+		cryptoType = binary.BigEndian.Uint16(cert[5:7])
+	}
+	privateKeyLen := 256
+	if cryptoType == i2pCryptoX25519 {
+		privateKeyLen = 32
+	}
+	signing := both[len(dest):]
+	if len(signing) < privateKeyLen {
+		return nil, fmt.Errorf("invalid I2P private keys: missing private key")
+	}
+	signing = signing[privateKeyLen:]
+
+	ecdsaSigner := func(curve elliptic.Curve, size int, hash func([]byte) []byte) (func([]byte) ([]byte, error), error) {
+		if len(signing) < size {
+			return nil, fmt.Errorf("invalid I2P private keys: missing signing key")
+		}
+		x, y := curve.ScalarBaseMult(signing[:size])
+		key := &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{Curve: curve, X: x, Y: y},
+			D:         new(big.Int).SetBytes(signing[:size]),
+		}
+		return func(msg []byte) ([]byte, error) {
+			r, s, err := ecdsa.Sign(rand.Reader, key, hash(msg))
+			if err != nil {
+				return nil, err
+			}
+			sig := make([]byte, 2*size)
+			r.FillBytes(sig[:size])
+			s.FillBytes(sig[size:])
+			return sig, nil
+		}, nil
+	}
+
+	switch sigType {
+	case i2pSigEdDSASHA512:
+		if len(signing) < ed25519.SeedSize {
+			return nil, fmt.Errorf("invalid I2P private keys: missing signing key")
+		}
+		key := ed25519.NewKeyFromSeed(signing[:ed25519.SeedSize])
+		return func(msg []byte) ([]byte, error) {
+			return key.Sign(nil, msg, crypto.Hash(0))
+		}, nil
+	case i2pSigECDSASHA256:
+		return ecdsaSigner(elliptic.P256(), 32, func(b []byte) []byte { h := sha256.Sum256(b); return h[:] })
+	case i2pSigECDSASHA384:
+		return ecdsaSigner(elliptic.P384(), 48, func(b []byte) []byte { h := sha512.Sum384(b); return h[:] })
+	case i2pSigECDSASHA512:
+		return ecdsaSigner(elliptic.P521(), 66, func(b []byte) []byte { h := sha512.Sum512(b); return h[:] })
+	case i2pSigDSASHA1:
+		return nil, fmt.Errorf("I2P destination uses DSA_SHA1 signatures, which registration does not support; generate Ed25519 keys instead")
+	default:
+		return nil, fmt.Errorf("unsupported I2P signature type %d", sigType)
+	}
+}
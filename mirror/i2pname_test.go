@@ -0,0 +1,101 @@
+package mirror
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/go-i2p/i2pkeys"
+)
+
+// testI2PKeys builds I2P keys for an Ed25519 destination.
+func testI2PKeys(t *testing.T) (i2pkeys.I2PKeys, ed25519.PublicKey) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	dest := make([]byte, i2pDestinationFixed, i2pDestinationFixed+7)
+	copy(dest[i2pDestinationFixed-ed25519.PublicKeySize:], public)
+	dest = append(dest, i2pKeyCertificate, 0, 4)
+	dest = binary.BigEndian.AppendUint16(dest, i2pSigEdDSASHA512)
+	dest = binary.BigEndian.AppendUint16(dest, 0)
+
+	both := append([]byte(nil), dest...)
+	both = append(both, make([]byte, 256)...)
+	both = append(both, private.Seed()...)
+
+	addr := i2pkeys.I2PAddr(i2pBase64.EncodeToString(dest))
+	return i2pkeys.NewKeys(addr, i2pBase64.EncodeToString(both)), public
+}
+
+// TestI2PRegistration verifies the authentication string format and that
+// its signature verifies against the destination's signing key.
+func TestI2PRegistration(t *testing.T) {
+	keys, public := testI2PKeys(t)
+
+	reg, err := NewI2PRegistration(keys, "Example.i2p")
+	if err != nil {
+		t.Fatalf("NewI2PRegistration failed: %v", err)
+	}
+	auth := reg.String()
+	if !strings.HasPrefix(auth, "example.i2p="+keys.Address.Base64()+"#!date=") {
+		t.Errorf("Unexpected authentication string %q", auth)
+	}
+	signed, sig, ok := strings.Cut(auth, "#sig=")
+	if !ok {
+		t.Fatalf("Missing signature in %q", auth)
+	}
+	raw, err := i2pBase64.DecodeString(sig)
+	if err != nil {
+		t.Fatalf("Signature is not I2P base64: %v", err)
+	}
+	if !ed25519.Verify(public, []byte(signed), raw) {
+		t.Error("Signature does not verify")
+	}
+
+	for _, name := range []string{"example.com", "abc.b32.i2p", "-bad.i2p", "sp ace.i2p"} {
+		if _, err := NewI2PRegistration(keys, name); err == nil {
+			t.Errorf("Expected %q to be rejected", name)
+		}
+	}
+}
+
+// TestLookupI2PName verifies the SAM NAMING LOOKUP exchange.
+func TestLookupI2PName(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		reader.ReadString('\n')
+		conn.Write([]byte("HELLO REPLY RESULT=OK VERSION=3.3\n"))
+		line, _ := reader.ReadString('\n')
+		if strings.TrimSpace(line) == "NAMING LOOKUP NAME=example.i2p" {
+			conn.Write([]byte("NAMING REPLY RESULT=OK NAME=example.i2p VALUE=dest~AAAA\n"))
+		} else {
+			conn.Write([]byte("NAMING REPLY RESULT=KEY_NOT_FOUND\n"))
+		}
+	}()
+
+	dest, err := LookupI2PName(context.Background(), listener.Addr().String(), "example.i2p")
+	if err != nil {
+		t.Fatalf("LookupI2PName failed: %v", err)
+	}
+	if dest != "dest~AAAA" {
+		t.Errorf("Expected dest~AAAA, got %q", dest)
+	}
+}
@@ -0,0 +1,121 @@
+package mirror
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/go-i2p/onramp"
+)
+
+// keystore coordinates the onramp calls that read or create keys. onramp
+// keeps its keystore directories in package variables, so a service with
+// its own key directory points them there while its calls run. Calls for
+// the same directory, including onramp's defaults, run concurrently; a call
+// for another directory waits until they are done, and keeps new calls for
+// the current one from overtaking it. Callers keep what runs inside short,
+// loading keys there and publishing or listening outside where onramp
+// allows it.
+var keystore = struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	// dir is the directory the keystore paths point at, "" for the defaults
+	dir string
+	// users counts the calls running in dir
+	users int
+	// waiting counts the calls waiting for each directory
+	waiting map[string]int
+	// defaults are onramp's keystore paths, saved while dir is swapped in
+	defaults [3]string
+}{waiting: make(map[string]int)}
+
+func init() {
+	keystore.cond = sync.NewCond(&keystore.mu)
+}
+
+// withKeyDir runs fn with onramp's onion, I2P, and TLS keystores in the
+// onionkeys, i2pkeys, and tlskeys subdirectories of dir, or in onramp's
+// defaults if dir is empty.
+func withKeyDir[T any](dir string, fn func() (T, error)) (T, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			var zero T
+			return zero, err
+		}
+	}
+	acquireKeyDir(dir)
+	defer releaseKeyDir()
+	return fn()
+}
+
+// acquireKeyDir waits until the keystore paths can point at dir and joins
+// the calls using them.
+func acquireKeyDir(dir string) {
+	keystore.mu.Lock()
+	defer keystore.mu.Unlock()
+
+	keystore.waiting[dir]++
+	for keystore.users > 0 && (keystore.dir != dir || otherKeyDirWaiting(dir)) {
+		keystore.cond.Wait()
+	}
+	keystore.waiting[dir]--
+	if keystore.waiting[dir] == 0 {
+		delete(keystore.waiting, dir)
+	}
+	if keystore.users == 0 {
+		setKeyDir(dir)
+	}
+	keystore.users++
+}
+
+// releaseKeyDir ends a call started with acquireKeyDir, restoring onramp's
+// defaults after the last one.
+func releaseKeyDir() {
+	keystore.mu.Lock()
+	defer keystore.mu.Unlock()
+
+	keystore.users--
+	if keystore.users == 0 {
+		setKeyDir("")
+		keystore.cond.Broadcast()
+	}
+}
+
+// otherKeyDirWaiting reports whether a call for a directory other than dir
+// is waiting. keystore.mu must be held.
+func otherKeyDirWaiting(dir string) bool {
+	for other := range keystore.waiting {
+		if other != dir {
+			return true
+		}
+	}
+	return false
+}
+
+// setKeyDir points onramp's keystore paths at dir, or back at the defaults
+// if it is empty. keystore.mu must be held and no call may be using them.
+func setKeyDir(dir string) {
+	if dir == keystore.dir {
+		return
+	}
+	if keystore.dir == "" {
+		keystore.defaults = [3]string{onramp.ONION_KEYSTORE_PATH, onramp.I2P_KEYSTORE_PATH, onramp.TLS_KEYSTORE_PATH}
+	}
+	if dir == "" {
+		onramp.ONION_KEYSTORE_PATH, onramp.I2P_KEYSTORE_PATH, onramp.TLS_KEYSTORE_PATH =
+			keystore.defaults[0], keystore.defaults[1], keystore.defaults[2]
+	} else {
+		onramp.ONION_KEYSTORE_PATH = filepath.Join(dir, "onionkeys")
+		onramp.I2P_KEYSTORE_PATH = filepath.Join(dir, "i2pkeys")
+		onramp.TLS_KEYSTORE_PATH = filepath.Join(dir, "tlskeys")
+	}
+	keystore.dir = dir
+}
+
+// keyDir returns the key directory of a service configured with cfg.
+func (ml *Mirror) keyDir(cfg ServiceConfig) string {
+	if cfg.KeyDir != "" {
+		return cfg.KeyDir
+	}
+	return ml.cfg().KeyDir
+}
@@ -0,0 +1,95 @@
+package mirror
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cretz/bine/torutil/ed25519"
+	"github.com/go-i2p/onramp"
+)
+
+// TestWithKeyDir verifies that keys created for a service land in its key
+// directory and that onramp's defaults are restored afterwards.
+func TestWithKeyDir(t *testing.T) {
+	dir := t.TempDir()
+	defaultOnion := onramp.ONION_KEYSTORE_PATH
+
+	_, err := withKeyDir(dir, func() (ed25519.KeyPair, error) {
+		return onramp.TorKeys("metalistener-keydir-test")
+	})
+	if err != nil {
+		t.Fatalf("TorKeys failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "onionkeys", "metalistener-keydir-test.tor.private")); err != nil {
+		t.Errorf("Expected the key in the service key directory: %v", err)
+	}
+	if onramp.ONION_KEYSTORE_PATH != defaultOnion {
+		t.Errorf("Expected keystore path restored to %s, got %s", defaultOnion, onramp.ONION_KEYSTORE_PATH)
+	}
+}
+
+// TestWithKeyDirConcurrent verifies that calls for the same key directory
+// run concurrently, while a call for another directory waits for them and
+// sees its own paths.
+func TestWithKeyDirConcurrent(t *testing.T) {
+	dir, other := t.TempDir(), t.TempDir()
+	release := make(chan struct{})
+	inside := make(chan string, 2)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			withKeyDir(dir, func() (struct{}, error) {
+				inside <- onramp.ONION_KEYSTORE_PATH
+				<-release
+				return struct{}{}, nil
+			})
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case path := <-inside:
+			if path != filepath.Join(dir, "onionkeys") {
+				t.Errorf("Expected the onion keystore in %s, got %s", dir, path)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Calls for the same key directory did not run concurrently")
+		}
+	}
+
+	done := make(chan string)
+	go withKeyDir(other, func() (struct{}, error) {
+		done <- onramp.ONION_KEYSTORE_PATH
+		return struct{}{}, nil
+	})
+	select {
+	case <-done:
+		t.Fatal("A call for another key directory ran while the directory was in use")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	wg.Wait()
+	select {
+	case path := <-done:
+		if path != filepath.Join(other, "onionkeys") {
+			t.Errorf("Expected the onion keystore in %s, got %s", other, path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The call for another key directory never ran")
+	}
+}
+
+// TestKeyDirPrecedence verifies that a service's KeyDir overrides the Mirror's.
+func TestKeyDirPrecedence(t *testing.T) {
+	ml := &Mirror{config: &MirrorConfig{KeyDir: "/mirror"}}
+	if got := ml.keyDir(ServiceConfig{}); got != "/mirror" {
+		t.Errorf("Expected the Mirror key directory, got %q", got)
+	}
+	if got := ml.keyDir(ServiceConfig{KeyDir: "/service"}); got != "/service" {
+		t.Errorf("Expected the service key directory, got %q", got)
+	}
+}
@@ -1,8 +1,10 @@
 package mirror
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"strings"
 	"sync"
@@ -10,56 +12,77 @@ import (
 	"github.com/go-i2p/go-meta-listener"
 	"github.com/go-i2p/go-meta-listener/tcp"
 	"github.com/go-i2p/onramp"
-
-	wileedot "github.com/opd-ai/wileedot"
 )
 
 type Mirror struct {
 	*meta.MetaListener
-	mu      sync.RWMutex // protects Onions and Garlics maps
+	mu      sync.RWMutex // protects Onions, Garlics, the maps below, and sniRoutes
 	Onions  map[string]*onramp.Onion
 	Garlics map[string]*onramp.Garlic
+	// transports holds the TransportProvider of every hidden transport set
+	// up, keyed by port, then transport name
+	transports map[string]map[string]TransportProvider
+	// services holds the configuration of every service, keyed by port
+	services map[string]ServiceConfig
+	// children holds the listener returned for every service, keyed by port
+	children map[string]*meta.MetaListener
+	// packetConns are the I2P datagram sessions of services, keyed by port
+	packetConns map[string]net.PacketConn
+	// httpServers are the companion HTTP listeners of services, keyed by port
+	httpServers map[string]*http.Server
+	// healthServer serves HealthHandler on MirrorConfig.HealthAddr
+	healthServer *http.Server
+	// name is the normalized name the Mirror was created with
+	name string
+	// config holds Mirror-wide settings; nil means DefaultMirrorConfig
+	config *MirrorConfig
+	// stopCh is closed by Close to stop background goroutines
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	// unpublishExpvar unbinds MirrorConfig.ExpvarName; set once at creation
+	unpublishExpvar func()
+	// status tracks the lifecycle of every transport set up by Listen
+	status statusTable
+	// stats holds per-transport traffic counters
+	stats statsTable
+	// certs reports certificate lifecycle events; created on first use
+	certs *certTracker
+	sniRoutes
+	torSessions
+	sharedI2P
+	samBridges
+	acceptState
 }
 
 var _ net.Listener = &Mirror{}
 
+// Close closes the Mirror like CloseContext, allowing defaultCloseTimeout
+// for services and transports to shut down.
 func (m *Mirror) Close() error {
-	log.Println("Closing Mirror")
-	if err := m.MetaListener.Close(); err != nil {
-		log.Println("Error closing MetaListener:", err)
-	} else {
-		log.Println("MetaListener closed")
-	}
-
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	for _, onion := range m.Onions {
-		if err := onion.Close(); err != nil {
-			log.Println("Error closing Onion:", err)
-		} else {
-			log.Println("Onion closed")
-		}
-	}
-	for _, garlic := range m.Garlics {
-		if err := garlic.Close(); err != nil {
-			log.Println("Error closing Garlic:", err)
-		} else {
-			log.Println("Garlic closed")
-		}
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultCloseTimeout)
+	defer cancel()
+	return m.CloseContext(ctx)
+}
 
-	// Clear the maps to prevent reuse of closed instances
-	m.Onions = make(map[string]*onramp.Onion)
-	m.Garlics = make(map[string]*onramp.Garlic)
+// NewMirror creates a Mirror with a session of every registered transport,
+// onion and garlic by default, for the port in name.
+func NewMirror(name string) (*Mirror, error) {
+	return NewMirrorContext(context.Background(), name)
+}
 
-	log.Println("Mirror closed")
-	return nil
+// NewMirrorContext is like NewMirror but gives up on Tor and I2P setup when
+// ctx is done, returning ctx.Err().
+func NewMirrorContext(ctx context.Context, name string) (*Mirror, error) {
+	return NewMirrorWithConfig(ctx, name, DefaultMirrorConfig())
 }
 
-func NewMirror(name string) (*Mirror, error) {
+// NewMirrorWithConfig is like NewMirrorContext but applies cfg to every
+// service of the Mirror.
+func NewMirrorWithConfig(ctx context.Context, name string, cfg MirrorConfig) (*Mirror, error) {
 	log.Println("Creating new Mirror")
 	inner := meta.NewMetaListener()
+	inner.SetFloodGuard(cfg.Flood)
+	inner.SetCapture(cfg.Capture)
 	name = strings.TrimSpace(name)
 	name = strings.ReplaceAll(name, " ", "")
 	if name == "" {
@@ -70,34 +93,58 @@ func NewMirror(name string) (*Mirror, error) {
 	if err != nil {
 		port = "3000"
 	}
-	onions := make(map[string]*onramp.Onion)
-	if !DisableTor() {
-		onion, err := onramp.NewOnion("metalistener-" + name)
-		if err != nil {
+	ml := &Mirror{
+		MetaListener: inner,
+		Onions:       make(map[string]*onramp.Onion),
+		Garlics:      make(map[string]*onramp.Garlic),
+		transports:   make(map[string]map[string]TransportProvider),
+		name:         name,
+		config:       &cfg,
+		stopCh:       make(chan struct{}),
+	}
+	ml.mu.Lock()
+	for _, transport := range enabledTransports() {
+		if _, err := ml.ensureTransport(ctx, port, transport, "metalistener-"+name, cfg.KeyDir, nil); err != nil {
+			closers := ml.detachTransports()
+			ml.mu.Unlock()
+			closeTransports(context.Background(), closers)
+			inner.Close()
+			return nil, err
+		}
+		log.Printf("Created new %s session\n", transport)
+		ml.status.setState(transport, port, TransportConfigured, nil)
+	}
+	ml.mu.Unlock()
+	if cfg.ExpvarName != "" {
+		if err := ml.publishExpvar(cfg.ExpvarName); err != nil {
+			ml.Close()
 			return nil, err
 		}
-		log.Println("Created new Onion manager")
-		onions[port] = onion
 	}
-	garlics := make(map[string]*onramp.Garlic)
-	if !DisableI2P() {
-		garlic, err := onramp.NewGarlic("metalistener-"+name, "127.0.0.1:7656", onramp.OPT_WIDE)
-		if err != nil {
+	if cfg.StatsD != nil {
+		if err := ml.startStatsD(*cfg.StatsD); err != nil {
+			ml.Close()
 			return nil, err
 		}
-		log.Println("Created new Garlic manager")
-		garlics[port] = garlic
 	}
-
-	ml := &Mirror{
-		MetaListener: inner,
-		Onions:       onions,
-		Garlics:      garlics,
+	if cfg.HealthAddr != "" {
+		if err := ml.startHealthListener(cfg.HealthAddr); err != nil {
+			ml.Close()
+			return nil, err
+		}
+	}
+	if len(cfg.SAMAddrs) > 0 && !DisableI2P() {
+		go ml.watchSAM()
 	}
 	log.Printf("Mirror created with name: '%s' and port: '%s', '%s'\n", name, port, ml.MetaListener.Addr().String())
 	return ml, nil
 }
 
+// listenContext runs a blocking listener constructor, bounded by ctx.
+func listenContext(ctx context.Context, listen func() (net.Listener, error)) (net.Listener, error) {
+	return runContext(ctx, listen, func(listener net.Listener) { listener.Close() })
+}
+
 // parsePortFromName extracts the port from a name string, defaulting to "3000" if parsing fails.
 func parsePortFromName(name string) string {
 	_, port, err := net.SplitHostPort(name)
@@ -111,9 +158,25 @@ func parsePortFromName(name string) string {
 	return port
 }
 
-// setupLocalTCPListener creates and configures a local TCP listener with hardening.
-func setupLocalTCPListener(port string, metaListener *meta.MetaListener) (*net.TCPListener, error) {
-	localAddr := net.JoinHostPort("127.0.0.1", port)
+// defaultLocalHost is the interface the local plaintext listener binds to
+// when a service does not configure one.
+const defaultLocalHost = "127.0.0.1"
+
+// unixPrefix marks a LocalAddr as a Unix socket path rather than a host.
+const unixPrefix = "unix:"
+
+// setupLocalTCPListener creates and configures the local plaintext listener.
+// bindAddr is a host or IP to bind on port (defaulting to 127.0.0.1), or a
+// "unix:/path" Unix socket path, in which case port is only used as the ID.
+func (ml *Mirror) setupLocalTCPListener(port, bindAddr string, metaListener *meta.MetaListener) (net.Listener, error) {
+	if strings.HasPrefix(bindAddr, unixPrefix) {
+		return ml.setupLocalUnixListener(port, strings.TrimPrefix(bindAddr, unixPrefix), metaListener)
+	}
+	if bindAddr == "" {
+		bindAddr = defaultLocalHost
+	}
+
+	localAddr := net.JoinHostPort(bindAddr, port)
 	listener, err := net.Listen("tcp", localAddr)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create TCP listener on %s: %w", localAddr, err)
@@ -121,238 +184,200 @@ func setupLocalTCPListener(port string, metaListener *meta.MetaListener) (*net.T
 	tcpListener := listener.(*net.TCPListener)
 	hardenedListener, err := tcp.Config(*tcpListener)
 	if err != nil {
-		log.Fatal(err)
+		tcpListener.Close()
+		return nil, fmt.Errorf("failed to configure TCP listener on %s: %w", localAddr, err)
 	}
 	log.Printf("TCP listener created on %s\n", localAddr)
-	if err := metaListener.AddListener(port, hardenedListener); err != nil {
+	if err := ml.registerListener(metaListener, TransportTCP, port, port, hardenedListener); err != nil {
+		tcpListener.Close()
 		return nil, err
 	}
 	log.Printf("HTTP Local listener added http://%s\n", tcpListener.Addr())
 	return tcpListener, nil
 }
 
-// ensureHiddenServiceListeners creates onion and garlic listeners if they don't exist.
-func (ml *Mirror) ensureHiddenServiceListeners(port, listenerId string) error {
-	ml.mu.Lock()
-	defer ml.mu.Unlock()
-
-	// Check if onion and garlic listeners already exist
-	if ml.Onions[port] == nil && !DisableTor() {
-		log.Println("Creating new onion listener")
-		onion, err := onramp.NewOnion(listenerId)
-		if err != nil {
-			return err
-		}
-		log.Println("Onion listener created for port", port)
-		ml.Onions[port] = onion
-	}
-
-	if ml.Garlics[port] == nil && !DisableI2P() {
-		log.Println("Creating new garlic listener")
-		garlic, err := onramp.NewGarlic(listenerId, "127.0.0.1:7656", onramp.OPT_WIDE)
-		if err != nil {
-			return err
-		}
-		log.Println("Garlic listener created for port", port)
-		ml.Garlics[port] = garlic
-	}
-
-	return nil
-}
-
-// addOnionListener adds an onion listener to the meta listener, either TLS or regular.
-func (ml *Mirror) addOnionListener(port string, metaListener *meta.MetaListener, useTLS bool) error {
-	if DisableTor() {
-		return nil
+// setupLocalUnixListener creates the local plaintext listener on a Unix
+// socket, replacing a stale socket file left behind by a previous run.
+func (ml *Mirror) setupLocalUnixListener(port, path string, metaListener *meta.MetaListener) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
 	}
 
-	onionInstance, err := ml.getOnionInstance(port)
+	listener, err := net.Listen("unix", path)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to create Unix listener on %s: %w", path, err)
 	}
-
-	listener, protocol, err := ml.createOnionListener(onionInstance, useTLS)
-	if err != nil {
-		return err
+	log.Printf("Unix listener created on %s\n", path)
+	if err := ml.registerListener(metaListener, TransportTCP, port, port, listener); err != nil {
+		listener.Close()
+		return nil, err
 	}
-
-	return ml.registerOnionListener(listener, metaListener, protocol, useTLS)
+	log.Printf("HTTP Local listener added unix:%s\n", path)
+	return listener, nil
 }
 
-// getOnionInstance retrieves the onion instance for the specified port.
-func (ml *Mirror) getOnionInstance(port string) (*onramp.Onion, error) {
-	ml.mu.RLock()
-	defer ml.mu.RUnlock()
+// ensureHiddenServiceListeners sets up a session of every enabled hidden
+// transport for port, keeping the ones that already exist.
+func (ml *Mirror) ensureHiddenServiceListeners(ctx context.Context, port, listenerId, keyDir string, torCfg *TorConfig) error {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
 
-	onionInstance := ml.Onions[port]
-	if onionInstance == nil {
-		return nil, fmt.Errorf("no onion instance found for port %s", port)
+	for _, transport := range enabledTransports() {
+		if _, err := ml.ensureTransport(ctx, port, transport, listenerId, keyDir, torCfg); err != nil {
+			return err
+		}
 	}
-	return onionInstance, nil
+	return nil
 }
 
-// createOnionListener creates either a TLS or regular onion listener.
-func (ml *Mirror) createOnionListener(onionInstance *onramp.Onion, useTLS bool) (net.Listener, string, error) {
+// addTransportListener adds a listener of the hidden transport set up for
+// port to the meta listener, either TLS or regular.
+func (ml *Mirror) addTransportListener(ctx context.Context, port, transport string, metaListener *meta.MetaListener, useTLS bool) error {
+	provider, ok := ml.Transport(port, transport)
+	if !ok {
+		return fmt.Errorf("no %s transport found for port %s", transport, port)
+	}
+
 	var listener net.Listener
 	var err error
-	var protocol string
-
+	protocol := "http"
 	if useTLS {
-		listener, err = onionInstance.ListenTLS()
+		listener, err = provider.ListenTLS(ctx)
 		protocol = "https"
 	} else {
-		listener, err = onionInstance.Listen()
-		protocol = "http"
-	}
-
-	return listener, protocol, err
-}
-
-// registerOnionListener registers the onion listener with the meta listener and logs the result.
-func (ml *Mirror) registerOnionListener(listener net.Listener, metaListener *meta.MetaListener, protocol string, useTLS bool) error {
-	oid := fmt.Sprintf("onion-%s", listener.Addr().String())
-	if err := metaListener.AddListener(oid, listener); err != nil {
-		return err
-	}
-
-	tlsPrefix := ""
-	if useTLS {
-		tlsPrefix = "TLS"
+		listener, err = provider.Listen(ctx)
 	}
-	log.Printf("Onion%s listener added %s://%s\n", tlsPrefix, protocol, listener.Addr())
-	return nil
-}
-
-// addGarlicListener adds a garlic listener to the meta listener, either TLS or regular.
-func (ml *Mirror) addGarlicListener(port string, metaListener *meta.MetaListener, useTLS bool) error {
-	if DisableI2P() {
-		return nil
-	}
-
-	garlicInstance, err := ml.getGarlicInstance(port)
-	if err != nil {
-		return err
-	}
-
-	listener, protocol, err := ml.createGarlicListener(garlicInstance, useTLS)
 	if err != nil {
 		return err
 	}
-
-	return ml.registerGarlicListener(listener, metaListener, protocol, useTLS)
-}
-
-// getGarlicInstance retrieves the garlic instance for the specified port.
-func (ml *Mirror) getGarlicInstance(port string) (*onramp.Garlic, error) {
-	ml.mu.RLock()
-	defer ml.mu.RUnlock()
-
-	garlicInstance := ml.Garlics[port]
-	if garlicInstance == nil {
-		return nil, fmt.Errorf("no garlic instance found for port %s", port)
+	if ca := ClientAuthFromContext(ctx); ca != nil && useTLS {
+		listener = newVerifiedListener(listener, ca.HandshakeTimeout)
 	}
-	return garlicInstance, nil
-}
-
-// createGarlicListener creates either a TLS or regular garlic listener.
-func (ml *Mirror) createGarlicListener(garlicInstance *onramp.Garlic, useTLS bool) (net.Listener, string, error) {
-	var listener net.Listener
-	var err error
-	var protocol string
 
-	if useTLS {
-		listener, err = garlicInstance.ListenTLS()
-		protocol = "https"
-	} else {
-		listener, err = garlicInstance.Listen()
-		protocol = "http"
+	id := fmt.Sprintf("%s-%s", transport, listener.Addr().String())
+	if err := ml.registerListener(metaListener, transport, port, id, listener); err != nil {
+		return err
 	}
-
-	return listener, protocol, err
+	log.Printf("%s listener added %s://%s\n", transport, protocol, listener.Addr())
+	return nil
 }
 
-// registerGarlicListener registers the garlic listener with the meta listener and logs the result.
-func (ml *Mirror) registerGarlicListener(listener net.Listener, metaListener *meta.MetaListener, protocol string, useTLS bool) error {
-	gid := fmt.Sprintf("garlic-%s", listener.Addr().String())
-	if err := metaListener.AddListener(gid, listener); err != nil {
+// startTransport marks transport as starting, runs setup, and records a
+// failure as TransportDown so it is visible through Status.
+func (ml *Mirror) startTransport(transport, port string, setup func() error) error {
+	ml.status.setState(transport, port, TransportStarting, nil)
+	if err := setup(); err != nil {
+		ml.status.setState(transport, port, TransportDown, err)
 		return err
 	}
-
-	tlsPrefix := ""
-	if useTLS {
-		tlsPrefix = "TLS"
-	}
-	log.Printf("Garlic%s listener added %s://%s\n", tlsPrefix, protocol, listener.Addr())
 	return nil
 }
 
-// setupTLSListener creates and adds a TLS listener using wileedot if addr is provided.
-func setupTLSListener(name, addr string, metaListener *meta.MetaListener) error {
-	if addr == "" {
-		return nil
-	}
-
-	cfg := wileedot.Config{
-		Domain:         name,
-		AllowedDomains: []string{name},
-		CertDir:        certDir(),
-		Email:          addr,
-	}
-	tlsListener, err := wileedot.New(cfg)
-	if err != nil {
+// registerListener adds listener to metaListener under id, wrapped so its
+// traffic is counted, and marks the transport as up with the listener's
+// published address.
+func (ml *Mirror) registerListener(metaListener *meta.MetaListener, transport, port, id string, listener net.Listener) error {
+	counted := &countingListener{
+		Listener:  listener,
+		transport: transport,
+		counters:  ml.stats.get(transport),
+		limit:     int64(ml.cfg().MaxConns[transport]),
+	}
+	if err := metaListener.AddListener(id, counted); err != nil {
 		return err
 	}
-	tid := fmt.Sprintf("tls-%s", tlsListener.Addr().String())
-	if err := metaListener.AddListener(tid, tlsListener); err != nil {
-		return err
-	}
-	log.Printf("TLS listener added https://%s\n", tlsListener.Addr())
+	ml.status.setUp(transport, port, listener.Addr().String(), metaListener, id)
 	return nil
 }
 
-// Listen creates a comprehensive network listener that supports multiple protocols.
-// It sets up TCP, onion, garlic, and optionally TLS listeners.
-func (ml *Mirror) Listen(name, addr string) (net.Listener, error) {
-	log.Println("Starting Mirror Listener")
-
-	// Create a new MetaListener for this specific Listen() call
-	newMetaListener := meta.NewMetaListener()
-
-	// Parse port from name
-	port := parsePortFromName(name)
-	hiddenTls := hiddenTls(port)
-	log.Printf("Actual args: name: '%s' addr: '%s' certDir: '%s' hiddenTls: '%t'\n", name, addr, certDir(), hiddenTls)
-
-	// Setup local TCP listener
-	_, err := setupLocalTCPListener(port, newMetaListener)
+// setupTLSListener creates and adds a TLS listener using the Mirror's
+// CertProvider, and the companion HTTP listener if cfg.HTTPAddr is set. When
+// the service has additional domains, the listener's connections are split
+// by SNI: cfg.Name and unmatched names go to metaListener, and each extra
+// domain gets its own listener, retrievable with DomainListener. It returns
+// the listener created by the CertProvider.
+func (ml *Mirror) setupTLSListener(ctx context.Context, cfg ServiceConfig, port string, metaListener *meta.MetaListener) (net.Listener, error) {
+	if ml.cfg().CheckDNS {
+		if err := checkDNS(ctx, cfg.tlsDomains(), ml.cfg().PublicIPs); err != nil {
+			return nil, err
+		}
+	}
+	cfg.certs = ml.certTracker()
+	tlsListener, err := ml.certProvider().Listen(ctx, cfg)
 	if err != nil {
 		return nil, err
 	}
+	provided := tlsListener
+	store := DirCertStore(certDir())
+	if storer, ok := tlsListener.(certStorer); ok {
+		store = storer.CertStore()
+	}
+	cfg.certs.watch(store, cfg.tlsDomains(), ml.stopCh)
+	tid := fmt.Sprintf("tls-%s", tlsListener.Addr().String())
 
-	// Ensure hidden service listeners exist
-	listenerId := fmt.Sprintf("metalistener-%s-%s", name, port)
-	log.Println("Listener ID:", listenerId)
-	log.Println("Checking for existing onion and garlic listeners")
-
-	if err := ml.ensureHiddenServiceListeners(port, listenerId); err != nil {
-		return nil, err
+	if cfg.HTTPAddr != "" {
+		if err := ml.startHTTPListener(cfg, port, tlsListener); err != nil {
+			tlsListener.Close()
+			return nil, err
+		}
 	}
 
-	// Add onion and garlic listeners
-	if err := ml.addOnionListener(port, newMetaListener, hiddenTls); err != nil {
-		return nil, err
+	if len(cfg.Domains) > 0 {
+		router := NewSNIRouter(tlsListener)
+		domains := make(map[string]net.Listener, len(cfg.Domains))
+		for _, domain := range cfg.Domains {
+			domains[domain] = &countingListener{
+				Listener:  router.Route(domain),
+				transport: TransportTLS,
+				counters:  ml.stats.get(TransportTLS),
+				limit:     int64(ml.cfg().MaxConns[TransportTLS]),
+			}
+			log.Printf("TLS SNI route added https://%s\n", domain)
+		}
+		ml.mu.Lock()
+		if ml.domains == nil {
+			ml.domains = make(map[string]map[string]net.Listener)
+		}
+		ml.domains[port] = domains
+		ml.mu.Unlock()
+		tlsListener = router.Default()
 	}
 
-	if err := ml.addGarlicListener(port, newMetaListener, hiddenTls); err != nil {
+	if err := ml.registerListener(metaListener, TransportTLS, port, tid, tlsListener); err != nil {
 		return nil, err
 	}
+	log.Printf("TLS listener added https://%s\n", tlsListener.Addr())
+	return provided, nil
+}
 
-	// Setup TLS listener if email address is provided
-	if err := setupTLSListener(name, addr, newMetaListener); err != nil {
-		return nil, err
+// DomainListener returns the listener receiving clearnet TLS connections for
+// one of the additional domains configured in ServiceConfig.Domains of the
+// service on port.
+func (ml *Mirror) DomainListener(port, domain string) (net.Listener, error) {
+	ml.mu.RLock()
+	defer ml.mu.RUnlock()
+
+	listener, ok := ml.domains[port][domain]
+	if !ok {
+		return nil, fmt.Errorf("no TLS route for domain %s on port %s", domain, port)
 	}
+	return listener, nil
+}
 
-	return newMetaListener, nil
+// Listen creates a comprehensive network listener that supports multiple protocols.
+// It sets up TCP, onion, garlic, and optionally TLS listeners.
+func (ml *Mirror) Listen(name, addr string) (net.Listener, error) {
+	return ml.ListenContext(context.Background(), name, addr)
+}
+
+// ListenContext is like Listen but bounds Tor, I2P, and ACME setup by ctx.
+// If ctx is canceled or its deadline passes before setup completes, every
+// listener created so far is closed and ctx.Err() is returned.
+func (ml *Mirror) ListenContext(ctx context.Context, name, addr string) (net.Listener, error) {
+	return ml.AddServiceContext(ctx, parsePortFromName(name), ServiceConfig{
+		Name:  name,
+		Email: addr,
+	})
 }
 
 // Listen creates a new Mirror instance and sets up listeners for TLS, Onion, and Garlic.
@@ -361,11 +386,17 @@ func (ml *Mirror) Listen(name, addr string) (net.Listener, error) {
 // addr is the email address used for Let's Encrypt registration.
 // It is recommended to use a valid email address for production use.
 func Listen(name, addr string) (net.Listener, error) {
-	ml, err := NewMirror(name)
+	return ListenContext(context.Background(), name, addr)
+}
+
+// ListenContext is like Listen but bounds the whole setup, including Tor and
+// I2P session creation and ACME certificate retrieval, by ctx.
+func ListenContext(ctx context.Context, name, addr string) (net.Listener, error) {
+	ml, err := NewMirrorContext(ctx, name)
 	if err != nil {
 		return nil, err
 	}
-	return ml.Listen(name, addr)
+	return ml.ListenContext(ctx, name, addr)
 }
 
 func DisableTor() bool {
@@ -386,22 +417,11 @@ func DisableI2P() bool {
 	return false
 }
 
-// HIDDEN_TLS is a global variable that determines whether to use hidden TLS.
-// It is set to true by default, but can be overridden by the hiddenTls function.
-// If the port ends with "22", it will return false, indicating that hidden TLS should not be used.
-// This is a useful workaround for SSH connections, which commonly use port 22.
+// HIDDEN_TLS is the default for whether onion and garlic listeners use TLS.
+// It applies to services whose ServiceConfig.HiddenTLS is HiddenTLSAuto,
+// which includes every service set up through Listen.
 var HIDDEN_TLS = true
 
-func hiddenTls(port string) bool {
-	// Check if the port is 22, which is commonly used for SSH
-	if strings.HasSuffix(port, "22") {
-		log.Println("Port ends with 22, setting hiddenTls to false")
-		return false
-	}
-	// Default to true for other ports
-	return HIDDEN_TLS
-}
-
 var default_CERT_DIR = "./certs"
 
 // CERT_DIR is the directory where certificates are stored.
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/go-i2p/go-meta-listener/mirror"
+)
+
+// transports are the names allow accepts, as the Mirror reports them.
+var transports = []string{mirror.TransportTCP, mirror.TransportTLS, mirror.TransportOnion, mirror.TransportGarlic}
+
+// validAllow checks that allow only names known transports.
+func validAllow(allow []string) error {
+	for _, transport := range allow {
+		if !slices.Contains(transports, transport) {
+			return fmt.Errorf("unknown transport %q in allow, want %s", transport, strings.Join(transports, ", "))
+		}
+	}
+	return nil
+}
+
+// transportFilter lists the transports a service's connections may arrive
+// on; an empty filter admits every connection.
+type transportFilter []string
+
+// admits reports whether conn arrived on one of the filter's transports,
+// and the transport it arrived on. Connections that do not tell their
+// transport are only admitted by an empty filter.
+func (f transportFilter) admits(conn net.Conn) (bool, string) {
+	transport := ""
+	if tc, ok := conn.(mirror.TransportConn); ok {
+		transport = tc.Transport()
+	}
+	return len(f) == 0 || slices.Contains(f, transport), transport
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	netproxy "golang.org/x/net/proxy"
+)
+
+// dialTimeout bounds connecting to a target, including the SOCKS handshake
+// when the target is reached through a backend proxy.
+const dialTimeout = 10 * time.Second
+
+// Backend selection policies for services with several targets.
+const (
+	balanceRoundRobin = "round-robin"
+	balanceLeastConns = "least-conns"
+)
+
+// validBalance reports whether policy is a known selection policy; empty
+// selects round-robin.
+func validBalance(policy string) error {
+	switch policy {
+	case "", balanceRoundRobin, balanceLeastConns:
+		return nil
+	}
+	return fmt.Errorf("unknown balance %q, want %s or %s", policy, balanceRoundRobin, balanceLeastConns)
+}
+
+// contextDialer connects to targets; *net.Dialer and SOCKS5 dialers
+// implement it.
+type contextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// backendDialer returns the dialer TCP targets are reached through: the
+// SOCKS5 proxy at rawURL, such as socks5://127.0.0.1:9050 for Tor, or a
+// direct dialer when rawURL is empty. Host names are resolved by the proxy,
+// so targets can be .onion addresses.
+func backendDialer(rawURL string) (contextDialer, error) {
+	direct := &net.Dialer{Timeout: dialTimeout}
+	if rawURL == "" {
+		return direct, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backend proxy %q: %w", rawURL, err)
+	}
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return nil, fmt.Errorf("backend proxy %q is not a socks5:// URL", rawURL)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("backend proxy %q has no address", rawURL)
+	}
+	d, err := netproxy.FromURL(u, direct)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backend proxy %q: %w", rawURL, err)
+	}
+	return d.(contextDialer), nil
+}
+
+// backendTLSConfig returns the base configuration targets are dialed over
+// TLS with: their certificates are verified against the CAs in the PEM file
+// caPath, or against the system roots when it is empty.
+func backendTLSConfig(caPath string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caPath == "" {
+		return config, nil
+	}
+	data, err := os.ReadFile(caPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backend-ca: %w", err)
+	}
+	config.RootCAs = x509.NewCertPool()
+	if !config.RootCAs.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("backend-ca %s contains no PEM certificates", caPath)
+	}
+	return config, nil
+}
+
+// backendSet spreads a service's connections over its targets.
+type backendSet struct {
+	targets    []string
+	leastConns bool
+	// dialer reaches TCP targets; Unix socket targets are always local
+	dialer contextDialer
+	// tlsConfig, if set, re-encrypts the connections to the targets
+	tlsConfig *tls.Config
+	// idHeader, if set, is the HTTP header the connection ID is added to
+	idHeader string
+	// allow admits connections by the transport they arrived on
+	allow transportFilter
+	// ips admits connections by the IP address of their client
+	ips ipFilter
+	// forwardHeaders adds X-Forwarded-For and X-Forwarded-Proto
+	forwardHeaders bool
+	// sendProxy, if set, is the PROXY protocol version sent to targets
+	sendProxy string
+	// scrub removes identifying headers from the targets' HTTP responses
+	scrub responseScrub
+	// altSvc, if set, returns the headers advertising the service's hidden
+	// mirrors in the responses to clearnet requests
+	altSvc func(*http.Request) http.Header
+	// shadow, if set, is a target that gets a copy of what clients send
+	shadow string
+	// page, if set, answers HTTP clients while no target can be reached
+	page *maintenancePage
+	// down is set while page is served instead of dialing the targets
+	down atomic.Bool
+	// stop is closed by close to end the health checks of a replaced set
+	stop      chan struct{}
+	closeOnce sync.Once
+	next      atomic.Uint64
+	// active counts the open connections of each target
+	active []atomic.Int64
+}
+
+func newBackendSet(targets []string, policy string, dialer contextDialer) *backendSet {
+	return &backendSet{
+		targets:    targets,
+		leastConns: policy == balanceLeastConns,
+		dialer:     dialer,
+		stop:       make(chan struct{}),
+		active:     make([]atomic.Int64, len(targets)),
+	}
+}
+
+// close ends the health checks of b once it no longer receives
+// connections.
+func (b *backendSet) close() {
+	b.closeOnce.Do(func() { close(b.stop) })
+}
+
+// order returns the indexes of the targets in the order a new connection
+// should try them: the selected target first, then the others as fallbacks.
+func (b *backendSet) order() []int {
+	start := int(b.next.Add(1)-1) % len(b.targets)
+	if b.leastConns {
+		// Round-robin breaks ties so idle targets share the load.
+		best := start
+		for i := range b.targets {
+			j := (start + i) % len(b.targets)
+			if b.active[j].Load() < b.active[best].Load() {
+				best = j
+			}
+		}
+		start = best
+	}
+	order := make([]int, len(b.targets))
+	for i := range order {
+		order[i] = (start + i) % len(b.targets)
+	}
+	return order
+}
+
+// acquire counts a connection to target i, returning the function that
+// ends it.
+func (b *backendSet) acquire(i int) func() {
+	b.active[i].Add(1)
+	return func() { b.active[i].Add(-1) }
+}
+
+// connect opens a plain connection to target.
+func (b *backendSet) connect(target string) (net.Conn, error) {
+	if path, ok := strings.CutPrefix(target, unixPrefix); ok {
+		return net.DialTimeout("unix", path, dialTimeout)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	return b.dialer.DialContext(ctx, "tcp", target)
+}
+
+// open connects to target for client, sending the PROXY header and starting
+// TLS as b is configured to.
+func (b *backendSet) open(target string, client net.Conn) (net.Conn, error) {
+	conn, err := b.connect(target)
+	if err != nil {
+		return nil, err
+	}
+	if b.sendProxy != "" {
+		// The header precedes the TLS handshake with the target
+		if err := writeProxyHeader(conn, b.sendProxy, client.RemoteAddr(), client.LocalAddr()); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("PROXY header: %w", err)
+		}
+	}
+	if b.tlsConfig != nil {
+		return b.handshake(conn, target)
+	}
+	return conn, nil
+}
+
+// dial connects to the selected target for client, falling back to the
+// others in turn when it cannot be reached, and logs to clog. It returns the
+// target connected to and the function that ends the connection's count
+// against it. When no target can be reached and b has a maintenance page,
+// dial returns errBackendsDown until one is back.
+func (b *backendSet) dial(clog *logrus.Entry, client net.Conn) (net.Conn, string, func(), error) {
+	if b.down.Load() {
+		return nil, "", nil, errBackendsDown
+	}
+	var err error
+	for _, i := range b.order() {
+		target := b.targets[i]
+		var conn net.Conn
+		conn, err = b.open(target, client)
+		if err == nil {
+			clog.Debugf("Connected to target %s", target)
+			return conn, target, b.acquire(i), nil
+		}
+		clog.Warnf("Failed to connect to target %s: %v", target, err)
+	}
+	b.markDown(clog)
+	return nil, "", nil, err
+}
+
+// handshake starts TLS on conn, the connection to target, verifying the
+// target's certificate for the configured server name or for its host.
+func (b *backendSet) handshake(conn net.Conn, target string) (net.Conn, error) {
+	config := b.tlsConfig
+	if config.ServerName == "" {
+		host, _, _ := net.SplitHostPort(target)
+		config = config.Clone()
+		config.ServerName = host
+	}
+	tlsConn := tls.Client(conn, config)
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake: %w", err)
+	}
+	return tlsConn, nil
+}
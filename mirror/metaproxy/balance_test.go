@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestBackendSetRoundRobin verifies that round-robin rotates the first
+// target and keeps the others as fallbacks.
+func TestBackendSetRoundRobin(t *testing.T) {
+	b := newBackendSet([]string{"a:1", "b:1", "c:1"}, "", &net.Dialer{})
+	for _, want := range [][]int{{0, 1, 2}, {1, 2, 0}, {2, 0, 1}, {0, 1, 2}} {
+		if got := b.order(); !reflect.DeepEqual(got, want) {
+			t.Errorf("order() = %v, want %v", got, want)
+		}
+	}
+}
+
+// TestBackendSetLeastConns verifies that least-conns picks the target with
+// the fewest open connections.
+func TestBackendSetLeastConns(t *testing.T) {
+	b := newBackendSet([]string{"a:1", "b:1", "c:1"}, balanceLeastConns, &net.Dialer{})
+	releaseA := b.acquire(0)
+	b.acquire(0)
+	b.acquire(2)
+	for i := 0; i < 3; i++ {
+		if got := b.order()[0]; got != 1 {
+			t.Errorf("picked %d, want 1", got)
+		}
+	}
+	releaseA()
+	b.acquire(1)
+	b.acquire(1)
+	if got := b.order()[0]; got != 0 && got != 2 {
+		t.Errorf("picked %d, want 0 or 2", got)
+	}
+}
+
+// TestBackendSetFailover verifies that dial falls back to a reachable
+// target.
+func TestBackendSetFailover(t *testing.T) {
+	up := backend(t, "web")
+	down := freePort(t)
+	b := newBackendSet([]string{net.JoinHostPort("127.0.0.1", strconv.Itoa(down)), up}, "", &net.Dialer{})
+	conn, _, release, err := b.dial(connLog("test"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if n := b.active[1].Load(); n != 1 {
+		t.Errorf("reachable target has %d connections, want 1", n)
+	}
+	release()
+	if n := b.active[1].Load(); n != 0 {
+		t.Errorf("released target has %d connections, want 0", n)
+	}
+}
+
+// socksServer runs a minimal SOCKS5 server that connects every CONNECT
+// request to upstream, sending the requested addresses on requests.
+func socksServer(t *testing.T, upstream string) (string, <-chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	requests := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				// Greeting: version, methods; accept "no authentication"
+				head := make([]byte, 2)
+				if _, err := io.ReadFull(conn, head); err != nil {
+					return
+				}
+				io.CopyN(io.Discard, conn, int64(head[1]))
+				conn.Write([]byte{5, 0})
+				// Request: version, CONNECT, reserved, domain name address
+				req := make([]byte, 5)
+				if _, err := io.ReadFull(conn, req); err != nil || req[3] != 3 {
+					return
+				}
+				host := make([]byte, int(req[4])+2)
+				if _, err := io.ReadFull(conn, host); err != nil {
+					return
+				}
+				port := binary.BigEndian.Uint16(host[len(host)-2:])
+				requests <- net.JoinHostPort(string(host[:len(host)-2]), strconv.Itoa(int(port)))
+				target, err := net.Dial("tcp", upstream)
+				if err != nil {
+					conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer target.Close()
+				conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	return listener.Addr().String(), requests
+}
+
+// TestBackendProxy verifies that targets are reached through the SOCKS5
+// backend proxy, which resolves their names.
+func TestBackendProxy(t *testing.T) {
+	addr, requests := socksServer(t, backend(t, "tor"))
+	dialer, err := backendDialer("socks5://" + addr)
+	if err != nil {
+		t.Fatalf("backendDialer: %v", err)
+	}
+	b := newBackendSet([]string{"example2345.onion:80"}, "", dialer)
+	conn, _, release, err := b.dial(connLog("test"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer release()
+	defer conn.Close()
+	got, err := io.ReadAll(conn)
+	if err != nil || string(got) != "tor" {
+		t.Errorf("read %q, %v; want tor", got, err)
+	}
+	if req := <-requests; req != "example2345.onion:80" {
+		t.Errorf("proxy asked for %s, want example2345.onion:80", req)
+	}
+}
+
+// TestBackendDialerErrors verifies that unusable proxy URLs are rejected.
+func TestBackendDialerErrors(t *testing.T) {
+	for _, rawURL := range []string{"http://127.0.0.1:8080", "socks5://", "127.0.0.1:9050", "%"} {
+		if _, err := backendDialer(rawURL); err == nil {
+			t.Errorf("%q: backendDialer succeeded", rawURL)
+		}
+	}
+}
+
+// TestBackendTLS verifies that targets with backend TLS are dialed over
+// TLS, verified against backend-ca for the server name.
+func TestBackendTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "tls "+r.TLS.ServerName)
+	}))
+	defer server.Close()
+	caPath := filepath.Join(t.TempDir(), "backend.pem")
+	if err := os.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	target := strings.TrimPrefix(server.URL, "https://")
+
+	config, err := backendTLSConfig(caPath)
+	if err != nil {
+		t.Fatalf("backendTLSConfig: %v", err)
+	}
+	b := newBackendSet([]string{target}, "", &net.Dialer{})
+	b.tlsConfig = config.Clone()
+	b.tlsConfig.ServerName = "example.com"
+	conn, _, release, err := b.dial(connLog("test"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer release()
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.0\r\nHost: example.com\r\n\r\n")
+	got, err := io.ReadAll(conn)
+	if err != nil || !strings.HasSuffix(string(got), "tls example.com") {
+		t.Errorf("read %q, %v; want a response over TLS for example.com", got, err)
+	}
+
+	// The test certificate is not trusted by the system roots
+	system, err := backendTLSConfig("")
+	if err != nil {
+		t.Fatalf("backendTLSConfig without backend-ca: %v", err)
+	}
+	untrusted := newBackendSet([]string{target}, "", &net.Dialer{})
+	untrusted.tlsConfig = system
+	if conn, _, _, err := untrusted.dial(connLog("test"), nil); err == nil {
+		conn.Close()
+		t.Error("dial verified an untrusted target")
+	}
+
+	garbage := filepath.Join(t.TempDir(), "garbage.pem")
+	os.WriteFile(garbage, []byte("not a certificate"), 0o600)
+	for _, path := range []string{garbage, filepath.Join(t.TempDir(), "missing.pem")} {
+		if _, err := backendTLSConfig(path); err == nil {
+			t.Errorf("backendTLSConfig(%s) succeeded", path)
+		}
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-i2p/go-meta-listener/mirror"
+)
+
+// samAddr is the SAM bridge the Mirror's I2P sessions use without
+// sam-addrs.
+const samAddr = "127.0.0.1:7656"
+
+// checkReport collects the results of -check.
+type checkReport struct {
+	w        io.Writer
+	failures int
+	warnings int
+}
+
+func (r *checkReport) ok(format string, args ...any) {
+	fmt.Fprintf(r.w, "ok    %s\n", fmt.Sprintf(format, args...))
+}
+
+func (r *checkReport) warn(format string, args ...any) {
+	r.warnings++
+	fmt.Fprintf(r.w, "warn  %s\n", fmt.Sprintf(format, args...))
+}
+
+func (r *checkReport) fail(format string, args ...any) {
+	r.failures++
+	fmt.Fprintf(r.w, "FAIL  %s\n", fmt.Sprintf(format, args...))
+}
+
+// checker runs the checks of -check. Its probes are replaced in tests.
+type checker struct {
+	// lookPath finds an executable, as exec.LookPath does
+	lookPath func(string) (string, error)
+	// dial connects to a backend or a local daemon
+	dial func(ctx context.Context, network, address string) (net.Conn, error)
+	// root reports whether ports below 1024 can be bound
+	root bool
+}
+
+func newChecker() *checker {
+	var d net.Dialer
+	return &checker{lookPath: exec.LookPath, dial: d.DialContext, root: os.Geteuid() == 0}
+}
+
+// run checks cfg, whose validation failed with validateErr, and writes a
+// report to w. With backends, every target is dialed. It reports whether
+// the configuration is free of failures; nothing is bound.
+func (c *checker) run(cfg proxyConfig, validateErr error, backends bool, w io.Writer) bool {
+	r := &checkReport{w: w}
+	if validateErr != nil {
+		r.fail("configuration: %v", validateErr)
+		return false
+	}
+	r.ok("configuration: %d services", len(cfg.Services))
+
+	c.checkDomains(r, cfg)
+	c.checkPorts(r, cfg)
+	checkAccess(r, cfg)
+	checkDir(r, "certdir", cfg.CertDir, "private keys")
+	if cfg.KeyDir != "" {
+		checkDir(r, "keydir", cfg.KeyDir, "private keys")
+	}
+	if cfg.CaptureDir != "" {
+		checkDir(r, "capture-dir", cfg.CaptureDir, "the clients' traffic")
+	}
+	checkClientAuth(r, cfg)
+	checkBackendTLS(r, cfg)
+	checkMaintenancePages(r, cfg)
+	if backends {
+		c.checkBackends(r, cfg)
+	}
+	c.checkTransports(r, cfg)
+
+	fmt.Fprintf(w, "%d failures, %d warnings\n", r.failures, r.warnings)
+	return r.failures == 0
+}
+
+// checkDomains checks that certificates can be issued for the domains.
+// Passthrough services have no certificates, so their routes may name
+// wildcards.
+func (c *checker) checkDomains(r *checkReport, cfg proxyConfig) {
+	names := []string{cfg.Domain}
+	for _, svc := range cfg.Services {
+		if !svc.Passthrough {
+			names = append(names, svc.domains()...)
+		}
+	}
+	for _, name := range names {
+		if err := validDomain(name); err != nil {
+			r.fail("domain %q: %v", name, err)
+		} else {
+			r.ok("domain %s", name)
+		}
+	}
+	if cfg.Email == "" {
+		r.warn("email is not set, so no clearnet TLS listeners are created")
+	}
+}
+
+// validDomain reports whether name is a fully qualified host name that
+// certificates can be issued for.
+func validDomain(name string) error {
+	if name == "" {
+		return errors.New("empty")
+	}
+	if net.ParseIP(name) != nil {
+		return errors.New("an IP address, not a domain name")
+	}
+	if len(name) > 253 {
+		return errors.New("longer than 253 characters")
+	}
+	labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+	if len(labels) < 2 {
+		return errors.New("not fully qualified")
+	}
+	for _, label := range labels {
+		if label == "" || len(label) > 63 {
+			return fmt.Errorf("label %q must be 1 to 63 characters", label)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("label %q starts or ends with a hyphen", label)
+		}
+		for _, ch := range label {
+			if !(ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || ch == '-') {
+				return fmt.Errorf("label %q contains %q", label, ch)
+			}
+		}
+	}
+	return nil
+}
+
+// checkPorts warns about ports that need privileges to bind.
+func (c *checker) checkPorts(r *checkReport, cfg proxyConfig) {
+	for _, svc := range cfg.Services {
+		if cfg.LocalTCP && svc.ListenPort < 1024 && !c.root {
+			r.warn("service %d: the local listener needs root or CAP_NET_BIND_SERVICE", svc.ListenPort)
+		}
+		if cfg.Email == "" {
+			continue
+		}
+		addr := cfg.tlsAddr(svc)
+		if addr == "" {
+			addr = ":443"
+		}
+		_, port, _ := net.SplitHostPort(addr)
+		if p, err := net.LookupPort("tcp", port); err == nil && p < 1024 && !c.root {
+			r.warn("service %d: the TLS listener on %s needs root, CAP_NET_BIND_SERVICE, or socket activation", svc.ListenPort, addr)
+		}
+	}
+}
+
+// checkAccess warns about services whose allow list names no transport
+// they are published on, so they accept no connection, and about routes for
+// transports a service is not published on, which receive none.
+func checkAccess(r *checkReport, cfg proxyConfig) {
+	published := map[string]bool{
+		mirror.TransportTCP:    cfg.LocalTCP,
+		mirror.TransportTLS:    cfg.Email != "",
+		mirror.TransportOnion:  cfg.Tor && os.Getenv("DISABLE_TOR") == "",
+		mirror.TransportGarlic: cfg.I2P && os.Getenv("DISABLE_I2P") == "",
+	}
+	for _, svc := range cfg.Services {
+		if len(svc.Allow) > 0 && !slices.ContainsFunc(svc.Allow, func(t string) bool { return published[t] }) {
+			r.warn("service %d: allows only %s, which it is not published on", svc.ListenPort, strings.Join(svc.Allow, ", "))
+		}
+		for _, route := range svc.Routes {
+			if route.Transport != "" && !published[route.Transport] && !(route.Transport == mirror.TransportTLS && svc.Passthrough) {
+				r.warn("service %d: routes %s, which it is not published on", svc.ListenPort, route.name())
+			}
+		}
+	}
+}
+
+// checkDir checks that dir exists and is writable, or can be created, and
+// warns if other users can reach what it holds.
+func checkDir(r *checkReport, name, dir, holds string) {
+	info, err := os.Stat(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		parent := filepath.Dir(filepath.Clean(dir))
+		for {
+			if _, err := os.Stat(parent); err == nil || parent == filepath.Dir(parent) {
+				break
+			}
+			parent = filepath.Dir(parent)
+		}
+		if err := writable(parent); err != nil {
+			r.fail("%s %s does not exist and cannot be created: %v", name, dir, err)
+		} else {
+			r.ok("%s %s will be created", name, dir)
+		}
+		return
+	}
+	if err != nil {
+		r.fail("%s %s: %v", name, dir, err)
+		return
+	}
+	if !info.IsDir() {
+		r.fail("%s %s is not a directory", name, dir)
+		return
+	}
+	if err := writable(dir); err != nil {
+		r.fail("%s %s is not writable: %v", name, dir, err)
+		return
+	}
+	if info.Mode().Perm()&0o077 != 0 {
+		r.warn("%s %s is accessible to other users (mode %04o); it holds %s", name, dir, info.Mode().Perm(), holds)
+		return
+	}
+	r.ok("%s %s", name, dir)
+}
+
+// writable reports whether files can be created in dir.
+func writable(dir string) error {
+	f, err := os.CreateTemp(dir, ".metaproxy-check-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkClientAuth checks that the client CA and CRL files can be loaded.
+func checkClientAuth(r *checkReport, cfg proxyConfig) {
+	if cfg.ClientCA == "" {
+		return
+	}
+	if _, err := newClientAuth(cfg); err != nil {
+		r.fail("client certificates: %v", err)
+		return
+	}
+	r.ok("client certificates: required, issued by %s", cfg.ClientCA)
+}
+
+// checkBackendTLS checks that the backend CA file can be loaded when a
+// service or route dials its targets over TLS.
+func checkBackendTLS(r *checkReport, cfg proxyConfig) {
+	if !slices.ContainsFunc(cfg.Services, func(svc serviceConfig) bool {
+		return svc.BackendTLS.Enabled || slices.ContainsFunc(svc.Routes, func(route routeConfig) bool { return route.BackendTLS.Enabled })
+	}) {
+		return
+	}
+	if _, err := backendTLSConfig(cfg.BackendCA); err != nil {
+		r.fail("backend TLS: %v", err)
+		return
+	}
+	if cfg.BackendCA == "" {
+		r.ok("backend TLS: targets verified against the system roots")
+		return
+	}
+	r.ok("backend TLS: targets verified against %s", cfg.BackendCA)
+}
+
+// checkMaintenancePages checks that the maintenance page of every service
+// can be read.
+func checkMaintenancePages(r *checkReport, cfg proxyConfig) {
+	for _, svc := range cfg.Services {
+		if svc.MaintenancePage == "" {
+			continue
+		}
+		if _, err := loadMaintenancePage(svc.MaintenancePage); err != nil {
+			r.fail("service %d: %v", svc.ListenPort, err)
+			continue
+		}
+		r.ok("service %d: maintenance page %s", svc.ListenPort, svc.MaintenancePage)
+	}
+}
+
+// checkBackends dials every target and shadow target, through the backend
+// proxy if set. Unreachable shadow targets are only warned about.
+func (c *checker) checkBackends(r *checkReport, cfg proxyConfig) {
+	dialer, err := backendDialer(cfg.BackendProxy)
+	if err != nil {
+		r.fail("backend-proxy: %v", err)
+		return
+	}
+	dial := c.dial
+	if cfg.BackendProxy != "" {
+		dial = dialer.DialContext
+	}
+	probe := func(target string) error {
+		ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+		defer cancel()
+		var conn net.Conn
+		var err error
+		if path, ok := strings.CutPrefix(target, unixPrefix); ok {
+			conn, err = c.dial(ctx, "unix", path)
+		} else {
+			conn, err = dial(ctx, "tcp", target)
+		}
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+	for _, svc := range cfg.Services {
+		targets := slices.Clone(svc.Targets)
+		var shadows []string
+		if svc.Shadow != "" {
+			shadows = append(shadows, svc.Shadow)
+		}
+		for _, route := range svc.Routes {
+			targets = append(targets, route.Targets...)
+			if route.Shadow != "" {
+				shadows = append(shadows, route.Shadow)
+			}
+		}
+		for _, target := range targets {
+			if err := probe(target); err != nil {
+				r.fail("service %d: target %s is unreachable: %v", svc.ListenPort, target, err)
+				continue
+			}
+			r.ok("service %d: target %s", svc.ListenPort, target)
+		}
+		// Clients do not depend on shadow targets
+		for _, shadow := range shadows {
+			if err := probe(shadow); err != nil {
+				r.warn("service %d: shadow target %s is unreachable: %v", svc.ListenPort, shadow, err)
+				continue
+			}
+			r.ok("service %d: shadow target %s", svc.ListenPort, shadow)
+		}
+	}
+}
+
+// checkTransports checks that Tor can be started and that an I2P router's
+// SAM bridge is reachable, for the transports that are enabled.
+func (c *checker) checkTransports(r *checkReport, cfg proxyConfig) {
+	if cfg.Tor && os.Getenv("DISABLE_TOR") == "" {
+		if path, err := c.lookPath("tor"); err != nil {
+			r.fail("tor: no tor executable on the PATH to run onion services with; install Tor or set tor = false")
+		} else {
+			r.ok("tor: %s", path)
+		}
+	}
+	if cfg.I2P && os.Getenv("DISABLE_I2P") == "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		addrs := cfg.SAMAddrs
+		if len(addrs) == 0 {
+			addrs = []string{samAddr}
+		}
+		errs := make([]error, len(addrs))
+		reachable := false
+		for i, addr := range addrs {
+			conn, err := c.dial(ctx, "tcp", addr)
+			if err == nil {
+				conn.Close()
+				reachable = true
+			}
+			errs[i] = err
+		}
+		for i, addr := range addrs {
+			switch {
+			case errs[i] == nil:
+				r.ok("i2p: SAM bridge %s", addr)
+			case reachable:
+				r.warn("i2p: SAM bridge %s is unreachable: %v; I2P cannot fail over to it", addr, errs[i])
+			default:
+				r.fail("i2p: SAM bridge %s is unreachable: %v; start an I2P router with SAM enabled or set i2p = false", addr, errs[i])
+			}
+		}
+	}
+}
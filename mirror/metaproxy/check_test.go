@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestValidDomain verifies which names certificates can be issued for.
+func TestValidDomain(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"example.org":                    true,
+		"www.example.org.":               true,
+		"xn--bcher-kva.ch":               true,
+		"":                               false,
+		"localhost":                      false,
+		"192.0.2.1":                      false,
+		"bad_name.org":                   false,
+		"-example.org":                   false,
+		"example..org":                   false,
+		strings.Repeat("a", 64) + ".org": false,
+	} {
+		if err := validDomain(name); (err == nil) != valid {
+			t.Errorf("validDomain(%q) = %v, want valid %t", name, err, valid)
+		}
+	}
+}
+
+// TestCheck verifies the report of -check with stubbed Tor and I2P probes.
+func TestCheck(t *testing.T) {
+	up := backend(t, "web")
+	certDir := filepath.Join(t.TempDir(), "certs")
+	keyDir := t.TempDir()
+	os.Chmod(keyDir, 0o755)
+	cfg := proxyConfig{
+		Domain:   "example.org",
+		CertDir:  certDir,
+		KeyDir:   keyDir,
+		MaxConns: 10,
+		LocalTCP: true,
+		Tor:      true,
+		I2P:      true,
+		Services: []serviceConfig{
+			{ListenPort: 80, Targets: []string{up}},
+			{ListenPort: 8443, Targets: []string{net.JoinHostPort("127.0.0.1", "1")}, Domains: []string{"bad_name.example.org"}},
+			{ListenPort: 9000, Targets: []string{up}, Allow: []string{"tls"}},
+			{ListenPort: 9001, Targets: []string{up}, Routes: []routeConfig{{Transport: "tls", Targets: []string{up}}}},
+		},
+	}
+	var d net.Dialer
+	c := &checker{
+		lookPath: func(string) (string, error) { return "/usr/bin/tor", nil },
+		dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			if address == samAddr {
+				return nil, errors.New("connection refused")
+			}
+			return d.DialContext(ctx, network, address)
+		},
+	}
+
+	var out bytes.Buffer
+	if c.run(cfg, cfg.validate(), true, &out) {
+		t.Error("check passed with an invalid domain, an unreachable target, and no SAM bridge")
+	}
+	report := out.String()
+	for _, want := range []string{
+		"ok    domain example.org\n",
+		`FAIL  domain "bad_name.example.org"`,
+		"warn  email is not set",
+		"warn  service 80: the local listener needs root",
+		"warn  service 9000: allows only tls, which it is not published on\n",
+		"warn  service 9001: routes tls connections, which it is not published on\n",
+		"ok    certdir " + certDir + " will be created\n",
+		"warn  keydir " + keyDir + " is accessible to other users",
+		"ok    service 80: target " + up + "\n",
+		"FAIL  service 8443: target 127.0.0.1:1 is unreachable",
+		"ok    tor: /usr/bin/tor\n",
+		"FAIL  i2p: SAM bridge 127.0.0.1:7656 is unreachable",
+		"3 failures, 5 warnings\n",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report lacks %q:\n%s", want, report)
+		}
+	}
+	if _, err := os.Stat(certDir); !os.IsNotExist(err) {
+		t.Errorf("check created the certificate directory: %v", err)
+	}
+
+	out.Reset()
+	cfg.Services = cfg.Services[:1]
+	cfg.Services[0].ListenPort = 8080
+	cfg.I2P = false
+	cfg.Email = "admin@example.org"
+	c.root = true
+	if !c.run(cfg, cfg.validate(), false, &out) {
+		t.Errorf("check failed:\n%s", out.String())
+	}
+
+	// A bridge to fail over to is enough
+	out.Reset()
+	cfg.I2P = true
+	cfg.SAMAddrs = []string{samAddr, up}
+	if !c.run(cfg, cfg.validate(), false, &out) {
+		t.Errorf("check failed with a reachable SAM bridge:\n%s", out.String())
+	}
+	for _, want := range []string{
+		"warn  i2p: SAM bridge 127.0.0.1:7656 is unreachable",
+		"ok    i2p: SAM bridge " + up + "\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("report lacks %q:\n%s", want, out.String())
+		}
+	}
+
+	out.Reset()
+	cfg.MaxConns = 0
+	if c.run(cfg, cfg.validate(), false, &out) || !strings.HasPrefix(out.String(), "FAIL  configuration: max-conns") {
+		t.Errorf("invalid configuration passed:\n%s", out.String())
+	}
+}
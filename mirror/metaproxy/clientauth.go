@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-i2p/go-meta-listener/mirror"
+	"golang.org/x/crypto/ocsp"
+)
+
+// Modes of client-ocsp: with soft, clients are let in when the responder
+// cannot be reached; with hard, they are refused.
+const (
+	ocspSoft = "soft"
+	ocspHard = "hard"
+)
+
+const (
+	// ocspTimeout bounds a query to an OCSP responder.
+	ocspTimeout = 5 * time.Second
+	// ocspDefaultTTL is how long a good response without a next update
+	// time is trusted.
+	ocspDefaultTTL = time.Hour
+)
+
+// newClientAuth returns the mutual TLS settings of the clearnet listeners,
+// or nil when client-ca is not set.
+func newClientAuth(cfg proxyConfig) (*mirror.ClientAuth, error) {
+	if cfg.ClientCA == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(cfg.ClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client-ca: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("client-ca %s contains no PEM certificates", cfg.ClientCA)
+	}
+	auth := &mirror.ClientAuth{CAs: pool}
+	if cfg.ClientCRL == "" && cfg.ClientOCSP == "" {
+		return auth, nil
+	}
+	rc := &revocationChecker{
+		crlPath:  cfg.ClientCRL,
+		ocspMode: cfg.ClientOCSP,
+		client:   &http.Client{Timeout: ocspTimeout},
+		ocspGood: make(map[string]time.Time),
+	}
+	if rc.crlPath != "" {
+		if _, err := rc.loadCRLs(); err != nil {
+			return nil, err
+		}
+	}
+	auth.Verify = rc.verify
+	return auth, nil
+}
+
+// revocationChecker rejects client certificates revoked by a CRL file or by
+// their OCSP responder.
+type revocationChecker struct {
+	// crlPath is re-read when it changes, so a renewed CRL applies
+	// without a restart
+	crlPath  string
+	ocspMode string
+	client   *http.Client
+
+	mu        sync.Mutex
+	crls      []*x509.RevocationList
+	crlLoaded time.Time
+	// ocspGood holds when the good responses, keyed by ocspKey, expire
+	ocspGood map[string]time.Time
+}
+
+// verify checks the leaf of the first verified chain against its issuer's
+// revocation information.
+func (rc *revocationChecker) verify(chains [][]*x509.Certificate) error {
+	if len(chains) == 0 || len(chains[0]) < 2 {
+		return nil
+	}
+	leaf, issuer := chains[0][0], chains[0][1]
+	if rc.crlPath != "" {
+		if err := rc.checkCRL(leaf, issuer); err != nil {
+			return err
+		}
+	}
+	if rc.ocspMode != "" {
+		return rc.checkOCSP(leaf, issuer)
+	}
+	return nil
+}
+
+// loadCRLs returns the CRLs of the file, reading it again if it was
+// modified since it was last read.
+func (rc *revocationChecker) loadCRLs() ([]*x509.RevocationList, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	info, err := os.Stat(rc.crlPath)
+	if err != nil {
+		return rc.crls, fmt.Errorf("failed to read client-crl: %w", err)
+	}
+	if rc.crls != nil && info.ModTime().Equal(rc.crlLoaded) {
+		return rc.crls, nil
+	}
+	data, err := os.ReadFile(rc.crlPath)
+	if err != nil {
+		return rc.crls, fmt.Errorf("failed to read client-crl: %w", err)
+	}
+	crls, err := parseCRLs(data)
+	if err != nil {
+		return rc.crls, fmt.Errorf("client-crl %s: %w", rc.crlPath, err)
+	}
+	if rc.crls != nil {
+		log.Printf("Reloaded client-crl %s", rc.crlPath)
+	}
+	rc.crls, rc.crlLoaded = crls, info.ModTime()
+	return crls, nil
+}
+
+// parseCRLs parses the PEM "X509 CRL" blocks of data, or data as a single
+// DER CRL.
+func parseCRLs(data []byte) ([]*x509.RevocationList, error) {
+	var crls []*x509.RevocationList
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "X509 CRL" {
+			continue
+		}
+		crl, err := x509.ParseRevocationList(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		crls = append(crls, crl)
+	}
+	if len(crls) > 0 {
+		return crls, nil
+	}
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, fmt.Errorf("no CRL in PEM or DER form: %w", err)
+	}
+	return []*x509.RevocationList{crl}, nil
+}
+
+// checkCRL rejects leaf if a CRL signed by issuer lists it. A CRL file that
+// became unreadable keeps the CRLs last read in force.
+func (rc *revocationChecker) checkCRL(leaf, issuer *x509.Certificate) error {
+	crls, err := rc.loadCRLs()
+	if err != nil {
+		if crls == nil {
+			return err
+		}
+		log.Warnf("Using the previous client CRLs: %v", err)
+	}
+	for _, crl := range crls {
+		if !bytes.Equal(crl.RawIssuer, leaf.RawIssuer) || crl.CheckSignatureFrom(issuer) != nil {
+			continue
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			if entry.SerialNumber.Cmp(leaf.SerialNumber) == 0 {
+				return fmt.Errorf("client certificate %s (serial %s) is revoked", leaf.Subject, leaf.SerialNumber)
+			}
+		}
+	}
+	return nil
+}
+
+// checkOCSP asks the OCSP responder of leaf whether it is revoked. Good
+// answers are remembered until the responder's next update. Certificates
+// naming no responder are not checked.
+func (rc *revocationChecker) checkOCSP(leaf, issuer *x509.Certificate) error {
+	if len(leaf.OCSPServer) == 0 {
+		return nil
+	}
+	key := ocspKey(leaf, issuer)
+	now := time.Now()
+	rc.mu.Lock()
+	expires, ok := rc.ocspGood[key]
+	rc.mu.Unlock()
+	if ok && now.Before(expires) {
+		return nil
+	}
+
+	resp, err := rc.queryOCSP(leaf.OCSPServer[0], leaf, issuer)
+	if err == nil {
+		switch resp.Status {
+		case ocsp.Good:
+			expires := resp.NextUpdate
+			if expires.IsZero() {
+				expires = now.Add(ocspDefaultTTL)
+			}
+			rc.mu.Lock()
+			for k, t := range rc.ocspGood {
+				if now.After(t) {
+					delete(rc.ocspGood, k)
+				}
+			}
+			rc.ocspGood[key] = expires
+			rc.mu.Unlock()
+			return nil
+		case ocsp.Revoked:
+			return fmt.Errorf("client certificate %s (serial %s) is revoked", leaf.Subject, leaf.SerialNumber)
+		}
+		err = errors.New("the responder does not know the certificate")
+	}
+	if rc.ocspMode == ocspHard {
+		return fmt.Errorf("OCSP check of %s failed: %w", leaf.Subject, err)
+	}
+	log.Warnf("OCSP check of client certificate %s failed, letting it in: %v", leaf.Subject, err)
+	return nil
+}
+
+// queryOCSP asks server for the status of leaf.
+func (rc *revocationChecker) queryOCSP(server string, leaf, issuer *x509.Certificate) (*ocsp.Response, error) {
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+	httpResp, err := rc.client.Post(server, "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("responder %s returned %s", server, httpResp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(httpResp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	return ocsp.ParseResponseForCert(body, leaf, issuer)
+}
+
+// ocspKey identifies leaf among the certificates of all issuers.
+func ocspKey(leaf, issuer *x509.Certificate) string {
+	return string(issuer.RawSubjectPublicKeyInfo) + leaf.SerialNumber.String()
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// testCA is a certificate authority issuing client certificates in tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// issue returns a client certificate with serial, naming ocspServer as its
+// responder if set.
+func (ca *testCA) issue(t *testing.T, serial int64, ocspServer string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if ocspServer != "" {
+		template.OCSPServer = []string{ocspServer}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// crl returns a PEM CRL revoking serials.
+func (ca *testCA) crl(t *testing.T, serials ...int64) []byte {
+	t.Helper()
+	var entries []x509.RevocationListEntry
+	for _, serial := range serials {
+		entries = append(entries, x509.RevocationListEntry{SerialNumber: big.NewInt(serial), RevocationTime: time.Now()})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(time.Now().UnixNano()),
+		ThisUpdate:                time.Now(),
+		NextUpdate:                time.Now().Add(time.Hour),
+		RevokedCertificateEntries: entries,
+	}, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+}
+
+// writeCA writes the CA certificate as a client-ca file.
+func (ca *testCA) writeCA(t *testing.T, dir string) string {
+	t.Helper()
+	path := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestClientAuthCRL verifies that certificates listed in the CRL are
+// rejected, and that a rewritten CRL applies without a restart.
+func TestClientAuthCRL(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	crlPath := filepath.Join(dir, "crl.pem")
+	if err := os.WriteFile(crlPath, ca.crl(t, 3), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := newClientAuth(proxyConfig{ClientCA: ca.writeCA(t, dir), ClientCRL: crlPath})
+	if err != nil {
+		t.Fatalf("newClientAuth: %v", err)
+	}
+	chain := func(serial int64) [][]*x509.Certificate {
+		return [][]*x509.Certificate{{ca.issue(t, serial, ""), ca.cert}}
+	}
+	if err := auth.Verify(chain(2)); err != nil {
+		t.Errorf("Certificate 2 rejected: %v", err)
+	}
+	if err := auth.Verify(chain(3)); err == nil || !strings.Contains(err.Error(), "revoked") {
+		t.Errorf("Certificate 3 accepted, got %v", err)
+	}
+
+	if err := os.WriteFile(crlPath, ca.crl(t, 2, 3), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(crlPath, later, later)
+	if err := auth.Verify(chain(2)); err == nil {
+		t.Error("Certificate 2 accepted after the CRL revoked it")
+	}
+
+	// Another CA's CRL does not apply
+	other := newTestCA(t)
+	if err := os.WriteFile(crlPath, other.crl(t, 2, 3), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(crlPath, later.Add(time.Minute), later.Add(time.Minute))
+	if err := auth.Verify(chain(2)); err != nil {
+		t.Errorf("Certificate 2 rejected by another CA's CRL: %v", err)
+	}
+}
+
+// TestClientAuthOCSP verifies that the responder's answers are enforced,
+// and that an unreachable responder only refuses clients in hard mode.
+func TestClientAuthOCSP(t *testing.T) {
+	ca := newTestCA(t)
+	var queries atomic.Int32
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		status := ocsp.Good
+		if req.SerialNumber.Int64() == 3 {
+			status = ocsp.Revoked
+		}
+		resp, err := ocsp.CreateResponse(ca.cert, ca.cert, ocsp.Response{
+			Status:       status,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now(),
+			NextUpdate:   time.Now().Add(time.Hour),
+			RevokedAt:    time.Now(),
+		}, ca.key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(resp)
+	}))
+	defer responder.Close()
+
+	dir := t.TempDir()
+	auth, err := newClientAuth(proxyConfig{ClientCA: ca.writeCA(t, dir), ClientOCSP: ocspHard})
+	if err != nil {
+		t.Fatalf("newClientAuth: %v", err)
+	}
+	good := [][]*x509.Certificate{{ca.issue(t, 2, responder.URL), ca.cert}}
+	if err := auth.Verify(good); err != nil {
+		t.Errorf("Good certificate rejected: %v", err)
+	}
+	auth.Verify(good)
+	if n := queries.Load(); n != 1 {
+		t.Errorf("Responder asked %d times, want the good answer cached", n)
+	}
+	revoked := [][]*x509.Certificate{{ca.issue(t, 3, responder.URL), ca.cert}}
+	if err := auth.Verify(revoked); err == nil || !strings.Contains(err.Error(), "revoked") {
+		t.Errorf("Revoked certificate accepted, got %v", err)
+	}
+
+	unreachable := [][]*x509.Certificate{{ca.issue(t, 4, "http://127.0.0.1:1"), ca.cert}}
+	if err := auth.Verify(unreachable); err == nil {
+		t.Error("Hard mode accepted a certificate whose responder is unreachable")
+	}
+	soft, err := newClientAuth(proxyConfig{ClientCA: ca.writeCA(t, dir), ClientOCSP: ocspSoft})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := soft.Verify(unreachable); err != nil {
+		t.Errorf("Soft mode rejected a certificate whose responder is unreachable: %v", err)
+	}
+	if err := soft.Verify(revoked); err == nil {
+		t.Error("Soft mode accepted a revoked certificate")
+	}
+}
+
+// TestNewClientAuthErrors verifies that unusable files are reported.
+func TestNewClientAuthErrors(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caPath := ca.writeCA(t, dir)
+	garbage := filepath.Join(dir, "garbage")
+	os.WriteFile(garbage, []byte("not a certificate"), 0o600)
+
+	for name, cfg := range map[string]proxyConfig{
+		"missing CA": {ClientCA: filepath.Join(dir, "missing.pem")},
+		"bad CA":     {ClientCA: garbage},
+		"bad CRL":    {ClientCA: caPath, ClientCRL: garbage},
+	} {
+		if _, err := newClientAuth(cfg); err == nil {
+			t.Errorf("%s: newClientAuth succeeded", name)
+		}
+	}
+	if auth, err := newClientAuth(proxyConfig{}); auth != nil || err != nil {
+		t.Errorf("newClientAuth without client-ca = %v, %v", auth, err)
+	}
+}
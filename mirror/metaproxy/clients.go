@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-i2p/go-meta-listener"
+)
+
+// clientLimits bound what a single client can take from the proxy.
+type clientLimits struct {
+	// MaxConns caps a client's concurrent connections; zero means no cap.
+	MaxConns int `toml:"client-max-conns"`
+	// Rate caps a client's new connections per minute; zero means no cap.
+	Rate int `toml:"client-rate"`
+	// Ban is how long a client going over Rate is refused; zero only
+	// refuses the connections over the rate.
+	Ban time.Duration `toml:"client-ban"`
+}
+
+// clientID returns the identity limits are applied to, the one flood
+// detection uses: the .b32.i2p address of I2P clients and the IP address of
+// clearnet and local clients. Tor does not identify the clients of onion
+// services, so they get "" and are only subject to the global limit.
+func clientID(conn net.Conn) string {
+	return meta.ConnIdentity(conn)
+}
+
+// clientState is what the tracker knows about one client.
+type clientState struct {
+	active      int
+	tokens      float64
+	refilled    time.Time
+	bannedUntil time.Time
+}
+
+// clientTracker enforces clientLimits per client identity.
+type clientTracker struct {
+	mu      sync.Mutex
+	limits  clientLimits
+	clients map[string]*clientState
+	admits  int
+	now     func() time.Time
+	// onBan, if set, is called with the tracker locked for every ban
+	onBan func(meta.BanEvent)
+}
+
+func newClientTracker(limits clientLimits) *clientTracker {
+	return &clientTracker{
+		limits:  limits,
+		clients: make(map[string]*clientState),
+		now:     time.Now,
+	}
+}
+
+// setLimits changes the limits; clients already over a lowered MaxConns
+// keep their connections.
+func (ct *clientTracker) setLimits(limits clientLimits) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.limits = limits
+}
+
+// setBanHandler makes the tracker report its bans to onBan.
+func (ct *clientTracker) setBanHandler(onBan func(meta.BanEvent)) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.onBan = onBan
+}
+
+// admit decides whether client id may open a connection, returning the
+// function to call when the connection ends.
+func (ct *clientTracker) admit(id string) (func(), bool) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	limits := ct.limits
+	if id == "" || (limits.MaxConns <= 0 && limits.Rate <= 0) {
+		return func() {}, true
+	}
+	now := ct.now()
+	ct.admits++
+	if ct.admits%256 == 0 {
+		ct.sweep(now)
+	}
+
+	c := ct.clients[id]
+	if c == nil {
+		c = &clientState{tokens: float64(limits.Rate), refilled: now}
+		ct.clients[id] = c
+	}
+	if now.Before(c.bannedUntil) {
+		return nil, false
+	}
+	if limits.Rate > 0 {
+		c.tokens += now.Sub(c.refilled).Minutes() * float64(limits.Rate)
+		if c.tokens > float64(limits.Rate) {
+			c.tokens = float64(limits.Rate)
+		}
+		c.refilled = now
+		if c.tokens < 1 {
+			if limits.Ban > 0 {
+				c.bannedUntil = now.Add(limits.Ban)
+				log.Warnf("Client %s exceeded %d connections per minute, banned for %s", id, limits.Rate, limits.Ban)
+				if ct.onBan != nil {
+					ct.onBan(meta.BanEvent{Type: meta.BanStarted, Identity: id, Until: c.bannedUntil, Offenses: 1})
+				}
+			}
+			return nil, false
+		}
+	}
+	if limits.MaxConns > 0 && c.active >= limits.MaxConns {
+		return nil, false
+	}
+	if limits.Rate > 0 {
+		c.tokens--
+	}
+	c.active++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ct.mu.Lock()
+			c.active--
+			ct.mu.Unlock()
+		})
+	}, true
+}
+
+// sweep forgets clients with no connections, no ban, and a full bucket,
+// so the table does not grow with every client ever seen.
+func (ct *clientTracker) sweep(now time.Time) {
+	for id, c := range ct.clients {
+		if c.active == 0 && !now.Before(c.bannedUntil) && now.Sub(c.refilled) >= time.Minute {
+			delete(ct.clients, id)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-i2p/go-meta-listener"
+)
+
+// TestClientTrackerMaxConns verifies the per-client concurrent connection
+// cap, and that it does not affect other clients.
+func TestClientTrackerMaxConns(t *testing.T) {
+	ct := newClientTracker(clientLimits{MaxConns: 2})
+	release, ok := ct.admit("a")
+	if !ok {
+		t.Fatal("first connection refused")
+	}
+	if _, ok := ct.admit("a"); !ok {
+		t.Fatal("second connection refused")
+	}
+	if _, ok := ct.admit("a"); ok {
+		t.Error("connection over the cap admitted")
+	}
+	if _, ok := ct.admit("b"); !ok {
+		t.Error("other client refused")
+	}
+	release()
+	release()
+	if _, ok := ct.admit("a"); !ok {
+		t.Error("connection refused after a release")
+	}
+	if _, ok := ct.admit(""); !ok {
+		t.Error("unidentified client refused")
+	}
+}
+
+// TestClientTrackerRate verifies the new-connection rate limit and bans.
+func TestClientTrackerRate(t *testing.T) {
+	now := time.Unix(0, 0)
+	ct := newClientTracker(clientLimits{Rate: 2, Ban: time.Hour})
+	ct.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if _, ok := ct.admit("a"); !ok {
+			t.Fatalf("connection %d refused", i+1)
+		}
+	}
+	if _, ok := ct.admit("a"); ok {
+		t.Fatal("connection over the rate admitted")
+	}
+
+	// The bucket refills, but the ban holds.
+	now = now.Add(time.Minute)
+	if _, ok := ct.admit("a"); ok {
+		t.Error("banned client admitted")
+	}
+	now = now.Add(time.Hour)
+	if _, ok := ct.admit("a"); !ok {
+		t.Error("client refused after the ban")
+	}
+
+	// Without a ban, the client is admitted again once the bucket refills.
+	ct.setLimits(clientLimits{Rate: 2})
+	ct.admit("b")
+	ct.admit("b")
+	if _, ok := ct.admit("b"); ok {
+		t.Error("connection over the rate admitted")
+	}
+	now = now.Add(30 * time.Second)
+	if _, ok := ct.admit("b"); !ok {
+		t.Error("client refused after refill")
+	}
+}
+
+// TestClientTrackerSweep verifies that idle clients are forgotten.
+func TestClientTrackerSweep(t *testing.T) {
+	now := time.Unix(0, 0)
+	ct := newClientTracker(clientLimits{MaxConns: 1})
+	ct.now = func() time.Time { return now }
+	release, _ := ct.admit("idle")
+	release()
+	ct.admit("busy")
+
+	now = now.Add(2 * time.Minute)
+	ct.sweep(now)
+	if _, ok := ct.clients["idle"]; ok {
+		t.Error("idle client kept")
+	}
+	if _, ok := ct.clients["busy"]; !ok {
+		t.Error("client with a connection forgotten")
+	}
+}
+
+// TestClientID verifies that plain connections are identified by IP.
+func TestClientID(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if id := clientID(conn); id != "127.0.0.1" {
+		t.Errorf("clientID = %q, want 127.0.0.1", id)
+	}
+}
+
+// TestClientTrackerBanLog verifies that bans are reported to the ban
+// handler in the format of meta.BanLog.
+func TestClientTrackerBanLog(t *testing.T) {
+	var banLog strings.Builder
+	ct := newClientTracker(clientLimits{Rate: 1, Ban: time.Hour})
+	ct.setBanHandler(meta.BanLog(&banLog))
+	ct.admit("203.0.113.7")
+	if _, ok := ct.admit("203.0.113.7"); ok {
+		t.Fatal("connection over the rate admitted")
+	}
+	if fields := strings.Fields(banLog.String()); len(fields) != 7 || fields[2] != "ban" || fields[3] != "203.0.113.7" {
+		t.Errorf("ban log %q", banLog.String())
+	}
+}
@@ -0,0 +1,676 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/go-i2p/go-meta-listener"
+	"golang.org/x/net/http/httpguts"
+)
+
+// proxyConfig is everything metaproxy can be configured with, from flags or
+// from the file given with -config.
+type proxyConfig struct {
+	// Domain is the name certificates are issued for; it is independent of
+	// the address the clearnet listener binds.
+	Domain string `toml:"domain"`
+	// ListenAddr is the host, such as "0.0.0.0", whose listen ports the
+	// clearnet TLS listeners bind. Empty binds ":443".
+	ListenAddr string `toml:"listen-addr"`
+	Email      string `toml:"email"`
+	CertDir    string `toml:"certdir"`
+	KeyDir     string `toml:"keydir"`
+	HiddenTLS  bool   `toml:"hidden-tls"`
+	MaxConns   int    `toml:"max-conns"`
+	// IdleTimeout closes connections that carry no data for this long;
+	// MaxLifetime closes them this long after they open. Zero disables them.
+	IdleTimeout time.Duration `toml:"idle-timeout"`
+	MaxLifetime time.Duration `toml:"max-lifetime"`
+	// DrainTimeout is how long active connections may finish on shutdown
+	// before they are closed.
+	DrainTimeout time.Duration `toml:"drain-timeout"`
+	// Clients limits each client's connections.
+	Clients clientLimits `toml:"-"`
+	// BanLog is a file every ban of a clearnet client over Clients.Rate is
+	// appended to, for fail2ban or an nftables script to block the client
+	// at the firewall. Empty writes none.
+	BanLog string `toml:"ban-log"`
+	// BackendProxy is the socks5:// URL of a proxy TCP targets are reached
+	// through, such as Tor's SOCKS port for .onion targets. Empty dials
+	// targets directly.
+	BackendProxy string `toml:"backend-proxy"`
+	// BackendCA is a PEM file of the authorities the certificates of
+	// targets dialed over TLS are verified against. Empty uses the system
+	// roots.
+	BackendCA string `toml:"backend-ca"`
+	// RequestIDHeader, such as "X-Request-ID", is the header the connection
+	// ID is added to on the first HTTP request of each connection. Empty
+	// adds none.
+	RequestIDHeader string `toml:"request-id-header"`
+	// ClientCA is a PEM file of the authorities whose client certificates
+	// the clearnet TLS listeners require; empty requires none. ClientCRL is
+	// a CRL file of revoked client certificates, and ClientOCSP, soft or
+	// hard, asks the certificates' OCSP responders as well.
+	ClientCA   string `toml:"client-ca"`
+	ClientCRL  string `toml:"client-crl"`
+	ClientOCSP string `toml:"client-ocsp"`
+	// AcceptProxy reads a PROXY protocol header, sent by a load balancer in
+	// front of the clearnet TLS listeners, from each of their connections,
+	// so the real client addresses are logged and limited.
+	AcceptProxy bool `toml:"accept-proxy"`
+	// ControlSocket is the path of the Unix socket metaproxy ctl manages the
+	// proxy through. Empty disables it.
+	ControlSocket string `toml:"control-socket"`
+	// LogLevel and LogFormat configure the shared logger: the least severe
+	// level logged, and text or json output.
+	LogLevel  string `toml:"log-level"`
+	LogFormat string `toml:"log-format"`
+	// LocalTCP, Tor, and I2P toggle the transports services are published on.
+	LocalTCP bool `toml:"local-tcp"`
+	Tor      bool `toml:"tor"`
+	I2P      bool `toml:"i2p"`
+	// SAMAddrs are the SAM bridges of redundant I2P routers, tried in order
+	// and failed over between. Empty uses the local router's.
+	SAMAddrs []string `toml:"sam-addrs"`
+	// StatsD is the host:port of a StatsD server or Datadog agent the
+	// counters are pushed to, each name starting with StatsDPrefix and
+	// carrying StatsDTags, in DogStatsD's tag format with StatsDDatadog.
+	// Empty pushes none.
+	StatsD        string   `toml:"statsd"`
+	StatsDPrefix  string   `toml:"statsd-prefix"`
+	StatsDTags    []string `toml:"statsd-tags"`
+	StatsDDatadog bool     `toml:"statsd-datadog"`
+	// CaptureDir is a directory the streams of the connections accepted on
+	// the listeners matching CaptureListeners, from the clients matching
+	// CaptureIdentities, are recorded to for debugging: up to CaptureBytes
+	// of each connection, in one file each, keeping the newest
+	// CaptureFiles. Empty records none.
+	CaptureDir        string          `toml:"capture-dir"`
+	CaptureListeners  []string        `toml:"capture-listeners"`
+	CaptureIdentities []string        `toml:"capture-identities"`
+	CaptureBytes      int64           `toml:"capture-bytes"`
+	CaptureFiles      int             `toml:"capture-files"`
+	Services          []serviceConfig `toml:"-"`
+}
+
+// serviceConfig is one listen port and the backend its connections are
+// forwarded to.
+type serviceConfig struct {
+	ListenPort int `toml:"listen-port"`
+	// ListenAddr overrides proxyConfig.ListenAddr for this service. With a
+	// port, as in "0.0.0.0:443", it is bound instead of the listen port.
+	ListenAddr string `toml:"listen-addr"`
+	// Targets are host:port addresses, or Unix socket paths written as
+	// "unix:/run/app.sock", that connections are spread over.
+	Targets []string `toml:"targets"`
+	// Balance selects a target for each connection: round-robin (the
+	// default) or least-conns.
+	Balance string `toml:"balance"`
+	// Domains are extra clearnet names served on the port, routed by SNI.
+	Domains []string `toml:"domains"`
+	// Routes send the clearnet connections for a domain, or the connections
+	// arriving on a transport, to targets of their own; other connections
+	// go to Targets.
+	Routes []routeConfig `toml:"-"`
+	// Shadow is a target, such as a new version of the application, that
+	// gets a copy of what clients send on each connection; its answers are
+	// discarded, and it is cut off from a connection it falls behind on, so
+	// clients are never held up by it. Empty copies to none.
+	Shadow string `toml:"shadow"`
+	// MaintenancePage is a file HTTP clients are answered with, with a 503
+	// status, while none of the targets of the service, or of one of its
+	// routes, can be reached. Empty closes their connections instead.
+	MaintenancePage string `toml:"maintenance-page"`
+	// RequestIDHeader overrides proxyConfig.RequestIDHeader; "-" adds none.
+	RequestIDHeader string `toml:"request-id-header"`
+	// Allow lists the transports, such as onion or i2p, connections to the
+	// service may arrive on; the others are closed before a target is
+	// dialed. Empty allows every transport.
+	Allow []string `toml:"allow"`
+	// Passthrough forwards the clearnet TLS connections without terminating
+	// them, choosing the route by the SNI of their ClientHello. metaproxy
+	// binds the clearnet listener itself and no certificate is issued.
+	Passthrough bool `toml:"passthrough"`
+	// BackendTLS re-encrypts the connections to Targets, which metaproxy
+	// terminates, over TLS.
+	BackendTLS backendTLS `toml:"-"`
+	// Middleware is the service's own header, PROXY protocol, IP filter,
+	// rate limit, bandwidth, and response scrubbing policy.
+	Middleware middleware `toml:"-"`
+}
+
+// routeConfig is a domain or a transport of a service forwarded to its own
+// backends. A route has a Domain or a Transport, never both.
+type routeConfig struct {
+	Domain string `toml:"domain"`
+	// Transport routes the connections accepted on the service's listener
+	// over a transport, such as onion, rather than those for a domain.
+	Transport string   `toml:"transport"`
+	Targets   []string `toml:"targets"`
+	Balance   string   `toml:"balance"`
+	// Shadow is a target the route's connections are copied to, like the
+	// service's Shadow.
+	Shadow string `toml:"shadow"`
+	// BackendTLS re-encrypts the connections to Targets over TLS.
+	BackendTLS backendTLS `toml:"-"`
+}
+
+// backendTLS is whether, and for which name, the targets of a service or
+// route are dialed over TLS.
+type backendTLS struct {
+	Enabled bool `toml:"backend-tls"`
+	// ServerName is sent as SNI and is the name the targets' certificates
+	// are verified for. Empty uses the host of each target.
+	ServerName string `toml:"backend-server-name"`
+}
+
+// name describes what the route forwards, for logs.
+func (rc routeConfig) name() string {
+	if rc.Transport != "" {
+		return rc.Transport + " connections"
+	}
+	return rc.Domain
+}
+
+// targets returns the targets of the service and its shadow target.
+func (s *serviceConfig) targets() []string {
+	if s.Shadow == "" {
+		return s.Targets
+	}
+	return append(slices.Clip(s.Targets), s.Shadow)
+}
+
+// targets returns the targets of the route and its shadow target.
+func (rc routeConfig) targets() []string {
+	if rc.Shadow == "" {
+		return rc.Targets
+	}
+	return append(slices.Clip(rc.Targets), rc.Shadow)
+}
+
+// domains returns every extra clearnet name of the service: its Domains,
+// then the domains of its Routes.
+func (s *serviceConfig) domains() []string {
+	domains := append([]string(nil), s.Domains...)
+	for _, route := range s.Routes {
+		if route.Domain != "" && !slices.Contains(domains, route.Domain) {
+			domains = append(domains, route.Domain)
+		}
+	}
+	return domains
+}
+
+// forwardFlags collects repeated -forward flags, each adding a service.
+// Targets written transport=host:port, as in onion=10.0.0.2:80, are routes
+// for the connections arriving over that transport.
+type forwardFlags []serviceConfig
+
+func (f *forwardFlags) String() string {
+	rules := make([]string, len(*f))
+	for i, svc := range *f {
+		targets := slices.Clone(svc.Targets)
+		for _, route := range svc.Routes {
+			for _, target := range route.Targets {
+				targets = append(targets, route.Transport+"="+target)
+			}
+		}
+		rules[i] = fmt.Sprintf("%d=%s", svc.ListenPort, strings.Join(targets, ","))
+	}
+	return strings.Join(rules, ",")
+}
+
+// Set parses a rule written as listen-port=target, such as 443=localhost:3000
+// or 443=unix:/run/app.sock. Several targets, separated by commas, are
+// balanced round-robin.
+func (f *forwardFlags) Set(rule string) error {
+	port, target, ok := strings.Cut(rule, "=")
+	if !ok {
+		return fmt.Errorf("expected listen-port=target, got %q", rule)
+	}
+	listenPort, err := strconv.Atoi(port)
+	if err != nil {
+		return fmt.Errorf("invalid listen port %q", port)
+	}
+	svc := serviceConfig{ListenPort: listenPort}
+	for _, target := range strings.Split(target, ",") {
+		transport, routeTarget, ok := strings.Cut(target, "=")
+		if !ok {
+			svc.Targets = append(svc.Targets, target)
+			continue
+		}
+		i := slices.IndexFunc(svc.Routes, func(route routeConfig) bool { return route.Transport == transport })
+		if i < 0 {
+			svc.Routes = append(svc.Routes, routeConfig{Transport: transport})
+			i = len(svc.Routes) - 1
+		}
+		svc.Routes[i].Targets = append(svc.Routes[i].Targets, routeTarget)
+	}
+	*f = append(*f, svc)
+	return nil
+}
+
+// loadConfig reads a configuration file into cfg, keeping the values of
+// keys the file does not set.
+func loadConfig(path string, cfg *proxyConfig) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := parseConfig(f, cfg); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// configFile is the layout of the configuration file: the top-level keys
+// of a proxyConfig, among them the client-* keys of its Clients, then one
+// [[service]] table per listen port.
+type configFile struct {
+	*proxyConfig
+	*clientLimits
+	Services []serviceFile `toml:"service"`
+}
+
+// serviceFile is a [[service]] table. Its keys are those of a
+// serviceConfig and of the backendTLS and middleware it holds, then its
+// [[service.route]] tables.
+type serviceFile struct {
+	serviceConfig
+	backendTLS
+	middleware
+	responseScrub
+	// Target is a single target, written instead of targets.
+	Target string `toml:"target"`
+	// The client-* keys override proxyConfig.Clients for the service, so
+	// that a zero limit is told apart from an unset one.
+	ClientMaxConns *int           `toml:"client-max-conns"`
+	ClientRate     *int           `toml:"client-rate"`
+	ClientBan      *time.Duration `toml:"client-ban"`
+	ConnReadRate   int64          `toml:"conn-read-rate"`
+	ConnWriteRate  int64          `toml:"conn-write-rate"`
+	ReadRate       int64          `toml:"read-rate"`
+	WriteRate      int64          `toml:"write-rate"`
+	Routes         []routeFile    `toml:"route"`
+}
+
+// routeFile is a [[service.route]] table.
+type routeFile struct {
+	routeConfig
+	backendTLS
+	// Target is a single target, written instead of targets.
+	Target string `toml:"target"`
+}
+
+// parseConfig decodes a TOML configuration file into cfg, keeping the
+// values of keys the file does not set and appending its services.
+func parseConfig(r io.Reader, cfg *proxyConfig) error {
+	file := configFile{proxyConfig: cfg, clientLimits: &cfg.Clients}
+	md, err := toml.NewDecoder(r).Decode(&file)
+	if err != nil {
+		return err
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return fmt.Errorf("unknown key %q", undecoded[0].String())
+	}
+	for i, sf := range file.Services {
+		svc, err := sf.config()
+		if err != nil {
+			return fmt.Errorf("service %d: %w", i+1, err)
+		}
+		cfg.Services = append(cfg.Services, svc)
+	}
+	return nil
+}
+
+// config returns the service the table describes.
+func (sf serviceFile) config() (serviceConfig, error) {
+	svc := sf.serviceConfig
+	targets, err := singleTarget(sf.Target, svc.Targets)
+	if err != nil {
+		return svc, err
+	}
+	svc.Targets = targets
+	svc.BackendTLS = sf.backendTLS
+	svc.Middleware = sf.middleware
+	svc.Middleware.Scrub = sf.responseScrub
+	svc.Middleware.Bandwidth = meta.Bandwidth{
+		ConnRead:      sf.ConnReadRate,
+		ConnWrite:     sf.ConnWriteRate,
+		ListenerRead:  sf.ReadRate,
+		ListenerWrite: sf.WriteRate,
+	}
+	if sf.ClientMaxConns != nil {
+		svc.Middleware.clients().MaxConns = *sf.ClientMaxConns
+	}
+	if sf.ClientRate != nil {
+		svc.Middleware.clients().Rate = *sf.ClientRate
+	}
+	if sf.ClientBan != nil {
+		svc.Middleware.clients().Ban = *sf.ClientBan
+	}
+	for _, rf := range sf.Routes {
+		route := rf.routeConfig
+		if route.Targets, err = singleTarget(rf.Target, route.Targets); err != nil {
+			return svc, fmt.Errorf("route %s: %w", route.name(), err)
+		}
+		route.BackendTLS = rf.backendTLS
+		svc.Routes = append(svc.Routes, route)
+	}
+	return svc, nil
+}
+
+// singleTarget returns targets, or target alone when it is set instead.
+func singleTarget(target string, targets []string) ([]string, error) {
+	if target == "" {
+		return targets, nil
+	}
+	if len(targets) > 0 {
+		return nil, fmt.Errorf("target and targets are both set")
+	}
+	return []string{target}, nil
+}
+
+// validate checks that the configuration can be served.
+func (c *proxyConfig) validate() error {
+	if c.MaxConns <= 0 {
+		return fmt.Errorf("max-conns must be positive")
+	}
+	if c.IdleTimeout < 0 || c.MaxLifetime < 0 || c.DrainTimeout < 0 {
+		return fmt.Errorf("timeouts must not be negative")
+	}
+	if c.Clients.MaxConns < 0 || c.Clients.Rate < 0 || c.Clients.Ban < 0 {
+		return fmt.Errorf("client limits must not be negative")
+	}
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		return err
+	}
+	if _, err := logFormatter(c.LogFormat); err != nil {
+		return err
+	}
+	if _, err := backendDialer(c.BackendProxy); err != nil {
+		return err
+	}
+	if c.RequestIDHeader != "" && !httpguts.ValidHeaderFieldName(c.RequestIDHeader) {
+		return fmt.Errorf("invalid request-id-header %q", c.RequestIDHeader)
+	}
+	if err := c.validateClientAuth(); err != nil {
+		return err
+	}
+	if err := c.validateAcceptProxy(); err != nil {
+		return err
+	}
+	for _, addr := range c.SAMAddrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid sam-addrs entry %q: %w", addr, err)
+		}
+	}
+	if err := c.validateStatsD(); err != nil {
+		return err
+	}
+	if err := c.validateCapture(); err != nil {
+		return err
+	}
+	if len(c.Services) == 0 {
+		return fmt.Errorf("no services configured")
+	}
+	ports := make(map[int]bool)
+	addrs := make(map[string]bool)
+	for i, svc := range c.Services {
+		if svc.ListenPort <= 0 || svc.ListenPort > 65535 {
+			return fmt.Errorf("service %d: invalid listen-port %d", i+1, svc.ListenPort)
+		}
+		if ports[svc.ListenPort] {
+			return fmt.Errorf("service %d: listen-port %d used twice", i+1, svc.ListenPort)
+		}
+		ports[svc.ListenPort] = true
+		if addr := c.tlsAddr(svc); addr != "" {
+			if _, port, _ := net.SplitHostPort(addr); port == "" {
+				return fmt.Errorf("service %d: listen-addr %q has no port", i+1, addr)
+			}
+			if addrs[addr] {
+				return fmt.Errorf("service %d: listen-addr %s used twice", i+1, addr)
+			}
+			addrs[addr] = true
+		}
+		if err := validTargets(svc.Targets, svc.Balance); err != nil {
+			return fmt.Errorf("service %d: %w", i+1, err)
+		}
+		if err := validAllow(svc.Allow); err != nil {
+			return fmt.Errorf("service %d: %w", i+1, err)
+		}
+		if svc.Passthrough && len(svc.Domains) > 0 {
+			return fmt.Errorf("service %d: passthrough services route their domains with [[service.route]], not domains", i+1)
+		}
+		if svc.Passthrough && svc.BackendTLS.Enabled {
+			return fmt.Errorf("service %d: passthrough services forward TLS as it is and cannot use backend-tls", i+1)
+		}
+		if svc.Passthrough && svc.MaintenancePage != "" {
+			return fmt.Errorf("service %d: passthrough services forward TLS as it is and cannot serve a maintenance-page", i+1)
+		}
+		if err := validShadow(svc.Shadow, svc.Passthrough); err != nil {
+			return fmt.Errorf("service %d: %w", i+1, err)
+		}
+		if err := validBackendTLS(svc.BackendTLS, svc.targets()); err != nil {
+			return fmt.Errorf("service %d: %w", i+1, err)
+		}
+		if err := svc.Middleware.validate(svc.Passthrough); err != nil {
+			return fmt.Errorf("service %d: %w", i+1, err)
+		}
+		routed := make(map[string]bool)
+		for _, route := range svc.Routes {
+			if err := validRoute(route, svc.Allow); err != nil {
+				return fmt.Errorf("service %d: %w", i+1, err)
+			}
+			if routed[route.name()] {
+				return fmt.Errorf("service %d: %s routed twice", i+1, route.name())
+			}
+			routed[route.name()] = true
+			if err := validTargets(route.Targets, route.Balance); err != nil {
+				return fmt.Errorf("service %d: route %s: %w", i+1, route.name(), err)
+			}
+			if svc.Passthrough && route.Domain != "" && route.BackendTLS.Enabled {
+				return fmt.Errorf("service %d: route %s is passed through and cannot use backend-tls", i+1, route.name())
+			}
+			if err := validShadow(route.Shadow, svc.Passthrough && route.Domain != ""); err != nil {
+				return fmt.Errorf("service %d: route %s: %w", i+1, route.name(), err)
+			}
+			if err := validBackendTLS(route.BackendTLS, route.targets()); err != nil {
+				return fmt.Errorf("service %d: route %s: %w", i+1, route.name(), err)
+			}
+		}
+		if h := c.requestIDHeader(svc); h != "" && !httpguts.ValidHeaderFieldName(h) {
+			return fmt.Errorf("service %d: invalid request-id-header %q", i+1, h)
+		}
+	}
+	return nil
+}
+
+// validateClientAuth checks the mutual TLS settings.
+func (c *proxyConfig) validateClientAuth() error {
+	switch c.ClientOCSP {
+	case "", ocspSoft, ocspHard:
+	default:
+		return fmt.Errorf("unknown client-ocsp %q, want %s or %s", c.ClientOCSP, ocspSoft, ocspHard)
+	}
+	if c.ClientCA == "" {
+		if c.ClientCRL != "" || c.ClientOCSP != "" {
+			return fmt.Errorf("client-crl and client-ocsp need client-ca")
+		}
+		return nil
+	}
+	if c.Email == "" {
+		return fmt.Errorf("client-ca needs email, without which there is no clearnet TLS listener")
+	}
+	return nil
+}
+
+// validateAcceptProxy checks that there is a clearnet TLS listener for
+// the PROXY protocol to be accepted on.
+func (c *proxyConfig) validateAcceptProxy() error {
+	if c.AcceptProxy && c.Email == "" && !slices.ContainsFunc(c.Services, func(svc serviceConfig) bool { return svc.Passthrough }) {
+		return fmt.Errorf("accept-proxy needs email or a passthrough service, without which there is no clearnet TLS listener")
+	}
+	return nil
+}
+
+// validateStatsD checks the StatsD server and tags.
+func (c *proxyConfig) validateStatsD() error {
+	if c.StatsD == "" {
+		if c.StatsDPrefix != "" || len(c.StatsDTags) > 0 || c.StatsDDatadog {
+			return fmt.Errorf("statsd-prefix, statsd-tags, and statsd-datadog need statsd")
+		}
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(c.StatsD); err != nil {
+		return fmt.Errorf("invalid statsd %q: %w", c.StatsD, err)
+	}
+	if strings.ContainsAny(c.StatsDPrefix, ":|@#, \t") {
+		return fmt.Errorf("invalid statsd-prefix %q", c.StatsDPrefix)
+	}
+	for _, tag := range c.StatsDTags {
+		if key, value, ok := strings.Cut(tag, ":"); !ok || key == "" || value == "" || strings.ContainsAny(tag, "|@#, \t") {
+			return fmt.Errorf("invalid statsd-tags entry %q, want key:value", tag)
+		}
+	}
+	return nil
+}
+
+// validateCapture checks the patterns and limits of stream capture.
+func (c *proxyConfig) validateCapture() error {
+	if c.CaptureDir == "" {
+		if len(c.CaptureListeners) > 0 || len(c.CaptureIdentities) > 0 || c.CaptureBytes != 0 || c.CaptureFiles != 0 {
+			return fmt.Errorf("capture-listeners, capture-identities, capture-bytes, and capture-files need capture-dir")
+		}
+		return nil
+	}
+	if c.CaptureBytes < 0 || c.CaptureFiles < 0 {
+		return fmt.Errorf("capture-bytes and capture-files must not be negative")
+	}
+	for _, pattern := range append(slices.Clone(c.CaptureListeners), c.CaptureIdentities...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid capture pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// validRoute checks that route matches a domain or one of the transports a
+// service with allow accepts.
+func validRoute(route routeConfig, allow []string) error {
+	switch {
+	case route.Domain == "" && route.Transport == "":
+		return fmt.Errorf("route without a domain or transport")
+	case route.Domain != "" && route.Transport != "":
+		return fmt.Errorf("route %s has both a domain and a transport", route.Domain)
+	case route.Transport == "":
+		return nil
+	}
+	if !slices.Contains(transports, route.Transport) {
+		return fmt.Errorf("unknown route transport %q, want %s", route.Transport, strings.Join(transports, ", "))
+	}
+	if len(allow) > 0 && !slices.Contains(allow, route.Transport) {
+		return fmt.Errorf("route for %s, which allow does not admit", route.name())
+	}
+	return nil
+}
+
+// validTargets checks the targets and balance policy of a service or route.
+func validTargets(targets []string, balance string) error {
+	if len(targets) == 0 {
+		return fmt.Errorf("no target")
+	}
+	for _, target := range targets {
+		if path, ok := strings.CutPrefix(target, unixPrefix); ok {
+			if path == "" {
+				return fmt.Errorf("target %q has no socket path", target)
+			}
+		} else if _, _, err := net.SplitHostPort(target); err != nil {
+			return fmt.Errorf("invalid target %q: %w", target, err)
+		}
+	}
+	return validBalance(balance)
+}
+
+// validShadow checks the shadow target of a service or route, whose
+// connections are passed through when passthrough is set.
+func validShadow(shadow string, passthrough bool) error {
+	if shadow == "" {
+		return nil
+	}
+	if passthrough {
+		return fmt.Errorf("passed through TLS cannot be copied to a shadow target")
+	}
+	if err := validTargets([]string{shadow}, ""); err != nil {
+		return fmt.Errorf("shadow: %w", err)
+	}
+	return nil
+}
+
+// validBackendTLS checks that every target dialed over TLS has a name to
+// verify its certificate for.
+func validBackendTLS(bt backendTLS, targets []string) error {
+	if !bt.Enabled {
+		if bt.ServerName != "" {
+			return fmt.Errorf("backend-server-name needs backend-tls")
+		}
+		return nil
+	}
+	if bt.ServerName != "" {
+		return nil
+	}
+	for _, target := range targets {
+		if strings.HasPrefix(target, unixPrefix) {
+			return fmt.Errorf("target %s is dialed over TLS and needs backend-server-name", target)
+		}
+	}
+	return nil
+}
+
+// tlsAddr returns where the clearnet TLS listener of svc binds: its
+// listen-addr when that has a port, otherwise the service's or the top-level
+// listen-addr host on its listen port, or "" for the certificate provider's
+// default.
+func (c *proxyConfig) tlsAddr(svc serviceConfig) string {
+	if _, _, err := net.SplitHostPort(svc.ListenAddr); err == nil {
+		return svc.ListenAddr
+	}
+	host := svc.ListenAddr
+	if host == "" {
+		host = c.ListenAddr
+	}
+	if host == "" {
+		return ""
+	}
+	return net.JoinHostPort(host, strconv.Itoa(svc.ListenPort))
+}
+
+// passthroughAddr returns the address the clearnet listener of a
+// passthrough service binds: its clearnet TLS address, or the listen port
+// on every interface.
+func (c *proxyConfig) passthroughAddr(svc serviceConfig) string {
+	if addr := c.tlsAddr(svc); addr != "" {
+		return addr
+	}
+	return net.JoinHostPort("", strconv.Itoa(svc.ListenPort))
+}
+
+// requestIDHeader returns the header svc adds the connection ID to, or ""
+// for none.
+func (c *proxyConfig) requestIDHeader(svc serviceConfig) string {
+	switch svc.RequestIDHeader {
+	case "":
+		return c.RequestIDHeader
+	case "-":
+		return ""
+	}
+	return svc.RequestIDHeader
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-i2p/go-meta-listener"
+)
+
+// TestParseConfig verifies that top-level keys and [[service]] tables are
+// read, and that keys the file does not set keep their values.
+func TestParseConfig(t *testing.T) {
+	file := `
+# metaproxy configuration
+domain = "example.com"
+email = 'admin@example.com'  # literal string
+hidden-tls = true
+max-conns = 250
+idle-timeout = "10m"
+max-lifetime = "24h"
+client-max-conns = 10
+client-rate = 60
+client-ban = "15m"
+ban-log = "/var/log/metaproxy/bans.log"
+backend-proxy = "socks5://127.0.0.1:9050"
+backend-ca = "/etc/metaproxy/backends.pem"
+log-level = "warn"
+request-id-header = "X-Request-ID"
+control-socket = "/run/metaproxy/control.sock"
+client-ca = "/etc/metaproxy/clients.pem"
+client-crl = "/etc/metaproxy/clients.crl"
+client-ocsp = "soft"
+accept-proxy = true
+log-format = "json"
+i2p = false
+sam-addrs = ["127.0.0.1:7656", "10.0.0.9:7656"]
+statsd = "127.0.0.1:8125"
+statsd-prefix = "metaproxy"
+statsd-tags = ["env:prod"]
+statsd-datadog = true
+capture-dir = "/var/lib/metaproxy/capture"
+capture-listeners = ["onion-*", "i2p-*"]
+capture-identities = ["*.b32.i2p"]
+capture-bytes = 65536
+capture-files = 20
+
+[[service]]
+listen-port = 443
+listen-addr = "0.0.0.0:443"
+target = "127.0.0.1:8080"
+shadow = "127.0.0.1:8090"
+domains = ["www.example.com", 'blog.example.com']
+
+[[service.route]]
+domain = "blog.example.com"
+target = "127.0.0.1:2368"
+
+[[service.route]]
+domain = "git.example.com"
+targets = ["10.0.0.3:3000", "10.0.0.4:3000"]
+balance = "least-conns"
+shadow = "10.0.0.5:3000"
+backend-tls = true
+
+[[service.route]]
+transport = "onion"
+target = "127.0.0.1:8081"
+
+[[service]]
+listen-port = 2222
+target = "localhost:22"
+request-id-header = "-"
+allow = ["onion", "i2p"]
+
+[[service]]
+listen-port = 3000
+target = "unix:/run/gitea/gitea.sock"
+backend-tls = true
+backend-server-name = "gitea.internal"
+
+[[service]]
+listen-port = 8443
+listen-addr = "[::]:8443"
+targets = ["10.0.0.1:80", "10.0.0.2:80"]
+balance = "least-conns"
+forward-headers = true
+send-proxy = "v2"
+allow-ips = ["10.0.0.0/8", "2001:db8::/32"]
+deny-ips = ["10.0.0.66"]
+maintenance-page = "/srv/maintenance.html"
+client-rate = 30
+client-ban = "1h"
+conn-write-rate = 1048576
+write-rate = 10485760
+scrub-responses = true
+scrub-headers = ["Server", "X-Backend"]
+scrub-date = "1h"
+scrub-transports = ["onion", "i2p", "tcp-local"]
+alt-svc = true
+
+[[service]]
+listen-port = 9443
+target = "10.0.0.6:443"
+passthrough = true
+send-proxy = "v1"
+
+[[service.route]]
+domain = "*.apps.example.com"
+target = "10.0.0.7:443"
+`
+	cfg := proxyConfig{CertDir: "./certs", Tor: true, I2P: true, LocalTCP: true}
+	if err := parseConfig(strings.NewReader(file), &cfg); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	want := proxyConfig{
+		Domain:            "example.com",
+		Email:             "admin@example.com",
+		CertDir:           "./certs",
+		HiddenTLS:         true,
+		MaxConns:          250,
+		IdleTimeout:       10 * time.Minute,
+		MaxLifetime:       24 * time.Hour,
+		Clients:           clientLimits{MaxConns: 10, Rate: 60, Ban: 15 * time.Minute},
+		BanLog:            "/var/log/metaproxy/bans.log",
+		BackendProxy:      "socks5://127.0.0.1:9050",
+		BackendCA:         "/etc/metaproxy/backends.pem",
+		LogLevel:          "warn",
+		RequestIDHeader:   "X-Request-ID",
+		ControlSocket:     "/run/metaproxy/control.sock",
+		ClientCA:          "/etc/metaproxy/clients.pem",
+		ClientCRL:         "/etc/metaproxy/clients.crl",
+		ClientOCSP:        "soft",
+		AcceptProxy:       true,
+		LogFormat:         "json",
+		LocalTCP:          true,
+		Tor:               true,
+		I2P:               false,
+		SAMAddrs:          []string{"127.0.0.1:7656", "10.0.0.9:7656"},
+		StatsD:            "127.0.0.1:8125",
+		StatsDPrefix:      "metaproxy",
+		StatsDTags:        []string{"env:prod"},
+		StatsDDatadog:     true,
+		CaptureDir:        "/var/lib/metaproxy/capture",
+		CaptureListeners:  []string{"onion-*", "i2p-*"},
+		CaptureIdentities: []string{"*.b32.i2p"},
+		CaptureBytes:      65536,
+		CaptureFiles:      20,
+		Services: []serviceConfig{
+			{ListenPort: 443, ListenAddr: "0.0.0.0:443", Targets: []string{"127.0.0.1:8080"}, Shadow: "127.0.0.1:8090", Domains: []string{"www.example.com", "blog.example.com"},
+				Routes: []routeConfig{
+					{Domain: "blog.example.com", Targets: []string{"127.0.0.1:2368"}},
+					{Domain: "git.example.com", Targets: []string{"10.0.0.3:3000", "10.0.0.4:3000"}, Balance: "least-conns", Shadow: "10.0.0.5:3000", BackendTLS: backendTLS{Enabled: true}},
+					{Transport: "onion", Targets: []string{"127.0.0.1:8081"}},
+				}},
+			{ListenPort: 2222, Targets: []string{"localhost:22"}, RequestIDHeader: "-", Allow: []string{"onion", "i2p"}},
+			{ListenPort: 3000, Targets: []string{"unix:/run/gitea/gitea.sock"}, BackendTLS: backendTLS{Enabled: true, ServerName: "gitea.internal"}},
+			{ListenPort: 8443, ListenAddr: "[::]:8443", Targets: []string{"10.0.0.1:80", "10.0.0.2:80"}, Balance: "least-conns",
+				MaintenancePage: "/srv/maintenance.html",
+				Middleware: middleware{
+					ForwardHeaders: true,
+					SendProxy:      "v2",
+					AllowIPs:       []string{"10.0.0.0/8", "2001:db8::/32"},
+					DenyIPs:        []string{"10.0.0.66"},
+					Clients:        &clientLimits{Rate: 30, Ban: time.Hour},
+					Bandwidth:      meta.Bandwidth{ConnWrite: 1 << 20, ListenerWrite: 10 << 20},
+					Scrub:          responseScrub{Enabled: true, Headers: []string{"Server", "X-Backend"}, Date: time.Hour, Transports: []string{"onion", "i2p", "tcp-local"}},
+					AltSvc:         true,
+				}},
+			{ListenPort: 9443, Targets: []string{"10.0.0.6:443"}, Passthrough: true, Middleware: middleware{SendProxy: "v1"},
+				Routes: []routeConfig{{Domain: "*.apps.example.com", Targets: []string{"10.0.0.7:443"}}}},
+		},
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("got %+v\nwant %+v", cfg, want)
+	}
+	if err := cfg.validate(); err != nil {
+		t.Errorf("validate: %v", err)
+	}
+}
+
+// TestParseConfigErrors verifies that malformed files and unknown keys are
+// reported.
+func TestParseConfigErrors(t *testing.T) {
+	for file, want := range map[string]string{
+		"domain = example.com":                      "line 1",
+		"\nport = 80":                               `unknown key "port"`,
+		"[server]":                                  `unknown key "server"`,
+		"[[service]]\nhost = \"x\"":                 `unknown key "service.host"`,
+		"[[service]]\ndomains = [\"a\" \"b\"]":      "line 2",
+		"max-conns":                                 "line 1",
+		"backend-proxy = 9050":                      "line 1",
+		"idle-timeout = \"10\"":                     "line 1",
+		"[[service.route]]":                         "service",
+		"[[service]]\n[[service.route]]\nport = 80": `unknown key "service.route.port"`,
+		"[[service]]\ntarget = \"a:80\"\ntargets = [\"b:80\"]": "service 1: target and targets are both set",
+		"[[service]]\nlisten-port = \"443\"":                   "line 2",
+	} {
+		var cfg proxyConfig
+		err := parseConfig(strings.NewReader(file), &cfg)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: got error %v, want %q", file, err, want)
+		}
+	}
+}
+
+// TestValidate verifies that unusable services are rejected.
+func TestValidate(t *testing.T) {
+	for name, services := range map[string][]serviceConfig{
+		"none":                    nil,
+		"bad port":                {{ListenPort: 0, Targets: []string{"localhost:80"}}},
+		"duplicate port":          {{ListenPort: 80, Targets: []string{"localhost:80"}}, {ListenPort: 80, Targets: []string{"localhost:81"}}},
+		"bad target":              {{ListenPort: 80, Targets: []string{"localhost"}}},
+		"no socket path":          {{ListenPort: 80, Targets: []string{"unix:"}}},
+		"no target":               {{ListenPort: 80}},
+		"bad balance":             {{ListenPort: 80, Targets: []string{"localhost:80"}, Balance: "random"}},
+		"no address port":         {{ListenPort: 80, ListenAddr: "0.0.0.0:", Targets: []string{"localhost:80"}}},
+		"shared address":          {{ListenPort: 80, ListenAddr: ":443", Targets: []string{"localhost:80"}}, {ListenPort: 81, ListenAddr: ":443", Targets: []string{"localhost:81"}}},
+		"route domain":            {{ListenPort: 80, Targets: []string{"localhost:80"}, Routes: []routeConfig{{Targets: []string{"localhost:81"}}}}},
+		"route twice":             {{ListenPort: 80, Targets: []string{"localhost:80"}, Routes: []routeConfig{{Domain: "a.example.com", Targets: []string{"localhost:81"}}, {Domain: "a.example.com", Targets: []string{"localhost:82"}}}}},
+		"bad allow":               {{ListenPort: 80, Targets: []string{"localhost:80"}, Allow: []string{"tor"}}},
+		"route target":            {{ListenPort: 80, Targets: []string{"localhost:80"}, Routes: []routeConfig{{Domain: "a.example.com"}}}},
+		"route both":              {{ListenPort: 80, Targets: []string{"localhost:80"}, Routes: []routeConfig{{Domain: "a.example.com", Transport: "onion", Targets: []string{"localhost:81"}}}}},
+		"route transport":         {{ListenPort: 80, Targets: []string{"localhost:80"}, Routes: []routeConfig{{Transport: "tor", Targets: []string{"localhost:81"}}}}},
+		"route disallowed":        {{ListenPort: 80, Targets: []string{"localhost:80"}, Allow: []string{"i2p"}, Routes: []routeConfig{{Transport: "onion", Targets: []string{"localhost:81"}}}}},
+		"passthrough domains":     {{ListenPort: 80, Targets: []string{"localhost:80"}, Passthrough: true, Domains: []string{"a.example.com"}}},
+		"passthrough tls":         {{ListenPort: 80, Targets: []string{"localhost:80"}, Passthrough: true, BackendTLS: backendTLS{Enabled: true}}},
+		"passthrough route":       {{ListenPort: 80, Targets: []string{"localhost:80"}, Passthrough: true, Routes: []routeConfig{{Domain: "a.example.com", Targets: []string{"localhost:81"}, BackendTLS: backendTLS{Enabled: true}}}}},
+		"tls socket":              {{ListenPort: 80, Targets: []string{"unix:/run/app.sock"}, BackendTLS: backendTLS{Enabled: true}}},
+		"server name alone":       {{ListenPort: 80, Targets: []string{"localhost:80"}, Routes: []routeConfig{{Transport: "onion", Targets: []string{"localhost:81"}, BackendTLS: backendTLS{ServerName: "app.internal"}}}}},
+		"passthrough headers":     {{ListenPort: 80, Targets: []string{"localhost:80"}, Passthrough: true, Middleware: middleware{ForwardHeaders: true}}},
+		"send-proxy version":      {{ListenPort: 80, Targets: []string{"localhost:80"}, Middleware: middleware{SendProxy: "v3"}}},
+		"bad allow-ips":           {{ListenPort: 80, Targets: []string{"localhost:80"}, Middleware: middleware{AllowIPs: []string{"10.0.0.0/33"}}}},
+		"passthrough maintenance": {{ListenPort: 80, Targets: []string{"localhost:80"}, Passthrough: true, MaintenancePage: "/srv/maintenance.html"}},
+		"bad shadow":              {{ListenPort: 80, Targets: []string{"localhost:80"}, Shadow: "localhost"}},
+		"passthrough shadow":      {{ListenPort: 80, Targets: []string{"localhost:80"}, Passthrough: true, Shadow: "localhost:81"}},
+		"tls shadow socket":       {{ListenPort: 80, Targets: []string{"localhost:80"}, Shadow: "unix:/run/new.sock", BackendTLS: backendTLS{Enabled: true}}},
+		"bad deny-ips":            {{ListenPort: 80, Targets: []string{"localhost:80"}, Middleware: middleware{DenyIPs: []string{"example.com"}}}},
+		"negative rate":           {{ListenPort: 80, Targets: []string{"localhost:80"}, Middleware: middleware{Bandwidth: meta.Bandwidth{ConnRead: -1}}}},
+		"passthrough scrub":       {{ListenPort: 80, Targets: []string{"localhost:80"}, Passthrough: true, Middleware: middleware{Scrub: responseScrub{Enabled: true}}}},
+		"passthrough alt-svc":     {{ListenPort: 80, Targets: []string{"localhost:80"}, Passthrough: true, Middleware: middleware{AltSvc: true}}},
+		"scrub header":            {{ListenPort: 80, Targets: []string{"localhost:80"}, Middleware: middleware{Scrub: responseScrub{Enabled: true, Headers: []string{"X Backend"}}}}},
+		"scrub transport":         {{ListenPort: 80, Targets: []string{"localhost:80"}, Middleware: middleware{Scrub: responseScrub{Enabled: true, Transports: []string{"tor"}}}}},
+		"scrub date alone":        {{ListenPort: 80, Targets: []string{"localhost:80"}, Middleware: middleware{Scrub: responseScrub{Date: time.Hour}}}},
+		"negative client cap":     {{ListenPort: 80, Targets: []string{"localhost:80"}, Middleware: middleware{Clients: &clientLimits{MaxConns: -1}}}},
+		"transport twice":         {{ListenPort: 80, Targets: []string{"localhost:80"}, Routes: []routeConfig{{Transport: "onion", Targets: []string{"localhost:81"}}, {Transport: "onion", Targets: []string{"localhost:82"}}}}},
+	} {
+		cfg := proxyConfig{MaxConns: 1, Services: services}
+		if err := cfg.validate(); err == nil {
+			t.Errorf("%s: validate succeeded", name)
+		}
+	}
+	valid := []serviceConfig{{ListenPort: 80, Targets: []string{"localhost:80"}}}
+	for name, cfg := range map[string]proxyConfig{
+		"log level":       {MaxConns: 1, LogLevel: "verbose", Services: valid},
+		"log format":      {MaxConns: 1, LogFormat: "xml", Services: valid},
+		"header":          {MaxConns: 1, RequestIDHeader: "X Request", Services: valid},
+		"ocsp mode":       {MaxConns: 1, Email: "a@example.com", ClientCA: "ca.pem", ClientOCSP: "always", Services: valid},
+		"crl alone":       {MaxConns: 1, ClientCRL: "crl.pem", Services: valid},
+		"no email":        {MaxConns: 1, ClientCA: "ca.pem", Services: valid},
+		"proxy alone":     {MaxConns: 1, AcceptProxy: true, Services: valid},
+		"sam address":     {MaxConns: 1, SAMAddrs: []string{"127.0.0.1"}, Services: valid},
+		"statsd addr":     {MaxConns: 1, StatsD: "127.0.0.1", Services: valid},
+		"statsd tag":      {MaxConns: 1, StatsD: "127.0.0.1:8125", StatsDTags: []string{"prod"}, Services: valid},
+		"tags alone":      {MaxConns: 1, StatsDTags: []string{"env:prod"}, Services: valid},
+		"capture pattern": {MaxConns: 1, CaptureDir: "capture", CaptureIdentities: []string{"[a"}, Services: valid},
+		"capture bytes":   {MaxConns: 1, CaptureDir: "capture", CaptureBytes: -1, Services: valid},
+		"capture alone":   {MaxConns: 1, CaptureListeners: []string{"tls"}, Services: valid},
+	} {
+		if err := cfg.validate(); err == nil {
+			t.Errorf("%s: validate succeeded", name)
+		}
+	}
+}
+
+// TestServiceDomains verifies that routed domains are served along with
+// the service's domains, once each.
+func TestServiceDomains(t *testing.T) {
+	svc := serviceConfig{
+		Domains: []string{"www.example.com", "blog.example.com"},
+		Routes:  []routeConfig{{Domain: "blog.example.com"}, {Transport: "onion"}, {Domain: "git.example.com"}},
+	}
+	want := []string{"www.example.com", "blog.example.com", "git.example.com"}
+	if got := svc.domains(); !reflect.DeepEqual(got, want) {
+		t.Errorf("domains() = %v, want %v", got, want)
+	}
+}
+
+// TestTLSAddr verifies how a service's clearnet listen address is derived
+// from the top-level and service listen-addr.
+func TestTLSAddr(t *testing.T) {
+	for _, tc := range []struct {
+		top, service string
+		want         string
+	}{
+		{"", "", ""},
+		{"0.0.0.0", "", "0.0.0.0:8443"},
+		{"::", "", "[::]:8443"},
+		{"0.0.0.0", "10.0.0.5", "10.0.0.5:8443"},
+		{"0.0.0.0", ":443", ":443"},
+	} {
+		cfg := proxyConfig{ListenAddr: tc.top}
+		got := cfg.tlsAddr(serviceConfig{ListenPort: 8443, ListenAddr: tc.service})
+		if got != tc.want {
+			t.Errorf("listen-addr %q and %q: got %q, want %q", tc.top, tc.service, got, tc.want)
+		}
+	}
+}
+
+// TestForwardFlags verifies that -forward rules are parsed into services.
+func TestForwardFlags(t *testing.T) {
+	var f forwardFlags
+	for _, rule := range []string{"443=localhost:3000", "2222=127.0.0.1:22", "80=10.0.0.1:80,10.0.0.2:80", "8080=10.0.0.3:80,onion=10.0.0.4:80,i2p=10.0.0.5:80,onion=10.0.0.6:80"} {
+		if err := f.Set(rule); err != nil {
+			t.Fatalf("Set(%q): %v", rule, err)
+		}
+	}
+	want := forwardFlags{
+		{ListenPort: 443, Targets: []string{"localhost:3000"}},
+		{ListenPort: 2222, Targets: []string{"127.0.0.1:22"}},
+		{ListenPort: 80, Targets: []string{"10.0.0.1:80", "10.0.0.2:80"}},
+		{ListenPort: 8080, Targets: []string{"10.0.0.3:80"}, Routes: []routeConfig{
+			{Transport: "onion", Targets: []string{"10.0.0.4:80", "10.0.0.6:80"}},
+			{Transport: "i2p", Targets: []string{"10.0.0.5:80"}},
+		}},
+	}
+	if !reflect.DeepEqual(f, want) {
+		t.Errorf("got %+v, want %+v", f, want)
+	}
+	if s := f.String(); s != "443=localhost:3000,2222=127.0.0.1:22,80=10.0.0.1:80,10.0.0.2:80,8080=10.0.0.3:80,onion=10.0.0.4:80,onion=10.0.0.6:80,i2p=10.0.0.5:80" {
+		t.Errorf("String() = %q", s)
+	}
+	for _, rule := range []string{"localhost:3000", "web=localhost:3000"} {
+		if err := f.Set(rule); err == nil {
+			t.Errorf("Set(%q) succeeded", rule)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// controlTimeout bounds reading a command from the control socket; the
+// client waits longer for the reply, since a reload can restart services.
+const (
+	controlTimeout      = 10 * time.Second
+	controlReplyTimeout = 2 * time.Minute
+)
+
+// errorPrefix starts the reply to a command that failed.
+const errorPrefix = "error: "
+
+// controlHelp lists the commands of the control socket.
+const controlHelp = `status             uptime, connections, and services
+list-conns         connections being forwarded
+kill <conn-id>     close a connection
+reload             re-read the configuration file, like SIGHUP
+`
+
+// controlServer answers commands on the control socket: one command line
+// per connection, answered with text and the connection closed.
+type controlServer struct {
+	listener net.Listener
+	// path is where the socket is, removed by close
+	path  string
+	proxy *proxy
+	pool  *connectionPool
+	// reload re-reads the configuration file on the main goroutine
+	reload  func() error
+	started time.Time
+}
+
+// listenControl creates the control socket at path, readable and writable
+// by its owner only. A socket left behind by a metaproxy that is no longer
+// running is replaced.
+func listenControl(path string, p *proxy, pool *connectionPool, reload func() error) (*controlServer, error) {
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("control socket %s is in use by another process", path)
+		}
+		os.Remove(path)
+	}
+	listener, err := listenPrivateUnix(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create control socket: %w", err)
+	}
+	cs := &controlServer{
+		listener: listener,
+		path:     path,
+		proxy:    p,
+		pool:     pool,
+		reload:   reload,
+		started:  time.Now(),
+	}
+	go cs.serve()
+	return cs, nil
+}
+
+// close stops answering commands and removes the socket.
+func (cs *controlServer) close() {
+	cs.listener.Close()
+	os.Remove(cs.path)
+}
+
+// listenPrivateUnix listens on a Unix socket at path that only its owner
+// can connect to. The socket is bound under the process umask, so it is
+// created in a directory of its own, accessible to the owner only, and
+// restricted there before being moved to path: other users never see it
+// with wider permissions. The listener does not remove path on close.
+func listenPrivateUnix(path string) (*net.UnixListener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".ctl")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "s")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	listener.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, 0o600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func (cs *controlServer) serve() {
+	for {
+		conn, err := cs.listener.Accept()
+		if err != nil {
+			return
+		}
+		go cs.handle(conn)
+	}
+}
+
+// handle reads one command from conn and writes its reply.
+func (cs *controlServer) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(controlTimeout))
+	line, err := bufio.NewReader(io.LimitReader(conn, 1024)).ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		fmt.Fprint(conn, errorPrefix+"empty command\n")
+		return
+	}
+	log.Debugf("Control command: %s", strings.Join(fields, " "))
+	if err := cs.command(conn, fields[0], fields[1:]); err != nil {
+		fmt.Fprintf(conn, "%s%v\n", errorPrefix, err)
+	}
+}
+
+// command runs name with args, writing its output to w.
+func (cs *controlServer) command(w io.Writer, name string, args []string) error {
+	switch name {
+	case "status":
+		return cs.status(w)
+	case "list-conns":
+		return cs.listConns(w)
+	case "kill":
+		if len(args) != 1 {
+			return errors.New("usage: kill <conn-id>")
+		}
+		if !cs.pool.kill(args[0]) {
+			return fmt.Errorf("no connection %s", args[0])
+		}
+		log.Printf("Connection %s closed from the control socket", args[0])
+		fmt.Fprintf(w, "closed %s\n", args[0])
+		return nil
+	case "reload":
+		if err := cs.reload(); err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "reloaded")
+		return nil
+	case "help":
+		fmt.Fprint(w, controlHelp)
+		return nil
+	}
+	return fmt.Errorf("unknown command %q, try help", name)
+}
+
+// status writes the uptime, connection counts, and services.
+func (cs *controlServer) status(w io.Writer) error {
+	cfg := cs.proxy.config()
+	fmt.Fprintf(w, "uptime: %s\n", time.Since(cs.started).Round(time.Second))
+	fmt.Fprintf(w, "connections: %d active, limit %d\n", cs.pool.activeCount(), cfg.MaxConns)
+	for _, svc := range cfg.Services {
+		balance := svc.Balance
+		if balance == "" {
+			balance = balanceRoundRobin
+		}
+		allow := ""
+		if len(svc.Allow) > 0 {
+			allow = ", allow " + strings.Join(svc.Allow, " ")
+		}
+		fmt.Fprintf(w, "service %d: %s (%s%s)\n", svc.ListenPort, strings.Join(svc.Targets, ", "), balance, allow)
+		for _, route := range svc.Routes {
+			balance := route.Balance
+			if balance == "" {
+				balance = balanceRoundRobin
+			}
+			fmt.Fprintf(w, "  route %s: %s (%s)\n", route.name(), strings.Join(route.Targets, ", "), balance)
+		}
+	}
+	return nil
+}
+
+// listConns writes a table of the connections being forwarded.
+func (cs *controlServer) listConns(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tCLIENT\tTARGET\tAGE\tIDLE")
+	for _, s := range cs.pool.list() {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", s.id, s.client, s.target,
+			time.Since(s.started).Round(time.Second), s.last.idleFor().Round(time.Second))
+	}
+	return tw.Flush()
+}
+
+// controlRequest sends command to the control socket at path and copies the
+// reply to out, returning the error a failed command replies with.
+func controlRequest(path, command string, out io.Writer) error {
+	conn, err := net.DialTimeout("unix", path, controlTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to control socket: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlReplyTimeout))
+	if _, err := fmt.Fprintf(conn, "%s\n", command); err != nil {
+		return err
+	}
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		return err
+	}
+	if msg, ok := strings.CutPrefix(string(reply), errorPrefix); ok {
+		return errors.New(strings.TrimSpace(msg))
+	}
+	_, err = out.Write(reply)
+	return err
+}
+
+// runCtl is the ctl subcommand, a client for the control socket. It returns
+// the exit status.
+func runCtl(args []string) int {
+	fs := flag.NewFlagSet("metaproxy ctl", flag.ExitOnError)
+	path := fs.String("control", "", "Control socket of the running metaproxy")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: metaproxy ctl -control <socket> <command>\n\nCommands:\n%s\nFlags:\n", controlHelp)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *path == "" || fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	if err := controlRequest(*path, strings.Join(fs.Args(), " "), os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
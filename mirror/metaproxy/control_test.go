@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestControlSocket verifies the control socket commands against a proxy
+// forwarding one connection.
+func TestControlSocket(t *testing.T) {
+	pool := newConnectionPool(10)
+	defer pool.shutdown()
+	client := proxiedConn(t, pool, echoBackend(t))
+	waitFor(t, func() bool { return len(pool.list()) == 1 })
+
+	cfg := proxyConfig{MaxConns: 10, Services: []serviceConfig{{ListenPort: 443, Targets: []string{"127.0.0.1:8080"}}}}
+	reloads := 0
+	path := filepath.Join(t.TempDir(), "control.sock")
+	control, err := listenControl(path, newProxy(nil, pool, cfg), pool, func() error {
+		reloads++
+		if reloads > 1 {
+			return errors.New("bad config")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("listenControl: %v", err)
+	}
+	defer control.close()
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("socket mode %v, %v; want 0600", info.Mode().Perm(), err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("Socket directory holds %d entries, want only the socket", len(entries))
+	}
+
+	run := func(command string) (string, error) {
+		var out bytes.Buffer
+		err := controlRequest(path, command, &out)
+		return out.String(), err
+	}
+	for command, want := range map[string]string{
+		"status":     "connections: 1 active, limit 10\nservice 443: 127.0.0.1:8080 (round-robin)\n",
+		"list-conns": "test ",
+		"help":       "kill <conn-id>",
+		"reload":     "reloaded\n",
+	} {
+		out, err := run(command)
+		if err != nil || !strings.Contains(out, want) {
+			t.Errorf("%s: got %q, %v; want %q", command, out, err, want)
+		}
+	}
+	for command, want := range map[string]string{
+		"reload":      "bad config",
+		"kill":        "usage: kill <conn-id>",
+		"kill nobody": "no connection nobody",
+		"restart":     `unknown command "restart"`,
+	} {
+		if _, err := run(command); err == nil || err.Error() != want && !strings.HasPrefix(err.Error(), want) {
+			t.Errorf("%s: got error %v, want %q", command, err, want)
+		}
+	}
+
+	if out, err := run("kill test"); err != nil || out != "closed test\n" {
+		t.Errorf("kill: got %q, %v", out, err)
+	}
+	if !waitClosed(client, 5*time.Second) {
+		t.Error("killed connection was not closed")
+	}
+	waitFor(t, func() bool { return len(pool.list()) == 0 })
+}
+
+// TestControlSocketInUse verifies that a running proxy's socket is not
+// taken over, while a stale one is replaced.
+func TestControlSocketInUse(t *testing.T) {
+	pool := newConnectionPool(1)
+	defer pool.shutdown()
+	p := newProxy(nil, pool, proxyConfig{})
+	path := filepath.Join(t.TempDir(), "control.sock")
+
+	control, err := listenControl(path, p, pool, nil)
+	if err != nil {
+		t.Fatalf("listenControl: %v", err)
+	}
+	if _, err := listenControl(path, p, pool, nil); err == nil {
+		t.Error("second listenControl on a socket in use succeeded")
+	}
+	control.close()
+
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	control, err = listenControl(path, p, pool, nil)
+	if err != nil {
+		t.Fatalf("listenControl over a stale socket: %v", err)
+	}
+	control.close()
+}
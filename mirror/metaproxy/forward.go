@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-i2p/go-meta-listener"
+	"github.com/sirupsen/logrus"
+)
+
+// activity records when a connection last carried data in either direction.
+type activity struct {
+	last atomic.Int64
+}
+
+func (a *activity) touch() { a.last.Store(time.Now().UnixNano()) }
+
+// idleFor returns how long ago the connection last carried data.
+func (a *activity) idleFor() time.Duration {
+	return time.Since(time.Unix(0, a.last.Load()))
+}
+
+// activityReader records activity on every read that returns data.
+type activityReader struct {
+	r    io.Reader
+	last *activity
+}
+
+func (ar activityReader) Read(p []byte) (int, error) {
+	n, err := ar.r.Read(p)
+	if n > 0 {
+		ar.last.touch()
+	}
+	return n, err
+}
+
+// forward copies src to dst until src is done sending, then half-closes
+// both so the peers see the end of this direction while the other one
+// keeps flowing. A leg that cannot be half-closed is closed. When both legs
+// are plain TCP, the kernel moves the data without copying it through user
+// space (splice on Linux); wrapped and TLS connections use a buffered copy.
+func forward(dst, src net.Conn, last *activity, idle time.Duration) error {
+	var err error
+	dstTCP, dstOK := dst.(*net.TCPConn)
+	srcTCP, srcOK := src.(*net.TCPConn)
+	if dstOK && srcOK {
+		err = spliceCopy(dstTCP, srcTCP, last, idle)
+	} else {
+		_, err = io.Copy(dst, activityReader{src, last})
+	}
+	meta.CloseWrite(dst, dst.Close)
+	meta.CloseRead(src)
+	if errors.Is(err, net.ErrClosed) {
+		// The other direction or the watchdog closed the connection.
+		return nil
+	}
+	return err
+}
+
+// spliceChunk bounds each kernel copy so activity is recorded regularly.
+const spliceChunk = 1 << 20
+
+// spliceCopy copies src to dst with TCPConn.ReadFrom, which splices on
+// Linux. The kernel copy has no per-read hook, so each chunk is bounded by
+// a read deadline of half the idle timeout; a chunk that moved data records
+// activity, which keeps slow but active streams from looking idle to the
+// watchdog.
+func spliceCopy(dst, src *net.TCPConn, last *activity, idle time.Duration) error {
+	defer src.SetReadDeadline(time.Time{})
+	for {
+		if idle > 0 {
+			src.SetReadDeadline(time.Now().Add(idle / 2))
+		}
+		n, err := dst.ReadFrom(io.LimitReader(src, spliceChunk))
+		if n > 0 {
+			last.touch()
+		}
+		var netErr net.Error
+		switch {
+		case err == nil && n == 0:
+			// EOF
+			return nil
+		case err == nil:
+			continue
+		case errors.As(err, &netErr) && netErr.Timeout():
+			// The watchdog decides whether the connection is idle.
+			continue
+		default:
+			return err
+		}
+	}
+}
+
+// watchdog closes conns when ctx is done, which covers proxy shutdown and
+// the connection's maximum lifetime, or when they have been idle for idle,
+// unless idle is zero. Closing the connections unblocks the copies. The
+// returned function stops the watchdog.
+func watchdog(ctx context.Context, clog *logrus.Entry, last *activity, idle time.Duration, conns ...net.Conn) func() {
+	stop := make(chan struct{})
+	closeAll := func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+	go func() {
+		var tick <-chan time.Time
+		if idle > 0 {
+			ticker := time.NewTicker(max(idle/4, time.Millisecond))
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ctx.Done():
+				if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					clog.Debugf("Closing connection from %s after its maximum lifetime", conns[0].RemoteAddr())
+				}
+				closeAll()
+				return
+			case <-tick:
+				if last.idleFor() >= idle {
+					clog.Debugf("Closing connection from %s after %s idle", conns[0].RemoteAddr(), idle)
+					closeAll()
+					return
+				}
+			}
+		}
+	}()
+	return func() { close(stop) }
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(tb testing.TB) (*net.TCPConn, *net.TCPConn) {
+	tb.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+// wrappedConn hides the concrete type of a connection, as the Mirror's
+// connection wrappers do, so forward takes the buffered path.
+type wrappedConn struct {
+	net.Conn
+}
+
+// BenchmarkForward measures loopback throughput of one forwarded
+// direction, with and without the splice path.
+func BenchmarkForward(b *testing.B) {
+	for _, tc := range []struct {
+		name string
+		wrap func(net.Conn) net.Conn
+	}{
+		{"splice", func(c net.Conn) net.Conn { return c }},
+		{"buffered", func(c net.Conn) net.Conn { return wrappedConn{c} }},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			writer, src := tcpPair(b)
+			dst, reader := tcpPair(b)
+			chunk := make([]byte, 64<<10)
+			b.SetBytes(int64(len(chunk)))
+
+			var last activity
+			forwarded := make(chan error, 1)
+			go func() { forwarded <- forward(tc.wrap(dst), tc.wrap(src), &last, 0) }()
+			go func() {
+				for i := 0; i < b.N; i++ {
+					writer.Write(chunk)
+				}
+				writer.CloseWrite()
+			}()
+
+			b.ResetTimer()
+			n, err := io.Copy(io.Discard, reader)
+			b.StopTimer()
+			if err != nil || n != int64(b.N)*int64(len(chunk)) {
+				b.Fatalf("read %d bytes, %v", n, err)
+			}
+			if err := <-forwarded; err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
+// TestForwardSplice verifies that data and the end of stream cross the
+// splice path intact.
+func TestForwardSplice(t *testing.T) {
+	writer, src := tcpPair(t)
+	dst, reader := tcpPair(t)
+	data := make([]byte, 3*spliceChunk+123)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	var last activity
+	forwarded := make(chan error, 1)
+	go func() { forwarded <- forward(dst, src, &last, 0) }()
+	go func() {
+		writer.Write(data)
+		writer.CloseWrite()
+	}()
+
+	got, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(data) {
+		t.Errorf("got %d bytes, want %d intact", len(got), len(data))
+	}
+	if err := <-forwarded; err != nil {
+		t.Errorf("forward: %v", err)
+	}
+}
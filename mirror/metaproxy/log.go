@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/go-i2p/logger"
+	"github.com/sirupsen/logrus"
+)
+
+// log is the logger shared with the meta and mirror packages, so -log-level
+// and -log-format apply to the library's messages too.
+var log = logger.GetGoI2PLogger()
+
+// Log output formats.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// parseLogLevel parses level, such as debug or warn; empty selects info.
+func parseLogLevel(level string) (logrus.Level, error) {
+	if level == "" {
+		return logrus.InfoLevel, nil
+	}
+	return logrus.ParseLevel(level)
+}
+
+// logFormatter returns the formatter for format, text (the default) or json.
+func logFormatter(format string) (logrus.Formatter, error) {
+	switch format {
+	case "", logFormatText:
+		return &logrus.TextFormatter{FullTimestamp: true}, nil
+	case logFormatJSON:
+		return &logrus.JSONFormatter{}, nil
+	}
+	return nil, fmt.Errorf("unknown log format %q, want %s or %s", format, logFormatText, logFormatJSON)
+}
+
+// configureLogging sends messages at level and above to w in format. The
+// logger is left unchanged if either is invalid.
+func configureLogging(w io.Writer, level, format string) error {
+	lvl, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	formatter, err := logFormatter(format)
+	if err != nil {
+		return err
+	}
+	log.SetOutput(w)
+	log.SetLevel(lvl)
+	log.SetFormatter(formatter)
+	return nil
+}
+
+// newConnID returns a random ID for a proxied session, unique across
+// restarts and instances so it can be correlated with backend logs.
+func newConnID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// connLog returns the logger of the proxied session id, which adds the ID
+// to every message as the conn field. It goes through logrus directly
+// because the shared logger's WithField entries drop their fields.
+func connLog(id string) *logrus.Entry {
+	return log.Logger.WithField("conn", id)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// TestConfigureLogging verifies that the level filters messages and that
+// json output is one object per message.
+func TestConfigureLogging(t *testing.T) {
+	out, level, formatter := log.Out, log.GetLevel(), log.Formatter
+	t.Cleanup(func() {
+		log.SetOutput(out)
+		log.SetLevel(level)
+		log.SetFormatter(formatter)
+	})
+
+	var buf bytes.Buffer
+	if err := configureLogging(&buf, "warn", logFormatJSON); err != nil {
+		t.Fatalf("configureLogging: %v", err)
+	}
+	log.Debugf("Accepted connection from %s", "127.0.0.1:1234")
+	log.Printf("Configuration reloaded")
+	log.Warnf("Failed to connect to target %s", "127.0.0.1:80")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("logged %d messages, want 1:\n%s", len(lines), buf.String())
+	}
+	var entry map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("not JSON: %v: %s", err, lines[0])
+	}
+	if entry["level"] != "warning" || entry["msg"] != "Failed to connect to target 127.0.0.1:80" {
+		t.Errorf("got %v", entry)
+	}
+
+	for _, bad := range [][2]string{{"verbose", logFormatText}, {"info", "xml"}} {
+		if err := configureLogging(&buf, bad[0], bad[1]); err == nil {
+			t.Errorf("configureLogging(%q, %q) succeeded", bad[0], bad[1])
+		}
+	}
+	if log.GetLevel().String() != "warning" {
+		t.Errorf("invalid settings changed the level to %s", log.GetLevel())
+	}
+}
+
+// TestConnLog verifies that messages about a connection carry its ID.
+func TestConnLog(t *testing.T) {
+	out, level, formatter := log.Out, log.GetLevel(), log.Formatter
+	t.Cleanup(func() {
+		log.SetOutput(out)
+		log.SetLevel(level)
+		log.SetFormatter(formatter)
+	})
+
+	var buf bytes.Buffer
+	if err := configureLogging(&buf, "debug", logFormatJSON); err != nil {
+		t.Fatalf("configureLogging: %v", err)
+	}
+	id := newConnID()
+	if other := newConnID(); other == id || len(id) != 16 {
+		t.Errorf("IDs %q and %q, want distinct 16 character IDs", id, other)
+	}
+	connLog(id).Debugf("Connected to target %s", "127.0.0.1:80")
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("not JSON: %v: %s", err, buf.String())
+	}
+	if entry["conn"] != id {
+		t.Errorf("got %v, want conn %s", entry, id)
+	}
+}
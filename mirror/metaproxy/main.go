@@ -2,253 +2,619 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
-	"log"
 	"net"
 	"os"
 	"os/signal"
+	"sort"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/go-i2p/go-meta-listener"
 	"github.com/go-i2p/go-meta-listener/mirror"
 )
 
 const (
 	maxConcurrentConnections = 100 // Limit concurrent connections
-	connectionTimeout        = 30 * time.Second
-	shutdownTimeout          = 5 * time.Second
+	defaultIdleTimeout       = 5 * time.Minute
+	defaultDrainTimeout      = 5 * time.Second
 )
 
 // connectionPool manages concurrent connections with proper lifecycle
 type connectionPool struct {
-	semaphore   chan struct{}
+	mu        sync.Mutex
+	slotFreed *sync.Cond // signaled when a slot frees up or the limit changes
+	active    int
+	limit     int
+	// draining refuses new connections while active ones finish
+	draining bool
+	// idleTimeout and maxLifetime apply to connections started after
+	// they are set; zero disables them
+	idleTimeout time.Duration
+	maxLifetime time.Duration
 	activeConns sync.WaitGroup
-	ctx         context.Context
-	cancel      context.CancelFunc
+	// sessions are the connections being forwarded, by ID
+	sessions map[string]*session
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// session is a connection being forwarded, as listed on the control socket.
+type session struct {
+	id      string
+	client  string
+	target  string
+	started time.Time
+	last    *activity
+	// cancel closes both legs of the connection
+	cancel context.CancelFunc
 }
 
 func newConnectionPool(maxConns int) *connectionPool {
 	ctx, cancel := context.WithCancel(context.Background())
-	return &connectionPool{
-		semaphore: make(chan struct{}, maxConns),
-		ctx:       ctx,
-		cancel:    cancel,
+	cp := &connectionPool{
+		limit:       maxConns,
+		idleTimeout: defaultIdleTimeout,
+		sessions:    make(map[string]*session),
+		ctx:         ctx,
+		cancel:      cancel,
 	}
+	cp.slotFreed = sync.NewCond(&cp.mu)
+	return cp
 }
 
-func (cp *connectionPool) handleConnection(clientConn net.Conn, targetHost string, targetPort int) {
-	// Acquire semaphore slot or block
-	select {
-	case cp.semaphore <- struct{}{}:
-		// Got slot, continue
-	case <-cp.ctx.Done():
+// setLimit changes the maximum number of concurrent connections. Lowering
+// it does not close connections; new ones wait until enough have finished.
+func (cp *connectionPool) setLimit(maxConns int) {
+	cp.mu.Lock()
+	cp.limit = maxConns
+	cp.mu.Unlock()
+	cp.slotFreed.Broadcast()
+}
+
+// setTimeouts changes how long new connections may stay idle and open.
+func (cp *connectionPool) setTimeouts(idle, lifetime time.Duration) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.idleTimeout, cp.maxLifetime = idle, lifetime
+}
+
+// acquire waits for a free slot, reporting false if the pool shut down.
+func (cp *connectionPool) acquire() bool {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	for cp.active >= cp.limit && cp.ctx.Err() == nil && !cp.draining {
+		cp.slotFreed.Wait()
+	}
+	if cp.ctx.Err() != nil || cp.draining {
+		return false
+	}
+	cp.active++
+	return true
+}
+
+// release frees a slot taken by acquire.
+func (cp *connectionPool) release() {
+	cp.mu.Lock()
+	cp.active--
+	cp.mu.Unlock()
+	cp.slotFreed.Signal()
+}
+
+// track lists s among the connections being forwarded until the returned
+// function is called.
+func (cp *connectionPool) track(s *session) func() {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.sessions[s.id] = s
+	return func() {
+		cp.mu.Lock()
+		defer cp.mu.Unlock()
+		delete(cp.sessions, s.id)
+	}
+}
+
+// list returns the connections being forwarded, oldest first.
+func (cp *connectionPool) list() []*session {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	sessions := make([]*session, 0, len(cp.sessions))
+	for _, s := range cp.sessions {
+		sessions = append(sessions, s)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].started.Before(sessions[j].started) })
+	return sessions
+}
+
+// kill closes the connection with ID id, reporting whether it was found.
+func (cp *connectionPool) kill(id string) bool {
+	cp.mu.Lock()
+	s, ok := cp.sessions[id]
+	cp.mu.Unlock()
+	if ok {
+		s.cancel()
+	}
+	return ok
+}
+
+// unixPrefix marks a target as a Unix socket path rather than host:port.
+const unixPrefix = "unix:"
+
+// handleConnection forwards clientConn to one of backends as session id,
+// calling done when the connection has been closed.
+func (cp *connectionPool) handleConnection(clientConn net.Conn, id string, backends *backendSet, done func()) {
+	// Acquire a slot or block
+	if !cp.acquire() {
 		clientConn.Close()
+		done()
 		return
 	}
 
 	// Track active connection
 	cp.activeConns.Add(1)
+	cp.mu.Lock()
+	idle, lifetime := cp.idleTimeout, cp.maxLifetime
+	cp.mu.Unlock()
 
+	clog := connLog(id)
 	// Handle connection in separate goroutine
 	go func() {
+		start := time.Now()
 		defer func() {
-			<-cp.semaphore // Release semaphore slot
+			cp.release()
 			cp.activeConns.Done()
 			clientConn.Close()
+			done()
+			clog.Debugf("Connection closed after %s", time.Since(start).Round(time.Millisecond))
 		}()
 
-		// Set connection timeout
-		clientConn.SetDeadline(time.Now().Add(connectionTimeout))
+		headers := make(map[string]string)
+		if backends.forwardHeaders {
+			headers = forwardedHeaders(clientConn)
+		}
+		if backends.idHeader != "" {
+			headers[backends.idHeader] = id
+		}
+		if len(headers) > 0 {
+			clientConn = mirror.AddHeaders(clientConn, headers)
+		}
 
-		// Connect to target with timeout
-		serverConn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", targetHost, targetPort), 10*time.Second)
+		// Connect to a target with timeout, answering HTTP clients with the
+		// maintenance page, if there is one, when none can be reached
+		serverConn, target, release, err := backends.dial(clog, clientConn)
 		if err != nil {
-			log.Printf("Failed to connect to target %s:%d: %v", targetHost, targetPort, err)
+			if backends.page != nil {
+				backends.page.serve(clog, clientConn)
+			}
 			return
 		}
+		defer release()
 		defer serverConn.Close()
 
-		// Set timeout on server connection
-		serverConn.SetDeadline(time.Now().Add(connectionTimeout))
+		// Copy what the client sends to the shadow target, if there is one
+		var src net.Conn = clientConn
+		if shadow := backends.startShadow(clog, clientConn); shadow != nil {
+			defer shadow.end()
+			src = teeConn{Conn: clientConn, shadow: shadow}
+		}
 
-		// Create context for this connection
+		// Rewrite the responses of HTTP targets: scrubbed for clients on the
+		// transports the service hides its identifying headers from, and
+		// advertising the hidden mirrors to clearnet clients
+		var rewrites []responseRewrite
+		if backends.scrub.applies(clientConn) {
+			rewrites = append(rewrites, backends.scrub.rewrite)
+		}
+		if clearnet, _ := (transportFilter{mirror.TransportTLS}).admits(clientConn); clearnet && backends.altSvc != nil {
+			rewrites = append(rewrites, altSvcRewrite(backends.altSvc))
+		}
+		var responses net.Conn = serverConn
+		if len(rewrites) > 0 {
+			var stopRewrite func()
+			src, responses, stopRewrite = rewriteResponses(src, serverConn, rewrites)
+			defer stopRewrite()
+		}
+
+		// Create context for this connection, ending it at its maximum
+		// lifetime; the watchdog closes both legs when it is done or the
+		// connection goes idle, which unblocks the copies
 		connCtx, connCancel := context.WithCancel(cp.ctx)
+		if lifetime > 0 {
+			connCtx, connCancel = context.WithTimeout(cp.ctx, lifetime)
+		}
 		defer connCancel()
-
-		// Forward data bidirectionally with proper error handling
+		var last activity
+		last.touch()
+		defer cp.track(&session{
+			id:      id,
+			client:  clientConn.RemoteAddr().String(),
+			target:  target,
+			started: start,
+			last:    &last,
+			cancel:  connCancel,
+		})()
+		stopWatchdog := watchdog(connCtx, clog, &last, idle, clientConn, serverConn)
+		defer stopWatchdog()
+
+		// Forward data bidirectionally, half-closing each leg when the
+		// other side is done sending
 		var wg sync.WaitGroup
 		wg.Add(2)
-
-		// Client to server
 		go func() {
 			defer wg.Done()
-			if _, err := copyWithContext(connCtx, serverConn, clientConn); err != nil && err != io.EOF {
-				log.Printf("Error copying client to server: %v", err)
-			}
-			// Close server write side to signal completion
-			if tcpConn, ok := serverConn.(*net.TCPConn); ok {
-				tcpConn.CloseWrite()
+			if err := forward(serverConn, src, &last, idle); err != nil && connCtx.Err() == nil {
+				clog.Debugf("Error copying client to server: %v", err)
 			}
 		}()
-
-		// Server to client
 		go func() {
 			defer wg.Done()
-			if _, err := copyWithContext(connCtx, clientConn, serverConn); err != nil && err != io.EOF {
-				log.Printf("Error copying server to client: %v", err)
-			}
-			// Close client write side to signal completion
-			if tcpConn, ok := clientConn.(*net.TCPConn); ok {
-				tcpConn.CloseWrite()
+			if err := forward(clientConn, responses, &last, idle); err != nil && connCtx.Err() == nil {
+				clog.Debugf("Error copying server to client: %v", err)
 			}
 		}()
+		wg.Wait()
+	}()
+}
 
-		// Wait for either copy operation to complete or context cancellation
-		done := make(chan struct{})
-		go func() {
-			wg.Wait()
-			close(done)
-		}()
+// activeCount returns the number of connections being forwarded.
+func (cp *connectionPool) activeCount() int {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.active
+}
 
-		select {
-		case <-done:
-			// Normal completion
-		case <-connCtx.Done():
-			// Context cancelled, connections will be closed by defers
-		}
+// drain refuses new connections and waits up to timeout for active ones to
+// finish, then closes the rest, returning how many it closed.
+func (cp *connectionPool) drain(timeout time.Duration) int {
+	cp.mu.Lock()
+	cp.draining = true
+	cp.mu.Unlock()
+	cp.slotFreed.Broadcast()
+
+	finished := make(chan struct{})
+	go func() {
+		cp.activeConns.Wait()
+		close(finished)
 	}()
+	cut := 0
+	select {
+	case <-finished:
+	case <-time.After(timeout):
+		cp.mu.Lock()
+		cut = cp.active
+		cp.mu.Unlock()
+	}
+	cp.shutdown()
+	return cut
 }
 
+// shutdown closes every connection and waits for them to finish.
 func (cp *connectionPool) shutdown() {
+	// Cancel under mu so no acquire misses the wakeup.
+	cp.mu.Lock()
 	cp.cancel()
+	cp.mu.Unlock()
+	cp.slotFreed.Broadcast()
 	cp.activeConns.Wait()
 }
 
-// copyWithContext copies data between connections with context cancellation support
-func copyWithContext(ctx context.Context, dst, src net.Conn) (int64, error) {
-	// Use a small buffer for responsive cancellation
-	buf := make([]byte, 32*1024)
-	var written int64
-
-	for {
-		select {
-		case <-ctx.Done():
-			return written, ctx.Err()
-		default:
-		}
-
-		// Set short read timeout for responsiveness
-		src.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
-		nr, er := src.Read(buf)
-		if nr > 0 {
-			nw, ew := dst.Write(buf[0:nr])
-			if nw < 0 || nr < nw {
-				nw = 0
-				if ew == nil {
-					ew = fmt.Errorf("invalid write count")
-				}
-			}
-			written += int64(nw)
-			if ew != nil {
-				return written, ew
-			}
-			if nr != nw {
-				return written, io.ErrShortWrite
-			}
-		}
-		if er != nil {
-			if netErr, ok := er.(net.Error); ok && netErr.Timeout() {
-				continue // Retry on timeout
-			}
-			if er != io.EOF {
-				return written, er
-			}
-			break
-		}
-	}
-	return written, nil
-}
-
 // main function sets up a meta listener that forwards connections to a specified host and port.
 // It listens for incoming connections and forwards them to the specified destination.
+// With -config, the settings are read from a file, and flags given on the
+// command line override the file's top-level keys.
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		os.Exit(runCtl(os.Args[2:]))
+	}
+
+	configPath := flag.String("config", "", "Configuration file; flags given on the command line override it")
 	host := flag.String("host", "localhost", "Host to forward connections to")
 	port := flag.Int("port", 8080, "Port to forward connections to")
 	listenPort := flag.Int("listen-port", 3002, "Port to listen for incoming connections")
-	domain := flag.String("domain", "i2pgit.org", "Domain name for TLS listener")
+	domain := flag.String("domain", "i2pgit.org", "Domain name the TLS certificates are issued for")
+	listenAddr := flag.String("listen-addr", "", "Host the clearnet TLS listeners bind on their listen ports, such as 0.0.0.0 (default :443 for every service)")
 	email := flag.String("email", "", "Email address for Let's Encrypt registration")
 	certDir := flag.String("certdir", "./certs", "Directory for storing certificates")
+	keyDir := flag.String("keydir", "", "Directory for storing Tor and I2P keys")
 	hiddenTls := flag.Bool("hidden-tls", false, "Enable hidden TLS")
 	maxConns := flag.Int("max-conns", maxConcurrentConnections, "Maximum concurrent connections")
+	idleTimeout := flag.Duration("idle-timeout", defaultIdleTimeout, "Close connections idle for this long (0 to never)")
+	drainTimeout := flag.Duration("drain-timeout", defaultDrainTimeout, "How long active connections may finish on shutdown before they are closed")
+	maxLifetime := flag.Duration("max-lifetime", 0, "Close connections open for this long (0 to never)")
+	clientMaxConns := flag.Int("client-max-conns", 0, "Maximum concurrent connections per client (0 for no limit)")
+	clientRate := flag.Int("client-rate", 0, "Maximum new connections per minute per client (0 for no limit)")
+	clientBan := flag.Duration("client-ban", 0, "How long clients going over -client-rate are refused")
+	banLog := flag.String("ban-log", "", "File every ban of a clearnet client over -client-rate is appended to, for fail2ban or nftables")
+	backendProxy := flag.String("backend-proxy", "", "SOCKS5 proxy targets are reached through, such as socks5://127.0.0.1:9050 for Tor")
+	backendCA := flag.String("backend-ca", "", "PEM file of the CAs the certificates of targets dialed over TLS are verified against (default: system roots)")
+	requestIDHeader := flag.String("request-id-header", "", "HTTP header, such as X-Request-ID, the connection ID is added to on each connection's first request")
+	check := flag.Bool("check", false, "Check the configuration, directories, and Tor and I2P availability, then exit without listening")
+	checkBackends := flag.Bool("check-backends", false, "With -check, also connect to every target")
+	clientCA := flag.String("client-ca", "", "PEM file of the CAs whose client certificates the clearnet TLS listeners require")
+	clientCRL := flag.String("client-crl", "", "CRL file of revoked client certificates, re-read when it changes")
+	clientOCSP := flag.String("client-ocsp", "", "Ask the OCSP responders of client certificates: soft lets clients in when one is unreachable, hard refuses them")
+	acceptProxyProtocol := flag.Bool("accept-proxy", false, "Read the PROXY protocol header a load balancer in front of the clearnet TLS listeners sends, for the real client addresses")
+	controlSocket := flag.String("control", "", "Unix socket to accept metaproxy ctl commands on")
+	logLevel := flag.String("log-level", "info", "Least severe messages logged: debug, info, warn, or error")
+	logFormat := flag.String("log-format", logFormatText, "Log output format: text or json")
+	var forwards forwardFlags
+	flag.Var(&forwards, "forward", "Forwarding rule listen-port=host:port[,host:port...]; repeat for several services")
 	flag.Parse()
 
-	mirror.CERT_DIR = *certDir
-	mirror.HIDDEN_TLS = *hiddenTls
-	addr := net.JoinHostPort(*domain, fmt.Sprintf("%d", *listenPort))
+	// Log with the flags until the configuration file is read
+	if err := configureLogging(os.Stderr, *logLevel, *logFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid logging flags: %v\n", err)
+		os.Exit(2)
+	}
+
+	// configure builds the configuration from the flags and the file; it
+	// runs again on SIGHUP to reload the file.
+	configure := func() (proxyConfig, error) {
+		cfg := proxyConfig{
+			Domain:          *domain,
+			ListenAddr:      *listenAddr,
+			Email:           *email,
+			CertDir:         *certDir,
+			KeyDir:          *keyDir,
+			HiddenTLS:       *hiddenTls,
+			MaxConns:        *maxConns,
+			IdleTimeout:     *idleTimeout,
+			MaxLifetime:     *maxLifetime,
+			DrainTimeout:    *drainTimeout,
+			Clients:         clientLimits{MaxConns: *clientMaxConns, Rate: *clientRate, Ban: *clientBan},
+			BanLog:          *banLog,
+			BackendProxy:    *backendProxy,
+			BackendCA:       *backendCA,
+			RequestIDHeader: *requestIDHeader,
+			ClientCA:        *clientCA,
+			ClientCRL:       *clientCRL,
+			ClientOCSP:      *clientOCSP,
+			AcceptProxy:     *acceptProxyProtocol,
+			ControlSocket:   *controlSocket,
+			LogLevel:        *logLevel,
+			LogFormat:       *logFormat,
+			LocalTCP:        true,
+			Tor:             true,
+			I2P:             true,
+		}
+		if *configPath != "" {
+			if err := loadConfig(*configPath, &cfg); err != nil {
+				return cfg, err
+			}
+			flag.Visit(func(f *flag.Flag) {
+				switch f.Name {
+				case "domain":
+					cfg.Domain = *domain
+				case "listen-addr":
+					cfg.ListenAddr = *listenAddr
+				case "email":
+					cfg.Email = *email
+				case "certdir":
+					cfg.CertDir = *certDir
+				case "keydir":
+					cfg.KeyDir = *keyDir
+				case "hidden-tls":
+					cfg.HiddenTLS = *hiddenTls
+				case "max-conns":
+					cfg.MaxConns = *maxConns
+				case "idle-timeout":
+					cfg.IdleTimeout = *idleTimeout
+				case "max-lifetime":
+					cfg.MaxLifetime = *maxLifetime
+				case "drain-timeout":
+					cfg.DrainTimeout = *drainTimeout
+				case "client-max-conns":
+					cfg.Clients.MaxConns = *clientMaxConns
+				case "client-rate":
+					cfg.Clients.Rate = *clientRate
+				case "client-ban":
+					cfg.Clients.Ban = *clientBan
+				case "ban-log":
+					cfg.BanLog = *banLog
+				case "backend-proxy":
+					cfg.BackendProxy = *backendProxy
+				case "backend-ca":
+					cfg.BackendCA = *backendCA
+				case "request-id-header":
+					cfg.RequestIDHeader = *requestIDHeader
+				case "client-ca":
+					cfg.ClientCA = *clientCA
+				case "client-crl":
+					cfg.ClientCRL = *clientCRL
+				case "client-ocsp":
+					cfg.ClientOCSP = *clientOCSP
+				case "accept-proxy":
+					cfg.AcceptProxy = *acceptProxyProtocol
+				case "control":
+					cfg.ControlSocket = *controlSocket
+				case "log-level":
+					cfg.LogLevel = *logLevel
+				case "log-format":
+					cfg.LogFormat = *logFormat
+				}
+			})
+		}
+		cfg.Services = append(cfg.Services, forwards...)
+		if len(cfg.Services) == 0 {
+			cfg.Services = []serviceConfig{{
+				ListenPort: *listenPort,
+				Targets:    []string{net.JoinHostPort(*host, strconv.Itoa(*port))},
+			}}
+		}
+		return cfg, cfg.validate()
+	}
+
+	cfg, err := configure()
+	if *check {
+		if !newChecker().run(cfg, err, *checkBackends, os.Stdout) {
+			os.Exit(1)
+		}
+		return
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if err := configureLogging(os.Stderr, cfg.LogLevel, cfg.LogFormat); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	mirror.CERT_DIR = cfg.CertDir
+	mirror.HIDDEN_TLS = cfg.HiddenTLS
+	if !cfg.Tor {
+		os.Setenv("DISABLE_TOR", "1")
+	}
+	if !cfg.I2P {
+		os.Setenv("DISABLE_I2P", "1")
+	}
 
 	// Create connection pool with specified limits
-	pool := newConnectionPool(*maxConns)
+	pool := newConnectionPool(cfg.MaxConns)
+	pool.setTimeouts(cfg.IdleTimeout, cfg.MaxLifetime)
 	defer pool.shutdown()
 
+	mirrorConfig := mirror.MirrorConfig{
+		EnableLocalTCP: cfg.LocalTCP,
+		KeyDir:         cfg.KeyDir,
+		SAMAddrs:       cfg.SAMAddrs,
+	}
+	if cfg.StatsD != "" {
+		mirrorConfig.StatsD = &mirror.StatsDConfig{Addr: cfg.StatsD, Prefix: cfg.StatsDPrefix, Tags: cfg.StatsDTags, Datadog: cfg.StatsDDatadog}
+	}
+	if cfg.CaptureDir != "" {
+		capture, err := meta.NewCapture(meta.CapturePolicy{
+			Dir:        cfg.CaptureDir,
+			Listeners:  cfg.CaptureListeners,
+			Identities: cfg.CaptureIdentities,
+			Limit:      cfg.CaptureBytes,
+			MaxFiles:   cfg.CaptureFiles,
+		})
+		if err != nil {
+			log.Fatalf("Failed to set up stream capture: %v", err)
+		}
+		log.Warnf("Recording the streams of selected connections to %s", cfg.CaptureDir)
+		mirrorConfig.Capture = capture
+	}
+	// Serve clearnet TLS on sockets passed by systemd socket activation
+	activated, err := activatedListeners()
+	if err != nil {
+		log.Fatalf("Failed to use systemd sockets: %v", err)
+	}
+	if len(activated) > 0 {
+		provider, err := newActivatedProvider(activated, cfg)
+		if err != nil {
+			log.Fatalf("Failed to use systemd sockets: %v", err)
+		}
+		mirrorConfig.CertProvider = provider
+	} else if cfg.AcceptProxy {
+		mirrorConfig.CertProvider = proxyProtocolProvider{}
+	} else if cfg.ClientCA != "" {
+		// wileedot cannot verify client certificates
+		mirrorConfig.CertProvider = &mirror.ACMEProvider{}
+	}
+
 	// Create a new meta listener
-	metaListener, err := mirror.Listen(addr, *email)
+	first := net.JoinHostPort(cfg.Domain, strconv.Itoa(cfg.Services[0].ListenPort))
+	metaListener, err := mirror.NewMirrorWithConfig(context.Background(), first, mirrorConfig)
 	if err != nil {
 		log.Fatalf("Failed to create meta listener: %v", err)
 	}
 	defer metaListener.Close()
 
-	// Set up graceful shutdown
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
-
-	log.Printf("Proxy server starting on %d, forwarding to %s:%d (max concurrent connections: %d)", *listenPort, *host, *port, *maxConns)
+	proxy := newProxy(metaListener, pool, cfg)
+	if err := proxy.start(); err != nil {
+		metaListener.Close()
+		log.Fatalf("Failed to start services: %v", err)
+	}
+	// Every transport of every service is listening; tell systemd
+	notify(fmt.Sprintf("READY=1\nSTATUS=Forwarding %d services", len(cfg.Services)))
+	go runWatchdog(pool.ctx)
+
+	// reload re-reads the configuration file; it runs on this goroutine,
+	// for SIGHUP and for the control socket
+	reload := func() error {
+		if *configPath == "" {
+			return errors.New("there is no configuration file to reload")
+		}
+		notify("RELOADING=1")
+		defer notify("READY=1")
+		cfg, err := configure()
+		if err == nil {
+			err = configureLogging(os.Stderr, cfg.LogLevel, cfg.LogFormat)
+		}
+		if err != nil {
+			log.Errorf("Keeping current configuration: %v", err)
+			return err
+		}
+		if err := proxy.reload(cfg); err != nil {
+			log.Warnf("Configuration reloaded with errors: %v", err)
+			return err
+		}
+		log.Println("Configuration reloaded")
+		return nil
+	}
 
-	// Start accepting connections in a separate goroutine
-	go func() {
-		for {
-			conn, err := metaListener.Accept()
-			if err != nil {
-				// Check if this is due to shutdown
-				select {
-				case <-pool.ctx.Done():
-					log.Println("Shutting down connection accept loop")
-					return
-				default:
-					log.Printf("Error accepting connection: %v", err)
-					continue
-				}
+	// Accept management commands on the control socket
+	reloads := make(chan chan error)
+	stopping := make(chan struct{})
+	if cfg.ControlSocket != "" {
+		control, err := listenControl(cfg.ControlSocket, proxy, pool, func() error {
+			reply := make(chan error, 1)
+			select {
+			case reloads <- reply:
+				return <-reply
+			case <-stopping:
+				return errors.New("metaproxy is shutting down")
 			}
-
-			log.Printf("Accepted connection from %s", conn.RemoteAddr())
-			pool.handleConnection(conn, *host, *port)
+		})
+		if err != nil {
+			log.Fatalf("Failed to start control socket: %v", err)
 		}
-	}()
+		defer control.close()
+		log.Printf("Accepting control commands on %s", cfg.ControlSocket)
+	}
+
+	// Set up graceful shutdown, and reloading on SIGHUP
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 
 	// Wait for shutdown signal
-	<-sigCh
+wait:
+	for {
+		select {
+		case sig := <-sigCh:
+			if sig != syscall.SIGHUP {
+				break wait
+			}
+			if *configPath == "" {
+				log.Warnln("SIGHUP received, but there is no configuration file to reload")
+				continue
+			}
+			log.Printf("SIGHUP received, reloading %s", *configPath)
+			reload()
+		case reply := <-reloads:
+			log.Printf("Reload requested on the control socket, reloading %s", *configPath)
+			reply <- reload()
+		}
+	}
+	close(stopping)
 	log.Println("Shutdown signal received, stopping proxy...")
+	notify("STOPPING=1")
 
 	// Close listener to stop accepting new connections
+	proxy.close()
 	metaListener.Close()
 
-	// Shutdown connection pool with timeout
-	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), shutdownTimeout)
-	defer shutdownCancel()
-
-	done := make(chan struct{})
-	go func() {
-		pool.shutdown()
-		close(done)
-	}()
-
-	select {
-	case <-done:
+	// Let active connections finish, up to the drain timeout
+	grace := proxy.drainTimeout()
+	log.Printf("Draining %d connections for up to %s", pool.activeCount(), grace)
+	if cut := pool.drain(grace); cut > 0 {
+		log.Warnf("Drain timeout exceeded, closed %d connections", cut)
+	} else {
 		log.Println("All connections closed gracefully")
-	case <-shutdownCtx.Done():
-		log.Println("Shutdown timeout exceeded, forcing exit")
 	}
 
 	log.Println("Proxy server stopped")
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// echoBackend echoes everything it receives and returns its address.
+func echoBackend(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// proxiedConn forwards a connection through pool to target and returns the
+// client end.
+func proxiedConn(t *testing.T, pool *connectionPool, target string) net.Conn {
+	t.Helper()
+	return proxiedConnVia(t, pool, newBackendSet([]string{target}, "", &net.Dialer{}))
+}
+
+// proxiedConnVia is proxiedConn forwarding to backends.
+func proxiedConnVia(t *testing.T, pool *connectionPool, backends *backendSet) net.Conn {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.handleConnection(server, "test", backends, func() {})
+	return client
+}
+
+// waitClosed reports whether conn is closed by the proxy within d.
+func waitClosed(conn net.Conn, d time.Duration) bool {
+	conn.SetReadDeadline(time.Now().Add(d))
+	_, err := conn.Read(make([]byte, 1))
+	return err == io.EOF
+}
+
+// waitFor polls cond until it holds, failing the test after five seconds.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within 5s")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// TestIdleTimeout verifies that active connections outlive the idle
+// timeout and idle ones are closed.
+func TestIdleTimeout(t *testing.T) {
+	pool := newConnectionPool(10)
+	defer pool.shutdown()
+	pool.setTimeouts(300*time.Millisecond, 0)
+	client := proxiedConn(t, pool, echoBackend(t))
+
+	buf := make([]byte, 1)
+	for i := 0; i < 10; i++ {
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := client.Write([]byte{'x'}); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+		if _, err := io.ReadFull(client, buf); err != nil {
+			t.Fatalf("read %d: %v", i, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !waitClosed(client, 5*time.Second) {
+		t.Error("idle connection was not closed")
+	}
+}
+
+// TestMaxLifetime verifies that connections are closed at their maximum
+// lifetime even while active.
+func TestMaxLifetime(t *testing.T) {
+	pool := newConnectionPool(10)
+	defer pool.shutdown()
+	pool.setTimeouts(0, 300*time.Millisecond)
+	client := proxiedConn(t, pool, echoBackend(t))
+
+	start := time.Now()
+	buf := make([]byte, 1)
+	for time.Since(start) < 5*time.Second {
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := client.Write([]byte{'x'}); err != nil {
+			break
+		}
+		if _, err := io.ReadFull(client, buf); err != nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed >= 5*time.Second {
+		t.Errorf("connection still open after %s", elapsed)
+	}
+}
+
+// TestHalfClose verifies that a client can finish sending and still
+// receive the backend's reply.
+func TestHalfClose(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request, _ := io.ReadAll(conn)
+		conn.Write(append([]byte("got "), request...))
+	}()
+
+	pool := newConnectionPool(10)
+	defer pool.shutdown()
+	client := proxiedConn(t, pool, listener.Addr().String())
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	client.Write([]byte("request"))
+	client.(*net.TCPConn).CloseWrite()
+	reply, err := io.ReadAll(client)
+	if err != nil || string(reply) != "got request" {
+		t.Errorf("got %q, %v, want \"got request\"", reply, err)
+	}
+}
+
+// TestShutdownClosesConnections verifies that shutting down the pool ends
+// forwarded connections blocked in a read.
+func TestShutdownClosesConnections(t *testing.T) {
+	pool := newConnectionPool(10)
+	pool.setTimeouts(0, 0)
+	client := proxiedConn(t, pool, echoBackend(t))
+
+	finished := make(chan struct{})
+	go func() {
+		pool.shutdown()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not return")
+	}
+	if !waitClosed(client, 5*time.Second) {
+		t.Error("connection was not closed")
+	}
+}
+
+// TestDrain verifies that draining lets connections finish within the
+// timeout, then closes and counts the rest, and refuses new ones.
+func TestDrain(t *testing.T) {
+	pool := newConnectionPool(10)
+	pool.setTimeouts(0, 0)
+	finishing := proxiedConn(t, pool, echoBackend(t))
+	proxiedConn(t, pool, echoBackend(t))
+
+	// One client finishes while the pool drains.
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		finishing.Close()
+	}()
+	if cut := pool.drain(time.Second); cut != 1 {
+		t.Errorf("drain closed %d connections, want 1", cut)
+	}
+	if pool.acquire() {
+		t.Error("acquire succeeded while draining")
+	}
+}
+
+// TestDrainIdle verifies that a pool with no connections drains at once.
+func TestDrainIdle(t *testing.T) {
+	pool := newConnectionPool(10)
+	start := time.Now()
+	if cut := pool.drain(5 * time.Second); cut != 0 {
+		t.Errorf("drain closed %d connections, want 0", cut)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("drain took %s", elapsed)
+	}
+}
+
+// TestRequestIDHeader verifies that the connection ID is added to the first
+// HTTP request when the service has a request ID header.
+func TestRequestIDHeader(t *testing.T) {
+	pool := newConnectionPool(10)
+	defer pool.shutdown()
+	backends := newBackendSet([]string{echoBackend(t)}, "", &net.Dialer{})
+	backends.idHeader = "X-Request-ID"
+	client := proxiedConnVia(t, pool, backends)
+
+	client.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	client.(*net.TCPConn).CloseWrite()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	echoed, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !strings.Contains(string(echoed), "X-Request-Id: test\r\n") {
+		t.Errorf("backend received %q, want an X-Request-Id: test header", echoed)
+	}
+}
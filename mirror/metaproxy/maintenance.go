@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maintenanceTimeout bounds reading the request a maintenance page answers.
+const maintenanceTimeout = 10 * time.Second
+
+// maintenanceCheckInterval is how often the targets of a service serving
+// its maintenance page are dialed to see whether one is back.
+var maintenanceCheckInterval = 5 * time.Second
+
+// errBackendsDown is returned by dial while a service serves its
+// maintenance page instead of dialing its targets.
+var errBackendsDown = errors.New("every target is down")
+
+// maintenancePage is the static response HTTP clients get while none of a
+// service's targets can be reached.
+type maintenancePage struct {
+	body        []byte
+	contentType string
+}
+
+// loadMaintenancePage reads the page at path, typed by its extension or,
+// failing that, its content. An empty path means no page.
+func loadMaintenancePage(path string) (*maintenancePage, error) {
+	if path == "" {
+		return nil, nil
+	}
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read maintenance-page: %w", err)
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	return &maintenancePage{body: body, contentType: contentType}, nil
+}
+
+// equal reports whether mp and other are the same response.
+func (mp *maintenancePage) equal(other *maintenancePage) bool {
+	if mp == nil || other == nil {
+		return mp == other
+	}
+	return mp.contentType == other.contentType && bytes.Equal(mp.body, other.body)
+}
+
+// serve reads the HTTP request on conn and answers it with the page and a
+// 503 status, logging to clog. Connections that do not start with an HTTP
+// request, such as those of SSH clients, are left for the caller to close.
+func (mp *maintenancePage) serve(clog *logrus.Entry, conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(maintenanceTimeout))
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		clog.Debugf("No HTTP request to answer with the maintenance page: %v", err)
+		return
+	}
+	resp := &http.Response{
+		StatusCode: http.StatusServiceUnavailable,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Request:    req,
+		Header: http.Header{
+			"Content-Type":  {mp.contentType},
+			"Cache-Control": {"no-store"},
+			"Retry-After":   {strconv.Itoa(max(1, int(maintenanceCheckInterval/time.Second)))},
+		},
+		ContentLength: int64(len(mp.body)),
+		Body:          io.NopCloser(bytes.NewReader(mp.body)),
+		Close:         true,
+	}
+	if err := resp.Write(conn); err != nil {
+		clog.Debugf("Error writing the maintenance page: %v", err)
+		return
+	}
+	clog.Debugf("Served the maintenance page for %s %s", req.Method, req.URL)
+}
+
+// markDown starts serving the maintenance page of b instead of dialing its
+// targets, until watch finds one of them reachable again.
+func (b *backendSet) markDown(clog *logrus.Entry) {
+	if b.page == nil || !b.down.CompareAndSwap(false, true) {
+		return
+	}
+	clog.Warnf("No target can be reached; serving the maintenance page until one of %v is back", b.targets)
+	go b.watch()
+}
+
+// watch dials the targets of b every maintenanceCheckInterval until one
+// answers, then lets connections through to them again. It ends early when
+// b is closed.
+func (b *backendSet) watch() {
+	ticker := time.NewTicker(maintenanceCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+		}
+		for _, target := range b.targets {
+			conn, err := b.connect(target)
+			if err != nil {
+				continue
+			}
+			conn.Close()
+			log.Printf("Target %s is reachable again; forwarding connections instead of serving the maintenance page", target)
+			b.down.Store(false)
+			return
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestMaintenancePage verifies the response HTTP clients get and that
+// other clients get none.
+func TestMaintenancePage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "maintenance.html")
+	if err := os.WriteFile(path, []byte("<h1>Back soon</h1>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	page, err := loadMaintenancePage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadMaintenancePage(filepath.Join(t.TempDir(), "missing.html")); err == nil {
+		t.Error("missing page loaded")
+	}
+
+	for method, wantBody := range map[string]string{"GET": "<h1>Back soon</h1>", "HEAD": ""} {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			page.serve(connLog("test"), server)
+		}()
+		req, _ := http.NewRequest(method, "http://example.com/", nil)
+		go req.Write(client)
+		resp, err := http.ReadResponse(bufio.NewReader(client), req)
+		if err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		client.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable || string(body) != wantBody {
+			t.Errorf("%s: status %d, body %q", method, resp.StatusCode, body)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "text/html; charset=utf-8" {
+			t.Errorf("%s: Content-Type %q", method, ct)
+		}
+	}
+
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		page.serve(connLog("test"), server)
+	}()
+	go client.Write([]byte("SSH-2.0-OpenSSH_9.6\r\n"))
+	if data, _ := io.ReadAll(client); len(data) > 0 {
+		t.Errorf("non-HTTP client got %q", data)
+	}
+}
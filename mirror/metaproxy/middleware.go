@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/go-i2p/go-meta-listener"
+)
+
+// middleware is how a service handles its connections between accepting
+// and forwarding them. It is set per [[service]], so the services behind
+// one proxy can each have a policy of their own.
+type middleware struct {
+	// ForwardHeaders adds X-Forwarded-For, naming the client, and
+	// X-Forwarded-Proto to the first HTTP request of each connection.
+	ForwardHeaders bool `toml:"forward-headers"`
+	// SendProxy, v1 or v2, starts each connection to a target with a PROXY
+	// protocol header naming the client. Empty sends none.
+	SendProxy string `toml:"send-proxy"`
+	// AllowIPs and DenyIPs are the addresses or CIDR prefixes clients with
+	// an IP address, those connecting over tcp and tls, must and must not
+	// connect from. Onion and I2P clients are not filtered; allow refuses
+	// their transports as a whole.
+	AllowIPs []string `toml:"allow-ips"`
+	DenyIPs  []string `toml:"deny-ips"`
+	// Clients, if set, limits the service's clients instead of
+	// proxyConfig.Clients, counting their connections to this service only.
+	Clients *clientLimits `toml:"-"`
+	// Bandwidth caps the rates, in bytes per second, at which the
+	// service's clients are read from and written to, each and together.
+	Bandwidth meta.Bandwidth `toml:"-"`
+	// Scrub removes identifying headers from the HTTP responses of the
+	// targets to clients on some transports.
+	Scrub responseScrub `toml:"-"`
+	// AltSvc advertises the service's onion and I2P addresses in the HTTP
+	// responses of the targets to clearnet clients, with the Alt-Svc and
+	// X-I2P-Location headers of mirror.Mirror.AltSvcHeaders.
+	AltSvc bool `toml:"alt-svc"`
+}
+
+// clients returns the limits of the service, allocating them on first use,
+// for the client-* keys of a [[service]] table.
+func (mw *middleware) clients() *clientLimits {
+	if mw.Clients == nil {
+		mw.Clients = &clientLimits{}
+	}
+	return mw.Clients
+}
+
+// validate checks the middleware of a service, passed through if
+// passthrough is set.
+func (mw *middleware) validate(passthrough bool) error {
+	if passthrough && mw.ForwardHeaders {
+		return fmt.Errorf("passthrough services forward TLS as it is and cannot add forward-headers")
+	}
+	if passthrough && mw.AltSvc {
+		return fmt.Errorf("passthrough services forward TLS as it is and cannot add alt-svc headers")
+	}
+	switch mw.SendProxy {
+	case "", proxyV1, proxyV2:
+	default:
+		return fmt.Errorf("unknown send-proxy %q, want %s or %s", mw.SendProxy, proxyV1, proxyV2)
+	}
+	if _, err := newIPFilter(mw.AllowIPs, mw.DenyIPs); err != nil {
+		return err
+	}
+	if c := mw.Clients; c != nil && (c.MaxConns < 0 || c.Rate < 0 || c.Ban < 0) {
+		return fmt.Errorf("client limits must not be negative")
+	}
+	bw := mw.Bandwidth
+	if bw.ConnRead < 0 || bw.ConnWrite < 0 || bw.ListenerRead < 0 || bw.ListenerWrite < 0 {
+		return fmt.Errorf("rates must not be negative")
+	}
+	return mw.Scrub.validate(passthrough)
+}
+
+// ipFilter admits clients by IP address; the zero filter admits every
+// client.
+type ipFilter struct {
+	allow, deny []netip.Prefix
+}
+
+// newIPFilter parses the allow-ips and deny-ips of a service.
+func newIPFilter(allow, deny []string) (ipFilter, error) {
+	var f ipFilter
+	var err error
+	if f.allow, err = parsePrefixes(allow); err != nil {
+		return ipFilter{}, fmt.Errorf("allow-ips: %w", err)
+	}
+	if f.deny, err = parsePrefixes(deny); err != nil {
+		return ipFilter{}, fmt.Errorf("deny-ips: %w", err)
+	}
+	return f, nil
+}
+
+// parsePrefixes parses CIDR prefixes, such as "10.0.0.0/8", and single
+// addresses.
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		if addr, err := netip.ParseAddr(value); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address or prefix %q", value)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// admits reports whether conn comes from an address the filter admits.
+// Clients without an IP address are always admitted.
+func (f ipFilter) admits(conn net.Conn) bool {
+	if len(f.allow) == 0 && len(f.deny) == 0 {
+		return true
+	}
+	ip, err := netip.ParseAddr(clientID(conn))
+	if err != nil {
+		return true
+	}
+	ip = ip.Unmap().WithZone("")
+	for _, prefix := range f.deny {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, prefix := range f.allow {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedHeaders returns the X-Forwarded-For and X-Forwarded-Proto
+// headers of conn. Onion clients are anonymous and get no X-Forwarded-For.
+func forwardedHeaders(conn net.Conn) map[string]string {
+	headers := map[string]string{"X-Forwarded-Proto": "http"}
+	if tc, ok := conn.(meta.TLSStateConn); ok && tc.ConnectionState().HandshakeComplete {
+		headers["X-Forwarded-Proto"] = "https"
+	}
+	if id := clientID(conn); id != "" {
+		headers["X-Forwarded-For"] = id
+	}
+	return headers
+}
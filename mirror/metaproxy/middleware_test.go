@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// remoteConn is a connection from a given remote address.
+type remoteConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c remoteConn) RemoteAddr() net.Addr { return c.remote }
+
+// from returns a connection from the client at ip.
+func from(ip string) net.Conn {
+	return remoteConn{remote: &net.TCPAddr{IP: net.ParseIP(ip), Port: 51234}}
+}
+
+// TestIPFilter verifies that deny-ips takes precedence over allow-ips and
+// that clients without an IP address are admitted.
+func TestIPFilter(t *testing.T) {
+	f, err := newIPFilter([]string{"10.0.0.0/8", "2001:db8::/32"}, []string{"10.0.0.66"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]bool{
+		"10.1.2.3":        true,
+		"::ffff:10.1.2.3": true,
+		"2001:db8::7":     true,
+		"10.0.0.66":       false,
+		"192.0.2.1":       false,
+	} {
+		if got := f.admits(from(ip)); got != want {
+			t.Errorf("admits(%s) = %v, want %v", ip, got, want)
+		}
+	}
+	if !f.admits(remoteConn{remote: &net.UnixAddr{Name: "onion", Net: "unix"}}) {
+		t.Error("client without an IP address refused")
+	}
+	if !(ipFilter{}).admits(from("192.0.2.1")) {
+		t.Error("zero filter refused a client")
+	}
+
+	if _, err := newIPFilter([]string{"10.0.0.0/33"}, nil); err == nil {
+		t.Error("invalid prefix accepted")
+	}
+}
+
+// TestForwardedHeaders verifies the headers added for a plain connection.
+func TestForwardedHeaders(t *testing.T) {
+	headers := forwardedHeaders(from("203.0.113.7"))
+	if headers["X-Forwarded-For"] != "203.0.113.7" || headers["X-Forwarded-Proto"] != "http" {
+		t.Errorf("headers %v", headers)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-i2p/go-meta-listener"
+	"github.com/go-i2p/go-meta-listener/mirror"
+)
+
+// helloTimeout bounds how long a client of a passthrough service may take
+// to send its ClientHello.
+const helloTimeout = 10 * time.Second
+
+// errHelloRead stops the handshake used to parse a ClientHello once its
+// server name is known.
+var errHelloRead = errors.New("client hello read")
+
+// passthroughListener reads the server name from the TLS ClientHello that
+// starts each connection of listener, without terminating TLS, so the
+// connection can be forwarded to a backend chosen by SNI with its bytes
+// untouched. Connections that are not TLS, or name no server, are
+// forwarded with an empty name. ClientHellos are read concurrently, so a
+// slow client does not hold up the others.
+type passthroughListener struct {
+	net.Listener
+
+	conns     chan net.Conn
+	closeOnce sync.Once
+	done      chan struct{}
+	err       error
+}
+
+// newPassthroughListener starts reading the ClientHellos of the connections
+// of listener.
+func newPassthroughListener(listener net.Listener) *passthroughListener {
+	pl := &passthroughListener{
+		Listener: listener,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go pl.acceptLoop()
+	return pl
+}
+
+func (pl *passthroughListener) acceptLoop() {
+	for {
+		conn, err := pl.Listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
+			pl.shutdown(err)
+			return
+		}
+		go pl.readHello(conn)
+	}
+}
+
+// readHello reads the ClientHello of conn and hands it to Accept.
+func (pl *passthroughListener) readHello(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	serverName, hello, err := readServerName(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		log.Debugf("Closing connection from %s before its ClientHello: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn = &passthroughConn{Conn: conn, r: io.MultiReader(bytes.NewReader(hello), conn), serverName: serverName}
+	select {
+	case pl.conns <- conn:
+	case <-pl.done:
+		conn.Close()
+	}
+}
+
+// Accept returns the next connection whose ClientHello has been read.
+func (pl *passthroughListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-pl.conns:
+		return conn, nil
+	case <-pl.done:
+		return nil, pl.err
+	}
+}
+
+func (pl *passthroughListener) Close() error {
+	pl.shutdown(net.ErrClosed)
+	return nil
+}
+
+func (pl *passthroughListener) shutdown(err error) {
+	pl.closeOnce.Do(func() {
+		pl.err = err
+		close(pl.done)
+		pl.Listener.Close()
+	})
+}
+
+// passthroughConn replays the bytes read to learn the server name of a
+// connection before the rest of it, and reports the connection as a
+// clearnet TLS one.
+type passthroughConn struct {
+	net.Conn
+	r          io.Reader
+	serverName string
+}
+
+func (pc *passthroughConn) Read(p []byte) (int, error) { return pc.r.Read(p) }
+
+// Transport reports the connection as clearnet TLS, which it is even though
+// metaproxy does not terminate it.
+func (pc *passthroughConn) Transport() string { return mirror.TransportTLS }
+
+// CloseWrite and CloseRead half-close the connection where supported.
+func (pc *passthroughConn) CloseWrite() error {
+	return meta.CloseWrite(pc.Conn, pc.Conn.Close)
+}
+
+func (pc *passthroughConn) CloseRead() error {
+	return meta.CloseRead(pc.Conn)
+}
+
+// readServerName reads a TLS ClientHello from r and returns the server name
+// it requests, in lower case, along with every byte read. A stream that is
+// not TLS returns an empty name and no error; only read errors are
+// returned.
+func readServerName(r io.Reader) (string, []byte, error) {
+	var read bytes.Buffer
+	var serverName string
+	err := tls.Server(helloConn{r: io.TeeReader(r, &read)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = strings.ToLower(hello.ServerName)
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	var readErr helloReadError
+	if errors.As(err, &readErr) {
+		return "", read.Bytes(), readErr.err
+	}
+	return serverName, read.Bytes(), nil
+}
+
+// helloReadError marks the errors of the reader a ClientHello is parsed
+// from, which the TLS stack returns as they are.
+type helloReadError struct{ err error }
+
+func (e helloReadError) Error() string { return e.err.Error() }
+func (e helloReadError) Unwrap() error { return e.err }
+
+// helloConn is the connection a ClientHello is parsed from: reads come from
+// r and writes, such as the alert sent when the handshake is stopped, are
+// discarded.
+type helloConn struct {
+	r io.Reader
+}
+
+func (hc helloConn) Read(p []byte) (int, error) {
+	n, err := hc.r.Read(p)
+	if err != nil {
+		err = helloReadError{err}
+	}
+	return n, err
+}
+
+func (hc helloConn) Write(p []byte) (int, error)        { return len(p), nil }
+func (hc helloConn) Close() error                       { return nil }
+func (hc helloConn) LocalAddr() net.Addr                { return nil }
+func (hc helloConn) RemoteAddr() net.Addr               { return nil }
+func (hc helloConn) SetDeadline(t time.Time) error      { return nil }
+func (hc helloConn) SetReadDeadline(t time.Time) error  { return nil }
+func (hc helloConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// route returns the backends of the route for serverName: the route of the
+// name itself, else that of a wildcard such as "*.example.com", else nil.
+func (rs *runningService) route(serverName string) *atomic.Pointer[backendSet] {
+	name := strings.TrimSuffix(serverName, ".")
+	if name == "" {
+		return nil
+	}
+	if backends, ok := rs.routes[name]; ok {
+		return backends
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		return rs.routes["*"+name[i:]]
+	}
+	return nil
+}
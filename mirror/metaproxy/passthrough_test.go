@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-i2p/go-meta-listener/mirror"
+)
+
+// clientHello returns the first TLS record a client requesting serverName
+// sends.
+func clientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, int(header[3])<<8|int(header[4]))
+	if _, err := io.ReadFull(server, body); err != nil {
+		t.Fatal(err)
+	}
+	return append(header, body...)
+}
+
+// TestReadServerName verifies that the server name is read from a
+// ClientHello, that streams which are not TLS have none, and that every
+// byte read is returned for replay.
+func TestReadServerName(t *testing.T) {
+	for name, tc := range map[string]struct {
+		data []byte
+		want string
+	}{
+		"sni":    {clientHello(t, "Blog.Example.com"), "blog.example.com"},
+		"no sni": {clientHello(t, ""), ""},
+		"http":   {[]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), ""},
+	} {
+		got, read, err := readServerName(bytes.NewReader(tc.data))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: server name %q, want %q", name, got, tc.want)
+		}
+		if !bytes.HasPrefix(tc.data, read) {
+			t.Errorf("%s: read bytes are not a prefix of the stream", name)
+		}
+	}
+	if _, _, err := readServerName(bytes.NewReader(clientHello(t, "example.com")[:20])); err == nil {
+		t.Errorf("truncated ClientHello: no error")
+	}
+}
+
+// TestProxyPassthrough verifies that the connections of a passthrough
+// service are forwarded untouched, to the route of the name, or of the
+// wildcard, in their ClientHello, and to the service's targets otherwise.
+func TestProxyPassthrough(t *testing.T) {
+	os.Setenv("DISABLE_TOR", "true")
+	os.Setenv("DISABLE_I2P", "true")
+	defer func() {
+		os.Unsetenv("DISABLE_TOR")
+		os.Unsetenv("DISABLE_I2P")
+	}()
+
+	web, blog, pages := backend(t, "web"), backend(t, "blg"), backend(t, "pgs")
+	port := freePort(t)
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	cfg := proxyConfig{
+		Domain:   "localhost",
+		MaxConns: 10,
+		Services: []serviceConfig{{
+			ListenPort:  port,
+			ListenAddr:  addr,
+			Targets:     []string{web},
+			Passthrough: true,
+			Routes: []routeConfig{
+				{Domain: "blog.example.com", Targets: []string{blog}},
+				{Domain: "*.pages.example.com", Targets: []string{pages}},
+			},
+		}},
+	}
+	m, err := mirror.NewMirrorWithConfig(context.Background(), net.JoinHostPort("localhost", strconv.Itoa(port)), mirror.MirrorConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	pool := newConnectionPool(cfg.MaxConns)
+	defer pool.shutdown()
+	p := newProxy(m, pool, cfg)
+	if err := p.start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.close()
+
+	for serverName, want := range map[string]string{
+		"blog.example.com":     "blg",
+		"a.pages.example.com":  "pgs",
+		"unrouted.example.com": "web",
+		"":                     "web",
+	} {
+		conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write(clientHello(t, serverName))
+		data := make([]byte, 3)
+		_, err = io.ReadFull(conn, data)
+		conn.Close()
+		if err != nil || string(data) != want {
+			t.Errorf("%q: got %q, %v, want %q", serverName, data, err, want)
+		}
+	}
+}
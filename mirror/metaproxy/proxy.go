@@ -0,0 +1,579 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-i2p/go-meta-listener"
+	"github.com/go-i2p/go-meta-listener/mirror"
+)
+
+// proxy runs the services of a configuration as services of one Mirror and
+// applies new configurations to them on reload.
+type proxy struct {
+	mu       sync.Mutex
+	mirror   *mirror.Mirror
+	pool     *connectionPool
+	clients  *clientTracker
+	cfg      proxyConfig
+	services map[int]*runningService
+	// dialer reaches the services' targets, through cfg.BackendProxy if set
+	dialer contextDialer
+	// backendTLS is the base configuration of the targets dialed over TLS
+	backendTLS *tls.Config
+	// clientAuth is the mutual TLS of the clearnet listeners, if enabled
+	clientAuth *mirror.ClientAuth
+	// onBan, if set, reports the bans of every client tracker to the ban log
+	onBan func(meta.BanEvent)
+}
+
+// runningService is a service being forwarded.
+type runningService struct {
+	cfg serviceConfig
+	// tlsAddr is where the service's clearnet listener is bound
+	tlsAddr string
+	// backends is where connections go; reload can replace it in place
+	backends atomic.Pointer[backendSet]
+	// routes are the backends of the domains with routes of their own
+	routes map[string]*atomic.Pointer[backendSet]
+	// transports are the backends of the transports with routes of their
+	// own, keyed by the backend the Mirror resolves for their connections
+	transports map[string]*atomic.Pointer[backendSet]
+	// passthrough is the clearnet listener of a passthrough service, which
+	// metaproxy binds itself
+	passthrough net.Listener
+	// clients, if set, limits the service's clients instead of the
+	// proxy-wide tracker
+	clients atomic.Pointer[clientTracker]
+	// shaper holds the service's connections to its bandwidth caps
+	shaper *meta.Shaper
+	// page is the maintenance page of the service's backends, if any
+	page *maintenancePage
+	// stop is closed before the service's listeners are, to end serve
+	stop chan struct{}
+	// serving counts the accept loops of the service's listeners
+	serving sync.WaitGroup
+}
+
+func newProxy(m *mirror.Mirror, pool *connectionPool, cfg proxyConfig) *proxy {
+	return &proxy{
+		mirror:   m,
+		pool:     pool,
+		clients:  newClientTracker(cfg.Clients),
+		cfg:      cfg,
+		services: make(map[int]*runningService),
+	}
+}
+
+// start sets up every service of the proxy's configuration.
+func (p *proxy) start() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	dialer, err := backendDialer(p.cfg.BackendProxy)
+	if err != nil {
+		return err
+	}
+	p.dialer = dialer
+	backendTLS, err := backendTLSConfig(p.cfg.BackendCA)
+	if err != nil {
+		return err
+	}
+	p.backendTLS = backendTLS
+	clientAuth, err := newClientAuth(p.cfg)
+	if err != nil {
+		return err
+	}
+	p.clientAuth = clientAuth
+	if p.cfg.BanLog != "" {
+		// Kept open for the life of the process, like the log
+		f, err := os.OpenFile(p.cfg.BanLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+		if err != nil {
+			return fmt.Errorf("failed to open ban log: %w", err)
+		}
+		p.onBan = meta.BanLog(f)
+		p.clients.setBanHandler(p.onBan)
+	}
+
+	for _, svc := range p.cfg.Services {
+		if err := p.startService(svc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startService adds svc to the Mirror and starts forwarding its connections.
+func (p *proxy) startService(svc serviceConfig) error {
+	listenPort := strconv.Itoa(svc.ListenPort)
+	tlsAddr := p.cfg.tlsAddr(svc)
+	page, err := loadMaintenancePage(svc.MaintenancePage)
+	if err != nil {
+		return err
+	}
+	serviceConfig := mirror.ServiceConfig{
+		Name:       net.JoinHostPort(p.cfg.Domain, listenPort),
+		Email:      p.cfg.Email,
+		Domains:    svc.domains(),
+		TLSAddr:    tlsAddr,
+		ClientAuth: p.clientAuth,
+	}
+	// The Mirror resolves the transport route of every connection as it
+	// accepts it; the backend it reports names the route's transport
+	for _, route := range svc.Routes {
+		if route.Transport != "" {
+			if serviceConfig.Backends == nil {
+				serviceConfig.Backends = make(map[string]string)
+			}
+			serviceConfig.Backends[route.Transport] = route.Transport
+		}
+	}
+	rs := &runningService{
+		cfg:        svc,
+		tlsAddr:    tlsAddr,
+		routes:     make(map[string]*atomic.Pointer[backendSet]),
+		transports: make(map[string]*atomic.Pointer[backendSet]),
+		shaper:     meta.NewShaper(svc.Middleware.Bandwidth),
+		page:       page,
+		stop:       make(chan struct{}),
+	}
+	if limits := svc.Middleware.Clients; limits != nil {
+		rs.clients.Store(p.newClientTracker(*limits))
+	}
+	if svc.Passthrough {
+		// The clearnet connections are forwarded as they are, so the
+		// Mirror publishes the service on the other transports only
+		serviceConfig.Email, serviceConfig.Domains = "", nil
+		listener, err := net.Listen("tcp", p.cfg.passthroughAddr(svc))
+		if err != nil {
+			return err
+		}
+		if p.cfg.AcceptProxy {
+			listener = newProxyProtocolListener(listener)
+		}
+		rs.passthrough = newPassthroughListener(listener)
+		log.Printf("Passing clearnet TLS connections on %s through by SNI", listener.Addr())
+	}
+	var listener net.Listener
+	if !svc.Passthrough || p.cfg.LocalTCP || p.cfg.Tor || p.cfg.I2P {
+		var err error
+		listener, err = p.mirror.AddService(listenPort, serviceConfig)
+		if err != nil {
+			if rs.passthrough != nil {
+				rs.passthrough.Close()
+			}
+			return err
+		}
+	}
+	rs.backends.Store(p.newBackends(svc, page, svc.Targets, svc.Balance, svc.Shadow, svc.BackendTLS))
+	for _, route := range svc.Routes {
+		backends := new(atomic.Pointer[backendSet])
+		backends.Store(p.newBackends(svc, page, route.Targets, route.Balance, route.Shadow, route.BackendTLS))
+		if route.Transport != "" {
+			log.Printf("Routing %s on port %s to %s", route.name(), listenPort, strings.Join(route.Targets, ", "))
+			rs.transports[route.Transport] = backends
+		} else {
+			rs.routes[route.Domain] = backends
+		}
+	}
+	p.services[svc.ListenPort] = rs
+	log.Printf("Proxy server starting on %s, forwarding to %s (max concurrent connections: %d)", listenPort, strings.Join(svc.Targets, ", "), p.cfg.MaxConns)
+
+	// Accept connections in separate goroutines: the service's listener,
+	// then the passthrough listener or the SNI listener of each extra
+	// domain, which only exists when the service has a clearnet TLS
+	// listener
+	if listener != nil {
+		rs.serving.Add(1)
+		go rs.serve(p.pool, p.clients, listener, &rs.backends)
+	}
+	if rs.passthrough != nil {
+		for _, route := range svc.Routes {
+			if route.Domain != "" {
+				log.Printf("Passing %s on port %s through to %s", route.Domain, listenPort, strings.Join(route.Targets, ", "))
+			}
+		}
+		// Passthrough connections are all clearnet TLS, of the tls route if
+		// there is one
+		backends, ok := rs.transports[mirror.TransportTLS]
+		if !ok {
+			backends = &rs.backends
+		}
+		rs.serving.Add(1)
+		go rs.serve(p.pool, p.clients, rs.passthrough, backends)
+		return nil
+	}
+	for _, domain := range svc.domains() {
+		domainListener, err := p.mirror.DomainListener(listenPort, domain)
+		if err != nil {
+			log.Debugf("No clearnet listener for %s on port %s: %v", domain, listenPort, err)
+			continue
+		}
+		backends, ok := rs.routes[domain]
+		if ok {
+			log.Printf("Routing %s on port %s to %s", domain, listenPort, strings.Join(backends.Load().targets, ", "))
+		} else {
+			backends = &rs.backends
+		}
+		rs.serving.Add(1)
+		go rs.serve(p.pool, p.clients, domainListener, backends)
+	}
+	return nil
+}
+
+// routeNames returns the domains and transports svc routes to backends of
+// their own, in order.
+func routeNames(svc serviceConfig) []string {
+	names := make([]string, 0, len(svc.Routes))
+	for _, route := range svc.Routes {
+		names = append(names, route.name())
+	}
+	return names
+}
+
+// newBackends returns the backendSet connections to svc, or to one of its
+// routes, are forwarded with, serving page while its targets are down.
+func (p *proxy) newBackends(svc serviceConfig, page *maintenancePage, targets []string, balance, shadow string, bt backendTLS) *backendSet {
+	b := newBackendSet(targets, balance, p.dialer)
+	b.shadow = shadow
+	b.page = page
+	b.idHeader = p.cfg.requestIDHeader(svc)
+	b.allow = svc.Allow
+	// Validated with the configuration
+	b.ips, _ = newIPFilter(svc.Middleware.AllowIPs, svc.Middleware.DenyIPs)
+	b.forwardHeaders = svc.Middleware.ForwardHeaders
+	b.sendProxy = svc.Middleware.SendProxy
+	b.scrub = svc.Middleware.Scrub
+	if svc.Middleware.AltSvc {
+		port := strconv.Itoa(svc.ListenPort)
+		b.altSvc = func(r *http.Request) http.Header {
+			return p.mirror.AltSvcHeaders(port, r)
+		}
+	}
+	if bt.Enabled {
+		b.tlsConfig = p.backendTLS.Clone()
+		b.tlsConfig.ServerName = bt.ServerName
+	}
+	return b
+}
+
+// newClientTracker returns a tracker of limits reporting its bans to the
+// ban log, for a service limiting its clients on its own.
+func (p *proxy) newClientTracker(limits clientLimits) *clientTracker {
+	ct := newClientTracker(limits)
+	if p.onBan != nil {
+		ct.setBanHandler(p.onBan)
+	}
+	return ct
+}
+
+// closeBackends ends the health checks of every backendSet of rs.
+func (rs *runningService) closeBackends() {
+	rs.backends.Load().close()
+	for _, backends := range rs.routes {
+		backends.Load().close()
+	}
+	for _, backends := range rs.transports {
+		backends.Load().close()
+	}
+}
+
+// replaceBackends stores b in backends, ending the health checks of the
+// set it replaces.
+func replaceBackends(backends *atomic.Pointer[backendSet], b *backendSet) {
+	if old := backends.Swap(b); old != nil {
+		old.close()
+	}
+}
+
+// stopService stops accepting connections for the service on port.
+// Connections already forwarded are left to finish.
+func (p *proxy) stopService(port int) {
+	rs := p.services[port]
+	delete(p.services, port)
+	close(rs.stop)
+	rs.closeBackends()
+	if rs.passthrough != nil {
+		rs.passthrough.Close()
+	}
+	if err := p.mirror.CloseService(strconv.Itoa(port)); err != nil {
+		log.Warnf("Error closing service on port %d: %v", port, err)
+	}
+	rs.serving.Wait()
+}
+
+// reload applies cfg: services no longer listed are stopped, new ones are
+// started, changed targets take effect for new connections, and the
+// connection limit is adjusted. Services whose domains or listen address
+// changed are restarted; connections already forwarded are kept throughout.
+func (p *proxy) reload(cfg proxyConfig) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if cfg.Domain != p.cfg.Domain || cfg.Email != p.cfg.Email || cfg.CertDir != p.cfg.CertDir ||
+		cfg.KeyDir != p.cfg.KeyDir || cfg.HiddenTLS != p.cfg.HiddenTLS || cfg.LocalTCP != p.cfg.LocalTCP ||
+		cfg.Tor != p.cfg.Tor || cfg.I2P != p.cfg.I2P || cfg.ControlSocket != p.cfg.ControlSocket || cfg.AcceptProxy != p.cfg.AcceptProxy ||
+		cfg.BanLog != p.cfg.BanLog || cfg.StatsD != p.cfg.StatsD || cfg.StatsDPrefix != p.cfg.StatsDPrefix ||
+		!slices.Equal(cfg.StatsDTags, p.cfg.StatsDTags) || cfg.StatsDDatadog != p.cfg.StatsDDatadog ||
+		cfg.CaptureDir != p.cfg.CaptureDir || !slices.Equal(cfg.CaptureListeners, p.cfg.CaptureListeners) ||
+		!slices.Equal(cfg.CaptureIdentities, p.cfg.CaptureIdentities) || cfg.CaptureBytes != p.cfg.CaptureBytes || cfg.CaptureFiles != p.cfg.CaptureFiles {
+		log.Warnln("Domain, email, directory, TLS, transport, PROXY protocol, ban log, StatsD, capture, and control socket settings only change on restart")
+		cfg.Domain, cfg.Email, cfg.CertDir, cfg.KeyDir = p.cfg.Domain, p.cfg.Email, p.cfg.CertDir, p.cfg.KeyDir
+		cfg.HiddenTLS, cfg.LocalTCP, cfg.Tor, cfg.I2P = p.cfg.HiddenTLS, p.cfg.LocalTCP, p.cfg.Tor, p.cfg.I2P
+		cfg.ControlSocket, cfg.AcceptProxy, cfg.BanLog = p.cfg.ControlSocket, p.cfg.AcceptProxy, p.cfg.BanLog
+		cfg.StatsD, cfg.StatsDPrefix, cfg.StatsDTags, cfg.StatsDDatadog = p.cfg.StatsD, p.cfg.StatsDPrefix, p.cfg.StatsDTags, p.cfg.StatsDDatadog
+		cfg.CaptureDir, cfg.CaptureListeners, cfg.CaptureIdentities = p.cfg.CaptureDir, p.cfg.CaptureListeners, p.cfg.CaptureIdentities
+		cfg.CaptureBytes, cfg.CaptureFiles = p.cfg.CaptureBytes, p.cfg.CaptureFiles
+	}
+
+	// proxyChanged is set when targets are dialed differently, through
+	// another backend proxy or verified against another backend CA
+	proxyChanged := cfg.BackendProxy != p.cfg.BackendProxy
+	if proxyChanged {
+		dialer, err := backendDialer(cfg.BackendProxy)
+		if err != nil {
+			return err
+		}
+		log.Printf("Targets are now reached through backend proxy %q", cfg.BackendProxy)
+		p.dialer = dialer
+		p.cfg.BackendProxy = cfg.BackendProxy
+	}
+	if cfg.BackendCA != p.cfg.BackendCA {
+		backendTLS, err := backendTLSConfig(cfg.BackendCA)
+		if err != nil {
+			return err
+		}
+		log.Printf("Targets dialed over TLS are now verified against %q", cfg.BackendCA)
+		p.backendTLS = backendTLS
+		p.cfg.BackendCA = cfg.BackendCA
+		proxyChanged = true
+	}
+
+	if cfg.MaxConns != p.cfg.MaxConns {
+		log.Printf("Maximum concurrent connections changed from %d to %d", p.cfg.MaxConns, cfg.MaxConns)
+		p.pool.setLimit(cfg.MaxConns)
+	}
+	p.cfg.MaxConns = cfg.MaxConns
+	if cfg.IdleTimeout != p.cfg.IdleTimeout || cfg.MaxLifetime != p.cfg.MaxLifetime {
+		log.Printf("New connections idle out after %s with a maximum lifetime of %s", cfg.IdleTimeout, cfg.MaxLifetime)
+		p.pool.setTimeouts(cfg.IdleTimeout, cfg.MaxLifetime)
+	}
+	p.cfg.IdleTimeout, p.cfg.MaxLifetime = cfg.IdleTimeout, cfg.MaxLifetime
+	p.cfg.DrainTimeout = cfg.DrainTimeout
+	if cfg.Clients != p.cfg.Clients {
+		log.Printf("Client limits changed to %d connections, %d per minute, %s ban", cfg.Clients.MaxConns, cfg.Clients.Rate, cfg.Clients.Ban)
+		p.clients.setLimits(cfg.Clients)
+	}
+	p.cfg.Clients = cfg.Clients
+	p.cfg.ListenAddr = cfg.ListenAddr
+	p.cfg.RequestIDHeader = cfg.RequestIDHeader
+
+	wanted := make(map[int]bool, len(cfg.Services))
+	for _, svc := range cfg.Services {
+		wanted[svc.ListenPort] = true
+	}
+	for port := range p.services {
+		if !wanted[port] {
+			log.Printf("Removing service on port %d", port)
+			p.stopService(port)
+		}
+	}
+
+	var firstErr error
+	for _, svc := range cfg.Services {
+		rs, ok := p.services[svc.ListenPort]
+		if ok && (!reflect.DeepEqual(rs.cfg.domains(), svc.domains()) || !reflect.DeepEqual(routeNames(rs.cfg), routeNames(svc)) ||
+			rs.tlsAddr != cfg.tlsAddr(svc) || rs.cfg.Passthrough != svc.Passthrough) {
+			log.Printf("Restarting service on port %d", svc.ListenPort)
+			p.stopService(svc.ListenPort)
+			ok = false
+		}
+		if !ok {
+			if err := p.startService(svc); err != nil {
+				log.Errorf("Failed to listen on port %d: %v", svc.ListenPort, err)
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+			continue
+		}
+		// The page is read again, since it may have been edited in place
+		page, err := loadMaintenancePage(svc.MaintenancePage)
+		if err != nil {
+			log.Errorf("Service on port %d keeps its maintenance page: %v", svc.ListenPort, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			page, svc.MaintenancePage = rs.page, rs.cfg.MaintenancePage
+		}
+		settingsChanged := rs.backends.Load().idHeader != cfg.requestIDHeader(svc) || !slices.Equal(rs.cfg.Allow, svc.Allow) ||
+			!reflect.DeepEqual(rs.cfg.Middleware, svc.Middleware) || !page.equal(rs.page)
+		if proxyChanged || settingsChanged || !reflect.DeepEqual(rs.cfg.Targets, svc.Targets) || rs.cfg.Balance != svc.Balance || rs.cfg.Shadow != svc.Shadow || rs.cfg.BackendTLS != svc.BackendTLS {
+			log.Printf("Service on port %d now forwards to %s", svc.ListenPort, strings.Join(svc.Targets, ", "))
+			replaceBackends(&rs.backends, p.newBackends(svc, page, svc.Targets, svc.Balance, svc.Shadow, svc.BackendTLS))
+		}
+		// The routed domains and transports are unchanged, or the service
+		// was restarted
+		for i, route := range svc.Routes {
+			if proxyChanged || settingsChanged || !reflect.DeepEqual(rs.cfg.Routes[i], route) {
+				log.Printf("Routing %s on port %d to %s", route.name(), svc.ListenPort, strings.Join(route.Targets, ", "))
+				backends := rs.routes[route.Domain]
+				if route.Transport != "" {
+					backends = rs.transports[route.Transport]
+				}
+				replaceBackends(backends, p.newBackends(svc, page, route.Targets, route.Balance, route.Shadow, route.BackendTLS))
+			}
+		}
+		p.reloadMiddleware(rs, svc.Middleware)
+		rs.cfg.Targets, rs.cfg.Balance, rs.cfg.Routes, rs.cfg.Allow = svc.Targets, svc.Balance, svc.Routes, svc.Allow
+		rs.cfg.Shadow = svc.Shadow
+		rs.cfg.BackendTLS, rs.cfg.Middleware = svc.BackendTLS, svc.Middleware
+		rs.cfg.MaintenancePage, rs.page = svc.MaintenancePage, page
+	}
+	p.cfg.Services = cfg.Services
+	return firstErr
+}
+
+// reloadMiddleware applies the client limits and bandwidth caps of mw to
+// the running service rs; the rest of mw takes effect with its backends.
+func (p *proxy) reloadMiddleware(rs *runningService, mw middleware) {
+	if mw.Bandwidth != rs.cfg.Middleware.Bandwidth {
+		log.Printf("Service on port %d now has bandwidth caps %+v", rs.cfg.ListenPort, mw.Bandwidth)
+		rs.shaper.Set(mw.Bandwidth)
+	}
+	if reflect.DeepEqual(mw.Clients, rs.cfg.Middleware.Clients) {
+		return
+	}
+	switch current := rs.clients.Load(); {
+	case mw.Clients == nil:
+		log.Printf("Service on port %d now uses the proxy-wide client limits", rs.cfg.ListenPort)
+		rs.clients.Store(nil)
+	case current == nil:
+		log.Printf("Service on port %d now limits its clients to %d connections, %d per minute", rs.cfg.ListenPort, mw.Clients.MaxConns, mw.Clients.Rate)
+		rs.clients.Store(p.newClientTracker(*mw.Clients))
+	default:
+		log.Printf("Service on port %d now limits its clients to %d connections, %d per minute", rs.cfg.ListenPort, mw.Clients.MaxConns, mw.Clients.Rate)
+		current.setLimits(*mw.Clients)
+	}
+}
+
+// config returns the configuration being served.
+func (p *proxy) config() proxyConfig {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.cfg
+}
+
+// drainTimeout returns how long connections may finish on shutdown.
+func (p *proxy) drainTimeout() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.cfg.DrainTimeout
+}
+
+// close stops every service's accept loop. The Mirror is closed by the caller.
+func (p *proxy) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, rs := range p.services {
+		close(rs.stop)
+		rs.closeBackends()
+		if rs.passthrough != nil {
+			rs.passthrough.Close()
+		}
+	}
+	p.services = make(map[int]*runningService)
+}
+
+// acceptMinDelay and acceptMaxDelay bound the delay before a service's
+// accept loop retries after an error, doubling between them.
+const (
+	acceptMinDelay = 5 * time.Millisecond
+	acceptMaxDelay = time.Second
+)
+
+// serve forwards the connections accepted on listener to backends, or to
+// the route of the transport the Mirror resolved for them, until the
+// service is stopped or the pool is shut down. Connections from transports
+// the service does not allow, from filtered IP addresses, and from clients
+// over their limits are disconnected right away; the service's own limits,
+// if it has them, replace clients.
+func (rs *runningService) serve(pool *connectionPool, clients *clientTracker, listener net.Listener, backends *atomic.Pointer[backendSet]) {
+	defer rs.serving.Done()
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			// Check if this is due to shutdown
+			select {
+			case <-pool.ctx.Done():
+				log.Debugln("Shutting down connection accept loop")
+				return
+			case <-rs.stop:
+				return
+			default:
+			}
+			// Back off, as net/http does, so that a persistent error such
+			// as running out of file descriptors does not spin the loop
+			delay = min(max(2*delay, acceptMinDelay), acceptMaxDelay)
+			log.Warnf("Error accepting connection: %v; retrying in %v", err, delay)
+			select {
+			case <-pool.ctx.Done():
+				log.Debugln("Shutting down connection accept loop")
+				return
+			case <-rs.stop:
+				return
+			case <-time.After(delay):
+			}
+			continue
+		}
+		delay = 0
+
+		b := backends.Load()
+		ok, transport := b.allow.admits(conn)
+		if !ok {
+			log.Debugf("Refused %s connection from %s on port %d: transport not allowed", transport, conn.RemoteAddr(), rs.cfg.ListenPort)
+			conn.Close()
+			continue
+		}
+		if !b.ips.admits(conn) {
+			log.Debugf("Refused connection from %s on port %d: address filtered", conn.RemoteAddr(), rs.cfg.ListenPort)
+			conn.Close()
+			continue
+		}
+		if bc, ok := conn.(mirror.BackendConn); ok {
+			if route, ok := rs.transports[bc.Backend()]; ok {
+				b = route.Load()
+			}
+		}
+		if pc, ok := conn.(*passthroughConn); ok {
+			if route := rs.route(pc.serverName); route != nil {
+				b = route.Load()
+			}
+		}
+		tracker := clients
+		if own := rs.clients.Load(); own != nil {
+			tracker = own
+		}
+		done, ok := tracker.admit(clientID(conn))
+		if !ok {
+			conn.Close()
+			continue
+		}
+		conn = rs.shaper.Shape(conn)
+		id := newConnID()
+		connLog(id).Debugf("Accepted connection from %s on port %d", conn.RemoteAddr(), rs.cfg.ListenPort)
+		pool.handleConnection(conn, id, b, done)
+	}
+}
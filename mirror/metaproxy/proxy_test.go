@@ -0,0 +1,749 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-i2p/go-meta-listener/mirror"
+)
+
+// backend serves name, three bytes long, to every connection and returns
+// its address.
+func backend(t *testing.T, name string) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte(name))
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// freePort returns a local port nothing is listening on.
+func freePort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// fetch connects to the local listener on port and returns the backend's
+// name.
+func fetch(port int) (string, error) {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), 5*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	data := make([]byte, 3)
+	_, err = io.ReadFull(conn, data)
+	return string(data), err
+}
+
+// TestProxyReload verifies that reload adds and removes services and
+// retargets existing ones.
+func TestProxyReload(t *testing.T) {
+	os.Setenv("DISABLE_TOR", "true")
+	os.Setenv("DISABLE_I2P", "true")
+	defer func() {
+		os.Unsetenv("DISABLE_TOR")
+		os.Unsetenv("DISABLE_I2P")
+	}()
+
+	web, ssh := backend(t, "web"), backend(t, "ssh")
+	first, second := freePort(t), freePort(t)
+	cfg := proxyConfig{
+		Domain:   "localhost",
+		MaxConns: 10,
+		LocalTCP: true,
+		Services: []serviceConfig{{ListenPort: first, Targets: []string{web}}},
+	}
+
+	m, err := mirror.NewMirrorWithConfig(context.Background(), net.JoinHostPort("localhost", strconv.Itoa(first)), mirror.MirrorConfig{EnableLocalTCP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	pool := newConnectionPool(cfg.MaxConns)
+	defer pool.shutdown()
+	p := newProxy(m, pool, cfg)
+	if err := p.start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.close()
+
+	if got, err := fetch(first); err != nil || got != "web" {
+		t.Fatalf("first service: got %q, %v", got, err)
+	}
+
+	// Retarget the first service and add a second one.
+	cfg.Services = []serviceConfig{{ListenPort: first, Targets: []string{ssh}}, {ListenPort: second, Targets: []string{web}}}
+	if err := p.reload(cfg); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if got, err := fetch(first); err != nil || got != "ssh" {
+		t.Errorf("retargeted service: got %q, %v", got, err)
+	}
+	if got, err := fetch(second); err != nil || got != "web" {
+		t.Errorf("added service: got %q, %v", got, err)
+	}
+
+	// Remove the first service.
+	cfg.Services = cfg.Services[1:]
+	if err := p.reload(cfg); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if _, err := fetch(first); err == nil {
+		t.Errorf("removed service still accepts connections")
+	}
+	if got, err := fetch(second); err != nil || got != "web" {
+		t.Errorf("remaining service: got %q, %v", got, err)
+	}
+}
+
+// TestProxyAllow verifies that connections from transports a service does
+// not allow are closed without reaching the target, and that reload
+// changes the allowed transports.
+func TestProxyAllow(t *testing.T) {
+	os.Setenv("DISABLE_TOR", "true")
+	os.Setenv("DISABLE_I2P", "true")
+	defer func() {
+		os.Unsetenv("DISABLE_TOR")
+		os.Unsetenv("DISABLE_I2P")
+	}()
+
+	web := backend(t, "web")
+	port := freePort(t)
+	cfg := proxyConfig{
+		Domain:   "localhost",
+		MaxConns: 10,
+		LocalTCP: true,
+		Services: []serviceConfig{{ListenPort: port, Targets: []string{web}, Allow: []string{mirror.TransportOnion}}},
+	}
+	m, err := mirror.NewMirrorWithConfig(context.Background(), net.JoinHostPort("localhost", strconv.Itoa(port)), mirror.MirrorConfig{EnableLocalTCP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	pool := newConnectionPool(cfg.MaxConns)
+	defer pool.shutdown()
+	p := newProxy(m, pool, cfg)
+	if err := p.start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.close()
+
+	if got, err := fetch(port); err == nil {
+		t.Errorf("local connection to an onion-only service got %q", got)
+	}
+
+	cfg.Services[0].Allow = []string{mirror.TransportOnion, mirror.TransportTCP}
+	if err := p.reload(cfg); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if got, err := fetch(port); err != nil || got != "web" {
+		t.Errorf("after allowing local connections: got %q, %v", got, err)
+	}
+}
+
+// TestProxyMiddleware verifies that a service refuses the clients its
+// deny-ips names, and that reload lifts the filter and starts sending
+// PROXY headers to the target.
+func TestProxyMiddleware(t *testing.T) {
+	os.Setenv("DISABLE_TOR", "true")
+	os.Setenv("DISABLE_I2P", "true")
+	defer func() {
+		os.Unsetenv("DISABLE_TOR")
+		os.Unsetenv("DISABLE_I2P")
+	}()
+
+	// The target answers with the start of the client address its PROXY
+	// header names, or "???" without one
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			reply := "???"
+			if addr, err := readProxyHeader(conn); err == nil && addr != nil {
+				reply = addr.String()[:3]
+			}
+			conn.Write([]byte(reply))
+			conn.Close()
+		}
+	}()
+
+	port := freePort(t)
+	cfg := proxyConfig{
+		Domain:   "localhost",
+		MaxConns: 10,
+		LocalTCP: true,
+		Services: []serviceConfig{{ListenPort: port, Targets: []string{target.Addr().String()},
+			Middleware: middleware{DenyIPs: []string{"127.0.0.0/8"}}}},
+	}
+	m, err := mirror.NewMirrorWithConfig(context.Background(), net.JoinHostPort("localhost", strconv.Itoa(port)), mirror.MirrorConfig{EnableLocalTCP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	pool := newConnectionPool(cfg.MaxConns)
+	defer pool.shutdown()
+	p := newProxy(m, pool, cfg)
+	if err := p.start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.close()
+
+	if got, err := fetch(port); err == nil {
+		t.Errorf("denied client got %q", got)
+	}
+
+	cfg.Services[0].Middleware = middleware{SendProxy: proxyV1}
+	if err := p.reload(cfg); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if got, err := fetch(port); err != nil || got != "127" {
+		t.Errorf("after reload: got %q, %v, want the client address", got, err)
+	}
+}
+
+// TestProxyShadow verifies that what a client sends reaches the shadow
+// target too, that its answer is discarded, and that an unreachable shadow
+// target does not affect clients.
+func TestProxyShadow(t *testing.T) {
+	os.Setenv("DISABLE_TOR", "true")
+	os.Setenv("DISABLE_I2P", "true")
+	defer func() {
+		os.Unsetenv("DISABLE_TOR")
+		os.Unsetenv("DISABLE_I2P")
+	}()
+
+	// Both answer once they have read a line; the shadow reports what it got
+	serve := func(listener net.Listener, reply string, got chan<- string) {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			conn.Write([]byte(reply))
+			conn.Close()
+			if got != nil {
+				got <- line
+			}
+		}
+	}
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go serve(target, "web", nil)
+	shadowTarget, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shadowTarget.Close()
+	shadowed := make(chan string, 1)
+	go serve(shadowTarget, "new", shadowed)
+
+	port := freePort(t)
+	cfg := proxyConfig{
+		Domain:   "localhost",
+		MaxConns: 10,
+		LocalTCP: true,
+		Services: []serviceConfig{{ListenPort: port, Targets: []string{target.Addr().String()}, Shadow: shadowTarget.Addr().String()}},
+	}
+	m, err := mirror.NewMirrorWithConfig(context.Background(), net.JoinHostPort("localhost", strconv.Itoa(port)), mirror.MirrorConfig{EnableLocalTCP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	pool := newConnectionPool(cfg.MaxConns)
+	defer pool.shutdown()
+	p := newProxy(m, pool, cfg)
+	if err := p.start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.close()
+
+	// request sends a line and returns the answer
+	request := func() (string, error) {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), 5*time.Second)
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("GET /\n"))
+		data, err := io.ReadAll(conn)
+		return string(data), err
+	}
+	if got, err := request(); err != nil || got != "web" {
+		t.Errorf("got %q, %v, want the target's answer alone", got, err)
+	}
+	select {
+	case line := <-shadowed:
+		if line != "GET /\n" {
+			t.Errorf("shadow target got %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("shadow target got nothing")
+	}
+
+	cfg.Services[0].Shadow = net.JoinHostPort("127.0.0.1", strconv.Itoa(freePort(t)))
+	if err := p.reload(cfg); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if got, err := request(); err != nil || got != "web" {
+		t.Errorf("with the shadow target down: got %q, %v", got, err)
+	}
+}
+
+// TestProxyScrub verifies that the responses of an HTTP target lose their
+// identifying headers on the transports scrubbed, over a connection
+// carrying several requests, and keep them on the others.
+func TestProxyScrub(t *testing.T) {
+	os.Setenv("DISABLE_TOR", "true")
+	os.Setenv("DISABLE_I2P", "true")
+	defer func() {
+		os.Unsetenv("DISABLE_TOR")
+		os.Unsetenv("DISABLE_I2P")
+	}()
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "Apache/2.4.58")
+		w.Header().Set("X-Powered-By", "PHP/8.2")
+		io.WriteString(w, "page "+r.URL.Path)
+	}))
+	defer target.Close()
+
+	port := freePort(t)
+	svc := serviceConfig{ListenPort: port, Targets: []string{target.Listener.Addr().String()}}
+	svc.Middleware.Scrub = responseScrub{Enabled: true, Transports: []string{mirror.TransportTCP}}
+	cfg := proxyConfig{Domain: "localhost", MaxConns: 10, LocalTCP: true, Services: []serviceConfig{svc}}
+	m, err := mirror.NewMirrorWithConfig(context.Background(), net.JoinHostPort("localhost", strconv.Itoa(port)), mirror.MirrorConfig{EnableLocalTCP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	pool := newConnectionPool(cfg.MaxConns)
+	defer pool.shutdown()
+	p := newProxy(m, pool, cfg)
+	if err := p.start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.close()
+
+	// get sends every path over one connection and returns the responses
+	get := func(paths ...string) []*http.Response {
+		t.Helper()
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(conn)
+		var responses []*http.Response
+		for _, path := range paths {
+			io.WriteString(conn, "GET "+path+" HTTP/1.1\r\nHost: localhost\r\n\r\n")
+			resp, err := http.ReadResponse(r, nil)
+			if err != nil {
+				t.Fatalf("GET %s: %v", path, err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != "page "+path {
+				t.Errorf("GET %s: body %q", path, body)
+			}
+			responses = append(responses, resp)
+		}
+		return responses
+	}
+	for _, resp := range get("/a", "/b") {
+		if resp.Header.Get("Server") != "" || resp.Header.Get("X-Powered-By") != "" {
+			t.Errorf("Scrubbed response has headers %v", resp.Header)
+		}
+		if date, err := http.ParseTime(resp.Header.Get("Date")); err != nil || date.Second() != 0 {
+			t.Errorf("Date %q not rounded to the minute", resp.Header.Get("Date"))
+		}
+	}
+
+	cfg.Services[0].Middleware.Scrub.Transports = []string{mirror.TransportOnion}
+	if err := p.reload(cfg); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if resp := get("/c")[0]; resp.Header.Get("Server") != "Apache/2.4.58" {
+		t.Errorf("Response on a transport not scrubbed has headers %v", resp.Header)
+	}
+}
+
+// TestProxyMaintenance verifies that HTTP clients get the maintenance page
+// while the target is down and reach the target again once the health
+// checks find it back.
+func TestProxyMaintenance(t *testing.T) {
+	os.Setenv("DISABLE_TOR", "true")
+	os.Setenv("DISABLE_I2P", "true")
+	defer func() {
+		os.Unsetenv("DISABLE_TOR")
+		os.Unsetenv("DISABLE_I2P")
+	}()
+	defer func(interval time.Duration) { maintenanceCheckInterval = interval }(maintenanceCheckInterval)
+	maintenanceCheckInterval = 10 * time.Millisecond
+
+	page := filepath.Join(t.TempDir(), "maintenance.html")
+	if err := os.WriteFile(page, []byte("back soon"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	target := net.JoinHostPort("127.0.0.1", strconv.Itoa(freePort(t)))
+	port := freePort(t)
+	cfg := proxyConfig{
+		Domain:   "localhost",
+		MaxConns: 10,
+		LocalTCP: true,
+		Services: []serviceConfig{{ListenPort: port, Targets: []string{target}, MaintenancePage: page}},
+	}
+	m, err := mirror.NewMirrorWithConfig(context.Background(), net.JoinHostPort("localhost", strconv.Itoa(port)), mirror.MirrorConfig{EnableLocalTCP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	pool := newConnectionPool(cfg.MaxConns)
+	defer pool.shutdown()
+	p := newProxy(m, pool, cfg)
+	if err := p.start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.close()
+
+	// get sends an HTTP request and returns everything sent back
+	get := func() string {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		data, _ := io.ReadAll(conn)
+		return string(data)
+	}
+	for i := 0; i < 2; i++ {
+		if got := get(); !strings.HasPrefix(got, "HTTP/1.1 503") || !strings.HasSuffix(got, "back soon") {
+			t.Fatalf("request %d with the target down got %q", i+1, got)
+		}
+	}
+
+	listener, err := net.Listen("tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("web"))
+			conn.Close()
+		}
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for get() != "web" {
+		if time.Now().After(deadline) {
+			t.Fatal("the target was not used again once it was back")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestProxyTransportRoute verifies that connections arriving on a routed
+// transport go to the route's targets, and that reload retargets and
+// removes the route.
+func TestProxyTransportRoute(t *testing.T) {
+	os.Setenv("DISABLE_TOR", "true")
+	os.Setenv("DISABLE_I2P", "true")
+	defer func() {
+		os.Unsetenv("DISABLE_TOR")
+		os.Unsetenv("DISABLE_I2P")
+	}()
+
+	web, replica, other := backend(t, "web"), backend(t, "rep"), backend(t, "oth")
+	port := freePort(t)
+	cfg := proxyConfig{
+		Domain:   "localhost",
+		MaxConns: 10,
+		LocalTCP: true,
+		Services: []serviceConfig{{
+			ListenPort: port,
+			Targets:    []string{web},
+			Routes:     []routeConfig{{Transport: mirror.TransportTCP, Targets: []string{replica}}},
+		}},
+	}
+	m, err := mirror.NewMirrorWithConfig(context.Background(), net.JoinHostPort("localhost", strconv.Itoa(port)), mirror.MirrorConfig{EnableLocalTCP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	pool := newConnectionPool(cfg.MaxConns)
+	defer pool.shutdown()
+	p := newProxy(m, pool, cfg)
+	if err := p.start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.close()
+
+	if got, err := fetch(port); err != nil || got != "rep" {
+		t.Errorf("routed transport: got %q, %v", got, err)
+	}
+
+	cfg.Services = []serviceConfig{{
+		ListenPort: port,
+		Targets:    []string{web},
+		Routes:     []routeConfig{{Transport: mirror.TransportTCP, Targets: []string{other}}},
+	}}
+	if err := p.reload(cfg); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if got, err := fetch(port); err != nil || got != "oth" {
+		t.Errorf("retargeted route: got %q, %v", got, err)
+	}
+
+	cfg.Services = []serviceConfig{{ListenPort: port, Targets: []string{web}}}
+	if err := p.reload(cfg); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if got, err := fetch(port); err != nil || got != "web" {
+		t.Errorf("after removing the route: got %q, %v", got, err)
+	}
+}
+
+// TestProxyUnixTarget verifies that connections are forwarded to a Unix
+// socket target.
+func TestProxyUnixTarget(t *testing.T) {
+	os.Setenv("DISABLE_TOR", "true")
+	os.Setenv("DISABLE_I2P", "true")
+	defer func() {
+		os.Unsetenv("DISABLE_TOR")
+		os.Unsetenv("DISABLE_I2P")
+	}()
+
+	path := filepath.Join(t.TempDir(), "app.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("app"))
+			conn.Close()
+		}
+	}()
+
+	port := freePort(t)
+	cfg := proxyConfig{
+		Domain:   "localhost",
+		MaxConns: 10,
+		LocalTCP: true,
+		Services: []serviceConfig{{ListenPort: port, Targets: []string{unixPrefix + path}}},
+	}
+	m, err := mirror.NewMirrorWithConfig(context.Background(), net.JoinHostPort("localhost", strconv.Itoa(port)), mirror.MirrorConfig{EnableLocalTCP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	pool := newConnectionPool(cfg.MaxConns)
+	defer pool.shutdown()
+	p := newProxy(m, pool, cfg)
+	if err := p.start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.close()
+
+	if got, err := fetch(port); err != nil || got != "app" {
+		t.Errorf("got %q, %v, want app", got, err)
+	}
+}
+
+// TestProxyBackendTLS verifies that a service with backend TLS re-encrypts
+// the connections it terminates to its target.
+func TestProxyBackendTLS(t *testing.T) {
+	os.Setenv("DISABLE_TOR", "true")
+	os.Setenv("DISABLE_I2P", "true")
+	defer func() {
+		os.Unsetenv("DISABLE_TOR")
+		os.Unsetenv("DISABLE_I2P")
+	}()
+
+	// The test server's certificate is valid for example.com
+	server := httptest.NewTLSServer(nil)
+	server.Close()
+	caPath := filepath.Join(t.TempDir(), "backend.pem")
+	if err := os.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", server.TLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("tls"))
+			conn.Close()
+		}
+	}()
+
+	port := freePort(t)
+	cfg := proxyConfig{
+		Domain:    "localhost",
+		MaxConns:  10,
+		LocalTCP:  true,
+		BackendCA: caPath,
+		Services: []serviceConfig{{
+			ListenPort: port,
+			Targets:    []string{listener.Addr().String()},
+			BackendTLS: backendTLS{Enabled: true, ServerName: "example.com"},
+		}},
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	m, err := mirror.NewMirrorWithConfig(context.Background(), net.JoinHostPort("localhost", strconv.Itoa(port)), mirror.MirrorConfig{EnableLocalTCP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	pool := newConnectionPool(cfg.MaxConns)
+	defer pool.shutdown()
+	p := newProxy(m, pool, cfg)
+	if err := p.start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.close()
+
+	if got, err := fetch(port); err != nil || got != "tls" {
+		t.Errorf("got %q, %v, want tls", got, err)
+	}
+}
+
+// TestConnectionPoolLimit verifies that acquire waits for a slot and that
+// raising the limit lets waiting connections through.
+func TestConnectionPoolLimit(t *testing.T) {
+	pool := newConnectionPool(1)
+	if !pool.acquire() {
+		t.Fatal("acquire failed")
+	}
+
+	acquired := make(chan bool, 1)
+	go func() { acquired <- pool.acquire() }()
+	select {
+	case <-acquired:
+		t.Fatal("acquire did not wait at the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	pool.setLimit(2)
+	if ok := <-acquired; !ok {
+		t.Fatal("acquire failed after raising the limit")
+	}
+
+	go func() { acquired <- pool.acquire() }()
+	pool.release()
+	if ok := <-acquired; !ok {
+		t.Fatal("acquire failed after a release")
+	}
+
+	pool.release()
+	pool.release()
+	pool.shutdown()
+	if pool.acquire() {
+		t.Error("acquire succeeded after shutdown")
+	}
+}
+
+// failingListener fails every Accept, counting the calls.
+type failingListener struct {
+	net.Listener
+	accepts atomic.Int32
+}
+
+func (fl *failingListener) Accept() (net.Conn, error) {
+	fl.accepts.Add(1)
+	return nil, errors.New("too many open files")
+}
+
+// TestServeAcceptBackoff verifies that a service's accept loop backs off
+// after Accept errors instead of spinning, and still stops right away.
+func TestServeAcceptBackoff(t *testing.T) {
+	pool := newConnectionPool(1)
+	defer pool.shutdown()
+	listener := &failingListener{}
+	rs := &runningService{stop: make(chan struct{})}
+	rs.serving.Add(1)
+	go rs.serve(pool, newClientTracker(clientLimits{}), listener, &rs.backends)
+
+	// 5+10+20+40+80+160ms: about seven attempts in 400ms, not thousands
+	time.Sleep(400 * time.Millisecond)
+	if n := listener.accepts.Load(); n < 2 || n > 10 {
+		t.Errorf("Accept called %d times in 400ms", n)
+	}
+
+	close(rs.stop)
+	done := make(chan struct{})
+	go func() {
+		rs.serving.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(100 * time.Millisecond):
+		t.Error("serve did not stop while backing off")
+	}
+}
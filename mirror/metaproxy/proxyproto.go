@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-i2p/go-meta-listener"
+	"github.com/go-i2p/go-meta-listener/mirror"
+)
+
+// proxyHeaderTimeout bounds how long a load balancer may take to send the
+// PROXY protocol header of a connection.
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV2Signature starts the header of PROXY protocol version 2.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolListener reads the PROXY protocol header, version 1 or 2,
+// that a load balancer sends at the start of each connection, and reports
+// the client it names as the connection's RemoteAddr. Connections without
+// a valid header are closed, so the listener must only be reachable
+// through the load balancer. Headers are read concurrently, so a slow
+// connection does not hold up the others.
+type proxyProtocolListener struct {
+	net.Listener
+
+	conns     chan net.Conn
+	closeOnce sync.Once
+	done      chan struct{}
+	err       error
+}
+
+// newProxyProtocolListener starts reading the headers of the connections
+// of listener.
+func newProxyProtocolListener(listener net.Listener) *proxyProtocolListener {
+	pl := &proxyProtocolListener{
+		Listener: listener,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go pl.acceptLoop()
+	return pl
+}
+
+func (pl *proxyProtocolListener) acceptLoop() {
+	for {
+		conn, err := pl.Listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
+			pl.shutdown(err)
+			return
+		}
+		go pl.readHeader(conn)
+	}
+}
+
+// readHeader reads the PROXY header of conn and hands it to Accept.
+func (pl *proxyProtocolListener) readHeader(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	remote, err := readProxyHeader(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		log.Warnf("Closing connection from %s: invalid PROXY protocol header: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	if remote != nil {
+		conn = &proxyHeaderConn{Conn: conn, remote: remote}
+	}
+	select {
+	case pl.conns <- conn:
+	case <-pl.done:
+		conn.Close()
+	}
+}
+
+// Accept returns the next connection whose header was read.
+func (pl *proxyProtocolListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-pl.conns:
+		return conn, nil
+	case <-pl.done:
+		return nil, pl.err
+	}
+}
+
+// Close stops accepting and closes the underlying listener.
+func (pl *proxyProtocolListener) Close() error {
+	pl.shutdown(net.ErrClosed)
+	return pl.Listener.Close()
+}
+
+func (pl *proxyProtocolListener) shutdown(err error) {
+	pl.closeOnce.Do(func() {
+		pl.err = err
+		close(pl.done)
+	})
+}
+
+// proxyHeaderConn is a connection whose client was named by a PROXY header.
+type proxyHeaderConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+// RemoteAddr returns the client named by the PROXY header.
+func (pc *proxyHeaderConn) RemoteAddr() net.Addr {
+	return pc.remote
+}
+
+// CloseWrite and CloseRead half-close the connection where supported.
+func (pc *proxyHeaderConn) CloseWrite() error {
+	return meta.CloseWrite(pc.Conn, pc.Conn.Close)
+}
+
+func (pc *proxyHeaderConn) CloseRead() error {
+	return meta.CloseRead(pc.Conn)
+}
+
+// readProxyHeader reads a PROXY protocol header from r, without reading
+// past it, and returns the client address it names, or nil for headers
+// that name none, such as the load balancer's own health checks.
+func readProxyHeader(r io.Reader) (net.Addr, error) {
+	start := make([]byte, 5)
+	if _, err := io.ReadFull(r, start); err != nil {
+		return nil, err
+	}
+	switch {
+	case string(start) == "PROXY":
+		return readProxyV1(r)
+	case bytes.Equal(start, proxyV2Signature[:5]):
+		return readProxyV2(r)
+	}
+	return nil, errors.New("no PROXY protocol signature")
+}
+
+// readProxyV1 reads the rest of a text header, after "PROXY".
+func readProxyV1(r io.Reader) (net.Addr, error) {
+	// The whole line is at most 107 bytes
+	line := make([]byte, 0, 102)
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == cap(line) {
+			return nil, errors.New("header line too long")
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) > 0 && fields[0] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return nil, fmt.Errorf("malformed header %q", "PROXY"+strings.TrimSuffix(string(line), "\r\n"))
+	}
+	ip := net.ParseIP(fields[1])
+	port, err := strconv.ParseUint(fields[3], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed source %s %s", fields[1], fields[3])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads the rest of a binary header, after the first five
+// bytes of its signature.
+func readProxyV2(r io.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyV2Signature)-5+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:7], proxyV2Signature[5:]) {
+		return nil, errors.New("no PROXY protocol signature")
+	}
+	verCmd, family := header[7], header[8]
+	body := make([]byte, binary.BigEndian.Uint16(header[9:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", verCmd>>4)
+	}
+	if verCmd&0xf == 0 {
+		// LOCAL: a connection of the load balancer itself
+		return nil, nil
+	}
+	switch family >> 4 {
+	case 1:
+		if len(body) < 12 {
+			return nil, errors.New("short IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 2:
+		if len(body) < 36 {
+			return nil, errors.New("short IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+	// UNSPEC or Unix addresses name no TCP client
+	return nil, nil
+}
+
+// PROXY protocol versions a service can send to its targets.
+const (
+	proxyV1 = "v1"
+	proxyV2 = "v2"
+)
+
+// writeProxyHeader writes a PROXY protocol header of version, v1 or v2,
+// naming the client src and the address dst it connected to. Clients
+// without an IP address, such as those of onion and I2P services, are
+// announced as unknown.
+func writeProxyHeader(w io.Writer, version string, src, dst net.Addr) error {
+	client, ok := addrPort(src)
+	if !ok {
+		if version == proxyV1 {
+			_, err := io.WriteString(w, "PROXY UNKNOWN\r\n")
+			return err
+		}
+		// PROXY command with the UNSPEC family and no addresses
+		header := append(bytes.Clone(proxyV2Signature), 0x21, 0x00, 0, 0)
+		_, err := w.Write(header)
+		return err
+	}
+	server, ok := addrPort(dst)
+	if !ok || server.Addr().Is4() != client.Addr().Is4() {
+		// The client reached a listener without an address of its family
+		server = netip.AddrPortFrom(netip.IPv6Unspecified(), 0)
+		if client.Addr().Is4() {
+			server = netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+		}
+	}
+
+	if version == proxyV1 {
+		family := "TCP6"
+		if client.Addr().Is4() {
+			family = "TCP4"
+		}
+		_, err := fmt.Fprintf(w, "PROXY %s %s %s %d %d\r\n", family, client.Addr(), server.Addr(), client.Port(), server.Port())
+		return err
+	}
+	family, addrs := byte(0x21), append(client.Addr().AsSlice(), server.Addr().AsSlice()...)
+	if client.Addr().Is4() {
+		family = 0x11
+	}
+	header := append(bytes.Clone(proxyV2Signature), 0x21, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)+4))
+	header = append(header, addrs...)
+	header = binary.BigEndian.AppendUint16(header, client.Port())
+	header = binary.BigEndian.AppendUint16(header, server.Port())
+	_, err := w.Write(header)
+	return err
+}
+
+// addrPort returns the IP address and port of addr, with IPv4-mapped IPv6
+// addresses as IPv4, reporting false for addresses that are not IP.
+func addrPort(addr net.Addr) (netip.AddrPort, bool) {
+	if addr == nil {
+		return netip.AddrPort{}, false
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(ap.Addr().Unmap().WithZone(""), ap.Port()), true
+}
+
+// proxyProtocolProvider serves the clearnet TLS listeners behind a load
+// balancer speaking the PROXY protocol, with the built-in ACME client.
+type proxyProtocolProvider struct{}
+
+// Listen binds the service's TLS address and reads PROXY headers from its
+// connections before their TLS handshake.
+func (proxyProtocolProvider) Listen(ctx context.Context, cfg mirror.ServiceConfig) (net.Listener, error) {
+	addr := cfg.TLSAddr
+	if addr == "" {
+		addr = ":443"
+	}
+	var lc net.ListenConfig
+	listener, err := lc.Listen(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create TLS listener on %s: %w", addr, err)
+	}
+	return acceptProxy(ctx, listener, cfg)
+}
+
+// acceptProxy serves the clearnet TLS listener of cfg on listener, reading
+// PROXY headers from its connections.
+func acceptProxy(ctx context.Context, listener net.Listener, cfg mirror.ServiceConfig) (net.Listener, error) {
+	log.Printf("Accepting PROXY protocol on %s", listener.Addr())
+	return (&mirror.ACMEProvider{Listener: newProxyProtocolListener(listener)}).Listen(ctx, cfg)
+}
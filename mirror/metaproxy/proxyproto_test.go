@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// proxyV2Header builds a binary PROXY header for an IPv4 client.
+func proxyV2Header(command byte, src *net.TCPAddr) []byte {
+	var header bytes.Buffer
+	header.Write(proxyV2Signature)
+	header.WriteByte(0x20 | command)
+	header.WriteByte(0x11)
+	binary.Write(&header, binary.BigEndian, uint16(12))
+	header.Write(src.IP.To4())
+	header.Write(net.IPv4(192, 0, 2, 1).To4())
+	binary.Write(&header, binary.BigEndian, uint16(src.Port))
+	binary.Write(&header, binary.BigEndian, uint16(443))
+	return header.Bytes()
+}
+
+// TestReadProxyHeader verifies that both header versions are parsed
+// without consuming the data that follows them.
+func TestReadProxyHeader(t *testing.T) {
+	client := &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 51234}
+	for name, tc := range map[string]struct {
+		header string
+		want   string
+	}{
+		"v1 tcp4":    {"PROXY TCP4 203.0.113.7 192.0.2.1 51234 443\r\n", "203.0.113.7:51234"},
+		"v1 tcp6":    {"PROXY TCP6 2001:db8::7 2001:db8::1 51234 443\r\n", "[2001:db8::7]:51234"},
+		"v1 unknown": {"PROXY UNKNOWN\r\n", ""},
+		"v2 proxy":   {string(proxyV2Header(1, client)), "203.0.113.7:51234"},
+		"v2 local":   {string(proxyV2Header(0, client)), ""},
+	} {
+		r := bytes.NewReader([]byte(tc.header + "hello"))
+		addr, err := readProxyHeader(r)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != tc.want {
+			t.Errorf("%s: address %q, want %q", name, got, tc.want)
+		}
+		if rest := r.Len(); rest != len("hello") {
+			t.Errorf("%s: %d bytes left after the header, want %d", name, rest, len("hello"))
+		}
+	}
+	for name, header := range map[string]string{
+		"no header":  "GET / HTTP/1.1\r\n",
+		"bad family": "PROXY UDP4 203.0.113.7 192.0.2.1 51234 443\r\n",
+		"bad port":   "PROXY TCP4 203.0.113.7 192.0.2.1 70000 443\r\n",
+		"truncated":  "PROXY TCP4 203.0.113.7",
+	} {
+		if _, err := readProxyHeader(bytes.NewReader([]byte(header))); err == nil {
+			t.Errorf("%s: header accepted", name)
+		}
+	}
+}
+
+// TestProxyProtocolListener verifies that accepted connections report the
+// client named by their header and that connections without one are
+// closed instead of being accepted.
+func TestProxyProtocolListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := newProxyProtocolListener(inner)
+	defer listener.Close()
+
+	bad, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bad.Close()
+	bad.Write([]byte("GET / HTTP/1.1\r\n"))
+	bad.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := bad.Read(make([]byte, 1)); err == nil {
+		t.Error("connection without a header was not closed")
+	}
+
+	good, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer good.Close()
+	good.Write([]byte("PROXY TCP4 203.0.113.7 192.0.2.1 51234 443\r\nhello"))
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := conn.RemoteAddr().String(); got != "203.0.113.7:51234" {
+		t.Errorf("RemoteAddr %s, want 203.0.113.7:51234", got)
+	}
+	buf := make([]byte, 5)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(buf); err != nil || string(buf) != "hello" {
+		t.Errorf("read %q, %v after the header, want hello", buf, err)
+	}
+
+	listener.Close()
+	if _, err := listener.Accept(); err == nil {
+		t.Error("Accept succeeded after Close")
+	}
+}
+
+// TestWriteProxyHeader verifies that both header versions written for a
+// target are read back as the client they name.
+func TestWriteProxyHeader(t *testing.T) {
+	v4 := &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 51234}
+	v6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 51234}
+	dst := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}
+	for _, version := range []string{proxyV1, proxyV2} {
+		for name, tc := range map[string]struct {
+			src  net.Addr
+			want string
+		}{
+			"tcp4":    {v4, "203.0.113.7:51234"},
+			"tcp6":    {v6, "[2001:db8::7]:51234"},
+			"unknown": {nil, ""},
+		} {
+			var buf bytes.Buffer
+			if err := writeProxyHeader(&buf, version, tc.src, dst); err != nil {
+				t.Fatalf("%s %s: %v", version, name, err)
+			}
+			buf.WriteString("hello")
+			addr, err := readProxyHeader(&buf)
+			if err != nil {
+				t.Errorf("%s %s: %v", version, name, err)
+				continue
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tc.want {
+				t.Errorf("%s %s: address %q, want %q", version, name, got, tc.want)
+			}
+			if buf.String() != "hello" {
+				t.Errorf("%s %s: %q left after the header", version, name, buf.String())
+			}
+		}
+	}
+}
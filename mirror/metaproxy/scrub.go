@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/go-i2p/go-meta-listener"
+	"github.com/go-i2p/go-meta-listener/mirror"
+	"golang.org/x/net/http/httpguts"
+)
+
+const (
+	// defaultScrubDate is the precision Date headers are rounded down to
+	// when responseScrub.Date is zero.
+	defaultScrubDate = time.Minute
+	// rewritePipeline bounds the requests a client may send ahead of their
+	// responses before reading from it waits for them.
+	rewritePipeline = 64
+	// maxScrubHead bounds how much of a connection is read looking for the
+	// end of a request head.
+	maxScrubHead = 64 << 10
+)
+
+var (
+	// defaultScrubHeaders are the response headers scrubbed when
+	// responseScrub.Headers is empty: those naming the server software and
+	// its version, and ETag, which Apache derives from the inode number of
+	// the file served.
+	defaultScrubHeaders = []string{"Server", "X-Powered-By", "X-AspNet-Version", "X-AspNetMvc-Version", "X-Generator", "ETag"}
+	// defaultScrubTransports are the transports responses are scrubbed on
+	// when responseScrub.Transports is empty.
+	defaultScrubTransports = []string{mirror.TransportOnion, mirror.TransportGarlic}
+)
+
+// errHeadTooLarge stops request parsing once maxScrubHead has been read
+// without finding the end of the head.
+var errHeadTooLarge = errors.New("request head exceeds size limit")
+
+// responseScrub removes the response headers of HTTP targets that would
+// let a service mirrored on several networks be recognized as the same
+// one across them, such as the server software and version, and rounds
+// Date down so the host's clock skew does not show.
+type responseScrub struct {
+	Enabled bool `toml:"scrub-responses"`
+	// Headers are the headers removed. Empty removes defaultScrubHeaders.
+	Headers []string `toml:"scrub-headers"`
+	// Date is the precision Date headers are rounded down to. Zero rounds
+	// them to the minute.
+	Date time.Duration `toml:"scrub-date"`
+	// Transports are those whose clients get scrubbed responses. Empty
+	// scrubs them on onion and i2p, the networks a clearnet service is
+	// told apart from.
+	Transports []string `toml:"scrub-transports"`
+}
+
+// validate checks the scrubbing settings of a service, passed through if
+// passthrough is set.
+func (s responseScrub) validate(passthrough bool) error {
+	if !s.Enabled {
+		if len(s.Headers) > 0 || s.Date != 0 || len(s.Transports) > 0 {
+			return fmt.Errorf("scrub-headers, scrub-date, and scrub-transports need scrub-responses")
+		}
+		return nil
+	}
+	if passthrough {
+		return fmt.Errorf("passthrough services forward TLS as it is and cannot scrub-responses")
+	}
+	for _, name := range s.Headers {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return fmt.Errorf("invalid scrub-headers entry %q", name)
+		}
+	}
+	if s.Date < 0 {
+		return fmt.Errorf("scrub-date must not be negative")
+	}
+	for _, transport := range s.Transports {
+		if !slices.Contains(transports, transport) {
+			return fmt.Errorf("unknown transport %q in scrub-transports", transport)
+		}
+	}
+	return nil
+}
+
+// applies reports whether the responses to conn are scrubbed, from the
+// transport it arrived on.
+func (s responseScrub) applies(conn net.Conn) bool {
+	if !s.Enabled {
+		return false
+	}
+	scrubbed := s.Transports
+	if len(scrubbed) == 0 {
+		scrubbed = defaultScrubTransports
+	}
+	ok, _ := transportFilter(scrubbed).admits(conn)
+	return ok
+}
+
+// rewrite scrubs the headers h of the response to a request, as a
+// responseRewrite.
+func (s responseScrub) rewrite(_ *http.Request, h http.Header) {
+	s.scrub(h)
+}
+
+// scrub removes and normalizes the identifying headers of h.
+func (s responseScrub) scrub(h http.Header) {
+	headers := s.Headers
+	if len(headers) == 0 {
+		headers = defaultScrubHeaders
+	}
+	for _, name := range headers {
+		h.Del(name)
+	}
+	precision := s.Date
+	if precision == 0 {
+		precision = defaultScrubDate
+	}
+	if date := h.Get("Date"); date != "" {
+		if t, err := http.ParseTime(date); err == nil {
+			h.Set("Date", t.UTC().Truncate(precision).Format(http.TimeFormat))
+		} else {
+			h.Del("Date")
+		}
+	}
+}
+
+// responseRewrite changes the headers h of the response to req.
+type responseRewrite func(req *http.Request, h http.Header)
+
+// altSvcRewrite returns the responseRewrite adding the headers altSvc
+// returns for a request, those the response already has excepted.
+func altSvcRewrite(altSvc func(*http.Request) http.Header) responseRewrite {
+	return func(req *http.Request, h http.Header) {
+		for key, values := range altSvc(req) {
+			if _, ok := h[key]; !ok {
+				h[key] = values
+			}
+		}
+	}
+}
+
+// rewriteResponses has the HTTP responses server sends to client rewritten
+// by rewrites, in order. It returns client, whose requests are followed to
+// know how each response ends, and server, whose reads return the
+// rewritten responses, to be forwarded in their place, and a function to
+// call once the connection is over. Targets that do not answer in
+// HTTP/1.x, and connections switched to another protocol, are passed
+// through as they are.
+func rewriteResponses(client, server net.Conn, rewrites []responseRewrite) (net.Conn, net.Conn, func()) {
+	tracked := make(chan *http.Request, rewritePipeline)
+	done := make(chan struct{})
+	requests, requestsW := io.Pipe()
+	responses, responsesW := io.Pipe()
+	go trackRequests(requests, tracked, done)
+	go func() {
+		responsesW.CloseWithError(copyResponses(responsesW, bufio.NewReader(server), tracked, done, rewrites))
+	}()
+	stop := func() {
+		close(done)
+		requestsW.Close()
+		responses.Close()
+	}
+	return requestTee{Conn: client, w: requestsW}, scrubbedConn{Conn: server, r: responses}, stop
+}
+
+// copyResponses writes the responses read from r to w, rewritten, until r
+// is done, learning the request each answers from requests.
+func copyResponses(w io.Writer, r *bufio.Reader, requests <-chan *http.Request, done <-chan struct{}, rewrites []responseRewrite) error {
+	for {
+		if head, _ := r.Peek(len("HTTP/")); string(head) != "HTTP/" {
+			// Not HTTP/1.x, or the end of the connection
+			_, err := io.Copy(w, r)
+			return err
+		}
+		var req *http.Request
+		select {
+		case tracked, ok := <-requests:
+			if !ok {
+				// The client's requests could not be followed
+				_, err := io.Copy(w, r)
+				return err
+			}
+			req = tracked
+		case <-done:
+			return nil
+		}
+		for {
+			resp, err := http.ReadResponse(r, req)
+			if err != nil {
+				return err
+			}
+			for _, rewrite := range rewrites {
+				rewrite(req, resp.Header)
+			}
+			err = resp.Write(w)
+			resp.Body.Close()
+			if err != nil {
+				return err
+			}
+			if resp.StatusCode == http.StatusSwitchingProtocols || (req.Method == http.MethodConnect && resp.StatusCode/100 == 2) {
+				_, err := io.Copy(w, r)
+				return err
+			}
+			// Interim responses, such as 100 Continue, precede the final
+			// response to the same request
+			if resp.StatusCode >= 200 {
+				break
+			}
+		}
+	}
+}
+
+// trackRequests parses the requests read from r, sending each to
+// requests, and closes requests once it cannot follow them any more: at
+// the end of the connection, on what is not an HTTP/1.x request, and after
+// a request switching to another protocol. What is left of r is discarded.
+func trackRequests(r io.Reader, requests chan<- *http.Request, done <-chan struct{}) {
+	defer io.Copy(io.Discard, r)
+	defer close(requests)
+	head := &headLimit{r: r}
+	br := bufio.NewReader(head)
+	for {
+		head.left = maxScrubHead
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		head.left = -1
+		select {
+		case requests <- req:
+		case <-done:
+			return
+		}
+		io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+		if req.Method == http.MethodConnect || req.Header.Get("Upgrade") != "" {
+			return
+		}
+	}
+}
+
+// headLimit fails reads once left bytes have been read, so a request head
+// without an end does not grow the parser's buffer without bound. A
+// negative left does not limit.
+type headLimit struct {
+	r    io.Reader
+	left int
+}
+
+func (hl *headLimit) Read(p []byte) (int, error) {
+	if hl.left < 0 {
+		return hl.r.Read(p)
+	}
+	if hl.left == 0 {
+		return 0, errHeadTooLarge
+	}
+	if len(p) > hl.left {
+		p = p[:hl.left]
+	}
+	n, err := hl.r.Read(p)
+	hl.left -= n
+	return n, err
+}
+
+// requestTee hands what is read from the client to trackRequests as well.
+type requestTee struct {
+	net.Conn
+	w *io.PipeWriter
+}
+
+func (rt requestTee) Read(p []byte) (int, error) {
+	n, err := rt.Conn.Read(p)
+	if n > 0 {
+		rt.w.Write(p[:n])
+	}
+	if err != nil {
+		rt.w.Close()
+	}
+	return n, err
+}
+
+// CloseRead shuts down the reading side of the client connection.
+func (rt requestTee) CloseRead() error {
+	return meta.CloseRead(rt.Conn)
+}
+
+// scrubbedConn reads the scrubbed responses of a target.
+type scrubbedConn struct {
+	net.Conn
+	r *io.PipeReader
+}
+
+func (sc scrubbedConn) Read(p []byte) (int, error) {
+	return sc.r.Read(p)
+}
+
+// CloseRead shuts down the reading side of the target connection, which
+// ends the scrubbed responses once those read are forwarded.
+func (sc scrubbedConn) CloseRead() error {
+	return meta.CloseRead(sc.Conn)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCopyResponses verifies that identifying headers are removed and Date
+// rounded in every response of a connection, that the bodies are framed
+// by the request they answer, and that what is not HTTP passes unchanged.
+func TestCopyResponses(t *testing.T) {
+	requests := "HEAD / HTTP/1.1\r\nHost: a\r\n\r\n" +
+		"POST /upload HTTP/1.1\r\nHost: a\r\nContent-Length: 4\r\nExpect: 100-continue\r\n\r\ndata" +
+		"GET /page HTTP/1.1\r\nHost: a\r\n\r\n"
+	responses := "HTTP/1.1 200 OK\r\nServer: Apache/2.4.58 (Debian)\r\nContent-Length: 42\r\n\r\n" +
+		"HTTP/1.1 100 Continue\r\n\r\n" +
+		"HTTP/1.1 201 Created\r\nX-Powered-By: PHP/8.2\r\nContent-Length: 0\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\nDate: Tue, 01 Oct 2024 12:34:56 GMT\r\nETag: \"2a0b3c-5d-61e2f\"\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n"
+
+	tracked := make(chan *http.Request, rewritePipeline)
+	done := make(chan struct{})
+	trackRequests(strings.NewReader(requests), tracked, done)
+	var out bytes.Buffer
+	scrub := []responseRewrite{responseScrub{Enabled: true}.rewrite}
+	if err := copyResponses(&out, bufio.NewReader(strings.NewReader(responses)), tracked, done, scrub); err != nil {
+		t.Fatalf("copyResponses: %v", err)
+	}
+	got := out.String()
+	for _, leak := range []string{"Apache", "PHP", "2a0b3c", "12:34:56"} {
+		if strings.Contains(got, leak) {
+			t.Errorf("Scrubbed responses contain %q:\n%s", leak, got)
+		}
+	}
+	for _, want := range []string{"Content-Length: 42\r\n\r\nHTTP/1.1 100 Continue", "201 Created", "Date: Tue, 01 Oct 2024 12:34:00 GMT", "5\r\nhello\r\n0\r\n\r\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Scrubbed responses lack %q:\n%s", want, got)
+		}
+	}
+
+	// A target that is not HTTP, or a client whose requests are not
+	tracked = make(chan *http.Request)
+	close(tracked)
+	for _, stream := range []string{"SSH-2.0-OpenSSH_9.6\r\n", "HTTP/1.1 200 OK\r\nServer: nginx\r\n\r\n"} {
+		out.Reset()
+		if err := copyResponses(&out, bufio.NewReader(strings.NewReader(stream)), tracked, done, scrub); err != nil || out.String() != stream {
+			t.Errorf("copyResponses(%q) = %q, %v", stream, out.String(), err)
+		}
+	}
+}
+
+// TestResponseScrubDate verifies the Date precision and that a header list
+// replaces the default one.
+func TestResponseScrubDate(t *testing.T) {
+	s := responseScrub{Enabled: true, Headers: []string{"X-Backend"}, Date: time.Hour}
+	h := map[string][]string{
+		"Date":      {"Tue, 01 Oct 2024 12:34:56 GMT"},
+		"Server":    {"nginx"},
+		"X-Backend": {"web3"},
+	}
+	s.scrub(h)
+	if h["Date"][0] != "Tue, 01 Oct 2024 12:00:00 GMT" || h["Server"] == nil || h["X-Backend"] != nil {
+		t.Errorf("Scrubbed headers %v", h)
+	}
+	h = map[string][]string{"Date": {"yesterday"}}
+	s.scrub(h)
+	if h["Date"] != nil {
+		t.Errorf("Unparsable Date kept: %v", h)
+	}
+}
+
+// TestAltSvcRewrite verifies that every response advertises the hidden
+// mirrors for the request it answers, keeping headers the target set.
+func TestAltSvcRewrite(t *testing.T) {
+	requests := "GET /a HTTP/1.1\r\nHost: example.org\r\n\r\n" +
+		"GET /b HTTP/1.1\r\nHost: example.org\r\n\r\n"
+	responses := "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\nAlt-Svc: clear\r\nContent-Length: 0\r\n\r\n"
+	altSvc := func(r *http.Request) http.Header {
+		return http.Header{
+			"Alt-Svc":        {`h2="abcdef.onion:443"; ma=86400`},
+			"X-I2p-Location": {"https://ghijkl.b32.i2p" + r.URL.RequestURI()},
+		}
+	}
+
+	tracked := make(chan *http.Request, rewritePipeline)
+	done := make(chan struct{})
+	trackRequests(strings.NewReader(requests), tracked, done)
+	var out bytes.Buffer
+	if err := copyResponses(&out, bufio.NewReader(strings.NewReader(responses)), tracked, done, []responseRewrite{altSvcRewrite(altSvc)}); err != nil {
+		t.Fatalf("copyResponses: %v", err)
+	}
+	r := bufio.NewReader(&out)
+	for _, want := range []struct{ altSvc, i2p string }{
+		{`h2="abcdef.onion:443"; ma=86400`, "https://ghijkl.b32.i2p/a"},
+		{"clear", "https://ghijkl.b32.i2p/b"},
+	} {
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatalf("ReadResponse: %v", err)
+		}
+		if got := resp.Header.Get("Alt-Svc"); got != want.altSvc {
+			t.Errorf("Alt-Svc %q, want %q", got, want.altSvc)
+		}
+		if got := resp.Header.Get("X-I2P-Location"); got != want.i2p {
+			t.Errorf("X-I2P-Location %q, want %q", got, want.i2p)
+		}
+	}
+}
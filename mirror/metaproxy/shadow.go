@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-i2p/go-meta-listener"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// shadowQueue bounds the reads of client data waiting to be written to
+	// a shadow target; a shadow further behind is cut off.
+	shadowQueue = 64
+	// shadowLinger is how long a shadow target may take to read the rest
+	// of a connection's data and answer once the connection has ended.
+	shadowLinger = 10 * time.Second
+)
+
+// shadow copies what a client sends to the shadow target of its service or
+// route, discarding what the target answers. It never holds the client up:
+// a shadow target that cannot be reached, fails, or falls behind is cut off
+// and the connection carries on without it.
+type shadow struct {
+	clog  *logrus.Entry
+	queue chan []byte
+	// cut is set once the shadow target no longer gets the client's data
+	cut       atomic.Bool
+	closeOnce sync.Once
+
+	mu sync.Mutex
+	// conn is the connection to the shadow target, once it is open
+	conn net.Conn
+	// ended is set by end once the client's connection is over
+	ended bool
+}
+
+// startShadow starts copying the data client sends to the shadow target of
+// b, returning nil if b has none.
+func (b *backendSet) startShadow(clog *logrus.Entry, client net.Conn) *shadow {
+	if b.shadow == "" {
+		return nil
+	}
+	s := &shadow{clog: clog.WithField("shadow", b.shadow), queue: make(chan []byte, shadowQueue)}
+	go s.run(b, client)
+	return s
+}
+
+// run connects to the shadow target of b and writes the queued data to it
+// until the client is done sending.
+func (s *shadow) run(b *backendSet, client net.Conn) {
+	conn, err := b.open(b.shadow, client)
+	if err != nil {
+		s.cutOff("Failed to connect to the shadow target: %v", err)
+		for range s.queue {
+		}
+		return
+	}
+	defer conn.Close()
+	s.mu.Lock()
+	s.conn = conn
+	if s.ended {
+		conn.SetDeadline(time.Now().Add(shadowLinger))
+	}
+	s.mu.Unlock()
+
+	discarded := make(chan struct{})
+	go func() {
+		defer close(discarded)
+		io.Copy(io.Discard, conn)
+	}()
+	for chunk := range s.queue {
+		if s.cut.Load() {
+			continue
+		}
+		if _, err := conn.Write(chunk); err != nil {
+			s.cutOff("Error copying client to the shadow target: %v", err)
+		}
+	}
+	if !s.cut.Load() {
+		// Wait for the target to answer, up to shadowLinger after the
+		// connection ends
+		meta.CloseWrite(conn, conn.Close)
+		<-discarded
+	}
+}
+
+// send queues data read from the client for the shadow target, cutting the
+// target off if too much is queued already.
+func (s *shadow) send(data []byte) {
+	if s.cut.Load() {
+		return
+	}
+	select {
+	case s.queue <- bytes.Clone(data):
+	default:
+		s.cutOff("Shadow target is falling behind; no longer copying this connection to it")
+	}
+}
+
+// finish tells the shadow target the client is done sending.
+func (s *shadow) finish() {
+	s.closeOnce.Do(func() { close(s.queue) })
+}
+
+// end gives the shadow target shadowLinger to finish once the client's
+// connection is over.
+func (s *shadow) end() {
+	s.finish()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ended = true
+	if s.conn != nil {
+		s.conn.SetDeadline(time.Now().Add(shadowLinger))
+	}
+}
+
+// cutOff stops copying to the shadow target, closing the connection to it,
+// and logs why.
+func (s *shadow) cutOff(format string, args ...any) {
+	if !s.cut.CompareAndSwap(false, true) {
+		return
+	}
+	s.clog.Debugf(format, args...)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+// teeConn hands what is read from the client to a shadow as well.
+type teeConn struct {
+	net.Conn
+	shadow *shadow
+}
+
+func (tc teeConn) Read(p []byte) (int, error) {
+	n, err := tc.Conn.Read(p)
+	if n > 0 {
+		tc.shadow.send(p[:n])
+	}
+	if err != nil {
+		tc.shadow.finish()
+	}
+	return n, err
+}
+
+// CloseRead shuts down the reading side of the client connection.
+func (tc teeConn) CloseRead() error {
+	return meta.CloseRead(tc.Conn)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+)
+
+// TestShadowFallingBehind verifies that a shadow target is cut off once
+// more reads are queued for it than shadowQueue, rather than holding up the
+// client.
+func TestShadowFallingBehind(t *testing.T) {
+	s := &shadow{clog: connLog("test"), queue: make(chan []byte, shadowQueue)}
+	for i := 0; i < shadowQueue; i++ {
+		s.send([]byte("data"))
+	}
+	if s.cut.Load() {
+		t.Fatal("cut off with room left in the queue")
+	}
+	s.send([]byte("data"))
+	if !s.cut.Load() {
+		t.Fatal("not cut off with the queue full")
+	}
+	s.send([]byte("data"))
+	if len(s.queue) != shadowQueue {
+		t.Errorf("%d reads queued after the cutoff, want %d", len(s.queue), shadowQueue)
+	}
+	s.end()
+	s.end()
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-i2p/go-meta-listener/mirror"
+)
+
+// sdNotify sends state, such as "READY=1", to the service manager. It does
+// nothing when metaproxy was not started by systemd with Type=notify.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if strings.HasPrefix(socket, "@") {
+		// Abstract socket namespace
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("failed to connect to systemd notify socket: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("failed to notify systemd: %w", err)
+	}
+	return nil
+}
+
+// notify is sdNotify for callers that only log failures.
+func notify(state string) {
+	if err := sdNotify(state); err != nil {
+		log.Warnln(err)
+	}
+}
+
+// watchdogInterval returns how often systemd expects a WATCHDOG=1 ping, or
+// zero when the watchdog is not enabled for this process.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	// Ping twice per interval so one late ping does not trip it.
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// runWatchdog pings the systemd watchdog until ctx is done.
+func runWatchdog(ctx context.Context) {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			notify("WATCHDOG=1")
+		}
+	}
+}
+
+// listenFdsStart is the first file descriptor passed by systemd.
+const listenFdsStart = 3
+
+// activatedListeners returns the sockets passed by systemd socket
+// activation, keyed by their FileDescriptorName, and clears the activation
+// environment so child processes do not inherit it.
+func activatedListeners() (map[string]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	listeners := make(map[string]net.Listener, count)
+	for i := 0; i < count; i++ {
+		fd := listenFdsStart + i
+		name := strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		// FileListener duplicates the descriptor with close-on-exec set,
+		// so the inherited one is closed.
+		file := os.NewFile(uintptr(fd), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("systemd socket %s is not a listening stream socket: %w", name, err)
+		}
+		listeners[name] = listener
+	}
+	return listeners, nil
+}
+
+// activatedProvider serves the clearnet TLS listener of services from
+// sockets passed by systemd, and of other services from fallback. A socket
+// named after a listen port, with FileDescriptorName=443, goes to that
+// service; a single socket of any name goes to the only service.
+type activatedProvider struct {
+	mu        sync.Mutex
+	listeners map[string]net.Listener
+	fallback  mirror.CertProvider
+	// acceptProxy reads PROXY headers from the sockets' connections
+	acceptProxy bool
+}
+
+// newActivatedProvider assigns listeners to the services of cfg. Sockets no
+// service claims are reported and closed.
+func newActivatedProvider(listeners map[string]net.Listener, cfg proxyConfig) (*activatedProvider, error) {
+	p := &activatedProvider{
+		listeners:   make(map[string]net.Listener),
+		fallback:    mirror.WileedotProvider{},
+		acceptProxy: cfg.AcceptProxy,
+	}
+	if cfg.AcceptProxy {
+		p.fallback = proxyProtocolProvider{}
+	} else if cfg.ClientCA != "" {
+		// wileedot cannot verify client certificates
+		p.fallback = &mirror.ACMEProvider{}
+	}
+	if len(listeners) == 1 && len(cfg.Services) == 1 {
+		for _, listener := range listeners {
+			p.listeners[strconv.Itoa(cfg.Services[0].ListenPort)] = listener
+		}
+		return p, nil
+	}
+	ports := make(map[string]bool, len(cfg.Services))
+	for _, svc := range cfg.Services {
+		ports[strconv.Itoa(svc.ListenPort)] = true
+	}
+	var unclaimed []string
+	for name, listener := range listeners {
+		if !ports[name] {
+			unclaimed = append(unclaimed, name)
+			listener.Close()
+			continue
+		}
+		p.listeners[name] = listener
+	}
+	if len(unclaimed) > 0 {
+		return p, fmt.Errorf("systemd sockets %s match no listen-port; set FileDescriptorName to the port", strings.Join(unclaimed, ", "))
+	}
+	return p, nil
+}
+
+// Listen serves the service on its activated socket with the built-in ACME
+// client, or defers to the fallback provider.
+func (p *activatedProvider) Listen(ctx context.Context, cfg mirror.ServiceConfig) (net.Listener, error) {
+	_, port, err := net.SplitHostPort(cfg.Name)
+	if err == nil {
+		p.mu.Lock()
+		listener, ok := p.listeners[port]
+		// The socket is closed with the service, so it is used once.
+		delete(p.listeners, port)
+		p.mu.Unlock()
+		if ok {
+			log.Printf("Using systemd socket %s for the TLS listener of port %s", listener.Addr(), port)
+			if p.acceptProxy {
+				return acceptProxy(ctx, listener, cfg)
+			}
+			return (&mirror.ACMEProvider{Listener: listener}).Listen(ctx, cfg)
+		}
+	}
+	return p.fallback.Listen(ctx, cfg)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestSdNotify verifies that states are sent to NOTIFY_SOCKET.
+func TestSdNotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", path)
+
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatalf("sdNotify: %v", err)
+	}
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "READY=1" {
+		t.Errorf("got %q, %v, want READY=1", buf[:n], err)
+	}
+
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Errorf("sdNotify without systemd: %v", err)
+	}
+}
+
+// TestWatchdogInterval verifies that pings are sent twice per watchdog
+// interval, and only to the process systemd watches.
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if got := watchdogInterval(); got != 15*time.Second {
+		t.Errorf("interval = %s, want 15s", got)
+	}
+	t.Setenv("WATCHDOG_PID", "1")
+	if got := watchdogInterval(); got != 0 {
+		t.Errorf("interval for another process = %s, want 0", got)
+	}
+	t.Setenv("WATCHDOG_USEC", "")
+	t.Setenv("WATCHDOG_PID", "")
+	if got := watchdogInterval(); got != 0 {
+		t.Errorf("interval without watchdog = %s, want 0", got)
+	}
+}
+
+// TestActivatedListenersOtherProcess verifies that sockets meant for
+// another process are ignored.
+func TestActivatedListenersOtherProcess(t *testing.T) {
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+	listeners, err := activatedListeners()
+	if err != nil || len(listeners) != 0 {
+		t.Errorf("got %v, %v, want no listeners", listeners, err)
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("activation environment not cleared")
+	}
+}
+
+// TestActivatedProvider verifies how sockets are assigned to services.
+func TestActivatedProvider(t *testing.T) {
+	listen := func() net.Listener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { l.Close() })
+		return l
+	}
+	one := proxyConfig{Services: []serviceConfig{{ListenPort: 443}}}
+	two := proxyConfig{Services: []serviceConfig{{ListenPort: 443}, {ListenPort: 8443}}}
+
+	p, err := newActivatedProvider(map[string]net.Listener{"metaproxy.socket": listen()}, one)
+	if err != nil || p.listeners["443"] == nil {
+		t.Errorf("single socket not assigned to the only service: %v", err)
+	}
+
+	p, err = newActivatedProvider(map[string]net.Listener{"443": listen(), "8443": listen()}, two)
+	if err != nil || p.listeners["443"] == nil || p.listeners["8443"] == nil {
+		t.Errorf("named sockets not assigned by port: %v", err)
+	}
+
+	if _, err := newActivatedProvider(map[string]net.Listener{"443": listen(), "web": listen()}, two); err == nil {
+		t.Error("unclaimed socket not reported")
+	}
+}
@@ -0,0 +1,202 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+// retireTimeout bounds recreating the TLS listener when a MigrateDomain
+// overlap ends.
+const retireTimeout = time.Minute
+
+// certIssuer is implemented by TLS listeners that can obtain the
+// certificate of a domain before a client asks for it.
+type certIssuer interface {
+	Issue(ctx context.Context, domain string) error
+}
+
+// domainMigration is a MigrateDomain overlap in progress.
+type domainMigration struct {
+	from, to string
+	// timer retires from when the overlap ends; nil until it is scheduled
+	timer *time.Timer
+}
+
+// stop cancels the retirement of the old domain, if it is scheduled.
+func (m *domainMigration) stop() {
+	if m.timer != nil {
+		m.timer.Stop()
+	}
+}
+
+// MigrateDomain moves the clearnet TLS listener of the service on port from
+// its current name to domain without restarting the service or touching its
+// certificate directory. The TLS listener is recreated for a certificate
+// covering both names, the certificate for domain is obtained right away if
+// the CertProvider can do so (ACMEProvider can; WileedotProvider issues it
+// on the first handshake), and both names are served by the service's
+// listener for overlap. The TLS listener is then recreated once more without
+// the old name. CertMigrating and CertMigrated events report both steps
+// through MirrorConfig.OnCertEvent.
+//
+// The service's listener and hidden transports keep running, but each step
+// briefly rebinds the TLS address and replaces the companion HTTP listener
+// and the listeners returned by DomainListener, which must be fetched again.
+// If the new certificate cannot be obtained, the service is moved back to
+// its old name and the error is returned. Adding or closing the service
+// cancels a pending retirement.
+func (ml *Mirror) MigrateDomain(ctx context.Context, port, domain string, overlap time.Duration) error {
+	cfg, migration, err := ml.beginMigration(port, domain)
+	if err != nil {
+		return err
+	}
+	next := cfg
+	next.Name = migration.to
+	next.Domains = slices.DeleteFunc(slices.Clone(cfg.Domains), func(name string) bool { return name == migration.to })
+	next.retiring = []string{migration.from}
+
+	certs := ml.certTracker()
+	provided, err := ml.replaceTLSListener(ctx, port, next)
+	if issuer, ok := provided.(certIssuer); ok && err == nil {
+		if err = issuer.Issue(ctx, migration.to); err != nil {
+			certs.fail(migration.to, err)
+		}
+	}
+	if err != nil {
+		ml.mu.Lock()
+		if ml.migrations[port] == migration {
+			delete(ml.migrations, port)
+		}
+		ml.mu.Unlock()
+		err = fmt.Errorf("failed to migrate service on port %s to %s: %w", port, migration.to, err)
+		restoreCtx, cancel := context.WithTimeout(context.Background(), retireTimeout)
+		defer cancel()
+		if _, restoreErr := ml.replaceTLSListener(restoreCtx, port, cfg); restoreErr != nil {
+			return errors.Join(err, fmt.Errorf("failed to restore %s: %w", migration.from, restoreErr))
+		}
+		return err
+	}
+	certs.migrate(CertMigrating, migration.to, migration.from)
+
+	ml.mu.Lock()
+	if ml.migrations[port] == migration {
+		migration.timer = time.AfterFunc(overlap, func() { ml.retireDomain(port, migration) })
+	}
+	ml.mu.Unlock()
+	return nil
+}
+
+// beginMigration records a migration of the service on port to domain,
+// returning the service's configuration, unless it cannot be migrated.
+func (ml *Mirror) beginMigration(port, domain string) (ServiceConfig, *domainMigration, error) {
+	domain = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+	if domain == "" {
+		return ServiceConfig{}, nil, errors.New("no domain to migrate to")
+	}
+
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	cfg, ok := ml.services[port]
+	if !ok {
+		return ServiceConfig{}, nil, fmt.Errorf("no service on port %s", port)
+	}
+	if cfg.Email == "" {
+		return ServiceConfig{}, nil, fmt.Errorf("service on port %s has no clearnet TLS listener", port)
+	}
+	if current := ml.migrations[port]; current != nil {
+		return ServiceConfig{}, nil, fmt.Errorf("service on port %s is still migrating from %s", port, current.from)
+	}
+	from := cfg.tlsDomains()[0]
+	if strings.EqualFold(from, domain) {
+		return ServiceConfig{}, nil, fmt.Errorf("service on port %s already uses %s", port, domain)
+	}
+
+	migration := &domainMigration{from: from, to: domain}
+	if ml.migrations == nil {
+		ml.migrations = make(map[string]*domainMigration)
+	}
+	ml.migrations[port] = migration
+	return cfg, migration, nil
+}
+
+// retireDomain ends the overlap of migration by recreating the TLS listener
+// of the service on port without the old domain.
+func (ml *Mirror) retireDomain(port string, migration *domainMigration) {
+	select {
+	case <-ml.stopCh:
+		return
+	default:
+	}
+
+	ml.mu.Lock()
+	cfg, ok := ml.services[port]
+	current := ml.migrations[port] == migration
+	if current {
+		delete(ml.migrations, port)
+	}
+	ml.mu.Unlock()
+	if !ok || !current {
+		return
+	}
+
+	cfg.retiring = nil
+	ctx, cancel := context.WithTimeout(context.Background(), retireTimeout)
+	defer cancel()
+	certs := ml.certTracker()
+	if _, err := ml.replaceTLSListener(ctx, port, cfg); err != nil {
+		log.Printf("Error retiring %s on port %s: %v\n", migration.from, port, err)
+		certs.emit(CertEvent{Type: CertFailed, Domain: migration.to, From: migration.from, Err: err})
+		return
+	}
+	certs.migrate(CertMigrated, migration.to, migration.from)
+}
+
+// replaceTLSListener closes the clearnet TLS listener of the service on
+// port, with its SNI domain listeners and companion HTTP listener, and sets
+// up a new one for cfg, which becomes the service's configuration. It
+// returns the listener created by the CertProvider.
+func (ml *Mirror) replaceTLSListener(ctx context.Context, port string, cfg ServiceConfig) (net.Listener, error) {
+	ml.mu.Lock()
+	child := ml.children[port]
+	server := ml.httpServers[port]
+	domains := ml.domains[port]
+	delete(ml.httpServers, port)
+	delete(ml.domains, port)
+	ml.mu.Unlock()
+	if child == nil {
+		return nil, fmt.Errorf("no service on port %s", port)
+	}
+
+	if server != nil {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), defaultCloseTimeout)
+		shutdownHTTPServer(shutdownCtx, server)
+		cancel()
+	}
+	for _, listener := range domains {
+		listener.Close()
+	}
+	if err := child.RemoveListenersByPrefix(TransportTLS + "-"); err != nil {
+		log.Printf("Error closing TLS listener on port %s: %v\n", port, err)
+	}
+
+	var provided net.Listener
+	if err := ml.startTransport(TransportTLS, port, func() error {
+		var err error
+		provided, err = ml.setupTLSListener(ctx, cfg, port, child)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	ml.mu.Lock()
+	if ml.children[port] == child {
+		ml.services[port] = cfg
+	}
+	ml.mu.Unlock()
+	return provided, nil
+}
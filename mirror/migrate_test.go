@@ -0,0 +1,130 @@
+package mirror
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-i2p/go-meta-listener"
+)
+
+// recordingProvider is a CertProvider serving a self-signed certificate on
+// loopback and recording the domains of every listener it creates.
+type recordingProvider struct {
+	config *tls.Config
+
+	mu      sync.Mutex
+	domains [][]string
+	addr    string
+}
+
+func (p *recordingProvider) Listen(ctx context.Context, cfg ServiceConfig) (net.Listener, error) {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", p.config)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	p.domains = append(p.domains, cfg.tlsDomains())
+	p.addr = listener.Addr().String()
+	p.mu.Unlock()
+	return listener, nil
+}
+
+// last returns the domains and address of the newest listener.
+func (p *recordingProvider) last() ([]string, string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.domains[len(p.domains)-1], p.addr
+}
+
+// TestMigrateDomain verifies that a service serves both names during the
+// overlap, only the new one afterwards, and reports both steps.
+func TestMigrateDomain(t *testing.T) {
+	t.Setenv("DISABLE_TOR", "true")
+	t.Setenv("DISABLE_I2P", "true")
+	t.Setenv("CERT_DIR", t.TempDir())
+
+	provider := &recordingProvider{config: testTLSConfig(t)}
+	events := make(chan CertEvent, 16)
+	cfg := DefaultMirrorConfig()
+	cfg.CertProvider = provider
+	cfg.OnCertEvent = func(e CertEvent) { events <- e }
+	mirror, err := NewMirrorWithConfig(context.Background(), "test-migrate", cfg)
+	if err != nil {
+		t.Fatalf("Failed to create mirror: %v", err)
+	}
+	defer mirror.Close()
+
+	service, err := mirror.AddService("3031", ServiceConfig{Name: "old.example", Email: "ops@example.org"})
+	if err != nil {
+		t.Fatalf("AddService failed: %v", err)
+	}
+	if err := mirror.MigrateDomain(context.Background(), "3031", "old.example", time.Second); err == nil {
+		t.Error("Migrating to the current domain succeeded")
+	}
+	if err := mirror.MigrateDomain(context.Background(), "3032", "new.example", time.Second); err == nil {
+		t.Error("Migrating a port without a service succeeded")
+	}
+
+	if err := mirror.MigrateDomain(context.Background(), "3031", "New.Example.", 500*time.Millisecond); err != nil {
+		t.Fatalf("MigrateDomain failed: %v", err)
+	}
+	domains, addr := provider.last()
+	if want := []string{"new.example", "old.example"}; !slices.Equal(domains, want) {
+		t.Errorf("Overlap listener for %v, want %v", domains, want)
+	}
+	if e := <-events; e.Type != CertMigrating || e.Domain != "new.example" || e.From != "old.example" {
+		t.Errorf("First event %+v, want migrating from old.example", e)
+	}
+	if err := mirror.MigrateDomain(context.Background(), "3031", "other.example", time.Second); err == nil {
+		t.Error("A second migration started during the overlap")
+	}
+
+	// Both names reach the service's listener during the overlap
+	for _, serverName := range []string{"old.example", "new.example"} {
+		dialed := make(chan error, 1)
+		go func() {
+			client, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+			if err == nil {
+				client.Close()
+			}
+			dialed <- err
+		}()
+		conn, err := service.Accept()
+		if err != nil {
+			t.Fatalf("Accept for SNI %s failed: %v", serverName, err)
+		}
+		// ConnectionState does not wait for the handshake, which the
+		// first Read completes
+		conn.Read(make([]byte, 1))
+		if got := conn.(meta.TLSStateConn).ConnectionState().ServerName; got != serverName {
+			t.Errorf("Accepted SNI %q, want %s", got, serverName)
+		}
+		if err := <-dialed; err != nil {
+			t.Errorf("Dial with SNI %s failed: %v", serverName, err)
+		}
+		conn.Close()
+	}
+
+	select {
+	case e := <-events:
+		if e.Type != CertMigrated || e.Domain != "new.example" || e.From != "old.example" {
+			t.Errorf("Second event %+v, want migrated from old.example", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The old domain was not retired")
+	}
+	if domains, _ := provider.last(); !slices.Equal(domains, []string{"new.example"}) {
+		t.Errorf("Listener after the overlap for %v, want only new.example", domains)
+	}
+	mirror.mu.RLock()
+	name := mirror.services["3031"].Name
+	mirror.mu.RUnlock()
+	if name != "new.example" {
+		t.Errorf("Service name %q after migrating", name)
+	}
+}
@@ -0,0 +1,162 @@
+package mirror
+
+import (
+	"bufio"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// onionKeyEncoding encodes the x25519 public keys of onion service clients
+// as Tor does.
+var onionKeyEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// OnionClient is a client authorized to reach an onion service restricted
+// with OnionOptions.ClientAuth.
+type OnionClient struct {
+	// Name identifies the grant, for example the user it was issued to.
+	Name string `json:"name"`
+	// PublicKey is the client's x25519 public key in base32, the part
+	// after "descriptor:x25519:" in Tor's authorized_clients files.
+	PublicKey string `json:"public_key"`
+}
+
+// AuthorizeOnionClient allows the client holding the x25519 private key of
+// publicKey to reach the onion service on port, under name, replacing a
+// grant of the same name. Grants are kept next to the service's onion key
+// and applied right away to a service restricted with
+// OnionOptions.ClientAuth, which Tor republishes, so users can be
+// onboarded without restarting. Clients already connected stay connected.
+func (ml *Mirror) AuthorizeOnionClient(port, name, publicKey string) error {
+	if name == "" || strings.ContainsAny(name, " \t\r\n") {
+		return fmt.Errorf("invalid onion client name %q", name)
+	}
+	publicKey = strings.ToUpper(strings.TrimSpace(publicKey))
+	if key, err := onionKeyEncoding.DecodeString(publicKey); err != nil || len(key) != 32 {
+		return fmt.Errorf("invalid x25519 public key for onion client %s", name)
+	}
+	tt, err := ml.managedOnion(port)
+	if err != nil {
+		return err
+	}
+	return tt.updateClients(func(clients []OnionClient) ([]OnionClient, error) {
+		clients = slices.DeleteFunc(clients, func(c OnionClient) bool { return c.Name == name })
+		return append(clients, OnionClient{Name: name, PublicKey: publicKey}), nil
+	})
+}
+
+// RevokeOnionClient removes the grant name from the onion service on port,
+// which is republished without it. Revoking the last grant leaves the
+// service reachable by no one rather than by everyone.
+func (ml *Mirror) RevokeOnionClient(port, name string) error {
+	tt, err := ml.managedOnion(port)
+	if err != nil {
+		return err
+	}
+	return tt.updateClients(func(clients []OnionClient) ([]OnionClient, error) {
+		n := len(clients)
+		clients = slices.DeleteFunc(clients, func(c OnionClient) bool { return c.Name == name })
+		if len(clients) == n {
+			return nil, fmt.Errorf("no onion client %q on port %s", name, port)
+		}
+		return clients, nil
+	})
+}
+
+// OnionClients returns the clients authorized to reach the onion service on
+// port, sorted by name.
+func (ml *Mirror) OnionClients(port string) ([]OnionClient, error) {
+	tt, err := ml.managedOnion(port)
+	if err != nil {
+		return nil, err
+	}
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	return readOnionClients(tt.clientsFile)
+}
+
+// managedOnion returns the onion transport of port, which must run on a
+// Tor the Mirror manages to be republished with new clients.
+func (ml *Mirror) managedOnion(port string) (*torTransport, error) {
+	provider, ok := ml.Transport(port, TransportOnion)
+	if !ok {
+		return nil, fmt.Errorf("no onion service on port %s", port)
+	}
+	tt, ok := provider.(*torTransport)
+	if !ok {
+		return nil, fmt.Errorf("onion client authorization on port %s needs a Tor managed with MirrorConfig.Tor or ServiceConfig.Tor", port)
+	}
+	return tt, nil
+}
+
+// readOnionClients reads the grants stored in path, one "name key" line
+// each. A missing file holds none.
+func readOnionClients(path string) ([]OnionClient, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var clients []OnionClient
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("malformed onion client line %q in %s", scanner.Text(), path)
+		}
+		clients = append(clients, OnionClient{Name: fields[0], PublicKey: fields[1]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	slices.SortFunc(clients, func(a, b OnionClient) int { return strings.Compare(a.Name, b.Name) })
+	return clients, nil
+}
+
+// writeOnionClients replaces the grants stored in path, readable only by
+// the owner since they list who may reach the service.
+func writeOnionClients(path string, clients []OnionClient) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	var b strings.Builder
+	for _, c := range clients {
+		fmt.Fprintf(&b, "%s %s\n", c.Name, c.PublicKey)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// authorizedKeys returns the public keys to publish a restricted service
+// with: those of its clients, or without any a random one no client holds,
+// since Tor publishes a service without keys to everyone.
+func authorizedKeys(clients []OnionClient) ([]string, error) {
+	keys := make([]string, 0, len(clients))
+	for _, c := range clients {
+		keys = append(keys, c.PublicKey)
+	}
+	if len(keys) == 0 {
+		placeholder, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, onionKeyEncoding.EncodeToString(placeholder.PublicKey().Bytes()))
+	}
+	return keys, nil
+}
@@ -0,0 +1,127 @@
+package mirror
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cretz/bine/torutil/ed25519"
+)
+
+// TestOnionClientAuth verifies that grants are stored, listed, and applied
+// to a restricted onion service by republishing it, and that revoking the
+// last one does not open the service to everyone.
+func TestOnionClientAuth(t *testing.T) {
+	tr, commands := fakeOnionControl(t)
+	keys, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientsFile := filepath.Join(t.TempDir(), "onionkeys", "service.clients")
+	tt := &torTransport{t: tr, keys: keys, clientsFile: clientsFile}
+	ml := &Mirror{transports: map[string]map[string]TransportProvider{"3000": {TransportOnion: tt}}}
+
+	listener, err := tt.Listen(WithOnionOptions(context.Background(), &OnionOptions{ClientAuth: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tt.Close()
+	if strings.Count(<-commands, "ClientAuthV3=") != 1 {
+		t.Error("Service without grants was not restricted to a placeholder key")
+	}
+
+	client, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := onionKeyEncoding.EncodeToString(client.PublicKey().Bytes())
+	if err := ml.AuthorizeOnionClient("3000", "alice", strings.ToLower(publicKey)); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := <-commands; cmd != "DEL_ONION onionid" {
+		t.Errorf("First command %q, want DEL_ONION onionid", cmd)
+	}
+	if cmd := <-commands; !strings.HasSuffix(cmd, " ClientAuthV3="+publicKey) || strings.Count(cmd, "ClientAuthV3=") != 1 {
+		t.Errorf("Republished with %q, want only alice's key", cmd)
+	}
+	clients, err := ml.OnionClients("3000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clients) != 1 || clients[0] != (OnionClient{Name: "alice", PublicKey: publicKey}) {
+		t.Errorf("OnionClients = %+v", clients)
+	}
+	if listener.Addr() == nil {
+		t.Error("Listener lost its address after republishing")
+	}
+
+	if err := ml.AuthorizeOnionClient("3000", "bob", "not a key"); err == nil {
+		t.Error("Invalid key accepted")
+	}
+	if err := ml.RevokeOnionClient("3000", "bob"); err == nil {
+		t.Error("Revoking an unknown client succeeded")
+	}
+	if err := ml.RevokeOnionClient("3000", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	<-commands
+	if cmd := <-commands; strings.Contains(cmd, publicKey) || strings.Count(cmd, "ClientAuthV3=") != 1 {
+		t.Errorf("Republished after revoking the last grant with %q", cmd)
+	}
+	if clients, err := ml.OnionClients("3000"); err != nil || len(clients) != 0 {
+		t.Errorf("OnionClients after revoking = %+v, %v", clients, err)
+	}
+
+	ml.transports["4000"] = map[string]TransportProvider{TransportOnion: &onionTransport{}}
+	if _, err := ml.OnionClients("4000"); err == nil {
+		t.Error("Client authorization accepted without a managed Tor")
+	}
+}
+
+// TestOnionClientAuthRollback verifies that when a restricted service
+// cannot be republished with new grants, it is published again with the
+// previous ones and the clients file is put back.
+func TestOnionClientAuthRollback(t *testing.T) {
+	tr, commands := fakeOnionControlFailing(t, func(add int) bool { return add == 2 })
+	keys, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientsFile := filepath.Join(t.TempDir(), "onionkeys", "service.clients")
+	tt := &torTransport{t: tr, keys: keys, clientsFile: clientsFile}
+	ml := &Mirror{transports: map[string]map[string]TransportProvider{"3000": {TransportOnion: tt}}}
+
+	if _, err := tt.Listen(WithOnionOptions(context.Background(), &OnionOptions{ClientAuth: true})); err != nil {
+		t.Fatal(err)
+	}
+	defer tt.Close()
+	<-commands
+
+	client, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := onionKeyEncoding.EncodeToString(client.PublicKey().Bytes())
+	if err := ml.AuthorizeOnionClient("3000", "alice", publicKey); err == nil {
+		t.Fatal("AuthorizeOnionClient succeeded although republishing failed")
+	}
+	if cmd := <-commands; cmd != "DEL_ONION onionid" {
+		t.Errorf("First command %q, want DEL_ONION onionid", cmd)
+	}
+	if cmd := <-commands; !strings.Contains(cmd, publicKey) {
+		t.Errorf("Republished with %q, want alice's key", cmd)
+	}
+	if cmd := <-commands; strings.Contains(cmd, publicKey) || strings.Count(cmd, "ClientAuthV3=") != 1 {
+		t.Errorf("Restored with %q, want only the placeholder key", cmd)
+	}
+	if clients, err := ml.OnionClients("3000"); err != nil || len(clients) != 0 {
+		t.Errorf("OnionClients after the failed update = %+v, %v", clients, err)
+	}
+	if data, err := os.ReadFile(clientsFile); err != nil || len(data) != 0 {
+		t.Errorf("Clients file after the failed update = %q, %v; want it empty", data, err)
+	}
+}
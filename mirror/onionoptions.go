@@ -0,0 +1,60 @@
+package mirror
+
+import (
+	"context"
+	"crypto"
+	"slices"
+
+	"github.com/cretz/bine/tor"
+)
+
+// OnionOptions tunes the onion services of a Mirror service, for example to
+// limit what a single client circuit can cost the service. Zero fields keep
+// Tor's defaults.
+type OnionOptions struct {
+	// MaxStreams caps the streams a rendezvous circuit may open to the
+	// service at once; further streams are refused. Zero means no limit.
+	MaxStreams int
+	// MaxStreamsCloseCircuit closes a circuit that exceeds MaxStreams
+	// instead of only refusing its extra streams.
+	MaxStreamsCloseCircuit bool
+	// Ports are the onion ports clients connect to, all forwarded to the
+	// service, such as []int{80, 443}. Empty publishes the service on the
+	// port of the local listener Tor forwards to, which is chosen at random.
+	Ports []int
+	// ClientAuth restricts the onion service to the clients authorized with
+	// Mirror.AuthorizeOnionClient, which Tor verifies before a client can
+	// even learn how to reach the service. It needs a Tor the Mirror
+	// manages, selected by MirrorConfig.Tor or ServiceConfig.Tor.
+	ClientAuth bool
+}
+
+// onionOptionsKey is the context key of WithOnionOptions.
+type onionOptionsKey struct{}
+
+// WithOnionOptions returns a copy of ctx telling TransportProvider.Listen
+// and ListenTLS how to publish an onion service. The Mirror passes
+// ServiceConfig.Onion this way; onion transports read it with
+// OnionOptionsFromContext.
+func WithOnionOptions(ctx context.Context, options *OnionOptions) context.Context {
+	return context.WithValue(ctx, onionOptionsKey{}, options)
+}
+
+// OnionOptionsFromContext returns the options set by WithOnionOptions, or
+// nil.
+func OnionOptionsFromContext(ctx context.Context) *OnionOptions {
+	options, _ := ctx.Value(onionOptionsKey{}).(*OnionOptions)
+	return options
+}
+
+// listenConf returns the configuration of an onion service with key and the
+// options of o. A nil o gives Tor's defaults.
+func (o *OnionOptions) listenConf(key crypto.PrivateKey) *tor.ListenConf {
+	conf := &tor.ListenConf{Key: key}
+	if o != nil {
+		conf.MaxStreams = o.MaxStreams
+		conf.MaxStreamsCloseCircuit = o.MaxStreamsCloseCircuit
+		conf.RemotePorts = slices.Clone(o.Ports)
+	}
+	return conf
+}
@@ -0,0 +1,34 @@
+package mirror
+
+import (
+	"context"
+	"testing"
+)
+
+// TestOnionOptions verifies that onion options travel through the context
+// into the onion service configuration, and that their absence keeps Tor's
+// defaults.
+func TestOnionOptions(t *testing.T) {
+	if OnionOptionsFromContext(context.Background()) != nil {
+		t.Error("Options found in a context without any")
+	}
+	options := &OnionOptions{MaxStreams: 8, MaxStreamsCloseCircuit: true, Ports: []int{80, 443}}
+	ctx := WithOnionOptions(context.Background(), options)
+	if got := OnionOptionsFromContext(ctx); got != options {
+		t.Fatalf("OnionOptionsFromContext = %+v, want %+v", got, options)
+	}
+
+	conf := OnionOptionsFromContext(ctx).listenConf("key")
+	if conf.Key != "key" || conf.MaxStreams != 8 || !conf.MaxStreamsCloseCircuit || len(conf.RemotePorts) != 2 || conf.RemotePorts[1] != 443 {
+		t.Errorf("listenConf = %+v", conf)
+	}
+	options.Ports[0] = 8080
+	if conf.RemotePorts[0] != 80 {
+		t.Error("listenConf shares its ports with the options")
+	}
+
+	conf = (*OnionOptions)(nil).listenConf("key")
+	if conf.Key != "key" || conf.MaxStreams != 0 || conf.MaxStreamsCloseCircuit || conf.RemotePorts != nil {
+		t.Errorf("listenConf without options = %+v", conf)
+	}
+}
@@ -0,0 +1,183 @@
+package mirror
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/go-i2p/i2pkeys"
+	"github.com/go-i2p/onramp"
+	"github.com/go-i2p/sam3"
+)
+
+// sharedI2P holds the SAM session shared for MirrorConfig.SharedI2P.
+type sharedI2P struct {
+	primary   *sam3.PrimarySession
+	primaryMu sync.Mutex
+}
+
+// primarySession returns the SAM primary session shared by every service of
+// the Mirror when MirrorConfig.SharedI2P is set, creating it on first use.
+// Its destination is derived from the Mirror's name, so it is stable across
+// restarts.
+func (ml *Mirror) primarySession(ctx context.Context) (*sam3.PrimarySession, error) {
+	ml.primaryMu.Lock()
+	defer ml.primaryMu.Unlock()
+
+	if ml.primary != nil {
+		return ml.primary, nil
+	}
+	id := "metalistener-" + ml.name
+	samAddr := ml.samBridge(ctx)
+	keys, err := runContext(ctx, func() (i2pkeys.I2PKeys, error) {
+		return withKeyDir(ml.cfg().KeyDir, func() (i2pkeys.I2PKeys, error) {
+			return onramp.I2PKeys(id, samAddr)
+		})
+	}, func(i2pkeys.I2PKeys) {})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load I2P keys for %s: %w", id, err)
+	}
+	primary, err := runContext(ctx, func() (*sam3.PrimarySession, error) {
+		sam, err := sam3.NewSAM(samAddr)
+		if err != nil {
+			return nil, err
+		}
+		primary, err := sam.NewPrimarySession(id, keys, onramp.OPT_WIDE)
+		if err != nil {
+			sam.Close()
+			return nil, err
+		}
+		return primary, nil
+	}, func(primary *sam3.PrimarySession) { primary.Close() })
+	if err != nil {
+		return nil, fmt.Errorf("failed to create SAM primary session: %w", err)
+	}
+	log.Printf("Created shared I2P primary session %s\n", primary.Addr().Base32())
+	ml.primary = primary
+	return primary, nil
+}
+
+// sharedPrimary returns the shared primary session, or nil if there is none.
+func (ml *Mirror) sharedPrimary() *sam3.PrimarySession {
+	ml.primaryMu.Lock()
+	defer ml.primaryMu.Unlock()
+
+	return ml.primary
+}
+
+// detachPrimary removes the shared primary session from the Mirror and
+// returns its closer, or nil if the Mirror does not have one.
+func (ml *Mirror) detachPrimary() []transportCloser {
+	ml.primaryMu.Lock()
+	defer ml.primaryMu.Unlock()
+
+	if ml.primary == nil {
+		return nil
+	}
+	primary := ml.primary
+	ml.primary = nil
+	return []transportCloser{{TransportGarlic, "", primary.Close}}
+}
+
+// sharedGarlicTransport publishes a service as a subsession of the Mirror's
+// shared SAM primary session, selected by MirrorConfig.SharedI2P. Streams
+// are received on the I2P port equal to the service port, so services share
+// one destination and are told apart by port.
+type sharedGarlicTransport struct {
+	port     string
+	primary  func(context.Context) (*sam3.PrimarySession, error)
+	session  *sam3.PrimarySession
+	stream   *sam3.StreamSession
+	datagram *sam3.DatagramSession
+	addr     string
+	keyDir   string
+}
+
+func (st *sharedGarlicTransport) Name() string { return TransportGarlic }
+
+func (st *sharedGarlicTransport) Setup(ctx context.Context, keyName string) error {
+	session, err := st.primary(ctx)
+	if err != nil {
+		return err
+	}
+	st.session = session
+	return nil
+}
+
+// Listen creates the stream subsession of the service, replacing the one of
+// a previous Listen.
+func (st *sharedGarlicTransport) Listen(ctx context.Context) (net.Listener, error) {
+	if st.stream != nil {
+		st.stream.Close()
+		st.stream = nil
+	}
+	id := fmt.Sprintf("%s-%s-stream", st.session.ID(), st.port)
+	stream, err := runContext(ctx, func() (*sam3.StreamSession, error) {
+		return st.session.NewStreamSubSessionWithPorts(id, st.port, "0")
+	}, func(stream *sam3.StreamSession) { stream.Close() })
+	if err != nil {
+		return nil, fmt.Errorf("failed to create I2P stream subsession for port %s: %w", st.port, err)
+	}
+	listener, err := stream.Listen()
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	st.stream = stream
+	st.addr = listener.Addr().String()
+	return listener, nil
+}
+
+func (st *sharedGarlicTransport) ListenTLS(ctx context.Context) (net.Listener, error) {
+	cert, err := withKeyDir(st.keyDir, func() (tls.Certificate, error) {
+		host := st.session.Addr().Base32()
+		return hiddenKeys(ctx, func() (tls.Certificate, error) { return onramp.TLSKeys(host) }, func() (string, error) { return host, nil })
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load I2P TLS keys: %w", err)
+	}
+	listener, err := st.Listen(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(listener, hiddenTLSConfig(ctx, cert)), nil
+}
+
+// ListenPacket creates the datagram subsession of the service, replacing
+// the one of a previous ListenPacket.
+func (st *sharedGarlicTransport) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	if st.datagram != nil {
+		st.datagram.Close()
+		st.datagram = nil
+	}
+	id := fmt.Sprintf("%s-%s-datagram", st.session.ID(), st.port)
+	datagram, err := runContext(ctx, func() (*sam3.DatagramSession, error) {
+		return st.session.NewDatagramSubSession(id, 0)
+	}, func(datagram *sam3.DatagramSession) { datagram.Close() })
+	if err != nil {
+		return nil, fmt.Errorf("failed to create I2P datagram subsession for port %s: %w", st.port, err)
+	}
+	st.datagram = datagram
+	return datagram, nil
+}
+
+// Close closes the service's subsessions; the primary session is closed
+// with the Mirror.
+func (st *sharedGarlicTransport) Close() error {
+	var firstErr error
+	if st.stream != nil {
+		firstErr = st.stream.Close()
+		st.stream = nil
+	}
+	if st.datagram != nil {
+		if err := st.datagram.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		st.datagram = nil
+	}
+	return firstErr
+}
+
+func (st *sharedGarlicTransport) Address() string { return st.addr }
@@ -0,0 +1,47 @@
+package mirror
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-i2p/sam3"
+)
+
+// TestSharedI2PTransport verifies that with SharedI2P every port gets a
+// subsession transport on the one primary session instead of its own Garlic.
+func TestSharedI2PTransport(t *testing.T) {
+	primary := &sam3.PrimarySession{}
+	ml := &Mirror{
+		name:      "shared",
+		config:    &MirrorConfig{SharedI2P: true},
+		sharedI2P: sharedI2P{primary: primary},
+	}
+
+	ml.mu.Lock()
+	for _, port := range []string{"3000", "2222"} {
+		provider, err := ml.ensureTransport(context.Background(), port, TransportGarlic, "metalistener-shared-"+port, "", nil)
+		if err != nil {
+			t.Fatalf("ensureTransport failed for port %s: %v", port, err)
+		}
+		shared, ok := provider.(*sharedGarlicTransport)
+		if !ok {
+			t.Fatalf("Expected a shared transport for port %s, got %T", port, provider)
+		}
+		if shared.session != primary || shared.port != port {
+			t.Errorf("Expected port %s on the shared primary session", port)
+		}
+	}
+	if len(ml.Garlics) != 0 {
+		t.Errorf("Expected no per-port Garlics, got %d", len(ml.Garlics))
+	}
+	ml.mu.Unlock()
+
+	if got, err := ml.i2pKeys("2222"); err != nil || got.Address != primary.Keys().Address {
+		t.Errorf("Expected the primary session's keys, got %v (%v)", got.Address, err)
+	}
+
+	closers := ml.detachPrimary()
+	if len(closers) != 1 || closers[0].transport != TransportGarlic || ml.sharedPrimary() != nil {
+		t.Errorf("Expected the primary session to be detached for closing, got %v", closers)
+	}
+}
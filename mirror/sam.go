@@ -0,0 +1,252 @@
+package mirror
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// samCheckInterval is how often the active SAM bridge is probed when
+	// MirrorConfig.SAMAddrs lists bridges to fail over to.
+	samCheckInterval = 30 * time.Second
+	// samProbeTimeout bounds connecting to a SAM bridge and its HELLO.
+	samProbeTimeout = 5 * time.Second
+	// samFailoverTimeout bounds re-establishing the I2P sessions of every
+	// service on a new bridge.
+	samFailoverTimeout = 5 * time.Minute
+)
+
+// samBridges holds the SAM bridge of MirrorConfig.SAMAddrs that a Mirror's
+// I2P sessions are created on.
+type samBridges struct {
+	// sam is the bridge in use; chosen on first use
+	sam   string
+	samMu sync.Mutex
+	// samStale is set while I2P sessions are not established on sam;
+	// failoverMu serializes checkSAM and protects it
+	samStale   bool
+	failoverMu sync.Mutex
+}
+
+// samAddrs returns the SAM bridges of the configuration in order of
+// preference, defaulting to the local router's.
+func (c MirrorConfig) samAddrs() []string {
+	if len(c.SAMAddrs) == 0 {
+		return []string{defaultSAMAddr}
+	}
+	return c.SAMAddrs
+}
+
+// SAMBridge returns the address of the SAM bridge the Mirror's I2P sessions
+// are created on, choosing the first reachable one of MirrorConfig.SAMAddrs
+// if none was chosen yet.
+func (ml *Mirror) SAMBridge() string {
+	ctx, cancel := context.WithTimeout(context.Background(), samProbeTimeout*time.Duration(len(ml.cfg().samAddrs())))
+	defer cancel()
+	return ml.samBridge(ctx)
+}
+
+// samBridge returns the active SAM bridge, choosing the first of the
+// configured bridges that answers when there is none. When none answers,
+// the first is used, so session setup reports why it is unreachable.
+func (ml *Mirror) samBridge(ctx context.Context) string {
+	ml.samMu.Lock()
+	defer ml.samMu.Unlock()
+
+	if ml.sam != "" {
+		return ml.sam
+	}
+	addrs := ml.cfg().samAddrs()
+	ml.sam = addrs[0]
+	if len(addrs) > 1 {
+		if addr, err := firstSAMBridge(ctx, addrs); err == nil {
+			ml.sam = addr
+		} else {
+			log.Printf("No SAM bridge is reachable, using %s: %v\n", ml.sam, err)
+		}
+	}
+	return ml.sam
+}
+
+// firstSAMBridge returns the first of addrs whose SAM bridge answers.
+func firstSAMBridge(ctx context.Context, addrs []string) (string, error) {
+	if len(addrs) == 0 {
+		return "", errors.New("no other SAM bridge is configured")
+	}
+	var errs []error
+	for _, addr := range addrs {
+		err := probeSAM(ctx, addr)
+		if err == nil {
+			return addr, nil
+		}
+		errs = append(errs, err)
+	}
+	return "", errors.Join(errs...)
+}
+
+// probeSAM reports whether the SAM bridge at addr completes a HELLO.
+func probeSAM(ctx context.Context, addr string) error {
+	ctx, cancel := context.WithTimeout(ctx, samProbeTimeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to SAM bridge %s: %w", addr, err)
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	reply, err := samCommand(conn, bufio.NewReader(conn), "HELLO VERSION MIN=3.0 MAX=3.3")
+	if err != nil {
+		return fmt.Errorf("SAM bridge %s: %w", addr, err)
+	}
+	if reply["RESULT"] != "OK" {
+		return fmt.Errorf("SAM bridge %s refused the handshake: %s", addr, reply["RESULT"])
+	}
+	return nil
+}
+
+// watchSAM probes the active SAM bridge until the Mirror is closed, failing
+// over to the next reachable one when it stops answering.
+func (ml *Mirror) watchSAM() {
+	ticker := time.NewTicker(samCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ml.stopCh:
+			return
+		case <-ticker.C:
+			if err := ml.checkSAM(context.Background()); err != nil {
+				log.Printf("SAM failover failed: %v\n", err)
+			}
+		}
+	}
+}
+
+// checkSAM probes the active SAM bridge and, if it does not answer, moves
+// the Mirror's I2P sessions to the first other bridge that does. The Mirror
+// stays on the new bridge until it fails in turn. Sessions that could not be
+// re-established are retried on the next check, which also brings them back
+// when the only bridge returns.
+func (ml *Mirror) checkSAM(ctx context.Context) error {
+	ml.failoverMu.Lock()
+	defer ml.failoverMu.Unlock()
+
+	active := ml.samBridge(ctx)
+	next := active
+	if err := probeSAM(ctx, active); err != nil {
+		log.Printf("Active SAM bridge is down: %v\n", err)
+		ml.samStale = true
+		var others []string
+		for _, addr := range ml.cfg().samAddrs() {
+			if addr != active {
+				others = append(others, addr)
+			}
+		}
+		if next, err = firstSAMBridge(ctx, others); err != nil {
+			return fmt.Errorf("no SAM bridge is reachable: %w", err)
+		}
+		ml.samMu.Lock()
+		ml.sam = next
+		ml.samMu.Unlock()
+		log.Printf("Failing over from SAM bridge %s to %s\n", active, next)
+	} else if !ml.samStale {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, samFailoverTimeout)
+	defer cancel()
+	err := ml.reconnectI2P(ctx, next)
+	ml.samStale = err != nil
+	return err
+}
+
+// reconnectI2P re-creates every I2P session of the Mirror on the SAM bridge
+// at addr, with the keys it had, so each service keeps its address, and
+// then replaces the I2P listener and datagram session of each service.
+func (ml *Mirror) reconnectI2P(ctx context.Context, addr string) error {
+	closers := ml.detachPrimary()
+
+	var errs []error
+	ml.mu.Lock()
+	for port, providers := range ml.transports {
+		switch provider := providers[TransportGarlic].(type) {
+		case *garlicTransport:
+			if provider.keyName == "" {
+				log.Printf("Cannot move the I2P session of port %s, created outside the Mirror, to %s\n", port, addr)
+				continue
+			}
+			closers = append(closers, transportCloser{TransportGarlic, port, provider.garlic.Close})
+			provider.samAddr = addr
+			if err := provider.Setup(ctx, provider.keyName); err != nil {
+				errs = append(errs, fmt.Errorf("port %s: %w", port, err))
+				continue
+			}
+			ml.Garlics[port] = provider.garlic
+		case *sharedGarlicTransport:
+			// The subsessions went down with the primary session
+			provider.stream, provider.datagram = nil, nil
+			if err := provider.Setup(ctx, ""); err != nil {
+				errs = append(errs, fmt.Errorf("port %s: %w", port, err))
+			}
+		}
+	}
+	services := make(map[string]ServiceConfig, len(ml.services))
+	for port, cfg := range ml.services {
+		services[port] = cfg
+	}
+	ml.mu.Unlock()
+
+	// The old sessions belong to a router that is gone; do not wait long
+	closeCtx, cancel := context.WithTimeout(context.Background(), defaultCloseTimeout)
+	closeTransports(closeCtx, closers)
+	cancel()
+
+	for port, cfg := range services {
+		if err := ml.relistenI2P(ctx, port, cfg); err != nil {
+			errs = append(errs, fmt.Errorf("port %s: %w", port, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// relistenI2P replaces the I2P listener and datagram session of the service
+// on port with ones of its current session.
+func (ml *Mirror) relistenI2P(ctx context.Context, port string, cfg ServiceConfig) error {
+	ml.mu.Lock()
+	child := ml.children[port]
+	packetConn := ml.packetConns[port]
+	delete(ml.packetConns, port)
+	ml.mu.Unlock()
+	if child == nil {
+		return nil
+	}
+
+	if packetConn != nil {
+		packetConn.Close()
+	}
+	if err := child.RemoveListenersByPrefix(TransportGarlic + "-"); err != nil {
+		log.Printf("Error closing I2P listener on port %s: %v\n", port, err)
+	}
+	ctx = ml.serviceContext(ctx, cfg)
+	if cfg.I2PMode.datagram() {
+		if err := ml.startTransport(TransportGarlicDatagram, port, func() error {
+			return ml.addPacketConn(ctx, port, TransportGarlic)
+		}); err != nil {
+			return err
+		}
+	}
+	if !cfg.I2PMode.streaming() {
+		return nil
+	}
+	return ml.startTransport(TransportGarlic, port, func() error {
+		ctx := WithClientAuth(WithALPN(ctx, cfg.ALPN), cfg.TransportClientAuth[TransportGarlic])
+		return ml.addTransportListener(ctx, port, TransportGarlic, child, cfg.HiddenTLS.enabled())
+	})
+}
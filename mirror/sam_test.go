@@ -0,0 +1,96 @@
+package mirror
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+)
+
+// fakeSAM answers the HELLO of every connection like a SAM bridge and
+// returns its listener.
+func fakeSAM(t *testing.T) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				bufio.NewReader(conn).ReadString('\n')
+				conn.Write([]byte("HELLO REPLY RESULT=OK VERSION=3.3\n"))
+			}()
+		}
+	}()
+	return listener
+}
+
+// deadAddr returns a local address nothing is listening on.
+func deadAddr(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+// TestSAMFailover verifies that the first reachable bridge is chosen, that
+// the Mirror fails over when it goes down, and that it stays put when no
+// other bridge answers.
+func TestSAMFailover(t *testing.T) {
+	t.Setenv("DISABLE_TOR", "true")
+	t.Setenv("DISABLE_I2P", "true")
+
+	dead := deadAddr(t)
+	primary := fakeSAM(t)
+	backup := fakeSAM(t)
+	cfg := DefaultMirrorConfig()
+	cfg.SAMAddrs = []string{dead, primary.Addr().String(), backup.Addr().String()}
+	mirror, err := NewMirrorWithConfig(context.Background(), "test-sam", cfg)
+	if err != nil {
+		t.Fatalf("Failed to create mirror: %v", err)
+	}
+	defer mirror.Close()
+
+	if got := mirror.SAMBridge(); got != primary.Addr().String() {
+		t.Fatalf("SAMBridge = %s, want the first reachable %s", got, primary.Addr())
+	}
+	if err := mirror.checkSAM(context.Background()); err != nil {
+		t.Errorf("checkSAM with the bridge up: %v", err)
+	}
+
+	primary.Close()
+	if err := mirror.checkSAM(context.Background()); err != nil {
+		t.Fatalf("checkSAM failed to fail over: %v", err)
+	}
+	if got := mirror.SAMBridge(); got != backup.Addr().String() {
+		t.Errorf("SAMBridge after failover = %s, want %s", got, backup.Addr())
+	}
+
+	backup.Close()
+	if err := mirror.checkSAM(context.Background()); err == nil {
+		t.Error("checkSAM succeeded with every bridge down")
+	}
+	if got := mirror.SAMBridge(); got != backup.Addr().String() {
+		t.Errorf("SAMBridge with every bridge down = %s, want %s kept", got, backup.Addr())
+	}
+}
+
+// TestSAMBridgeDefault verifies that the local router's bridge is used
+// when no bridge is configured.
+func TestSAMBridgeDefault(t *testing.T) {
+	mirror := &Mirror{}
+	if got := mirror.SAMBridge(); got != defaultSAMAddr {
+		t.Errorf("SAMBridge = %s, want %s", got, defaultSAMAddr)
+	}
+}
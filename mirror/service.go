@@ -0,0 +1,277 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/go-i2p/go-meta-listener"
+)
+
+// ServiceConfig describes one service hosted by a Mirror.
+type ServiceConfig struct {
+	// Name is the domain name used for the TLS listener and as part of the
+	// onion and garlic key names. If empty, the Mirror's name is used.
+	Name string
+	// Email is the address used for Let's Encrypt registration. The clearnet
+	// TLS listener is only created when it is set.
+	Email string
+	// Domains lists additional clearnet domain names served by the TLS
+	// listener. TLS connections are routed by SNI: Name and unknown names
+	// go to the listener returned by AddService, and each domain listed
+	// here goes to its own listener, returned by Mirror.DomainListener.
+	Domains []string
+	// LocalAddr is where the plaintext listener binds: a host or IP such as
+	// "0.0.0.0" or "10.0.0.5" (listening on the service port), or a Unix
+	// socket path written as "unix:/run/service.sock". Defaults to 127.0.0.1.
+	// It is ignored when MirrorConfig.EnableLocalTCP is false.
+	LocalAddr string
+	// HiddenTLS selects whether the onion and garlic listeners use TLS.
+	// The default, HiddenTLSAuto, follows HIDDEN_TLS.
+	HiddenTLS TLSPolicy
+	// HTTPAddr, when set (usually ":80"), starts a companion plain HTTP
+	// listener that redirects requests to HTTPS and, if the CertProvider
+	// supports it, answers ACME HTTP-01 challenges. It requires Email.
+	HTTPAddr string
+	// TLSAddr is where the clearnet TLS listener binds, such as
+	// "0.0.0.0:443" or "10.0.0.5:8443", independent of Name. Empty leaves
+	// the address to the CertProvider, which binds ":443" by default.
+	TLSAddr string
+	// OnionLocation adds an Onion-Location header pointing at the service's
+	// onion address to the companion listener's redirects.
+	OnionLocation bool
+	// I2PMode selects whether the garlic side of the service uses streaming,
+	// repliable datagrams, or both. Datagrams are read with Mirror.PacketConn.
+	I2PMode I2PMode
+	// ALPN lists the protocols the TLS listeners offer to clients, in order
+	// of preference, such as []string{ProtoHTTP2, ProtoHTTP1} to serve
+	// HTTP/2 with ServeHTTP. The clearnet listener offers HTTP/1.1 when it
+	// is empty, and the onion and garlic listeners offer nothing. ACMEProvider
+	// supports it; WileedotProvider refuses it.
+	ALPN []string
+	// ClientAuth, when set, makes the clearnet TLS listener require client
+	// certificates. ACMEProvider supports it; WileedotProvider refuses it.
+	ClientAuth *ClientAuth
+	// TransportClientAuth makes the hidden TLS listeners of the transports
+	// it names, such as TransportOnion, require client certificates, each
+	// with its own policy. Transports without an entry keep relying on
+	// their own addresses. It requires hidden TLS for those transports.
+	TransportClientAuth map[string]*ClientAuth
+	// KeyDir is where the Tor and I2P keys of the service's sessions are
+	// stored, for example on an encrypted volume. Empty uses
+	// MirrorConfig.KeyDir. It applies to the built-in transports when the
+	// service's sessions are created; sessions already set up for the port,
+	// such as those of the port NewMirror was given, keep their keys.
+	KeyDir string
+	// Tor, if set, runs the service's onion service on the Tor it selects
+	// instead of MirrorConfig.Tor's, so unrelated services do not share
+	// circuits or Tor state. Services selecting the same control address,
+	// executable, and data directory share a Tor; give each its own DataDir
+	// and a ControlAddr of "-" to launch one per service. Like KeyDir, it
+	// applies when the service's onion session is created.
+	Tor *TorConfig
+	// Onion tunes the service's onion services: the streams a circuit may
+	// open and the onion ports clients connect to.
+	Onion *OnionOptions
+	// HiddenCert sets the key algorithm, validity, names, and issuer of
+	// the certificates of the service's hidden TLS listeners, instead of
+	// onramp's defaults.
+	HiddenCert *HiddenCertOptions
+	// Backends maps transports, such as TransportOnion, to the backend
+	// their connections are meant for, for applications forwarding the
+	// service's connections rather than serving them: hidden-service
+	// clients can be kept on isolated instances, away from clearnet ones.
+	// The connections the service's listener accepts are BackendConns
+	// reporting the backend of their transport, or the one under the empty
+	// key for transports without their own. The Mirror does not dial the
+	// backends; what they name, an address or a pool, is up to the
+	// application.
+	Backends map[string]string
+
+	// certs receives certificate observations from the CertProvider; it is
+	// set by the Mirror before the provider is called.
+	certs *certTracker
+	// retiring are former names still covered by the certificate and
+	// served like Name while a MigrateDomain overlap lasts.
+	retiring []string
+}
+
+// AddService sets up an independent listener for port, reachable over the
+// local TCP listener, Tor, I2P, and optionally clearnet TLS. Each port gets
+// its own onion and garlic service, all managed by the Mirror, so one Mirror
+// can host for example HTTP on 3000 and SSH on 2222 at the same time.
+func (ml *Mirror) AddService(port string, cfg ServiceConfig) (net.Listener, error) {
+	return ml.AddServiceContext(context.Background(), port, cfg)
+}
+
+// AddServiceContext is like AddService but bounds Tor, I2P, and ACME setup by
+// ctx. If ctx is done before setup completes, every listener created so far
+// is closed and ctx.Err() is returned.
+//
+// The Mirror keeps track of the listener it returns and closes it in Close.
+// Adding a service on a port that already has one replaces it: the previous
+// listener is closed first, as if by CloseService.
+func (ml *Mirror) AddServiceContext(ctx context.Context, port string, cfg ServiceConfig) (l net.Listener, err error) {
+	log.Println("Starting Mirror Listener")
+
+	if err := ml.CloseService(port); err != nil {
+		log.Printf("Error closing previous service on port %s: %v\n", port, err)
+	}
+
+	if cfg.Name == "" {
+		cfg.Name = ml.name
+	}
+	if cfg.Name == "" {
+		cfg.Name = "mirror"
+	}
+
+	// Create a new MetaListener for this service
+	newMetaListener := meta.NewMetaListener()
+	newMetaListener.SetFloodGuard(ml.cfg().Flood)
+	newMetaListener.SetCapture(ml.cfg().Capture)
+	defer func() {
+		if err != nil {
+			newMetaListener.Close()
+			ml.CloseService(port)
+		}
+	}()
+
+	ctx = ml.serviceContext(ctx, cfg)
+	hiddenTls := cfg.HiddenTLS.enabled()
+	log.Printf("Actual args: name: '%s' addr: '%s' port: '%s' certDir: '%s' hiddenTls: '%t' (%s)\n", cfg.Name, cfg.Email, port, certDir(), hiddenTls, cfg.HiddenTLS)
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if cfg.HTTPAddr != "" && cfg.Email == "" {
+		return nil, fmt.Errorf("service on port %s sets HTTPAddr without Email", port)
+	}
+	if err := validBackends(cfg.Backends); err != nil {
+		return nil, fmt.Errorf("service on port %s: %w", port, err)
+	}
+
+	// Setup local TCP listener unless the operator opted out of it
+	if ml.cfg().EnableLocalTCP {
+		if err := ml.startTransport(TransportTCP, port, func() error {
+			_, err := ml.setupLocalTCPListener(port, cfg.LocalAddr, newMetaListener)
+			return err
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	// Ensure hidden service listeners exist
+	listenerId := fmt.Sprintf("metalistener-%s-%s", cfg.Name, port)
+	log.Println("Listener ID:", listenerId)
+	log.Println("Checking for existing hidden transport sessions")
+
+	if err := ml.ensureHiddenServiceListeners(ctx, port, listenerId, ml.keyDir(cfg), cfg.Tor); err != nil {
+		return nil, err
+	}
+
+	// Add a listener for every enabled hidden transport
+	for _, transport := range enabledTransports() {
+		if transport == TransportGarlic && cfg.I2PMode.datagram() {
+			if err := ml.startTransport(TransportGarlicDatagram, port, func() error {
+				return ml.addPacketConn(ctx, port, transport)
+			}); err != nil {
+				return nil, err
+			}
+			if !cfg.I2PMode.streaming() {
+				continue
+			}
+		}
+		ca := cfg.TransportClientAuth[transport]
+		if ca != nil && !hiddenTls {
+			return nil, fmt.Errorf("service on port %s requires %s client certificates without hidden TLS", port, transport)
+		}
+		if err := ml.startTransport(transport, port, func() error {
+			return ml.addTransportListener(WithClientAuth(WithALPN(ctx, cfg.ALPN), ca), port, transport, newMetaListener, hiddenTls)
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	// Setup TLS listener if email address is provided
+	if cfg.Email != "" {
+		if err := ml.startTransport(TransportTLS, port, func() error {
+			_, err := ml.setupTLSListener(ctx, cfg, port, newMetaListener)
+			return err
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	if newMetaListener.Count() == 0 && !ml.hasPacketConn(port) {
+		return nil, fmt.Errorf("service on port %s has no enabled transports", port)
+	}
+
+	ml.mu.Lock()
+	if ml.services == nil {
+		ml.services = make(map[string]ServiceConfig)
+	}
+	ml.services[port] = cfg
+	if ml.children == nil {
+		ml.children = make(map[string]*meta.MetaListener)
+	}
+	ml.children[port] = newMetaListener
+	ml.mu.Unlock()
+
+	if len(cfg.Backends) > 0 {
+		return BackendListener(newMetaListener, cfg.Backends), nil
+	}
+	return newMetaListener, nil
+}
+
+// serviceContext returns ctx carrying the Mirror's TLSSettings and the
+// OnionOptions and HiddenCert of cfg, for setting up the service's
+// listeners.
+func (ml *Mirror) serviceContext(ctx context.Context, cfg ServiceConfig) context.Context {
+	if settings := ml.cfg().TLS; settings != nil {
+		ctx = WithTLSSettings(ctx, settings)
+	}
+	if cfg.Onion != nil {
+		ctx = WithOnionOptions(ctx, cfg.Onion)
+	}
+	if cfg.HiddenCert != nil {
+		ctx = WithHiddenCert(ctx, cfg.HiddenCert)
+	}
+	return ctx
+}
+
+// CloseService shuts down the service on port: its listener, SNI domain
+// listeners, I2P datagram session, and companion HTTP listener. The port's Tor and I2P sessions
+// stay open, so adding the service again keeps its addresses. Closing a
+// port without a service is a no-op.
+func (ml *Mirror) CloseService(port string) error {
+	ml.mu.Lock()
+	child := ml.children[port]
+	server := ml.httpServers[port]
+	packetConn := ml.packetConns[port]
+	delete(ml.children, port)
+	delete(ml.httpServers, port)
+	delete(ml.packetConns, port)
+	delete(ml.services, port)
+	delete(ml.domains, port)
+	if migration := ml.migrations[port]; migration != nil {
+		migration.stop()
+		delete(ml.migrations, port)
+	}
+	ml.mu.Unlock()
+
+	if server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultCloseTimeout)
+		shutdownHTTPServer(ctx, server)
+		cancel()
+	}
+	if packetConn != nil {
+		if err := packetConn.Close(); err != nil {
+			log.Printf("Error closing datagram session on port %s: %v\n", port, err)
+		}
+	}
+	if child == nil {
+		return nil
+	}
+	ml.status.markPortDown(port)
+	return child.Close()
+}
@@ -0,0 +1,260 @@
+package mirror
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestAddServiceMultiplePorts verifies that one Mirror can host independent
+// services on several ports at once.
+func TestAddServiceMultiplePorts(t *testing.T) {
+	os.Setenv("DISABLE_TOR", "true")
+	os.Setenv("DISABLE_I2P", "true")
+	defer func() {
+		os.Unsetenv("DISABLE_TOR")
+		os.Unsetenv("DISABLE_I2P")
+	}()
+
+	mirror, err := NewMirror("test-services")
+	if err != nil {
+		t.Fatalf("Failed to create mirror: %v", err)
+	}
+	defer mirror.Close()
+
+	web, err := mirror.AddService("3012", ServiceConfig{})
+	if err != nil {
+		t.Fatalf("AddService(3012) failed: %v", err)
+	}
+	defer web.Close()
+
+	ssh, err := mirror.AddService("3013", ServiceConfig{Name: "ssh.example"})
+	if err != nil {
+		t.Fatalf("AddService(3013) failed: %v", err)
+	}
+	defer ssh.Close()
+
+	for _, tc := range []struct {
+		addr     string
+		listener net.Listener
+	}{
+		{"127.0.0.1:3012", web},
+		{"127.0.0.1:3013", ssh},
+	} {
+		conn, err := net.Dial("tcp", tc.addr)
+		if err != nil {
+			t.Fatalf("Failed to dial %s: %v", tc.addr, err)
+		}
+		accepted, err := tc.listener.Accept()
+		if err != nil {
+			t.Fatalf("Accept on %s failed: %v", tc.addr, err)
+		}
+		if accepted.LocalAddr().String() != tc.addr {
+			t.Errorf("Expected connection on %s, got %s", tc.addr, accepted.LocalAddr())
+		}
+		accepted.Close()
+		conn.Close()
+	}
+}
+
+// TestAddServiceUnixLocalAddr verifies that the plaintext listener can be
+// bound to a Unix socket instead of a loopback TCP port.
+func TestAddServiceUnixLocalAddr(t *testing.T) {
+	os.Setenv("DISABLE_TOR", "true")
+	os.Setenv("DISABLE_I2P", "true")
+	defer func() {
+		os.Unsetenv("DISABLE_TOR")
+		os.Unsetenv("DISABLE_I2P")
+	}()
+
+	mirror, err := NewMirror("test-unix")
+	if err != nil {
+		t.Fatalf("Failed to create mirror: %v", err)
+	}
+	defer mirror.Close()
+
+	path := filepath.Join(t.TempDir(), "mirror.sock")
+	listener, err := mirror.AddService("3014", ServiceConfig{LocalAddr: "unix:" + path})
+	if err != nil {
+		t.Fatalf("AddService failed: %v", err)
+	}
+	defer listener.Close()
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Failed to dial Unix socket: %v", err)
+	}
+	defer conn.Close()
+
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	accepted.Close()
+
+	if addr := mirror.Status()["tcp-local:3014"].Address; addr != path {
+		t.Errorf("Expected status address %s, got %s", path, addr)
+	}
+}
+
+// TestAddServiceWithoutLocalTCP verifies that disabling the local listener
+// leaves the port unbound and that a service with no transports is rejected.
+func TestAddServiceWithoutLocalTCP(t *testing.T) {
+	os.Setenv("DISABLE_TOR", "true")
+	os.Setenv("DISABLE_I2P", "true")
+	defer func() {
+		os.Unsetenv("DISABLE_TOR")
+		os.Unsetenv("DISABLE_I2P")
+	}()
+
+	cfg := DefaultMirrorConfig()
+	cfg.EnableLocalTCP = false
+	mirror, err := NewMirrorWithConfig(context.Background(), "test-nolocal", cfg)
+	if err != nil {
+		t.Fatalf("Failed to create mirror: %v", err)
+	}
+	defer mirror.Close()
+
+	if _, err := mirror.AddService("3015", ServiceConfig{}); err == nil {
+		t.Fatal("Expected error for service without transports")
+	}
+
+	if _, ok := mirror.Status()["tcp-local:3015"]; ok {
+		t.Error("Local TCP transport should not be tracked when disabled")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:3015")
+	if err != nil {
+		t.Fatalf("Port should not be bound when local TCP is disabled: %v", err)
+	}
+	listener.Close()
+}
+
+// TestCloseService verifies that the Mirror tracks service listeners, that
+// re-adding a port replaces its service, and that Close shuts services down.
+func TestCloseService(t *testing.T) {
+	os.Setenv("DISABLE_TOR", "true")
+	os.Setenv("DISABLE_I2P", "true")
+	defer func() {
+		os.Unsetenv("DISABLE_TOR")
+		os.Unsetenv("DISABLE_I2P")
+	}()
+
+	mirror, err := NewMirror("test-close-service")
+	if err != nil {
+		t.Fatalf("Failed to create mirror: %v", err)
+	}
+
+	first, err := mirror.AddService("3016", ServiceConfig{})
+	if err != nil {
+		t.Fatalf("AddService failed: %v", err)
+	}
+	second, err := mirror.AddService("3016", ServiceConfig{})
+	if err != nil {
+		t.Fatalf("Re-adding the service should replace it: %v", err)
+	}
+	if _, err := first.Accept(); err == nil {
+		t.Error("Expected the replaced listener to be closed")
+	}
+
+	if err := mirror.CloseService("3016"); err != nil {
+		t.Fatalf("CloseService failed: %v", err)
+	}
+	if _, err := second.Accept(); err == nil {
+		t.Error("Expected CloseService to close the listener")
+	}
+	if state := mirror.Status()[statusKey(TransportTCP, "3016")].State; state != TransportDown {
+		t.Errorf("Expected local transport down after CloseService, got %s", state)
+	}
+
+	third, err := mirror.AddService("3017", ServiceConfig{})
+	if err != nil {
+		t.Fatalf("AddService failed: %v", err)
+	}
+	mirror.Close()
+	if _, err := third.Accept(); err == nil {
+		t.Error("Expected Mirror.Close to close service listeners")
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:3017")
+	if err != nil {
+		t.Fatalf("Port should be free after Mirror.Close: %v", err)
+	}
+	listener.Close()
+}
+
+// TestAddServiceBackends verifies that the connections a service accepts
+// report the backend of their transport, falling back to the default, and
+// that backends for unknown transports are rejected.
+func TestAddServiceBackends(t *testing.T) {
+	os.Setenv("DISABLE_TOR", "true")
+	os.Setenv("DISABLE_I2P", "true")
+	defer func() {
+		os.Unsetenv("DISABLE_TOR")
+		os.Unsetenv("DISABLE_I2P")
+	}()
+
+	mirror, err := NewMirror("test-backends")
+	if err != nil {
+		t.Fatalf("Failed to create mirror: %v", err)
+	}
+	defer mirror.Close()
+
+	if _, err := mirror.AddService("3033", ServiceConfig{Backends: map[string]string{"carrier-pigeon": "10.0.0.9:80"}}); err == nil {
+		t.Error("Backend for an unknown transport accepted")
+	}
+	listener, err := mirror.AddService("3033", ServiceConfig{Backends: map[string]string{
+		"":             "10.0.0.1:80",
+		TransportTCP:   "10.0.0.2:80",
+		TransportOnion: "10.0.0.3:80",
+	}})
+	if err != nil {
+		t.Fatalf("AddService failed: %v", err)
+	}
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:3033")
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer accepted.Close()
+	bc, ok := accepted.(BackendConn)
+	if !ok {
+		t.Fatalf("Expected a BackendConn, got %T", accepted)
+	}
+	if bc.Backend() != "10.0.0.2:80" {
+		t.Errorf("Local connection routed to %q, want 10.0.0.2:80", bc.Backend())
+	}
+	if tc, ok := accepted.(TransportConn); !ok || tc.Transport() != TransportTCP {
+		t.Errorf("Routed connection lost its transport")
+	}
+
+	// Transports without a backend of their own get the default
+	for transport, want := range map[string]string{TransportOnion: "10.0.0.3:80", TransportGarlic: "10.0.0.1:80"} {
+		inner, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		routed := BackendListener(&countingListener{Listener: inner, transport: transport, counters: &transportCounters{}}, map[string]string{"": "10.0.0.1:80", TransportOnion: "10.0.0.3:80"})
+		client, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		conn, err := routed.Accept()
+		if err != nil {
+			t.Fatalf("Accept failed: %v", err)
+		}
+		if got := conn.(BackendConn).Backend(); got != want {
+			t.Errorf("%s connection routed to %q, want %q", transport, got, want)
+		}
+		conn.Close()
+		client.Close()
+		routed.Close()
+	}
+}
@@ -0,0 +1,264 @@
+package mirror
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultSNIHandshakeTimeout bounds how long a client may take to send its
+// ClientHello before the router drops the connection.
+const defaultSNIHandshakeTimeout = 10 * time.Second
+
+// ErrRouteClosed is returned by Accept on a closed SNI route.
+var ErrRouteClosed = errors.New("sni route is closed")
+
+// sniRoutes holds the SNI routing state of a Mirror, protected by Mirror.mu.
+type sniRoutes struct {
+	// domains holds per-domain SNI route listeners keyed by port, then domain
+	domains map[string]map[string]net.Listener
+	// migrations are the MigrateDomain overlaps in progress, keyed by port
+	migrations map[string]*domainMigration
+}
+
+// tlsConnectionStater is implemented by *tls.Conn and by wrappers that
+// expose the TLS handshake of the connection they wrap.
+type tlsConnectionStater interface {
+	HandshakeContext(ctx context.Context) error
+	ConnectionState() tls.ConnectionState
+}
+
+// SNIRouter splits the connections of a TLS listener into several listeners
+// by the server name the client requested, so one TLS endpoint can front
+// several domains that are served by different handlers or backends.
+//
+// Names are matched case-insensitively, first exactly and then against a
+// wildcard route such as "*.example.org". Connections that match no route,
+// and connections that are not TLS, go to the default route if one exists
+// and are closed otherwise.
+type SNIRouter struct {
+	listener net.Listener
+	// HandshakeTimeout bounds the TLS handshake performed to learn the SNI.
+	HandshakeTimeout time.Duration
+
+	mu       sync.RWMutex
+	routes   map[string]*sniRoute
+	fallback *sniRoute
+
+	closeOnce sync.Once
+	done      chan struct{}
+	err       error
+}
+
+// NewSNIRouter starts routing the connections accepted from listener.
+func NewSNIRouter(listener net.Listener) *SNIRouter {
+	r := &SNIRouter{
+		listener:         listener,
+		HandshakeTimeout: defaultSNIHandshakeTimeout,
+		routes:           make(map[string]*sniRoute),
+		done:             make(chan struct{}),
+	}
+	go r.acceptLoop()
+	return r
+}
+
+// Route returns the listener receiving connections for serverName, creating
+// it if needed. serverName may be a wildcard of the form "*.example.org".
+// Closing the returned listener detaches the route without affecting others.
+func (r *SNIRouter) Route(serverName string) net.Listener {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if route, ok := r.routes[name]; ok {
+		return route
+	}
+	route := newSNIRoute(r, name)
+	r.routes[name] = route
+	return route
+}
+
+// Lookup returns the existing listener for serverName, if any.
+func (r *SNIRouter) Lookup(serverName string) (net.Listener, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	route, ok := r.routes[strings.ToLower(strings.TrimSuffix(serverName, "."))]
+	return route, ok
+}
+
+// Default returns the listener receiving connections that match no route.
+// Closing it closes the whole router and the underlying listener.
+func (r *SNIRouter) Default() net.Listener {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.fallback == nil {
+		r.fallback = newSNIRoute(r, "")
+		r.fallback.isDefault = true
+	}
+	return r.fallback
+}
+
+// Close stops routing, closes the underlying listener, and unblocks every
+// route's Accept.
+func (r *SNIRouter) Close() error {
+	return r.shutdown(nil)
+}
+
+func (r *SNIRouter) shutdown(cause error) error {
+	var err error
+	r.closeOnce.Do(func() {
+		r.err = cause
+		close(r.done)
+		err = r.listener.Close()
+	})
+	return err
+}
+
+// acceptLoop accepts from the underlying listener until it fails permanently.
+func (r *SNIRouter) acceptLoop() {
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			select {
+			case <-r.done:
+				return
+			default:
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
+			log.Printf("SNI router stopping after accept error: %v", err)
+			r.shutdown(err)
+			return
+		}
+		go r.dispatch(conn)
+	}
+}
+
+// dispatch completes the TLS handshake to learn the SNI and hands the
+// connection to the matching route.
+func (r *SNIRouter) dispatch(conn net.Conn) {
+	serverName := ""
+	if tlsConn, ok := conn.(tlsConnectionStater); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), r.HandshakeTimeout)
+		err := tlsConn.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
+			log.Printf("SNI router handshake with %s failed: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		serverName = tlsConn.ConnectionState().ServerName
+	}
+
+	route := r.match(serverName)
+	if route == nil {
+		log.Printf("No SNI route for %q from %s, closing connection", serverName, conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	route.deliver(conn)
+}
+
+// match finds the route for serverName, falling back to wildcard and default routes.
+func (r *SNIRouter) match(serverName string) *sniRoute {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if name != "" {
+		if route, ok := r.routes[name]; ok {
+			return route
+		}
+		if i := strings.IndexByte(name, '.'); i > 0 {
+			if route, ok := r.routes["*"+name[i:]]; ok {
+				return route
+			}
+		}
+	}
+	return r.fallback
+}
+
+// detach removes route from the router.
+func (r *SNIRouter) detach(route *sniRoute) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.fallback == route {
+		r.fallback = nil
+	} else if r.routes[route.name] == route {
+		delete(r.routes, route.name)
+	}
+}
+
+// sniRoute is the net.Listener for one server name of an SNIRouter.
+type sniRoute struct {
+	router    *SNIRouter
+	name      string
+	isDefault bool
+	connCh    chan net.Conn
+	closeCh   chan struct{}
+	closeOnce sync.Once
+}
+
+func newSNIRoute(r *SNIRouter, name string) *sniRoute {
+	return &sniRoute{
+		router:  r,
+		name:    name,
+		connCh:  make(chan net.Conn),
+		closeCh: make(chan struct{}),
+	}
+}
+
+// deliver passes conn to a pending Accept, closing it if the route or
+// router shuts down first.
+func (sr *sniRoute) deliver(conn net.Conn) {
+	select {
+	case sr.connCh <- conn:
+	case <-sr.closeCh:
+		conn.Close()
+	case <-sr.router.done:
+		conn.Close()
+	}
+}
+
+// Accept returns the next connection routed to this server name.
+func (sr *sniRoute) Accept() (net.Conn, error) {
+	select {
+	case conn := <-sr.connCh:
+		return conn, nil
+	case <-sr.closeCh:
+		return nil, ErrRouteClosed
+	case <-sr.router.done:
+		if sr.router.err != nil {
+			return nil, sr.router.err
+		}
+		return nil, ErrRouteClosed
+	}
+}
+
+// Close detaches the route. Closing the default route closes the router.
+func (sr *sniRoute) Close() error {
+	var err error
+	sr.closeOnce.Do(func() {
+		close(sr.closeCh)
+		sr.router.detach(sr)
+		if sr.isDefault {
+			err = sr.router.Close()
+		}
+	})
+	return err
+}
+
+// Addr returns the address of the underlying TLS listener.
+func (sr *sniRoute) Addr() net.Addr {
+	return sr.router.listener.Addr()
+}
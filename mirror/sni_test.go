@@ -0,0 +1,98 @@
+package mirror
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// testTLSConfig returns a server config with a throwaway self-signed certificate.
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// TestSNIRouterRoutesByServerName verifies exact, wildcard, and default routing.
+func TestSNIRouterRoutesByServerName(t *testing.T) {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", testTLSConfig(t))
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	router := NewSNIRouter(listener)
+	defer router.Close()
+
+	routes := map[string]net.Listener{
+		"gitea.example.org": router.Route("Gitea.Example.org"),
+		"x.pages.example":   router.Route("*.pages.example"),
+		"other.example":     router.Default(),
+	}
+
+	for serverName, want := range routes {
+		accepted := make(chan net.Conn, 1)
+		go func(l net.Listener) {
+			conn, err := l.Accept()
+			if err == nil {
+				accepted <- conn
+			}
+		}(want)
+
+		client, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			t.Fatalf("Dial with SNI %s failed: %v", serverName, err)
+		}
+
+		select {
+		case conn := <-accepted:
+			if got := conn.(*tls.Conn).ConnectionState().ServerName; got != serverName {
+				t.Errorf("Expected SNI %s, got %s", serverName, got)
+			}
+			conn.Close()
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Connection with SNI %s was not routed", serverName)
+		}
+		client.Close()
+	}
+}
+
+// TestSNIRouterDefaultCloseClosesRouter verifies that closing the default
+// route shuts down the router and unblocks other routes.
+func TestSNIRouterDefaultCloseClosesRouter(t *testing.T) {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", testTLSConfig(t))
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	router := NewSNIRouter(listener)
+	route := router.Route("a.example")
+
+	router.Default().Close()
+	if _, err := route.Accept(); err != ErrRouteClosed {
+		t.Errorf("Expected ErrRouteClosed, got %v", err)
+	}
+	if _, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+		t.Error("Underlying listener should be closed")
+	}
+}
@@ -0,0 +1,277 @@
+package mirror
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-i2p/go-meta-listener"
+)
+
+// TransportStats is a snapshot of the traffic counters for one transport,
+// aggregated over every service of a Mirror.
+type TransportStats struct {
+	// Connections is the total number of connections accepted.
+	Connections uint64 `json:"connections"`
+	// Active is the number of accepted connections not yet closed.
+	Active int64 `json:"active"`
+	// BytesRead is the number of bytes read from clients.
+	BytesRead uint64 `json:"bytes_read"`
+	// BytesWritten is the number of bytes written to clients.
+	BytesWritten uint64 `json:"bytes_written"`
+	// Errors counts accept failures and connection read/write failures.
+	Errors uint64 `json:"errors"`
+	// Shed is the number of connections closed on accept because the
+	// transport was at its MirrorConfig.MaxConns limit.
+	Shed uint64 `json:"shed"`
+}
+
+// transportCounters holds the live counters behind a TransportStats.
+type transportCounters struct {
+	connections  atomic.Uint64
+	active       atomic.Int64
+	bytesRead    atomic.Uint64
+	bytesWritten atomic.Uint64
+	errors       atomic.Uint64
+	shed         atomic.Uint64
+}
+
+func (tc *transportCounters) snapshot() TransportStats {
+	return TransportStats{
+		Connections:  tc.connections.Load(),
+		Active:       tc.active.Load(),
+		BytesRead:    tc.bytesRead.Load(),
+		BytesWritten: tc.bytesWritten.Load(),
+		Errors:       tc.errors.Load(),
+		Shed:         tc.shed.Load(),
+	}
+}
+
+// recordErr counts err unless it is an expected end-of-stream or timeout.
+func (tc *transportCounters) recordErr(err error) {
+	if err == nil || errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		return
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return
+	}
+	tc.errors.Add(1)
+}
+
+// statsTable holds transport counters keyed by transport name.
+type statsTable struct {
+	mu       sync.Mutex
+	counters map[string]*transportCounters
+}
+
+// get returns the counters for transport, creating them if needed.
+func (st *statsTable) get(transport string) *transportCounters {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.counters == nil {
+		st.counters = make(map[string]*transportCounters)
+	}
+	tc, ok := st.counters[transport]
+	if !ok {
+		tc = &transportCounters{}
+		st.counters[transport] = tc
+	}
+	return tc
+}
+
+func (st *statsTable) snapshot() map[string]TransportStats {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	out := make(map[string]TransportStats, len(st.counters))
+	for transport, tc := range st.counters {
+		out[transport] = tc.snapshot()
+	}
+	return out
+}
+
+// countingListener wraps a transport listener and counts its connections.
+type countingListener struct {
+	net.Listener
+	transport string
+	counters  *transportCounters
+	// limit caps the transport's open connections; zero means no limit
+	limit int64
+}
+
+// Accept accepts a connection and wraps it so its traffic is counted.
+// Connections over the transport's limit are closed immediately and
+// counted as shed, and Accept waits for the next one.
+func (cl *countingListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := cl.Listener.Accept()
+		if err != nil {
+			cl.counters.recordErr(err)
+			return nil, err
+		}
+		cl.counters.connections.Add(1)
+		if active := cl.counters.active.Add(1); cl.limit > 0 && active > cl.limit {
+			cl.counters.active.Add(-1)
+			cl.counters.shed.Add(1)
+			conn.Close()
+			continue
+		}
+		return &countingConn{Conn: conn, transport: cl.transport, counters: cl.counters}, nil
+	}
+}
+
+// SetDeadline forwards accept deadlines to the wrapped listener when it
+// supports them, so the MetaListener can still poll it.
+func (cl *countingListener) SetDeadline(t time.Time) error {
+	if deadline, ok := cl.Listener.(interface{ SetDeadline(time.Time) error }); ok {
+		return deadline.SetDeadline(t)
+	}
+	return nil
+}
+
+// File returns a duplicate of the wrapped listener's file descriptor, so
+// meta.MetaListener.Files can hand the socket to another process. Listeners
+// without one, such as those of Tor or I2P, report errors.ErrUnsupported.
+func (cl *countingListener) File() (*os.File, error) {
+	if f, ok := cl.Listener.(interface{ File() (*os.File, error) }); ok {
+		return f.File()
+	}
+	return nil, errors.ErrUnsupported
+}
+
+// countingConn counts bytes and errors on an accepted connection. It is the
+// TransportConn handed out by Mirror listeners.
+type countingConn struct {
+	net.Conn
+	transport string
+	counters  *transportCounters
+	closed    atomic.Bool
+}
+
+// Transport returns the name of the transport the connection arrived on.
+func (cc *countingConn) Transport() string {
+	return cc.transport
+}
+
+// PeerID returns the anonymized identity of the peer, if the transport has one.
+func (cc *countingConn) PeerID() string {
+	return peerID(cc.Conn.RemoteAddr())
+}
+
+// NegotiatedProtocol returns the ALPN protocol of a TLS connection.
+func (cc *countingConn) NegotiatedProtocol() string {
+	return connProtocol(cc.Conn)
+}
+
+// ClientCertificate returns the verified client certificate of a TLS
+// connection.
+func (cc *countingConn) ClientCertificate() *x509.Certificate {
+	return clientCertificate(cc.Conn)
+}
+
+// ConnectionState returns the state of a TLS connection.
+func (cc *countingConn) ConnectionState() tls.ConnectionState {
+	return tlsState(cc.Conn)
+}
+
+func (cc *countingConn) Read(b []byte) (int, error) {
+	n, err := cc.Conn.Read(b)
+	cc.counters.bytesRead.Add(uint64(n))
+	cc.counters.recordErr(err)
+	return n, err
+}
+
+func (cc *countingConn) Write(b []byte) (int, error) {
+	n, err := cc.Conn.Write(b)
+	cc.counters.bytesWritten.Add(uint64(n))
+	cc.counters.recordErr(err)
+	return n, err
+}
+
+// Close closes the connection and decrements the active count exactly once.
+func (cc *countingConn) Close() error {
+	if cc.closed.CompareAndSwap(false, true) {
+		cc.counters.active.Add(-1)
+	}
+	return cc.Conn.Close()
+}
+
+// CloseWrite shuts down the writing side of the connection, or closes it if
+// it cannot be half-closed.
+func (cc *countingConn) CloseWrite() error {
+	return meta.CloseWrite(cc.Conn, cc.Close)
+}
+
+// CloseRead shuts down the reading side of the connection where supported.
+func (cc *countingConn) CloseRead() error {
+	return meta.CloseRead(cc.Conn)
+}
+
+// Stats returns traffic counters for every transport the Mirror has set up,
+// keyed by transport name (TransportTCP, TransportTLS, TransportOnion,
+// TransportGarlic, and the names of registered transports).
+func (ml *Mirror) Stats() map[string]TransportStats {
+	return ml.stats.snapshot()
+}
+
+// WritePrometheus writes the Mirror's transport counters to w in the
+// Prometheus text exposition format.
+func (ml *Mirror) WritePrometheus(w io.Writer) error {
+	stats := ml.Stats()
+	transports := make([]string, 0, len(stats))
+	for transport := range stats {
+		transports = append(transports, transport)
+	}
+	sort.Strings(transports)
+
+	metrics := []struct {
+		name, kind, help string
+		value            func(TransportStats) string
+	}{
+		{"mirror_connections_total", "counter", "Connections accepted per transport.",
+			func(s TransportStats) string { return fmt.Sprint(s.Connections) }},
+		{"mirror_connections_active", "gauge", "Open connections per transport.",
+			func(s TransportStats) string { return fmt.Sprint(s.Active) }},
+		{"mirror_bytes_read_total", "counter", "Bytes read from clients per transport.",
+			func(s TransportStats) string { return fmt.Sprint(s.BytesRead) }},
+		{"mirror_bytes_written_total", "counter", "Bytes written to clients per transport.",
+			func(s TransportStats) string { return fmt.Sprint(s.BytesWritten) }},
+		{"mirror_errors_total", "counter", "Accept and connection errors per transport.",
+			func(s TransportStats) string { return fmt.Sprint(s.Errors) }},
+		{"mirror_connections_shed_total", "counter", "Connections closed at the per-transport limit.",
+			func(s TransportStats) string { return fmt.Sprint(s.Shed) }},
+	}
+
+	for _, m := range metrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind); err != nil {
+			return err
+		}
+		for _, transport := range transports {
+			if _, err := fmt.Fprintf(w, "%s{transport=%q} %s\n", m.name, transport, m.value(stats[transport])); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// PrometheusHandler returns an http.Handler serving WritePrometheus output,
+// suitable for mounting at /metrics.
+func (ml *Mirror) PrometheusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := ml.WritePrometheus(w); err != nil {
+			log.Printf("Error writing Prometheus metrics: %v", err)
+		}
+	})
+}
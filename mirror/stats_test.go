@@ -0,0 +1,156 @@
+package mirror
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-i2p/go-meta-listener/tcp"
+)
+
+// TestStatsCountLocalTraffic verifies that connections and bytes on the local
+// TCP transport are reflected in Stats and the Prometheus output.
+func TestStatsCountLocalTraffic(t *testing.T) {
+	os.Setenv("DISABLE_TOR", "true")
+	os.Setenv("DISABLE_I2P", "true")
+	defer func() {
+		os.Unsetenv("DISABLE_TOR")
+		os.Unsetenv("DISABLE_I2P")
+	}()
+
+	mirror, err := NewMirror("test-stats")
+	if err != nil {
+		t.Fatalf("Failed to create mirror: %v", err)
+	}
+	defer mirror.Close()
+
+	listener, err := mirror.AddService("3016", ServiceConfig{})
+	if err != nil {
+		t.Fatalf("AddService failed: %v", err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", "127.0.0.1:3016")
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer client.Close()
+
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+
+	client.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(server, buf); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	server.Write([]byte("pong!"))
+
+	stats := mirror.Stats()[TransportTCP]
+	if stats.Connections != 1 || stats.Active != 1 {
+		t.Errorf("Expected 1 connection and 1 active, got %+v", stats)
+	}
+	if stats.BytesRead != 4 || stats.BytesWritten != 5 {
+		t.Errorf("Expected 4 bytes read and 5 written, got %+v", stats)
+	}
+
+	server.Close()
+	server.Close()
+	if active := mirror.Stats()[TransportTCP].Active; active != 0 {
+		t.Errorf("Expected 0 active after close, got %d", active)
+	}
+
+	var out bytes.Buffer
+	if err := mirror.WritePrometheus(&out); err != nil {
+		t.Fatalf("WritePrometheus failed: %v", err)
+	}
+	if !strings.Contains(out.String(), `mirror_bytes_read_total{transport="tcp-local"} 4`) {
+		t.Errorf("Prometheus output missing bytes read:\n%s", out.String())
+	}
+}
+
+// TestMaxConnsSheds verifies that connections over the transport limit are
+// closed and counted, and that capacity frees up when connections close.
+func TestMaxConnsSheds(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	counters := &transportCounters{}
+	listener := &countingListener{Listener: inner, transport: TransportGarlic, counters: counters, limit: 1}
+	defer listener.Close()
+	addr := inner.Addr().String()
+
+	c1, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer c1.Close()
+	first, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	c2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer c2.Close()
+	c2.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c2.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected the connection over the limit to be closed, got %v", err)
+	}
+	if shed := counters.snapshot().Shed; shed != 1 {
+		t.Errorf("Expected 1 shed connection, got %d", shed)
+	}
+
+	first.Close()
+	c3, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer c3.Close()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a connection to be accepted after capacity freed up")
+	}
+}
+
+// TestCountingListenerFile verifies that a counted listener hands out the
+// file of the listener it wraps, and reports listeners without one as
+// unsupported.
+func TestCountingListenerFile(t *testing.T) {
+	inner, err := tcp.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer inner.Close()
+	counted := &countingListener{Listener: inner, transport: TransportTCP, counters: &transportCounters{}}
+	file, err := counted.File()
+	if err != nil {
+		t.Fatalf("File failed: %v", err)
+	}
+	file.Close()
+
+	hidden := &countingListener{Listener: BackendListener(inner, nil), transport: TransportOnion, counters: &transportCounters{}}
+	if _, err := hidden.File(); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("File of a listener without one = %v, want errors.ErrUnsupported", err)
+	}
+}
@@ -0,0 +1,260 @@
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-i2p/go-meta-listener"
+)
+
+const (
+	// defaultStatsDPrefix is the metric name prefix when StatsDConfig.Prefix
+	// is empty.
+	defaultStatsDPrefix = "mirror"
+	// defaultStatsDInterval is how often counters are pushed when
+	// StatsDConfig.Interval is zero.
+	defaultStatsDInterval = 10 * time.Second
+	// statsdPacketSize keeps each UDP packet within a typical MTU.
+	statsdPacketSize = 1432
+)
+
+// StatsDConfig pushes a Mirror's counters to a StatsD server, or to a
+// Datadog agent's DogStatsD port, for environments that do not scrape
+// WritePrometheus.
+type StatsDConfig struct {
+	// Addr is the host:port of the server, such as "127.0.0.1:8125".
+	// Metrics are sent over UDP.
+	Addr string
+	// Prefix starts every metric name, followed by a dot. Defaults to
+	// "mirror".
+	Prefix string
+	// Tags, written "key:value", are added to every metric, for example
+	// "env:prod" or "host:web1".
+	Tags []string
+	// Datadog sends tags in DogStatsD's |#key:value format. Plain StatsD
+	// has no tags, so without it each tag becomes two segments of the
+	// metric name after the prefix, as in mirror.transport.tls.connections.
+	Datadog bool
+	// Interval is how often the counters are pushed. Defaults to 10
+	// seconds.
+	Interval time.Duration
+}
+
+// prefix returns the metric name prefix of the configuration.
+func (c StatsDConfig) prefix() string {
+	if c.Prefix == "" {
+		return defaultStatsDPrefix
+	}
+	return c.Prefix
+}
+
+// interval returns the push interval of the configuration.
+func (c StatsDConfig) interval() time.Duration {
+	if c.Interval <= 0 {
+		return defaultStatsDInterval
+	}
+	return c.Interval
+}
+
+// validate checks that the configuration can be written as StatsD lines.
+func (c StatsDConfig) validate() error {
+	if c.Addr == "" {
+		return errors.New("StatsD address is empty")
+	}
+	if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+		return fmt.Errorf("invalid StatsD address %q: %w", c.Addr, err)
+	}
+	if strings.ContainsAny(c.Prefix, ":|@#, \t\r\n") {
+		return fmt.Errorf("invalid StatsD prefix %q", c.Prefix)
+	}
+	for _, tag := range c.Tags {
+		key, value, ok := strings.Cut(tag, ":")
+		if !ok || key == "" || value == "" || strings.ContainsAny(tag, "|@#, \t\r\n") {
+			return fmt.Errorf("invalid StatsD tag %q, want key:value", tag)
+		}
+	}
+	return nil
+}
+
+// statsdMetric is one value pushed to StatsD.
+type statsdMetric struct {
+	name string
+	// kind is "c" for a counter, whose increase since the last push is
+	// sent, or "g" for a gauge
+	kind  string
+	value int64
+	tags  []string
+}
+
+// statsdExporter pushes the counters of a Mirror to a StatsD server.
+type statsdExporter struct {
+	cfg  StatsDConfig
+	conn net.Conn
+	// last holds the value of every counter at the previous push, by key
+	last map[string]int64
+	// failing is set while pushes fail, so each outage is logged once
+	failing bool
+}
+
+// startStatsD pushes the Mirror's counters as cfg describes until the
+// Mirror is closed.
+func (ml *Mirror) startStatsD(cfg StatsDConfig) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	conn, err := net.Dial("udp", cfg.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to StatsD server %s: %w", cfg.Addr, err)
+	}
+	exporter := &statsdExporter{cfg: cfg, conn: conn, last: make(map[string]int64)}
+	go func() {
+		defer conn.Close()
+		ticker := time.NewTicker(cfg.interval())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ml.stopCh:
+				return
+			case <-ticker.C:
+				exporter.push(ml.statsdMetrics())
+			}
+		}
+	}()
+	log.Printf("Pushing metrics to StatsD server %s every %s\n", cfg.Addr, cfg.interval())
+	return nil
+}
+
+// statsdMetrics collects the counters the Mirror pushes: those of Stats,
+// tagged with their transport, those of the MetaListener of the Mirror and
+// of each service, tagged with the Mirror's name or the service's port as
+// the listener, and HeaderOverflow.
+func (ml *Mirror) statsdMetrics() []statsdMetric {
+	var metrics []statsdMetric
+	stats := ml.Stats()
+	transports := make([]string, 0, len(stats))
+	for transport := range stats {
+		transports = append(transports, transport)
+	}
+	sort.Strings(transports)
+	for _, transport := range transports {
+		s := stats[transport]
+		tags := []string{"transport:" + transport}
+		metrics = append(metrics,
+			statsdMetric{"connections", "c", int64(s.Connections), tags},
+			statsdMetric{"connections.active", "g", s.Active, tags},
+			statsdMetric{"connections.shed", "c", int64(s.Shed), tags},
+			statsdMetric{"bytes.read", "c", int64(s.BytesRead), tags},
+			statsdMetric{"bytes.written", "c", int64(s.BytesWritten), tags},
+			statsdMetric{"errors", "c", int64(s.Errors), tags},
+		)
+	}
+
+	listeners := map[string]meta.Stats{ml.name: ml.MetaListener.Stats()}
+	ml.mu.RLock()
+	for port, child := range ml.children {
+		listeners[port] = child.Stats()
+	}
+	ml.mu.RUnlock()
+	ids := make([]string, 0, len(listeners))
+	for id := range listeners {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		s := listeners[id]
+		tags := []string{"listener:" + id}
+		metrics = append(metrics,
+			statsdMetric{"listeners", "g", int64(s.Listeners), tags},
+			statsdMetric{"accepted", "c", int64(s.Accepted), tags},
+			statsdMetric{"dropped", "c", int64(s.Dropped), tags},
+			statsdMetric{"queued", "g", int64(s.Queued), tags},
+			statsdMetric{"refused", "c", int64(s.Refused), tags},
+		)
+	}
+	return append(metrics, statsdMetric{"header_overflow", "c", int64(ml.HeaderOverflow()), nil})
+}
+
+// push sends metrics to the server, batched into packets.
+func (e *statsdExporter) push(metrics []statsdMetric) {
+	var packet strings.Builder
+	var err error
+	flush := func() {
+		if packet.Len() == 0 {
+			return
+		}
+		if _, werr := e.conn.Write([]byte(packet.String())); werr != nil && err == nil {
+			err = werr
+		}
+		packet.Reset()
+	}
+	for _, m := range metrics {
+		line := e.line(m)
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdPacketSize {
+			flush()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	flush()
+
+	if err != nil && !e.failing {
+		log.Printf("Error pushing metrics to StatsD server %s: %v\n", e.cfg.Addr, err)
+	} else if err == nil && e.failing {
+		log.Printf("Pushing metrics to StatsD server %s again\n", e.cfg.Addr)
+	}
+	e.failing = err != nil
+}
+
+// line formats m, sending the increase of a counter since the last push.
+// A counter that went down, because a service was re-created, is sent
+// whole.
+func (e *statsdExporter) line(m statsdMetric) string {
+	tags := make([]string, 0, len(e.cfg.Tags)+len(m.tags))
+	tags = append(tags, e.cfg.Tags...)
+	for _, tag := range m.tags {
+		key, value, _ := strings.Cut(tag, ":")
+		tags = append(tags, key+":"+statsdSanitize(value))
+	}
+
+	name := e.cfg.prefix()
+	if !e.cfg.Datadog {
+		for _, tag := range tags {
+			key, value, _ := strings.Cut(tag, ":")
+			name += "." + key + "." + strings.ReplaceAll(value, ".", "_")
+		}
+	}
+	name += "." + m.name
+
+	value := m.value
+	if m.kind == "c" {
+		key := name + "|" + strings.Join(tags, ",")
+		if last, ok := e.last[key]; ok && last <= value {
+			value -= last
+		}
+		e.last[key] = m.value
+	}
+	line := name + ":" + strconv.FormatInt(value, 10) + "|" + m.kind
+	if e.cfg.Datadog && len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line
+}
+
+// statsdSanitize replaces the characters StatsD lines reserve in a tag
+// value, such as the colon of a host:port Mirror name.
+func statsdSanitize(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', '@', '#', ',', ' ', '\t', '\r', '\n':
+			return '_'
+		}
+		return r
+	}, value)
+}
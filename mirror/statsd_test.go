@@ -0,0 +1,114 @@
+package mirror
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestStatsDLine verifies the plain and DogStatsD formats and that counters
+// are sent as their increase since the previous push.
+func TestStatsDLine(t *testing.T) {
+	plain := &statsdExporter{cfg: StatsDConfig{Tags: []string{"env:prod"}}, last: make(map[string]int64)}
+	dog := &statsdExporter{cfg: StatsDConfig{Prefix: "app", Tags: []string{"env:prod"}, Datadog: true}, last: make(map[string]int64)}
+	conns := statsdMetric{"connections", "c", 5, []string{"transport:tls"}}
+	active := statsdMetric{"connections.active", "g", 2, []string{"listener:localhost:3000"}}
+
+	for _, tc := range []struct {
+		exporter *statsdExporter
+		metric   statsdMetric
+		want     string
+	}{
+		{plain, conns, "mirror.env.prod.transport.tls.connections:5|c"},
+		{plain, active, "mirror.env.prod.listener.localhost_3000.connections.active:2|g"},
+		{dog, conns, "app.connections:5|c|#env:prod,transport:tls"},
+		{dog, statsdMetric{"connections", "c", 12, []string{"transport:tls"}}, "app.connections:7|c|#env:prod,transport:tls"},
+		{dog, statsdMetric{"connections", "c", 3, []string{"transport:tls"}}, "app.connections:3|c|#env:prod,transport:tls"},
+		{dog, statsdMetric{"header_overflow", "c", 0, nil}, "app.header_overflow:0|c|#env:prod"},
+	} {
+		if got := tc.exporter.line(tc.metric); got != tc.want {
+			t.Errorf("line(%v) = %q, want %q", tc.metric, got, tc.want)
+		}
+	}
+}
+
+// TestStatsDConfigValidate verifies that settings StatsD lines cannot carry
+// are refused.
+func TestStatsDConfigValidate(t *testing.T) {
+	if err := (StatsDConfig{Addr: "127.0.0.1:8125", Tags: []string{"env:prod"}}).validate(); err != nil {
+		t.Errorf("valid configuration refused: %v", err)
+	}
+	for name, cfg := range map[string]StatsDConfig{
+		"no address":  {},
+		"no port":     {Addr: "127.0.0.1"},
+		"bad prefix":  {Addr: "127.0.0.1:8125", Prefix: "my app"},
+		"bare tag":    {Addr: "127.0.0.1:8125", Tags: []string{"prod"}},
+		"comma tag":   {Addr: "127.0.0.1:8125", Tags: []string{"env:prod,x"}},
+		"empty value": {Addr: "127.0.0.1:8125", Tags: []string{"env:"}},
+	} {
+		if err := cfg.validate(); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+// TestStatsDPush verifies that a Mirror pushes the counters of its
+// services to the configured server.
+func TestStatsDPush(t *testing.T) {
+	os.Setenv("DISABLE_TOR", "true")
+	os.Setenv("DISABLE_I2P", "true")
+	defer func() {
+		os.Unsetenv("DISABLE_TOR")
+		os.Unsetenv("DISABLE_I2P")
+	}()
+
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer server.Close()
+
+	cfg := DefaultMirrorConfig()
+	cfg.StatsD = &StatsDConfig{Addr: server.LocalAddr().String(), Tags: []string{"env:test"}, Datadog: true, Interval: 10 * time.Millisecond}
+	mirror, err := NewMirrorWithConfig(context.Background(), "test-statsd", cfg)
+	if err != nil {
+		t.Fatalf("Failed to create mirror: %v", err)
+	}
+	defer mirror.Close()
+	listener, err := mirror.AddService("3031", ServiceConfig{})
+	if err != nil {
+		t.Fatalf("AddService failed: %v", err)
+	}
+	defer listener.Close()
+
+	want := []string{
+		"mirror.connections.active:0|g|#env:test,transport:tcp-local",
+		"mirror.listeners:1|g|#env:test,listener:3031",
+	}
+	buf := make([]byte, 65536)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(want) > 0 {
+		n, _, err := server.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("No packet with %v: %v", want, err)
+		}
+		lines := strings.Split(string(buf[:n]), "\n")
+		for i := 0; i < len(want); i++ {
+			for _, line := range lines {
+				if line == want[i] {
+					want = append(want[:i], want[i+1:]...)
+					i--
+					break
+				}
+			}
+		}
+	}
+
+	cfg.StatsD = &StatsDConfig{Addr: server.LocalAddr().String(), Tags: []string{"bad"}}
+	if _, err := NewMirrorWithConfig(context.Background(), "test-statsd-bad", cfg); err == nil {
+		t.Error("Expected an error for an invalid tag")
+	}
+}
@@ -0,0 +1,210 @@
+package mirror
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-i2p/go-meta-listener"
+)
+
+// Transport names used as keys in the Mirror status and statistics APIs.
+const (
+	TransportTCP    = "tcp-local"
+	TransportTLS    = "tls"
+	TransportOnion  = "onion"
+	TransportGarlic = "i2p"
+	// TransportGarlicDatagram is the I2P datagram session of a service
+	// whose I2PMode includes datagrams.
+	TransportGarlicDatagram = "i2p-datagram"
+)
+
+// TransportState describes the lifecycle state of a single transport.
+type TransportState int
+
+const (
+	// TransportConfigured means the transport is enabled but setup has not started.
+	TransportConfigured TransportState = iota
+	// TransportStarting means the transport is being set up.
+	TransportStarting
+	// TransportUp means the transport's listener is registered and accepting.
+	TransportUp
+	// TransportDegraded means the transport came up but its listener has since
+	// been dropped by the MetaListener.
+	TransportDegraded
+	// TransportDown means setup failed or the transport was shut down.
+	TransportDown
+)
+
+// String returns the lowercase name of the state.
+func (s TransportState) String() string {
+	switch s {
+	case TransportConfigured:
+		return "configured"
+	case TransportStarting:
+		return "starting"
+	case TransportUp:
+		return "up"
+	case TransportDegraded:
+		return "degraded"
+	case TransportDown:
+		return "down"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalText implements encoding.TextMarshaler so states render as names in JSON.
+func (s TransportState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler so JSON from Status and
+// the /status endpoint can be decoded.
+func (s *TransportState) UnmarshalText(text []byte) error {
+	for state := TransportConfigured; state <= TransportDown; state++ {
+		if state.String() == string(text) {
+			*s = state
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown transport state %q", text)
+}
+
+// TransportStatus is a point-in-time view of one transport of one service.
+type TransportStatus struct {
+	Transport string         `json:"transport"`
+	Port      string         `json:"port"`
+	State     TransportState `json:"state"`
+	LastError string         `json:"last_error,omitempty"`
+	Address   string         `json:"address,omitempty"`
+	Uptime    time.Duration  `json:"uptime"`
+}
+
+// transportRecord is the mutable bookkeeping behind a TransportStatus.
+type transportRecord struct {
+	status TransportStatus
+	since  time.Time
+	// ml and id locate the registered listener so Status can detect removal.
+	ml *meta.MetaListener
+	id string
+}
+
+// statusTable holds transport records keyed by "<transport>:<port>".
+type statusTable struct {
+	mu      sync.Mutex
+	records map[string]*transportRecord
+}
+
+func statusKey(transport, port string) string {
+	return transport + ":" + port
+}
+
+// record returns the record for transport/port, creating it if needed.
+// The caller must hold st.mu.
+func (st *statusTable) record(transport, port string) *transportRecord {
+	if st.records == nil {
+		st.records = make(map[string]*transportRecord)
+	}
+	key := statusKey(transport, port)
+	rec, ok := st.records[key]
+	if !ok {
+		rec = &transportRecord{status: TransportStatus{Transport: transport, Port: port}}
+		st.records[key] = rec
+	}
+	return rec
+}
+
+// setState moves a transport into state, recording err if it is non-nil.
+func (st *statusTable) setState(transport, port string, state TransportState, err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	rec := st.record(transport, port)
+	if rec.status.State != state {
+		rec.since = time.Now()
+	}
+	rec.status.State = state
+	if err != nil {
+		rec.status.LastError = err.Error()
+	}
+}
+
+// setUp marks a transport as up and remembers where its listener is registered.
+func (st *statusTable) setUp(transport, port, address string, ml *meta.MetaListener, id string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	rec := st.record(transport, port)
+	rec.status.State = TransportUp
+	rec.status.Address = address
+	rec.since = time.Now()
+	rec.ml = ml
+	rec.id = id
+}
+
+// markAllDown moves every tracked transport to TransportDown.
+func (st *statusTable) markAllDown() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := time.Now()
+	for _, rec := range st.records {
+		if rec.status.State != TransportDown {
+			rec.status.State = TransportDown
+			rec.since = now
+		}
+	}
+}
+
+// markPortDown moves every transport of the service on port to TransportDown.
+func (st *statusTable) markPortDown(port string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := time.Now()
+	for _, rec := range st.records {
+		if rec.status.Port == port && rec.status.State != TransportDown {
+			rec.status.State = TransportDown
+			rec.since = now
+		}
+	}
+}
+
+// snapshot returns a copy of every record with uptime and degradation resolved.
+func (st *statusTable) snapshot() map[string]TransportStatus {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	out := make(map[string]TransportStatus, len(st.records))
+	for key, rec := range st.records {
+		if rec.status.State == TransportUp && rec.ml != nil && !hasListener(rec.ml, rec.id) {
+			rec.status.State = TransportDegraded
+			rec.status.LastError = "listener " + rec.id + " is no longer registered"
+			rec.since = time.Now()
+		}
+		status := rec.status
+		if status.State == TransportUp {
+			status.Uptime = time.Since(rec.since)
+		}
+		out[key] = status
+	}
+	return out
+}
+
+// hasListener reports whether id is still registered on ml.
+func hasListener(ml *meta.MetaListener, id string) bool {
+	for _, registered := range ml.ListenerIDs() {
+		if registered == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Status reports the state of every transport the Mirror has configured,
+// keyed by "<transport>:<port>" (for example "onion:3000"). It is safe to call
+// concurrently with Listen and Close and is suitable for health endpoints.
+func (ml *Mirror) Status() map[string]TransportStatus {
+	return ml.status.snapshot()
+}
@@ -0,0 +1,49 @@
+package mirror
+
+import (
+	"os"
+	"testing"
+)
+
+// TestStatusReflectsListenerLifecycle verifies that Status tracks the local
+// TCP transport through setup, listener removal, and Mirror shutdown.
+func TestStatusReflectsListenerLifecycle(t *testing.T) {
+	os.Setenv("DISABLE_TOR", "true")
+	os.Setenv("DISABLE_I2P", "true")
+	defer func() {
+		os.Unsetenv("DISABLE_TOR")
+		os.Unsetenv("DISABLE_I2P")
+	}()
+
+	mirror, err := NewMirror("test-status:3010")
+	if err != nil {
+		t.Fatalf("Failed to create mirror: %v", err)
+	}
+	defer mirror.Close()
+
+	listener, err := mirror.Listen("test-status:3010", "")
+	if err != nil {
+		t.Fatalf("Listen() failed: %v", err)
+	}
+
+	status, ok := mirror.Status()["tcp-local:3010"]
+	if !ok {
+		t.Fatalf("Expected tcp-local:3010 in status, got %v", mirror.Status())
+	}
+	if status.State != TransportUp {
+		t.Errorf("Expected state up, got %s", status.State)
+	}
+	if status.Address != "127.0.0.1:3010" {
+		t.Errorf("Expected address 127.0.0.1:3010, got %q", status.Address)
+	}
+
+	listener.Close()
+	if state := mirror.Status()["tcp-local:3010"].State; state != TransportDegraded {
+		t.Errorf("Expected state degraded after listener close, got %s", state)
+	}
+
+	mirror.Close()
+	if state := mirror.Status()["tcp-local:3010"].State; state != TransportDown {
+		t.Errorf("Expected state down after mirror close, got %s", state)
+	}
+}
@@ -0,0 +1,66 @@
+package mirror
+
+import (
+	"context"
+	"crypto/tls"
+	"slices"
+)
+
+// TLSSettings tightens the TLS listeners of a Mirror beyond the defaults of
+// crypto/tls. Zero fields keep those defaults.
+type TLSSettings struct {
+	// MinVersion is the lowest TLS version accepted, such as
+	// tls.VersionTLS13.
+	MinVersion uint16
+	// CipherSuites lists the TLS 1.0-1.2 cipher suites offered. TLS 1.3
+	// suites are not configurable in crypto/tls.
+	CipherSuites []uint16
+	// CurvePreferences lists the key exchange groups offered, in order of
+	// preference.
+	CurvePreferences []tls.CurveID
+	// SessionTicketsDisabled turns off session resumption with tickets.
+	SessionTicketsDisabled bool
+}
+
+// tlsSettingsKey is the context key of WithTLSSettings.
+type tlsSettingsKey struct{}
+
+// WithTLSSettings returns a copy of ctx telling CertProvider.Listen and
+// TransportProvider.ListenTLS how to restrict their TLS configuration. The
+// Mirror passes MirrorConfig.TLS this way; providers building their own
+// tls.Config read it with TLSSettingsFromContext.
+func WithTLSSettings(ctx context.Context, settings *TLSSettings) context.Context {
+	return context.WithValue(ctx, tlsSettingsKey{}, settings)
+}
+
+// TLSSettingsFromContext returns the settings set by WithTLSSettings, or nil.
+func TLSSettingsFromContext(ctx context.Context) *TLSSettings {
+	settings, _ := ctx.Value(tlsSettingsKey{}).(*TLSSettings)
+	return settings
+}
+
+// apply sets the fields of config that s restricts. A nil s leaves config
+// unchanged.
+func (s *TLSSettings) apply(config *tls.Config) *tls.Config {
+	if s == nil {
+		return config
+	}
+	if s.MinVersion != 0 {
+		config.MinVersion = s.MinVersion
+	}
+	if len(s.CipherSuites) > 0 {
+		config.CipherSuites = slices.Clone(s.CipherSuites)
+	}
+	if len(s.CurvePreferences) > 0 {
+		config.CurvePreferences = slices.Clone(s.CurvePreferences)
+	}
+	config.SessionTicketsDisabled = s.SessionTicketsDisabled
+	return config
+}
+
+// customTLS reports whether ctx asks for a TLS configuration onramp's own
+// ListenTLS cannot provide.
+func customTLS(ctx context.Context) bool {
+	return len(ALPNFromContext(ctx)) > 0 || TLSSettingsFromContext(ctx) != nil || ClientAuthFromContext(ctx) != nil ||
+		HiddenCertFromContext(ctx) != nil
+}
@@ -0,0 +1,59 @@
+package mirror
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+// TestTLSSettings verifies that hidden TLS listeners apply the settings of
+// their context and that WileedotProvider refuses them.
+func TestTLSSettings(t *testing.T) {
+	cert := testTLSConfig(t).Certificates[0]
+	ctx := WithTLSSettings(context.Background(), &TLSSettings{
+		MinVersion:             tls.VersionTLS13,
+		CurvePreferences:       []tls.CurveID{tls.X25519},
+		SessionTicketsDisabled: true,
+	})
+	if !customTLS(ctx) || customTLS(context.Background()) {
+		t.Error("customTLS does not follow the TLS settings of the context")
+	}
+
+	listener, err := listenTLSWithConfig(ctx,
+		func() (tls.Certificate, error) { return cert, nil },
+		func(...string) (net.Listener, error) { return net.Listen("tcp", "127.0.0.1:0") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	handshake := func(max uint16) error {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true, MaxVersion: max})
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+	if err := handshake(tls.VersionTLS12); err == nil {
+		t.Error("TLS 1.2 client accepted with MinVersion TLS 1.3")
+	}
+	if err := handshake(tls.VersionTLS13); err != nil {
+		t.Errorf("TLS 1.3 client refused: %v", err)
+	}
+
+	_, err = WileedotProvider{}.Listen(ctx, ServiceConfig{Name: "example.com"})
+	if err == nil {
+		t.Error("WileedotProvider accepted TLS settings")
+	}
+}
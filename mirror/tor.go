@@ -0,0 +1,494 @@
+package mirror
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cretz/bine/control"
+	"github.com/cretz/bine/tor"
+	"github.com/cretz/bine/torutil/ed25519"
+	"github.com/go-i2p/onramp"
+)
+
+// defaultTorControlAddr is the control port of a system Tor.
+const defaultTorControlAddr = "127.0.0.1:9051"
+
+// TorConfig makes a Mirror run its onion services on a Tor it manages
+// itself: the system Tor when its control port is reachable, and otherwise a
+// Tor process the Mirror launches and stops with Close. This lets
+// single-binary deployments work without a Tor set up beforehand.
+type TorConfig struct {
+	// ControlAddr is the control port of the system Tor to try first.
+	// Defaults to 127.0.0.1:9051; set it to "-" to always launch Tor.
+	ControlAddr string
+	// ControlPassword authenticates to the system Tor. If empty, cookie or
+	// null authentication is used, whichever the system Tor offers.
+	ControlPassword string
+	// ExePath is the tor executable launched when no system Tor is
+	// reachable. Defaults to "tor" on the PATH.
+	ExePath string
+	// DataDir is the data directory of the launched Tor. It is kept across
+	// restarts so later starts bootstrap quickly. Defaults to "tor-data"
+	// next to the certificate directory.
+	DataDir string
+	// OnBootstrap, if set, is called as Tor bootstraps, ending with
+	// Progress 100. It is called during Mirror setup and must not block.
+	OnBootstrap func(TorBootstrap)
+	// PoW, if set, enables the proof-of-work defense on the onion services
+	// published on this Tor, for mirrors under introduction floods. Tor
+	// versions whose ADD_ONION does not accept it fail the services.
+	PoW *OnionPoW
+	// Bridges, if set, are the bridge lines the launched Tor reaches the
+	// network through instead of connecting to relays directly, for hosts
+	// on censored networks. They are written as BridgeDB and Tor Browser
+	// give them, such as "obfs4 192.0.2.1:443 <fingerprint> cert=...
+	// iat-mode=0", and a bridge using a pluggable transport needs one of
+	// PluggableTransports to provide it. With bridges, Tor is always
+	// launched, as a system Tor keeps the bridges of its own torrc:
+	// ControlAddr must be empty or "-", and naming a system Tor's control
+	// port is an error.
+	Bridges []string
+	// PluggableTransports are the pluggable transport clients the launched
+	// Tor runs to reach Bridges.
+	PluggableTransports []PluggableTransport
+}
+
+// TorBootstrap reports the bootstrap progress of the Tor a Mirror uses.
+type TorBootstrap struct {
+	// Progress is the bootstrap percentage, from 0 to 100.
+	Progress int
+	// Summary describes the current bootstrap phase.
+	Summary string
+	// Warning is set when Tor reports a bootstrap problem.
+	Warning string
+	// Launched is true when the Mirror launched Tor itself, and false when
+	// it attached to the system Tor.
+	Launched bool
+}
+
+// dataDir returns the data directory of a launched Tor.
+func (c TorConfig) dataDir() string {
+	if c.DataDir != "" {
+		return c.DataDir
+	}
+	return filepath.Join(filepath.Dir(filepath.Clean(certDir())), "tor-data")
+}
+
+// key identifies the Tor cfg selects: configurations with the same key
+// attach to or launch the same Tor.
+func (c TorConfig) key() string {
+	addr := c.ControlAddr
+	if addr == "" {
+		addr = defaultTorControlAddr
+	}
+	return strings.Join([]string{addr, c.ExePath, filepath.Clean(c.dataDir())}, "\x00")
+}
+
+// torInstance returns the Tor the Mirror manages, attaching to or launching
+// it on first use.
+func (ml *Mirror) torInstance(ctx context.Context) (*tor.Tor, error) {
+	ml.torMu.Lock()
+	defer ml.torMu.Unlock()
+
+	if ml.tor != nil {
+		return ml.tor, nil
+	}
+	cfg := ml.cfg().Tor
+	if cfg == nil {
+		return nil, fmt.Errorf("mirror has no Tor configuration")
+	}
+	t, err := startTor(ctx, *cfg)
+	if err != nil {
+		return nil, err
+	}
+	ml.tor = t
+	return t, nil
+}
+
+// torFor returns the function setting up the Tor of a service configured
+// with cfg: the Tor of MirrorConfig.Tor when cfg is nil or selects the same
+// Tor, and otherwise one shared only by services selecting the same Tor.
+func (ml *Mirror) torFor(cfg *TorConfig) func(context.Context) (*tor.Tor, error) {
+	if cfg == nil {
+		return ml.torInstance
+	}
+	if own := ml.cfg().Tor; own != nil && own.key() == cfg.key() {
+		return ml.torInstance
+	}
+	key := cfg.key()
+	return func(ctx context.Context) (*tor.Tor, error) {
+		ml.torMu.Lock()
+		defer ml.torMu.Unlock()
+
+		if t, ok := ml.serviceTors[key]; ok {
+			return t, nil
+		}
+		t, err := startTor(ctx, *cfg)
+		if err != nil {
+			return nil, err
+		}
+		if ml.serviceTors == nil {
+			ml.serviceTors = make(map[string]*tor.Tor)
+		}
+		ml.serviceTors[key] = t
+		return t, nil
+	}
+}
+
+// detachTor removes the managed Tors from the Mirror and returns their
+// closers, or nil if the Mirror does not manage any.
+func (ml *Mirror) detachTor() []transportCloser {
+	ml.torMu.Lock()
+	defer ml.torMu.Unlock()
+
+	var closers []transportCloser
+	if ml.tor != nil {
+		closers = append(closers, transportCloser{TransportOnion, "", ml.tor.Close})
+		ml.tor = nil
+	}
+	for _, t := range ml.serviceTors {
+		closers = append(closers, transportCloser{TransportOnion, "", t.Close})
+	}
+	ml.serviceTors = nil
+	return closers
+}
+
+// startTor attaches to the system Tor or, if it is not reachable, launches
+// one, and waits for it to bootstrap.
+func startTor(ctx context.Context, cfg TorConfig) (*tor.Tor, error) {
+	if err := cfg.validateBridges(); err != nil {
+		return nil, err
+	}
+	addr := cfg.ControlAddr
+	if addr == "" {
+		addr = defaultTorControlAddr
+	}
+	// Bridges are only applied to a Tor the Mirror launches
+	if len(cfg.Bridges) > 0 {
+		addr = "-"
+	}
+	if addr != "-" {
+		t, err := attachTor(ctx, addr, cfg.ControlPassword)
+		if err == nil {
+			log.Printf("Using system Tor at %s\n", addr)
+			if err := waitBootstrap(ctx, t, false, cfg.OnBootstrap); err != nil {
+				t.Close()
+				return nil, err
+			}
+			return t, nil
+		}
+		log.Printf("System Tor not reachable at %s (%v), launching Tor\n", addr, err)
+	}
+
+	dataDir := cfg.dataDir()
+	log.Printf("Launching Tor with data directory %s\n", dataDir)
+	// The process outlives ctx, which only bounds setup; Close stops it.
+	t, err := tor.Start(context.WithoutCancel(ctx), &tor.StartConf{ExePath: cfg.ExePath, DataDir: dataDir})
+	if err != nil {
+		return nil, fmt.Errorf("failed to launch Tor: %w", err)
+	}
+	if conf := cfg.bridgeConf(); conf != nil {
+		if err := t.Control.SetConf(conf...); err != nil {
+			t.Close()
+			return nil, fmt.Errorf("failed to configure Tor bridges: %w", err)
+		}
+		log.Printf("Tor reaches the network through %d bridges\n", len(cfg.Bridges))
+	}
+	if err := t.Control.SetConf(control.KeyVals("DisableNetwork", "0")...); err != nil {
+		t.Close()
+		return nil, fmt.Errorf("failed to enable Tor network: %w", err)
+	}
+	if err := waitBootstrap(ctx, t, true, cfg.OnBootstrap); err != nil {
+		t.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// attachTor connects and authenticates to the control port at addr. The
+// returned Tor has only Control set, which is all publishing onion services
+// and reading bootstrap status use: Process, ControlPort, DataDir, and the
+// other fields describing a process bine launched are zero, so Close only
+// closes the control connection and leaves the process running.
+func attachTor(ctx context.Context, addr, password string) (*tor.Tor, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	controller := control.NewConn(textproto.NewConn(conn))
+	if err := controller.Authenticate(password); err != nil {
+		controller.Close()
+		return nil, fmt.Errorf("failed to authenticate to Tor control port: %w", err)
+	}
+	return &tor.Tor{Control: controller}, nil
+}
+
+// torBootstrapPoll is how often bootstrap progress is checked.
+var torBootstrapPoll = 500 * time.Millisecond
+
+// waitBootstrap polls the bootstrap phase of t until it reaches 100 or ctx
+// is done, reporting each change to report.
+func waitBootstrap(ctx context.Context, t *tor.Tor, launched bool, report func(TorBootstrap)) error {
+	last := -1
+	for {
+		info, err := t.Control.GetInfo("status/bootstrap-phase")
+		if err != nil {
+			return fmt.Errorf("failed to read Tor bootstrap phase: %w", err)
+		}
+		if len(info) > 0 {
+			status := parseBootstrapPhase(info[0].Val)
+			status.Launched = launched
+			if status.Progress != last {
+				last = status.Progress
+				log.Printf("Tor bootstrap %d%%: %s\n", status.Progress, status.Summary)
+				if report != nil {
+					report(status)
+				}
+			}
+			if status.Progress >= 100 {
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Tor bootstrap stopped at %d%%: %w", last, ctx.Err())
+		case <-time.After(torBootstrapPoll):
+		}
+	}
+}
+
+// parseBootstrapPhase parses a status/bootstrap-phase value such as
+// `NOTICE BOOTSTRAP PROGRESS=100 TAG=done SUMMARY="Done"`.
+func parseBootstrapPhase(phase string) TorBootstrap {
+	args := make(map[string]string)
+	for rest := phase; rest != ""; {
+		rest = strings.TrimLeft(rest, " ")
+		i := strings.IndexAny(rest, " =")
+		if i < 0 {
+			break
+		}
+		if rest[i] == ' ' {
+			rest = rest[i:]
+			continue
+		}
+		key, value := rest[:i], rest[i+1:]
+		if quoted, err := strconv.QuotedPrefix(value); err == nil {
+			rest = value[len(quoted):]
+			value, _ = strconv.Unquote(quoted)
+		} else {
+			value, rest, _ = strings.Cut(value, " ")
+		}
+		args[key] = value
+	}
+	progress, _ := strconv.Atoi(args["PROGRESS"])
+	return TorBootstrap{
+		Progress: progress,
+		Summary:  args["SUMMARY"],
+		Warning:  args["WARNING"],
+	}
+}
+
+// torSessions holds the Tors a Mirror manages.
+type torSessions struct {
+	// tor is the Tor managed for MirrorConfig.Tor; started on first use
+	tor *tor.Tor
+	// serviceTors are the Tors managed for ServiceConfig.Tor, by torKey
+	serviceTors map[string]*tor.Tor
+	torMu       sync.Mutex
+}
+
+// torTransport publishes services as onion services on the Tor the Mirror
+// manages, selected by MirrorConfig.Tor. Keys are kept in onramp's key
+// store, so addresses are the same as with the default onion transport.
+type torTransport struct {
+	tor    func(context.Context) (*tor.Tor, error)
+	t      *tor.Tor
+	onion  *onramp.Onion
+	keys   ed25519.KeyPair
+	addr   string
+	keyDir string
+	// pow enables the proof-of-work defense of the services
+	pow *OnionPoW
+	// clientsFile stores the clients authorized with AuthorizeOnionClient
+	clientsFile string
+
+	mu       sync.Mutex // protects services and clientsFile's contents
+	services []torService
+}
+
+// torService is an onion service of a torTransport, with what it was
+// published with so it can be republished with other clients.
+type torService struct {
+	*tor.OnionService
+	conf       *tor.ListenConf
+	clientAuth bool
+}
+
+func (tt *torTransport) Name() string { return TransportOnion }
+
+func (tt *torTransport) Setup(ctx context.Context, keyName string) error {
+	t, err := tt.tor(ctx)
+	if err != nil {
+		return err
+	}
+	onion, err := onramp.NewOnion(keyName)
+	if err != nil {
+		return err
+	}
+	keys, err := withKeyDir(tt.keyDir, onion.Keys)
+	if err != nil {
+		return err
+	}
+	clientsFile, _ := withKeyDir(tt.keyDir, func() (string, error) {
+		return filepath.Join(onramp.ONION_KEYSTORE_PATH, keyName+".clients"), nil
+	})
+	tt.t, tt.onion, tt.keys, tt.clientsFile = t, onion, keys, clientsFile
+	return nil
+}
+
+func (tt *torTransport) Listen(ctx context.Context) (net.Listener, error) {
+	options := OnionOptionsFromContext(ctx)
+	conf := options.listenConf(tt.keys)
+	clientAuth := options != nil && options.ClientAuth
+
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	var svc *tor.OnionService
+	var err error
+	if tt.pow != nil || clientAuth {
+		var keys []string
+		if clientAuth {
+			if keys, err = tt.authorizedKeys(); err != nil {
+				return nil, err
+			}
+		}
+		svc, err = listenOnion(tt.t, conf, tt.pow, keys)
+	} else {
+		svc, err = tt.t.Listen(ctx, conf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	tt.services = append(tt.services, torService{svc, conf, clientAuth})
+	tt.addr = svc.Addr().String()
+	return svc, nil
+}
+
+// authorizedKeys returns the keys to publish a restricted service with.
+// tt.mu must be held.
+func (tt *torTransport) authorizedKeys() ([]string, error) {
+	clients, err := readOnionClients(tt.clientsFile)
+	if err != nil {
+		return nil, err
+	}
+	return authorizedKeys(clients)
+}
+
+// updateClients stores the grants update returns for the current ones and
+// republishes the restricted services with them. If a service cannot be
+// republished, the previous grants are put back, in the file and on every
+// service already republished, so what Tor serves keeps matching the file.
+func (tt *torTransport) updateClients(update func([]OnionClient) ([]OnionClient, error)) error {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+
+	previous, err := readOnionClients(tt.clientsFile)
+	if err != nil {
+		return err
+	}
+	clients, err := update(slices.Clone(previous))
+	if err != nil {
+		return err
+	}
+	previousKeys, err := authorizedKeys(previous)
+	if err != nil {
+		return err
+	}
+	keys, err := authorizedKeys(clients)
+	if err != nil {
+		return err
+	}
+	if err := writeOnionClients(tt.clientsFile, clients); err != nil {
+		return err
+	}
+
+	var republished []torService
+	for _, svc := range tt.services {
+		if !svc.clientAuth || svc.ID == "" {
+			continue
+		}
+		if err := svc.Tor.Control.DelOnion(svc.ID); err != nil {
+			tt.restoreClients(previous, previousKeys, republished)
+			return fmt.Errorf("failed to remove onion service for republishing: %w", err)
+		}
+		if err := publishOnion(svc.OnionService, svc.conf, tt.pow, keys); err != nil {
+			if restoreErr := publishOnion(svc.OnionService, svc.conf, tt.pow, previousKeys); restoreErr != nil {
+				log.Printf("Failed to restore onion service %s: %v", svc.ID, restoreErr)
+			}
+			tt.restoreClients(previous, previousKeys, republished)
+			return err
+		}
+		republished = append(republished, svc)
+	}
+	return nil
+}
+
+// restoreClients puts back the grants of a failed updateClients: the
+// previous clients in the file, and their keys on the services already
+// republished. Failures are logged, as the update's error is reported.
+func (tt *torTransport) restoreClients(previous []OnionClient, keys []string, republished []torService) {
+	if err := writeOnionClients(tt.clientsFile, previous); err != nil {
+		log.Printf("Failed to restore onion clients file %s: %v", tt.clientsFile, err)
+	}
+	for _, svc := range republished {
+		if err := svc.Tor.Control.DelOnion(svc.ID); err != nil {
+			log.Printf("Failed to restore onion service %s: %v", svc.ID, err)
+			continue
+		}
+		if err := publishOnion(svc.OnionService, svc.conf, tt.pow, keys); err != nil {
+			log.Printf("Failed to restore onion service %s: %v", svc.ID, err)
+		}
+	}
+}
+
+func (tt *torTransport) ListenTLS(ctx context.Context) (net.Listener, error) {
+	cert, err := withKeyDir(tt.keyDir, func() (tls.Certificate, error) {
+		return hiddenKeys(ctx, tt.onion.TLSKeys, func() (string, error) { return onionHost(tt.onion) })
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load onion TLS keys: %w", err)
+	}
+	listener, err := tt.Listen(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(listener, hiddenTLSConfig(ctx, cert)), nil
+}
+
+// Close removes the transport's onion services; the Tor itself is closed
+// with the Mirror.
+func (tt *torTransport) Close() error {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	var firstErr error
+	for _, svc := range tt.services {
+		if err := svc.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	tt.services = nil
+	return firstErr
+}
+
+func (tt *torTransport) Address() string { return tt.addr }
@@ -0,0 +1,131 @@
+package mirror
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeTorControl serves a Tor control port with null authentication whose
+// bootstrap phase advances through phases, one per GETINFO.
+func fakeTorControl(t *testing.T, phases ...string) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch {
+			case strings.HasPrefix(line, "PROTOCOLINFO"):
+				fmt.Fprint(conn, "250-PROTOCOLINFO 1\r\n250-AUTH METHODS=NULL\r\n250-VERSION Tor=\"0.4.8.0\"\r\n250 OK\r\n")
+			case strings.HasPrefix(line, "GETINFO status/bootstrap-phase"):
+				phase := phases[0]
+				if len(phases) > 1 {
+					phases = phases[1:]
+				}
+				fmt.Fprintf(conn, "250-status/bootstrap-phase=%s\r\n250 OK\r\n", phase)
+			default:
+				fmt.Fprint(conn, "250 OK\r\n")
+			}
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// TestStartTorSystem verifies attaching to a reachable system Tor and
+// reporting its bootstrap progress.
+func TestStartTorSystem(t *testing.T) {
+	defer func(poll time.Duration) { torBootstrapPoll = poll }(torBootstrapPoll)
+	torBootstrapPoll = time.Millisecond
+
+	addr := fakeTorControl(t,
+		`NOTICE BOOTSTRAP PROGRESS=50 TAG=loading_descriptors SUMMARY="Loading relay descriptors"`,
+		`NOTICE BOOTSTRAP PROGRESS=50 TAG=loading_descriptors SUMMARY="Loading relay descriptors"`,
+		`NOTICE BOOTSTRAP PROGRESS=100 TAG=done SUMMARY="Done"`,
+	)
+
+	var reports []TorBootstrap
+	tor, err := startTor(context.Background(), TorConfig{
+		ControlAddr: addr,
+		OnBootstrap: func(b TorBootstrap) { reports = append(reports, b) },
+	})
+	if err != nil {
+		t.Fatalf("startTor failed: %v", err)
+	}
+	defer tor.Close()
+
+	if tor.Process != nil {
+		t.Error("Expected no process to be launched for a system Tor")
+	}
+	if len(reports) != 2 || reports[0].Progress != 50 || reports[1].Progress != 100 {
+		t.Fatalf("Expected progress 50 then 100, got %+v", reports)
+	}
+	if reports[0].Summary != "Loading relay descriptors" || reports[1].Launched {
+		t.Errorf("Unexpected report %+v", reports[0])
+	}
+}
+
+// TestParseBootstrapPhase verifies parsing of bootstrap warnings.
+func TestParseBootstrapPhase(t *testing.T) {
+	b := parseBootstrapPhase(`WARN BOOTSTRAP PROGRESS=10 TAG=conn SUMMARY="Connecting to a relay" WARNING="Connection refused"`)
+	if b.Progress != 10 || b.Summary != "Connecting to a relay" || b.Warning != "Connection refused" {
+		t.Errorf("Unexpected bootstrap status %+v", b)
+	}
+}
+
+// TestServiceTor verifies that services selecting another Tor than
+// MirrorConfig.Tor get their own, shared only with services selecting the
+// same one, and that Close detaches all of them.
+func TestServiceTor(t *testing.T) {
+	done := `NOTICE BOOTSTRAP PROGRESS=100 TAG=done SUMMARY="Done"`
+	own := fakeTorControl(t, done)
+	other := fakeTorControl(t, done)
+	ml := &Mirror{config: &MirrorConfig{Tor: &TorConfig{ControlAddr: own}}}
+	ctx := context.Background()
+
+	mirrorTor, err := ml.torFor(nil)(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	same, err := ml.torFor(&TorConfig{ControlAddr: own})(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same != mirrorTor {
+		t.Error("A service selecting the Mirror's Tor got another one")
+	}
+	first, err := ml.torFor(&TorConfig{ControlAddr: other})(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := ml.torFor(&TorConfig{ControlAddr: other})(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == mirrorTor || first != second {
+		t.Error("Services selecting another Tor do not get one apart from the Mirror's, shared between them")
+	}
+
+	if closers := ml.detachTor(); len(closers) != 2 {
+		t.Errorf("Detached %d Tors, want 2", len(closers))
+	} else {
+		closeTransports(ctx, closers)
+	}
+}
@@ -0,0 +1,105 @@
+package mirror
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/cretz/bine/control"
+)
+
+// PluggableTransport is a pluggable transport client, such as lyrebird for
+// obfs4 or snowflake-client, that a launched Tor runs to reach its bridges.
+type PluggableTransport struct {
+	// Transports are the names of the transports the client provides, such
+	// as "obfs4" or "snowflake", as they appear at the start of bridge
+	// lines.
+	Transports []string
+	// ExePath is the client executable, for example /usr/bin/lyrebird.
+	ExePath string
+	// Args are passed to the client; Tor cannot pass arguments containing
+	// spaces.
+	Args []string
+}
+
+// line returns the value of the ClientTransportPlugin option running pt.
+func (pt PluggableTransport) line() string {
+	return strings.Join(append([]string{strings.Join(pt.Transports, ","), "exec", pt.ExePath}, pt.Args...), " ")
+}
+
+// validate checks that pt can be written as a ClientTransportPlugin line.
+func (pt PluggableTransport) validate() error {
+	if len(pt.Transports) == 0 {
+		return fmt.Errorf("pluggable transport %s provides no transports", pt.ExePath)
+	}
+	if pt.ExePath == "" {
+		return fmt.Errorf("pluggable transport %s has no ExePath", strings.Join(pt.Transports, ","))
+	}
+	for _, name := range pt.Transports {
+		if name == "" || strings.ContainsAny(name, ", \t\r\n") {
+			return fmt.Errorf("pluggable transport %s: invalid transport name %q", pt.ExePath, name)
+		}
+	}
+	for _, field := range append([]string{pt.ExePath}, pt.Args...) {
+		if strings.ContainsAny(field, " \t\r\n") {
+			return fmt.Errorf("pluggable transport %s: %q contains spaces", pt.ExePath, field)
+		}
+	}
+	return nil
+}
+
+// bridgeTransport returns the pluggable transport a bridge line uses, or ""
+// for a plain bridge, whose line starts with its address.
+func bridgeTransport(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return ""
+	}
+	if _, _, err := net.SplitHostPort(fields[0]); err == nil {
+		return ""
+	}
+	return fields[0]
+}
+
+// validateBridges checks the bridge lines and pluggable transports of c,
+// that every bridge's transport is provided by one of them, and that they
+// are not set for a system Tor, which would silently keep its own.
+func (c TorConfig) validateBridges() error {
+	if (len(c.Bridges) > 0 || len(c.PluggableTransports) > 0) && c.ControlAddr != "" && c.ControlAddr != "-" {
+		return fmt.Errorf("Tor bridges cannot be applied to the system Tor at %s; leave ControlAddr empty or set it to \"-\" to launch Tor", c.ControlAddr)
+	}
+	provided := make(map[string]bool)
+	for _, pt := range c.PluggableTransports {
+		if err := pt.validate(); err != nil {
+			return err
+		}
+		for _, name := range pt.Transports {
+			provided[name] = true
+		}
+	}
+	for _, line := range c.Bridges {
+		if strings.TrimSpace(line) == "" || strings.ContainsAny(line, "\r\n") {
+			return fmt.Errorf("invalid bridge line %q", line)
+		}
+		if transport := bridgeTransport(strings.TrimSpace(line)); transport != "" && !provided[transport] {
+			return fmt.Errorf("bridge %q uses transport %s, which no PluggableTransport provides", line, transport)
+		}
+	}
+	return nil
+}
+
+// bridgeConf returns the options making a Tor reach the network through the
+// bridges of c, or nil if c has none.
+func (c TorConfig) bridgeConf() []*control.KeyVal {
+	if len(c.Bridges) == 0 {
+		return nil
+	}
+	conf := control.KeyVals("UseBridges", "1")
+	for _, pt := range c.PluggableTransports {
+		conf = append(conf, control.NewKeyVal("ClientTransportPlugin", pt.line()))
+	}
+	for _, line := range c.Bridges {
+		conf = append(conf, control.NewKeyVal("Bridge", strings.TrimSpace(line)))
+	}
+	return conf
+}
@@ -0,0 +1,62 @@
+package mirror
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+const testObfs4Bridge = "obfs4 192.0.2.1:443 0123456789ABCDEF0123456789ABCDEF01234567 cert=AAAA iat-mode=0"
+
+// TestBridgeConf verifies the options that make a launched Tor use bridges.
+func TestBridgeConf(t *testing.T) {
+	if conf := (TorConfig{}).bridgeConf(); conf != nil {
+		t.Errorf("Options %v without bridges", conf)
+	}
+
+	cfg := TorConfig{
+		Bridges: []string{testObfs4Bridge, " 192.0.2.2:9001 "},
+		PluggableTransports: []PluggableTransport{
+			{Transports: []string{"obfs4", "meek_lite"}, ExePath: "/usr/bin/lyrebird", Args: []string{"-enableLogging"}},
+		},
+	}
+	if err := cfg.validateBridges(); err != nil {
+		t.Fatalf("validateBridges failed: %v", err)
+	}
+	var got []string
+	for _, kv := range cfg.bridgeConf() {
+		got = append(got, kv.Key+"="+kv.Val)
+	}
+	want := []string{
+		"UseBridges=1",
+		"ClientTransportPlugin=obfs4,meek_lite exec /usr/bin/lyrebird -enableLogging",
+		"Bridge=" + testObfs4Bridge,
+		"Bridge=192.0.2.2:9001",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Options\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// TestValidateBridges verifies that bridges Tor could not use are refused.
+func TestValidateBridges(t *testing.T) {
+	lyrebird := PluggableTransport{Transports: []string{"obfs4"}, ExePath: "/usr/bin/lyrebird"}
+	for name, cfg := range map[string]TorConfig{
+		"no transport":   {Bridges: []string{testObfs4Bridge}},
+		"other":          {Bridges: []string{"snowflake 192.0.2.3:80 2B280B23E1107BB62ABFC40DDCC8824814F80A72"}, PluggableTransports: []PluggableTransport{lyrebird}},
+		"empty line":     {Bridges: []string{" "}},
+		"newline":        {Bridges: []string{"192.0.2.2:9001\nControlPort 9051"}},
+		"no exe":         {PluggableTransports: []PluggableTransport{{Transports: []string{"obfs4"}}}},
+		"no names":       {PluggableTransports: []PluggableTransport{{ExePath: "/usr/bin/lyrebird"}}},
+		"name comma":     {PluggableTransports: []PluggableTransport{{Transports: []string{"obfs4,x"}, ExePath: "/usr/bin/lyrebird"}}},
+		"system tor":     {ControlAddr: "127.0.0.1:9051", Bridges: []string{"192.0.2.2:9001"}},
+		"argument space": {PluggableTransports: []PluggableTransport{{Transports: []string{"obfs4"}, ExePath: "/usr/bin/lyrebird", Args: []string{"-log file"}}}},
+	} {
+		if err := cfg.validateBridges(); err == nil {
+			t.Errorf("%s: bridges accepted", name)
+		}
+	}
+	if _, err := startTor(context.Background(), TorConfig{ControlAddr: "-", Bridges: []string{testObfs4Bridge}}); err == nil {
+		t.Error("startTor launched Tor with a bridge it cannot use")
+	}
+}
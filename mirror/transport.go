@@ -0,0 +1,432 @@
+package mirror
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/go-i2p/onramp"
+)
+
+// TransportProvider publishes a service on an anonymity or overlay network.
+// A Mirror creates one provider per service port, calls Setup once, and then
+// Listen or ListenTLS depending on the service's HiddenTLS policy.
+type TransportProvider interface {
+	// Name returns the transport name used in Status, Stats, and listener IDs.
+	Name() string
+	// Setup creates the network session; keyName identifies the service and
+	// should select its persistent keys so the address is stable.
+	Setup(ctx context.Context, keyName string) error
+	// Listen returns a plaintext listener on the transport.
+	Listen(ctx context.Context) (net.Listener, error)
+	// ListenTLS returns a listener whose connections are TLS-wrapped.
+	ListenTLS(ctx context.Context) (net.Listener, error)
+	// Close tears down the session and every listener created from it.
+	Close() error
+	// Address returns the published address of the service, or "" if it is
+	// not known yet.
+	Address() string
+}
+
+// PacketTransport is implemented by transports that can also publish a
+// service as datagrams, such as the built-in I2P transport.
+type PacketTransport interface {
+	// ListenPacket returns a datagram session on the transport's address.
+	ListenPacket(ctx context.Context) (net.PacketConn, error)
+}
+
+// TransportFactory returns a new, not yet set up, TransportProvider.
+type TransportFactory func() TransportProvider
+
+var transportRegistry struct {
+	sync.RWMutex
+	factories map[string]TransportFactory
+	names     []string
+}
+
+// RegisterTransport makes a transport available to every Mirror created
+// afterwards. It is meant to be called from the init function of the package
+// implementing the transport, and panics if name is already registered or
+// factory is nil. A registered transport can be turned off at runtime with
+// the DISABLE_<NAME> environment variable, like DISABLE_TOR and DISABLE_I2P.
+func RegisterTransport(name string, factory TransportFactory) {
+	transportRegistry.Lock()
+	defer transportRegistry.Unlock()
+
+	if factory == nil {
+		panic("mirror: RegisterTransport factory is nil")
+	}
+	if _, dup := transportRegistry.factories[name]; dup {
+		panic("mirror: RegisterTransport called twice for transport " + name)
+	}
+	if transportRegistry.factories == nil {
+		transportRegistry.factories = make(map[string]TransportFactory)
+	}
+	transportRegistry.factories[name] = factory
+	transportRegistry.names = append(transportRegistry.names, name)
+}
+
+// Transports returns the names of the registered transports in registration
+// order, beginning with the built-in TransportOnion and TransportGarlic.
+func Transports() []string {
+	transportRegistry.RLock()
+	defer transportRegistry.RUnlock()
+
+	return append([]string(nil), transportRegistry.names...)
+}
+
+// transportFactory returns the factory registered for name.
+func transportFactory(name string) (TransportFactory, bool) {
+	transportRegistry.RLock()
+	defer transportRegistry.RUnlock()
+
+	factory, ok := transportRegistry.factories[name]
+	return factory, ok
+}
+
+// enabledTransports returns the registered transports not disabled through
+// the environment.
+func enabledTransports() []string {
+	var names []string
+	for _, name := range Transports() {
+		if !transportDisabled(name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// transportDisabled reports whether the environment turns transport name off.
+func transportDisabled(name string) bool {
+	switch name {
+	case TransportOnion:
+		return DisableTor()
+	case TransportGarlic:
+		return DisableI2P()
+	}
+	key := "DISABLE_" + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(name))
+	val := os.Getenv(key)
+	if val == "1" || strings.ToLower(val) == "true" {
+		log.Printf("Transport %s is disabled by environment variable %s\n", name, key)
+		return true
+	}
+	return false
+}
+
+func init() {
+	RegisterTransport(TransportOnion, func() TransportProvider { return &onionTransport{} })
+	RegisterTransport(TransportGarlic, func() TransportProvider { return &garlicTransport{} })
+}
+
+// onionTransport publishes services as Tor onion services through onramp.
+type onionTransport struct {
+	onion  *onramp.Onion
+	addr   string
+	keyDir string
+}
+
+func (ot *onionTransport) Name() string { return TransportOnion }
+
+func (ot *onionTransport) Setup(ctx context.Context, keyName string) error {
+	onion, err := newOnion(ctx, keyName)
+	if err != nil {
+		return err
+	}
+	ot.onion = onion
+	return nil
+}
+
+func (ot *onionTransport) Listen(ctx context.Context) (net.Listener, error) {
+	return ot.track(listenContext(ctx, func() (net.Listener, error) {
+		if _, err := withKeyDir(ot.keyDir, func() (struct{}, error) { return struct{}{}, ot.configure(ctx) }); err != nil {
+			return nil, err
+		}
+		return ot.onion.Listen()
+	}))
+}
+
+func (ot *onionTransport) ListenTLS(ctx context.Context) (net.Listener, error) {
+	return ot.track(listenContext(ctx, func() (net.Listener, error) {
+		cert, err := withKeyDir(ot.keyDir, func() (tls.Certificate, error) {
+			if err := ot.configure(ctx); err != nil {
+				return tls.Certificate{}, err
+			}
+			return hiddenKeys(ctx, ot.onion.TLSKeys, func() (string, error) { return onionHost(ot.onion) })
+		})
+		if err != nil {
+			return nil, err
+		}
+		listener, err := ot.onion.Listen()
+		if err != nil {
+			return nil, err
+		}
+		return tls.NewListener(listener, hiddenTLSConfig(ctx, cert)), nil
+	}))
+}
+
+// configure applies the OnionOptions of ctx to the next onion service of
+// the session, loading its keys so publishing it does not read the
+// keystore again. It must run in the session's key directory.
+func (ot *onionTransport) configure(ctx context.Context) error {
+	if options := OnionOptionsFromContext(ctx); options != nil && options.ClientAuth {
+		return fmt.Errorf("onion client authorization needs a Tor managed with MirrorConfig.Tor or ServiceConfig.Tor")
+	}
+	keys, err := ot.onion.Keys()
+	if err != nil {
+		return err
+	}
+	ot.onion.ListenConf = OnionOptionsFromContext(ctx).listenConf(keys)
+	return nil
+}
+
+func (ot *onionTransport) track(listener net.Listener, err error) (net.Listener, error) {
+	if err == nil {
+		ot.addr = listener.Addr().String()
+	}
+	return listener, err
+}
+
+func (ot *onionTransport) Close() error { return ot.onion.Close() }
+
+func (ot *onionTransport) Address() string { return ot.addr }
+
+// garlicTransport publishes services as I2P tunnels through onramp.
+type garlicTransport struct {
+	garlic *onramp.Garlic
+	addr   string
+	keyDir string
+	// samAddr is the SAM bridge Setup connects to; empty uses the default
+	samAddr string
+	// keyName is the name Setup was called with, so the session can be
+	// re-created with the same keys on another SAM bridge
+	keyName string
+}
+
+func (gt *garlicTransport) Name() string { return TransportGarlic }
+
+func (gt *garlicTransport) Setup(ctx context.Context, keyName string) error {
+	garlic, err := newGarlic(ctx, keyName, gt.keyDir, gt.samAddr)
+	if err != nil {
+		return err
+	}
+	gt.garlic = garlic
+	gt.keyName = keyName
+	return nil
+}
+
+// Listen and ListenTLS run in the key directory throughout, since onramp
+// reads the keys while it creates the session on the SAM bridge; calls for
+// services sharing the directory still run concurrently.
+func (gt *garlicTransport) Listen(ctx context.Context) (net.Listener, error) {
+	return gt.track(listenContext(ctx, func() (net.Listener, error) {
+		return withKeyDir(gt.keyDir, func() (net.Listener, error) { return gt.garlic.Listen() })
+	}))
+}
+
+func (gt *garlicTransport) ListenTLS(ctx context.Context) (net.Listener, error) {
+	return gt.track(listenContext(ctx, func() (net.Listener, error) {
+		return withKeyDir(gt.keyDir, func() (net.Listener, error) {
+			if !customTLS(ctx) {
+				return gt.garlic.ListenTLS()
+			}
+			keys := func() (tls.Certificate, error) {
+				return hiddenKeys(ctx, gt.garlic.TLSKeys, func() (string, error) { return garlicHost(gt.garlic) })
+			}
+			return listenTLSWithConfig(ctx, keys, gt.garlic.Listen)
+		})
+	}))
+}
+
+func (gt *garlicTransport) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	// A datagram session left by a replaced service is already closed;
+	// drop it so onramp creates a fresh one.
+	gt.garlic.DatagramSession = nil
+	return runContext(ctx, func() (net.PacketConn, error) {
+		return withKeyDir(gt.keyDir, gt.garlic.ListenPacket)
+	}, func(pc net.PacketConn) { pc.Close() })
+}
+
+func (gt *garlicTransport) track(listener net.Listener, err error) (net.Listener, error) {
+	if err == nil {
+		gt.addr = listener.Addr().String()
+	}
+	return listener, err
+}
+
+func (gt *garlicTransport) Close() error { return gt.garlic.Close() }
+
+func (gt *garlicTransport) Address() string { return gt.addr }
+
+// newOnion creates an onion manager, bounded by ctx.
+func newOnion(ctx context.Context, name string) (*onramp.Onion, error) {
+	return runContext(ctx, func() (*onramp.Onion, error) {
+		return onramp.NewOnion(name)
+	}, func(onion *onramp.Onion) { onion.Close() })
+}
+
+// newGarlic creates a garlic manager on the SAM bridge at samAddr, or the
+// default one if it is empty, with keys in keyDir, bounded by ctx.
+func newGarlic(ctx context.Context, name, keyDir, samAddr string) (*onramp.Garlic, error) {
+	if samAddr == "" {
+		samAddr = defaultSAMAddr
+	}
+	return runContext(ctx, func() (*onramp.Garlic, error) {
+		return withKeyDir(keyDir, func() (*onramp.Garlic, error) {
+			return onramp.NewGarlic(name, samAddr, onramp.OPT_WIDE)
+		})
+	}, func(garlic *onramp.Garlic) { garlic.Close() })
+}
+
+// Transport returns the provider of transport name for the service on port.
+func (ml *Mirror) Transport(port, name string) (TransportProvider, bool) {
+	ml.mu.RLock()
+	defer ml.mu.RUnlock()
+
+	provider, ok := ml.transports[port][name]
+	return provider, ok
+}
+
+// ensureTransport returns the provider of transport name for port, setting
+// it up if needed. The built-in transports adopt a session already present
+// in Onions or Garlics, record the sessions they create there, and keep
+// their keys in keyDir; onion services run on the Tor torCfg selects, or
+// MirrorConfig.Tor's if it is nil. ml.mu must be held.
+func (ml *Mirror) ensureTransport(ctx context.Context, port, name, keyName, keyDir string, torCfg *TorConfig) (TransportProvider, error) {
+	if provider, ok := ml.transports[port][name]; ok {
+		return provider, nil
+	}
+
+	var provider TransportProvider
+	switch {
+	case name == TransportOnion && ml.Onions[port] != nil:
+		provider = &onionTransport{onion: ml.Onions[port]}
+	case name == TransportGarlic && ml.Garlics[port] != nil:
+		provider = &garlicTransport{garlic: ml.Garlics[port]}
+	default:
+		factory, ok := transportFactory(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown transport %s", name)
+		}
+		log.Printf("Creating new %s session for port %s\n", name, port)
+		provider = factory()
+		switch p := provider.(type) {
+		case *onionTransport:
+			p.keyDir = keyDir
+			if torCfg == nil {
+				torCfg = ml.cfg().Tor
+			}
+			if torCfg != nil {
+				provider = &torTransport{tor: ml.torFor(torCfg), keyDir: keyDir, pow: torCfg.PoW}
+			}
+		case *garlicTransport:
+			p.keyDir = keyDir
+			p.samAddr = ml.samBridge(ctx)
+			if ml.cfg().SharedI2P {
+				provider = &sharedGarlicTransport{port: port, primary: ml.primarySession, keyDir: ml.cfg().KeyDir}
+			}
+		}
+		if err := provider.Setup(ctx, keyName); err != nil {
+			return nil, err
+		}
+		switch p := provider.(type) {
+		case *onionTransport:
+			if ml.Onions == nil {
+				ml.Onions = make(map[string]*onramp.Onion)
+			}
+			ml.Onions[port] = p.onion
+		case *garlicTransport:
+			if ml.Garlics == nil {
+				ml.Garlics = make(map[string]*onramp.Garlic)
+			}
+			ml.Garlics[port] = p.garlic
+		}
+	}
+
+	if ml.transports == nil {
+		ml.transports = make(map[string]map[string]TransportProvider)
+	}
+	if ml.transports[port] == nil {
+		ml.transports[port] = make(map[string]TransportProvider)
+	}
+	ml.transports[port][name] = provider
+	return provider, nil
+}
+
+// transportCloser closes one transport session.
+type transportCloser struct {
+	transport string
+	port      string
+	close     func() error
+}
+
+// detachTransports removes every transport session from the Mirror and
+// returns their closers. Sessions of the built-in transports are taken from
+// Onions and Garlics, which also hold the sessions callers placed there
+// directly. ml.mu must be held.
+func (ml *Mirror) detachTransports() []transportCloser {
+	var closers []transportCloser
+	for port, onion := range ml.Onions {
+		closers = append(closers, transportCloser{TransportOnion, port, onion.Close})
+	}
+	for port, garlic := range ml.Garlics {
+		closers = append(closers, transportCloser{TransportGarlic, port, garlic.Close})
+	}
+	for port, providers := range ml.transports {
+		for name, provider := range providers {
+			switch provider.(type) {
+			case *onionTransport, *garlicTransport:
+				continue
+			}
+			closers = append(closers, transportCloser{name, port, provider.Close})
+		}
+	}
+
+	// Clear the maps to prevent reuse of closed instances
+	ml.Onions = make(map[string]*onramp.Onion)
+	ml.Garlics = make(map[string]*onramp.Garlic)
+	ml.transports = make(map[string]map[string]TransportProvider)
+	return closers
+}
+
+// closeTransports closes the sessions of closers concurrently and waits for
+// them until ctx is done. Sessions still closing then are reported with
+// ctx.Err() and left to finish in the background.
+func closeTransports(ctx context.Context, closers []transportCloser) []CloseFailure {
+	done := make(chan int, len(closers))
+	errs := make([]error, len(closers))
+	for i, closer := range closers {
+		go func() {
+			errs[i] = closer.close()
+			done <- i
+		}()
+	}
+
+	var failures []CloseFailure
+	finished := make([]bool, len(closers))
+	for range closers {
+		select {
+		case i := <-done:
+			finished[i] = true
+			closer := closers[i]
+			if errs[i] != nil {
+				log.Printf("Error closing %s session for port %s: %v\n", closer.transport, closer.port, errs[i])
+				failures = append(failures, CloseFailure{closer.transport, closer.port, errs[i]})
+			} else {
+				log.Printf("%s session for port %s closed\n", closer.transport, closer.port)
+			}
+		case <-ctx.Done():
+			for i, closer := range closers {
+				if !finished[i] {
+					log.Printf("Gave up waiting for %s session for port %s to close: %v\n", closer.transport, closer.port, ctx.Err())
+					failures = append(failures, CloseFailure{closer.transport, closer.port, ctx.Err()})
+				}
+			}
+			return failures
+		}
+	}
+	return failures
+}
@@ -0,0 +1,122 @@
+package mirror
+
+import (
+	"context"
+	"net"
+	"os"
+	"slices"
+	"testing"
+)
+
+// loopbackTransport is a TransportProvider that listens on loopback TCP.
+type loopbackTransport struct {
+	keyName  string
+	listener net.Listener
+	closed   bool
+}
+
+func (lt *loopbackTransport) Name() string { return "loopback" }
+
+func (lt *loopbackTransport) Setup(ctx context.Context, keyName string) error {
+	lt.keyName = keyName
+	return nil
+}
+
+func (lt *loopbackTransport) Listen(ctx context.Context) (net.Listener, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	lt.listener = listener
+	return listener, err
+}
+
+func (lt *loopbackTransport) ListenTLS(ctx context.Context) (net.Listener, error) {
+	return lt.Listen(ctx)
+}
+
+func (lt *loopbackTransport) Close() error {
+	lt.closed = true
+	return lt.listener.Close()
+}
+
+func (lt *loopbackTransport) Address() string {
+	if lt.listener == nil {
+		return ""
+	}
+	return lt.listener.Addr().String()
+}
+
+// registerTestTransport registers a transport for the duration of the test.
+func registerTestTransport(t *testing.T, name string, factory TransportFactory) {
+	t.Helper()
+	RegisterTransport(name, factory)
+	t.Cleanup(func() {
+		transportRegistry.Lock()
+		defer transportRegistry.Unlock()
+		delete(transportRegistry.factories, name)
+		transportRegistry.names = slices.DeleteFunc(transportRegistry.names, func(n string) bool { return n == name })
+	})
+}
+
+// TestRegisteredTransport verifies that a third-party transport is set up
+// for each service, accepts connections, and is closed with the Mirror.
+func TestRegisteredTransport(t *testing.T) {
+	os.Setenv("DISABLE_TOR", "true")
+	os.Setenv("DISABLE_I2P", "true")
+	defer func() {
+		os.Unsetenv("DISABLE_TOR")
+		os.Unsetenv("DISABLE_I2P")
+	}()
+
+	provider := &loopbackTransport{}
+	registerTestTransport(t, "loopback", func() TransportProvider { return provider })
+
+	cfg := DefaultMirrorConfig()
+	cfg.EnableLocalTCP = false
+	mirror, err := NewMirrorWithConfig(context.Background(), "test-transport:3015", cfg)
+	if err != nil {
+		t.Fatalf("Failed to create mirror: %v", err)
+	}
+
+	listener, err := mirror.AddService("3015", ServiceConfig{HiddenTLS: HiddenTLSOff})
+	if err != nil {
+		t.Fatalf("AddService failed: %v", err)
+	}
+	defer listener.Close()
+
+	if got, ok := mirror.Transport("3015", "loopback"); !ok || got != provider {
+		t.Fatalf("Expected the registered provider for port 3015, got %v", got)
+	}
+	if provider.keyName != "metalistener-test-transport:3015" {
+		t.Errorf("Unexpected key name %q", provider.keyName)
+	}
+
+	conn, err := net.Dial("tcp", provider.Address())
+	if err != nil {
+		t.Fatalf("Failed to dial transport: %v", err)
+	}
+	defer conn.Close()
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	accepted.Close()
+
+	if status := mirror.Status()[statusKey("loopback", "3015")]; status.State != TransportUp {
+		t.Errorf("Expected loopback transport up, got %s", status.State)
+	}
+
+	mirror.Close()
+	if !provider.closed {
+		t.Error("Expected the transport to be closed with the mirror")
+	}
+}
+
+// TestTransportDisabledByEnvironment verifies the generic DISABLE_<NAME> switch.
+func TestTransportDisabledByEnvironment(t *testing.T) {
+	t.Setenv("DISABLE_MY_NET", "1")
+	if !transportDisabled("my-net") {
+		t.Error("Expected my-net to be disabled by DISABLE_MY_NET")
+	}
+	if transportDisabled("other") {
+		t.Error("Expected other to be enabled")
+	}
+}
@@ -0,0 +1,264 @@
+package meta
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// namespaceSeparator joins a namespace's name and the IDs of its listeners
+// into the IDs they have in the MetaListener.
+const namespaceSeparator = "/"
+
+// Namespace is a tenant of a MetaListener: a group of listeners whose
+// connections are returned only by the namespace's own Accept, with its own
+// stats, connection limit and Close, so one process can front many
+// applications without one seeing or starving another's clients.
+// Namespace implements net.Listener.
+//
+// In the MetaListener, the listeners of a namespace have IDs of the form
+// "name/id", and count towards its Stats; its Accept never returns their
+// connections.
+type Namespace struct {
+	name string
+	ml   *MetaListener
+
+	connCh    chan ConnResult
+	closeCh   chan struct{}
+	closeOnce sync.Once
+
+	accepted  atomic.Uint64
+	dropped   atomic.Uint64
+	refused   atomic.Uint64
+	active    atomic.Int64
+	connLimit atomic.Int64
+}
+
+var _ net.Listener = &Namespace{}
+
+// Namespace returns the namespace called name, creating it if it does not
+// exist. name must not be empty or contain a slash.
+func (ml *MetaListener) Namespace(name string) (*Namespace, error) {
+	if name == "" || strings.Contains(name, namespaceSeparator) {
+		return nil, fmt.Errorf("invalid namespace name %q", name)
+	}
+
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	if atomic.LoadInt64(&ml.isClosed) != 0 {
+		return nil, ErrListenerClosed
+	}
+	if ns, ok := ml.namespaces[name]; ok {
+		return ns, nil
+	}
+	ns := &Namespace{
+		name:    name,
+		ml:      ml,
+		connCh:  make(chan ConnResult, 100),
+		closeCh: make(chan struct{}),
+	}
+	if ml.namespaces == nil {
+		ml.namespaces = make(map[string]*Namespace)
+	}
+	ml.namespaces[name] = ns
+	return ns, nil
+}
+
+// ownCount returns the number of listeners whose connections the
+// MetaListener's Accept returns, those not added through a Namespace.
+func (ml *MetaListener) ownCount() int {
+	ml.mu.RLock()
+	defer ml.mu.RUnlock()
+
+	count := 0
+	for id := range ml.listeners {
+		if name, _, ok := strings.Cut(id, namespaceSeparator); !ok || ml.namespaces[name] == nil {
+			count++
+		}
+	}
+	return count
+}
+
+// Name returns the name of the namespace.
+func (ns *Namespace) Name() string {
+	return ns.name
+}
+
+// fullID returns the ID in the MetaListener of the namespace's listener id.
+func (ns *Namespace) fullID(id string) string {
+	return ns.name + namespaceSeparator + id
+}
+
+// AddListener adds a listener to the namespace with the specified ID,
+// which only needs to be unique within the namespace.
+func (ns *Namespace) AddListener(id string, listener net.Listener) error {
+	return ns.ml.addListener(ns.fullID(id), listener, ns)
+}
+
+// RemoveListener stops and removes the namespace's listener with the
+// specified ID.
+func (ns *Namespace) RemoveListener(id string) error {
+	return ns.ml.RemoveListener(ns.fullID(id))
+}
+
+// RemoveListenersMatching stops and removes the namespace's listeners whose
+// IDs, as given to AddListener, match accepts.
+func (ns *Namespace) RemoveListenersMatching(match func(id string) bool) error {
+	prefix := ns.fullID("")
+	return ns.ml.RemoveListenersMatching(func(id string) bool {
+		local, ok := strings.CutPrefix(id, prefix)
+		return ok && match(local)
+	})
+}
+
+// ListenerIDs returns the IDs of the namespace's listeners.
+func (ns *Namespace) ListenerIDs() []string {
+	prefix := ns.fullID("")
+	var ids []string
+	for _, id := range ns.ml.ListenerIDs() {
+		if local, ok := strings.CutPrefix(id, prefix); ok {
+			ids = append(ids, local)
+		}
+	}
+	return ids
+}
+
+// Count returns the number of the namespace's listeners.
+func (ns *Namespace) Count() int {
+	return len(ns.ListenerIDs())
+}
+
+// SetConnLimit caps the connections of the namespace open at once: past
+// it, new connections are closed as soon as they are accepted, so a busy
+// tenant cannot exhaust the process. Zero or less removes the limit.
+func (ns *Namespace) SetConnLimit(limit int) {
+	ns.connLimit.Store(int64(limit))
+}
+
+// Active returns the number of the namespace's connections accepted and
+// not closed yet, including those waiting for Accept.
+func (ns *Namespace) Active() int {
+	return int(ns.active.Load())
+}
+
+// Stats returns the namespace's current counters.
+func (ns *Namespace) Stats() Stats {
+	return Stats{
+		Listeners: ns.Count(),
+		Accepted:  ns.accepted.Load(),
+		Dropped:   ns.dropped.Load(),
+		Queued:    len(ns.connCh),
+		Refused:   ns.refused.Load(),
+	}
+}
+
+// Accept returns the next connection from one of the namespace's
+// listeners.
+func (ns *Namespace) Accept() (net.Conn, error) {
+	select {
+	case result := <-ns.connCh:
+		return result, nil
+	case <-ns.closeCh:
+		return nil, ErrListenerClosed
+	case <-ns.ml.closeCh:
+		return nil, ErrListenerClosed
+	}
+}
+
+// Addr returns a MetaAddr of the namespace's listeners.
+func (ns *Namespace) Addr() net.Addr {
+	prefix := ns.fullID("")
+	ns.ml.mu.RLock()
+	defer ns.ml.mu.RUnlock()
+
+	var addresses []net.Addr
+	for id, listener := range ns.ml.listeners {
+		if strings.HasPrefix(id, prefix) {
+			addresses = append(addresses, listener.Addr())
+		}
+	}
+	return &MetaAddr{addresses: addresses}
+}
+
+// Close closes the namespace's listeners and the connections waiting for
+// its Accept, and removes it from the MetaListener. Connections already
+// returned by Accept and the other namespaces are unaffected.
+func (ns *Namespace) Close() error {
+	var errs []error
+	ns.closeOnce.Do(func() {
+		close(ns.closeCh)
+
+		prefix := ns.fullID("")
+		ns.ml.mu.Lock()
+		if ns.ml.namespaces[ns.name] == ns {
+			delete(ns.ml.namespaces, ns.name)
+		}
+		if err := ns.ml.removeListenersLocked(func(id string) bool { return strings.HasPrefix(id, prefix) }); err != nil {
+			errs = append(errs, err)
+		}
+		ns.ml.mu.Unlock()
+
+		for drained := false; !drained; {
+			select {
+			case result := <-ns.connCh:
+				ns.drop(result)
+			default:
+				drained = true
+			}
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// isClosed reports whether Close was called.
+func (ns *Namespace) isClosed() bool {
+	select {
+	case <-ns.closeCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// forwardConnection hands conn, accepted by the namespace's listener id,
+// to its Accept, unless the namespace is at its connection limit.
+func (ns *Namespace) forwardConnection(ctx context.Context, id string, conn net.Conn) {
+	if limit := ns.connLimit.Load(); limit > 0 && ns.active.Load() >= limit {
+		log.Printf("Namespace %s is at its limit of %d connections, closing connection from %s", ns.name, limit, conn.RemoteAddr())
+		ns.drop(conn)
+		return
+	}
+	ns.active.Add(1)
+	result := ConnResult{
+		Conn:    conn,
+		src:     strings.TrimPrefix(id, ns.fullID("")),
+		ctx:     ctx,
+		release: &connRelease{fn: func() { ns.active.Add(-1) }},
+	}
+
+	select {
+	case ns.connCh <- result:
+		ns.accepted.Add(1)
+		ns.ml.accepted.Add(1)
+	case <-ns.closeCh:
+		ns.drop(result)
+	case <-ns.ml.closeCh:
+		ns.drop(result)
+	case <-time.After(5 * time.Second):
+		log.Printf("WARNING: Connection forwarding to namespace %s timed out, closing connection from %s", ns.name, conn.RemoteAddr())
+		ns.drop(result)
+	}
+}
+
+// drop closes conn, counting it as dropped by the namespace and the
+// MetaListener.
+func (ns *Namespace) drop(conn net.Conn) {
+	ns.dropped.Add(1)
+	ns.ml.dropped.Add(1)
+	conn.Close()
+}
@@ -0,0 +1,203 @@
+package meta
+
+import (
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// acceptWithin returns the next connection of l, or nil after timeout.
+func acceptWithin(t *testing.T, l net.Listener, timeout time.Duration) net.Conn {
+	t.Helper()
+	result := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		result <- conn
+	}()
+	select {
+	case conn := <-result:
+		return conn
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+// TestNamespaceIsolation verifies that each namespace only accepts the
+// connections of its own listeners, under IDs local to it.
+func TestNamespaceIsolation(t *testing.T) {
+	ml := NewMetaListener()
+	defer ml.Close()
+	alpha, err := ml.Namespace("alpha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	beta, _ := ml.Namespace("beta")
+	if again, _ := ml.Namespace("alpha"); again != alpha {
+		t.Error("Namespace returned a new namespace for an existing name")
+	}
+	if _, err := ml.Namespace("a/b"); err == nil {
+		t.Error("Namespace accepted a name with a slash")
+	}
+
+	alphaListener, betaListener := newMockListener("alpha"), newMockListener("beta")
+	if err := alpha.AddListener("tcp", alphaListener); err != nil {
+		t.Fatal(err)
+	}
+	if err := beta.AddListener("tcp", betaListener); err != nil {
+		t.Fatalf("Same ID in another namespace: %v", err)
+	}
+	ids := ml.ListenerIDs()
+	slices.Sort(ids)
+	if !slices.Equal(ids, []string{"alpha/tcp", "beta/tcp"}) {
+		t.Errorf("MetaListener IDs = %v", ids)
+	}
+	if ids := alpha.ListenerIDs(); !slices.Equal(ids, []string{"tcp"}) {
+		t.Errorf("alpha IDs = %v", ids)
+	}
+
+	server, client := net.Pipe()
+	defer client.Close()
+	alphaListener.connCh <- server
+	conn := acceptWithin(t, alpha, 5*time.Second)
+	if conn == nil {
+		t.Fatal("alpha did not accept its connection")
+	}
+	if len(beta.connCh) != 0 || len(ml.connCh) != 0 {
+		t.Error("Connection of alpha queued for beta or the MetaListener")
+	}
+	if src := conn.(ConnResult).Source(); src != "tcp" {
+		t.Errorf("Source = %q, want tcp", src)
+	}
+	conn.Close()
+
+	if got := alpha.Stats(); got != (Stats{Listeners: 1, Accepted: 1}) {
+		t.Errorf("alpha Stats = %+v", got)
+	}
+	if got := beta.Stats(); got != (Stats{Listeners: 1}) {
+		t.Errorf("beta Stats = %+v", got)
+	}
+	if got := ml.Stats(); got != (Stats{Listeners: 2, Accepted: 1}) {
+		t.Errorf("MetaListener Stats = %+v", got)
+	}
+
+	// Closing a namespace leaves the others serving
+	if err := alpha.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	if _, err := alpha.Accept(); err == nil {
+		t.Error("Accept succeeded on a closed namespace")
+	}
+	if err := alpha.AddListener("late", newMockListener("late")); err == nil {
+		t.Error("AddListener succeeded on a closed namespace")
+	}
+	if ids := ml.ListenerIDs(); !slices.Equal(ids, []string{"beta/tcp"}) {
+		t.Errorf("IDs after closing alpha = %v", ids)
+	}
+	server, client = net.Pipe()
+	defer client.Close()
+	betaListener.connCh <- server
+	if conn := acceptWithin(t, beta, 5*time.Second); conn == nil {
+		t.Error("beta stopped accepting after alpha was closed")
+	} else {
+		conn.Close()
+	}
+}
+
+// TestNamespaceConnLimit verifies that connections past the limit are
+// dropped until an open one is closed.
+func TestNamespaceConnLimit(t *testing.T) {
+	ml := NewMetaListener()
+	defer ml.Close()
+	ns, _ := ml.Namespace("limited")
+	ns.SetConnLimit(1)
+	listener := newMockListener("limited")
+	if err := ns.AddListener("tcp", listener); err != nil {
+		t.Fatal(err)
+	}
+
+	send := func() net.Conn {
+		server, client := net.Pipe()
+		t.Cleanup(func() { client.Close() })
+		listener.connCh <- server
+		return client
+	}
+	send()
+	first := acceptWithin(t, ns, 5*time.Second)
+	if first == nil {
+		t.Fatal("First connection not accepted")
+	}
+	if ns.Active() != 1 {
+		t.Errorf("Active = %d, want 1", ns.Active())
+	}
+
+	over := send()
+	over.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := over.Read(make([]byte, 1)); err == nil {
+		t.Error("Connection over the limit was not closed")
+	}
+	if got := ns.Stats().Dropped; got != 1 {
+		t.Errorf("Dropped = %d, want 1", got)
+	}
+
+	first.Close()
+	first.Close()
+	if ns.Active() != 0 {
+		t.Errorf("Active = %d after Close, want 0", ns.Active())
+	}
+	send()
+	if conn := acceptWithin(t, ns, 5*time.Second); conn == nil {
+		t.Error("Connection not accepted after a slot was freed")
+	} else {
+		conn.Close()
+	}
+}
+
+// TestNamespaceNoListenersTimeout verifies that the listeners of a
+// namespace do not keep the MetaListener's Accept from reporting
+// ErrNoListeners, since it never returns their connections.
+func TestNamespaceNoListenersTimeout(t *testing.T) {
+	ml := NewMetaListener()
+	defer ml.Close()
+	tenant, err := ml.Namespace("tenant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tenant.AddListener("tcp", newMockListener("tenant")); err != nil {
+		t.Fatal(err)
+	}
+
+	ml.SetNoListenersTimeout(0)
+	if _, err := ml.Accept(); err == nil || err.Error() != ErrNoListeners.Error() {
+		t.Errorf("Accept with only namespace listeners returned %v, want ErrNoListeners", err)
+	}
+
+	ml.SetNoListenersTimeout(50 * time.Millisecond)
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := ml.Accept()
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		if err == nil || err.Error() != ErrNoListeners.Error() {
+			t.Errorf("Accept with only namespace listeners returned %v, want ErrNoListeners", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept still blocked with only namespace listeners")
+	}
+
+	// A listener of the MetaListener's own keeps Accept waiting
+	if err := ml.AddListener("own", newMockListener("own")); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_, err := ml.Accept()
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		t.Errorf("Accept with a listener of its own returned %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
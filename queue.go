@@ -0,0 +1,117 @@
+package meta
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// queueWarningPoll is how often the accept queue is sampled once
+	// SetQueueWarning was called.
+	queueWarningPoll = 100 * time.Millisecond
+	// queueWarningInterval limits saturation warnings to one per interval.
+	queueWarningInterval = time.Minute
+)
+
+// QueueStats is a snapshot of the connections waiting for Accept.
+type QueueStats struct {
+	// Depth is the number of connections in the accept queue.
+	Depth int `json:"depth"`
+	// Capacity is the size of the accept queue. Once it is full, listeners
+	// wait for room, closing connections that find none within 5 seconds.
+	Capacity int `json:"capacity"`
+	// Pending counts, by listener ID, the connections accepted from each
+	// listener that Accept has not returned yet, queued or waiting for room.
+	Pending map[string]int `json:"pending"`
+}
+
+// Queue returns the current fill level of the accept queue, so a consumer
+// falling behind can be noticed before connections get dropped.
+func (ml *MetaListener) Queue() QueueStats {
+	ml.queueMu.Lock()
+	defer ml.queueMu.Unlock()
+	pending := make(map[string]int, len(ml.pending))
+	for id, n := range ml.pending {
+		pending[id] = n
+	}
+	return QueueStats{Depth: len(ml.connCh), Capacity: cap(ml.connCh), Pending: pending}
+}
+
+// addPending adds delta to the connections pending from listener id.
+func (ml *MetaListener) addPending(id string, delta int) {
+	ml.queueMu.Lock()
+	defer ml.queueMu.Unlock()
+	if ml.pending == nil {
+		ml.pending = make(map[string]int)
+	}
+	ml.pending[id] += delta
+	if ml.pending[id] <= 0 {
+		delete(ml.pending, id)
+	}
+}
+
+// taken records that Accept returned result.
+func (ml *MetaListener) taken(result ConnResult) ConnResult {
+	ml.addPending(result.src, -1)
+	return result
+}
+
+// SetQueueWarning logs a warning, and calls fn if it is not nil, when at
+// least threshold connections have been waiting in the accept queue for
+// after, so operators learn that the consumer of Accept is too slow before
+// connections start getting dropped. Warnings are repeated at most once a
+// minute while the queue stays full. fn is called from a background
+// goroutine and must not block for long. A threshold of zero or less turns
+// the warning off.
+func (ml *MetaListener) SetQueueWarning(threshold int, after time.Duration, fn func(QueueStats)) {
+	ml.queueMu.Lock()
+	ml.queueThreshold, ml.queueAfter, ml.queueWarn = threshold, after, fn
+	ml.queueMu.Unlock()
+	if threshold <= 0 {
+		return
+	}
+
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	if atomic.LoadInt64(&ml.isClosed) != 0 || !ml.queueWatching.CompareAndSwap(false, true) {
+		return
+	}
+	ml.listenerWg.Add(1)
+	go ml.watchQueue()
+}
+
+// watchQueue samples the accept queue until ml is closed, warning when it
+// stays above the threshold of SetQueueWarning.
+func (ml *MetaListener) watchQueue() {
+	defer ml.listenerWg.Done()
+	ticker := time.NewTicker(queueWarningPoll)
+	defer ticker.Stop()
+
+	var fullSince, lastWarning time.Time
+	for {
+		select {
+		case <-ml.closeCh:
+			return
+		case now := <-ticker.C:
+			ml.queueMu.Lock()
+			threshold, after, fn := ml.queueThreshold, ml.queueAfter, ml.queueWarn
+			ml.queueMu.Unlock()
+			if threshold <= 0 || len(ml.connCh) < threshold {
+				fullSince = time.Time{}
+				continue
+			}
+			if fullSince.IsZero() {
+				fullSince = now
+			}
+			if now.Sub(fullSince) < after || (!lastWarning.IsZero() && now.Sub(lastWarning) < queueWarningInterval) {
+				continue
+			}
+			lastWarning = now
+			stats := ml.Queue()
+			log.Printf("WARNING: %d of %d connections waiting for Accept for %v, pending by listener: %v", stats.Depth, stats.Capacity, now.Sub(fullSince).Round(time.Millisecond), stats.Pending)
+			if fn != nil {
+				fn(stats)
+			}
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package meta
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestQueueWarning verifies the queue gauges and that a queue staying above
+// the threshold is warned about once.
+func TestQueueWarning(t *testing.T) {
+	ml := NewMetaListener()
+	defer ml.Close()
+	warnings := make(chan QueueStats, 10)
+	ml.SetQueueWarning(2, 200*time.Millisecond, func(stats QueueStats) { warnings <- stats })
+	listener := newMockListener("queued")
+	if err := ml.AddListener("queued", listener); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	for range 3 {
+		server, client := net.Pipe()
+		defer client.Close()
+		listener.connCh <- server
+	}
+	select {
+	case stats := <-warnings:
+		if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+			t.Errorf("Warned after %v, before the queue stayed full for 200ms", elapsed)
+		}
+		if stats.Depth != 3 || stats.Capacity != 100 || stats.Pending["queued"] != 3 {
+			t.Errorf("Warning stats = %+v", stats)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No warning for a full queue")
+	}
+	if queued := ml.Stats().Queued; queued != 3 {
+		t.Errorf("Stats.Queued = %d, want 3", queued)
+	}
+	select {
+	case stats := <-warnings:
+		t.Errorf("Warned again within the interval: %+v", stats)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	conn, err := ml.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if stats := ml.Queue(); stats.Depth != 2 || stats.Pending["queued"] != 2 {
+		t.Errorf("Queue after Accept = %+v", stats)
+	}
+}
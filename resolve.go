@@ -0,0 +1,173 @@
+package meta
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/go-i2p/go-meta-listener/tcp"
+)
+
+const (
+	// defaultResolveInterval is how often AddTCP re-resolves hostnames when
+	// SetResolveInterval was not called.
+	defaultResolveInterval = time.Minute
+	// resolveTimeout bounds each lookup.
+	resolveTimeout = 10 * time.Second
+)
+
+// lookupHost resolves a hostname to its addresses. Tests replace it.
+var lookupHost = net.DefaultResolver.LookupHost
+
+// SetResolveInterval sets how often the hostnames given to AddTCP are
+// resolved again. Defaults to one minute; the new interval applies after
+// the pending lookup.
+func (ml *MetaListener) SetResolveInterval(interval time.Duration) {
+	ml.resolveInterval.Store(int64(interval))
+}
+
+// resolveEvery returns the interval set by SetResolveInterval.
+func (ml *MetaListener) resolveEvery() time.Duration {
+	if interval := time.Duration(ml.resolveInterval.Load()); interval > 0 {
+		return interval
+	}
+	return defaultResolveInterval
+}
+
+// AddTCP listens on address, a host:port, with the hardening of the tcp
+// package. An IP address or empty host gets one listener with address as
+// its ID. A hostname gets one listener per address it resolves to, with
+// IDs of the form "git.example.org:443@192.0.2.1", and is resolved again
+// every resolve interval: listeners are added for new addresses and
+// removed for vanished ones, so DNS-driven failover reaches the plain TCP
+// side. A failed lookup keeps the current listeners. Re-resolution stops
+// when ml is closed.
+func (ml *MetaListener) AddTCP(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if host == "" || net.ParseIP(host) != nil {
+		listener, err := listenTCP(address)
+		if err != nil {
+			return err
+		}
+		if err := ml.AddListener(address, listener); err != nil {
+			listener.Close()
+			return err
+		}
+		return nil
+	}
+
+	ips, err := resolve(host)
+	if err != nil {
+		return err
+	}
+	bound := make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		if err := ml.bindResolved(address, ip, port); err != nil {
+			for ip := range bound {
+				ml.RemoveListener(resolvedID(address, ip))
+			}
+			return err
+		}
+		bound[ip] = true
+	}
+
+	ml.listenerWg.Add(1)
+	go ml.reresolve(address, host, port, bound)
+	return nil
+}
+
+// reresolve re-resolves host every resolve interval until ml is closed.
+func (ml *MetaListener) reresolve(address, host, port string, bound map[string]bool) {
+	defer ml.listenerWg.Done()
+
+	timer := time.NewTimer(ml.resolveEvery())
+	defer timer.Stop()
+	for {
+		select {
+		case <-ml.closeCh:
+			return
+		case <-timer.C:
+		}
+		ml.rebindResolved(address, host, port, bound)
+		timer.Reset(ml.resolveEvery())
+	}
+}
+
+// rebindResolved resolves host and updates the listeners of address, whose
+// current IPs are bound, to the addresses found.
+func (ml *MetaListener) rebindResolved(address, host, port string, bound map[string]bool) {
+	ips, err := resolve(host)
+	if err != nil {
+		log.Printf("Keeping the listeners of %s: %v", address, err)
+		return
+	}
+	for ip := range bound {
+		if slices.Contains(ips, ip) {
+			continue
+		}
+		log.Printf("%s no longer resolves to %s, removing its listener", host, ip)
+		if err := ml.RemoveListener(resolvedID(address, ip)); err != nil {
+			log.Printf("Failed to remove listener of %s on %s: %v", address, ip, err)
+		}
+		delete(bound, ip)
+	}
+	for _, ip := range ips {
+		if bound[ip] {
+			continue
+		}
+		if err := ml.bindResolved(address, ip, port); err != nil {
+			log.Printf("Failed to listen on new address %s of %s: %v", ip, host, err)
+			continue
+		}
+		log.Printf("%s now resolves to %s, added a listener", host, ip)
+		bound[ip] = true
+	}
+}
+
+// bindResolved listens on ip, one of the addresses of address, and adds the
+// listener.
+func (ml *MetaListener) bindResolved(address, ip, port string) error {
+	listener, err := listenTCP(net.JoinHostPort(ip, port))
+	if err != nil {
+		return err
+	}
+	if err := ml.AddListener(resolvedID(address, ip), listener); err != nil {
+		listener.Close()
+		return err
+	}
+	return nil
+}
+
+// resolvedID is the listener ID of ip, an address of address.
+func resolvedID(address, ip string) string {
+	return address + "@" + ip
+}
+
+// resolve returns the addresses of host.
+func resolve(host string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	ips, err := lookupHost(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+	if len(ips) == 0 {
+		return nil, errors.New("no addresses for " + host)
+	}
+	return ips, nil
+}
+
+// listenTCP listens on address with the hardening of the tcp package.
+func listenTCP(address string) (net.Listener, error) {
+	listener, err := tcp.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create TCP listener on %s: %w", address, err)
+	}
+	return listener, nil
+}
@@ -0,0 +1,90 @@
+package meta
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestAddTCPResolve verifies that a hostname gets a listener per address,
+// and that re-resolving it follows changes of its addresses.
+func TestAddTCPResolve(t *testing.T) {
+	var mu sync.Mutex
+	addrs := []string{"127.0.0.1"}
+	var lookupErr error
+	defer func(orig func(context.Context, string) ([]string, error)) { lookupHost = orig }(lookupHost)
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if host != "mirror.test" {
+			return nil, errors.New("unknown host")
+		}
+		return slices.Clone(addrs), lookupErr
+	}
+	setAddrs := func(ips []string, err error) {
+		mu.Lock()
+		addrs, lookupErr = ips, err
+		mu.Unlock()
+	}
+
+	ml := NewMetaListener()
+	defer ml.Close()
+	ml.SetResolveInterval(20 * time.Millisecond)
+	if err := ml.AddTCP("mirror.test:0"); err != nil {
+		t.Fatalf("AddTCP: %v", err)
+	}
+	waitForIDs := func(want ...string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			ids := ml.ListenerIDs()
+			slices.Sort(ids)
+			if slices.Equal(ids, want) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Listener IDs = %v, want %v", ids, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitForIDs("mirror.test:0@127.0.0.1")
+
+	setAddrs([]string{"127.0.0.1", "127.0.0.2"}, nil)
+	waitForIDs("mirror.test:0@127.0.0.1", "mirror.test:0@127.0.0.2")
+
+	// A failed lookup keeps the listeners
+	setAddrs(nil, errors.New("temporary failure"))
+	time.Sleep(60 * time.Millisecond)
+	waitForIDs("mirror.test:0@127.0.0.1", "mirror.test:0@127.0.0.2")
+
+	setAddrs([]string{"127.0.0.2"}, nil)
+	waitForIDs("mirror.test:0@127.0.0.2")
+}
+
+// TestAddTCPAddress verifies that an IP address is bound once, under its
+// own ID, and that unresolvable names are reported.
+func TestAddTCPAddress(t *testing.T) {
+	ml := NewMetaListener()
+	defer ml.Close()
+	if err := ml.AddTCP("127.0.0.1:0"); err != nil {
+		t.Fatalf("AddTCP: %v", err)
+	}
+	if ids := ml.ListenerIDs(); len(ids) != 1 || ids[0] != "127.0.0.1:0" {
+		t.Errorf("Listener IDs = %v", ids)
+	}
+	if err := ml.AddTCP("missing-port"); err == nil {
+		t.Error("AddTCP accepted an address without a port")
+	}
+
+	defer func(orig func(context.Context, string) ([]string, error)) { lookupHost = orig }(lookupHost)
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		return nil, errors.New("no such host")
+	}
+	if err := ml.AddTCP("unknown.test:0"); err == nil {
+		t.Error("AddTCP accepted an unresolvable name")
+	}
+}
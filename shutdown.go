@@ -0,0 +1,95 @@
+package meta
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// queuePoll is how often ShutdownHTTP checks whether the server has taken
+// the connections already accepted.
+const queuePoll = 10 * time.Millisecond
+
+// ShutdownReport describes how ShutdownHTTP went.
+type ShutdownReport struct {
+	// Listeners maps the ID of each listener closed to the error its Close
+	// returned, nil when it closed cleanly.
+	Listeners map[string]error
+	// Server is the error http.Server.Shutdown returned, such as the
+	// context's error when connections outlived it.
+	Server error
+	// Dropped is the number of connections accepted from the listeners but
+	// never taken by the server, which were closed.
+	Dropped int
+}
+
+// ShutdownHTTP gracefully stops srv, which serves ml, in the order a clean
+// drain needs: it stops accepting on every listener, waits for srv to take
+// the connections already accepted, lets srv finish its active requests
+// with http.Server.Shutdown, then closes ml and waits for its goroutines.
+// ctx bounds the whole drain.
+//
+// The report tells how each listener closed; the error joins every
+// failure in it, or is nil when all went well.
+func (ml *MetaListener) ShutdownHTTP(ctx context.Context, srv *http.Server) (*ShutdownReport, error) {
+	report := &ShutdownReport{Listeners: make(map[string]error)}
+
+	// Stop accepting on all transports; connections already accepted keep
+	// being served
+	atomic.StoreInt64(&ml.isShuttingDown, 1)
+	ml.mu.Lock()
+	for id, listener := range ml.listeners {
+		report.Listeners[id] = listener.Close()
+		delete(ml.listeners, id)
+	}
+	ml.mu.Unlock()
+
+	ml.waitForQueue(ctx)
+	report.Server = srv.Shutdown(ctx)
+	ml.Close()
+	report.Dropped = ml.dropQueued()
+
+	errs := []error{report.Server}
+	for id, err := range report.Listeners {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("closing %s listener: %w", id, err))
+		}
+	}
+	if err := ml.WaitForShutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("waiting for listener goroutines: %w", err))
+	}
+	return report, errors.Join(errs...)
+}
+
+// waitForQueue waits until the connections handed to Accept have all been
+// taken, or ctx is done.
+func (ml *MetaListener) waitForQueue(ctx context.Context) {
+	ticker := time.NewTicker(queuePoll)
+	defer ticker.Stop()
+	for len(ml.connCh) > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// dropQueued closes the connections left for Accept after ml was closed,
+// and returns how many there were.
+func (ml *MetaListener) dropQueued() int {
+	dropped := 0
+	for {
+		select {
+		case result := <-ml.connCh:
+			ml.taken(result).Close()
+			ml.dropped.Add(1)
+			dropped++
+		default:
+			return dropped
+		}
+	}
+}
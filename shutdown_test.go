@@ -0,0 +1,106 @@
+package meta
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestShutdownHTTP verifies that ShutdownHTTP stops accepting, lets an
+// active request finish and reports each listener.
+func TestShutdownHTTP(t *testing.T) {
+	ml := NewMetaListener()
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ml.AddListener("tcp", tcpListener); err != nil {
+		t.Fatal(err)
+	}
+	if err := ml.AddListener("mock", newMockListener("mock")); err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, "done")
+	})}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ml) }()
+
+	addr := tcpListener.Addr().String()
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr)
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		body <- string(b)
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	report, err := ml.ShutdownHTTP(ctx, srv)
+	if err != nil {
+		t.Errorf("ShutdownHTTP: %v", err)
+	}
+	if got := <-body; got != "done" {
+		t.Errorf("Active request got %q, want done", got)
+	}
+	if len(report.Listeners) != 2 || report.Listeners["tcp"] != nil || report.Listeners["mock"] != nil {
+		t.Errorf("Listeners = %v, want tcp and mock closed cleanly", report.Listeners)
+	}
+	if report.Server != nil || report.Dropped != 0 {
+		t.Errorf("report = %+v", report)
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		t.Errorf("Serve returned %v, want http.ErrServerClosed", err)
+	}
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Error("Listener still accepts after ShutdownHTTP")
+	}
+	if err := ml.AddListener("late", newMockListener("late")); err == nil {
+		t.Error("AddListener succeeded after ShutdownHTTP")
+	}
+}
+
+// TestShutdownHTTPTimeout verifies that a request outliving the context is
+// reported.
+func TestShutdownHTTPTimeout(t *testing.T) {
+	ml := NewMetaListener()
+	listener := newMockListener("mock")
+	if err := ml.AddListener("mock", listener); err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})}
+	go srv.Serve(ml)
+
+	server, client := net.Pipe()
+	defer client.Close()
+	listener.connCh <- server
+	go io.WriteString(client, "GET / HTTP/1.1\r\nHost: example\r\n\r\n")
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	report, err := ml.ShutdownHTTP(ctx, srv)
+	if err == nil || report.Server != context.DeadlineExceeded {
+		t.Errorf("ShutdownHTTP = %+v, %v, want the deadline exceeded", report, err)
+	}
+}
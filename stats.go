@@ -0,0 +1,106 @@
+package meta
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+)
+
+// expvars holds the current owner of each name published with
+// PublishExpvarFunc. expvar cannot remove a variable, so each name is
+// published once and its expvar.Func asks the registry for the value.
+var expvars = struct {
+	mu     sync.Mutex
+	owners map[string]*expvarOwner
+}{owners: make(map[string]*expvarOwner)}
+
+// expvarOwner is the value a published name currently reports, or nil
+// while no one owns it, and the number of times the name was bound.
+type expvarOwner struct {
+	value func() any
+	binds uint64
+}
+
+// Stats is a snapshot of the counters of a MetaListener.
+type Stats struct {
+	// Listeners is the number of listeners currently registered.
+	Listeners int `json:"listeners"`
+	// Accepted is the number of connections handed to Accept.
+	Accepted uint64 `json:"accepted"`
+	// Dropped is the number of accepted connections closed because Accept
+	// did not take them in time or the MetaListener was closing.
+	Dropped uint64 `json:"dropped"`
+	// Queued is the number of connections waiting for Accept.
+	Queued int `json:"queued"`
+	// Refused is the number of connections closed because their remote
+	// identity was flooding or banned, see SetFloodGuard.
+	Refused uint64 `json:"refused"`
+}
+
+// Stats returns the listener's current counters.
+func (ml *MetaListener) Stats() Stats {
+	return Stats{
+		Listeners: ml.Count(),
+		Accepted:  ml.accepted.Load(),
+		Dropped:   ml.dropped.Load(),
+		Queued:    len(ml.connCh),
+		Refused:   ml.refused.Load(),
+	}
+}
+
+// PublishExpvar publishes the listener's Stats as the expvar variable
+// name, served as JSON by expvar's /debug/vars handler, for visibility
+// without a metrics dependency. Close unbinds the variable, so a listener
+// created later can publish the same name.
+func (ml *MetaListener) PublishExpvar(name string) error {
+	unpublish, err := PublishExpvarFunc(name, func() any { return ml.Stats() })
+	if err != nil {
+		return err
+	}
+	ml.mu.Lock()
+	ml.unpublish = append(ml.unpublish, unpublish)
+	ml.mu.Unlock()
+	return nil
+}
+
+// PublishExpvarFunc publishes the result of value as the expvar variable
+// name. expvar variables live for the rest of the process, so the variable
+// is published once and then reports its current owner: unpublish unbinds
+// value, the variable reports null until the name is published again, and
+// publishing a name that is still bound, or that was published by other
+// means, is an error instead of expvar.Publish's panic.
+func PublishExpvarFunc(name string, value func() any) (unpublish func(), err error) {
+	expvars.mu.Lock()
+	defer expvars.mu.Unlock()
+
+	owner, ok := expvars.owners[name]
+	switch {
+	case ok && owner.value != nil:
+		return nil, fmt.Errorf("expvar %q is already published", name)
+	case !ok && expvar.Get(name) != nil:
+		return nil, fmt.Errorf("expvar %q is already published", name)
+	case !ok:
+		owner = &expvarOwner{}
+		expvars.owners[name] = owner
+		expvar.Publish(name, expvar.Func(func() any {
+			expvars.mu.Lock()
+			value := owner.value
+			expvars.mu.Unlock()
+			if value == nil {
+				return nil
+			}
+			return value()
+		}))
+	}
+	owner.value = value
+	owner.binds++
+	bind := owner.binds
+	return func() {
+		expvars.mu.Lock()
+		defer expvars.mu.Unlock()
+		// Only unbind what this call bound, not a later owner
+		if owner.binds == bind {
+			owner.value = nil
+		}
+	}, nil
+}
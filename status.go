@@ -0,0 +1,132 @@
+package meta
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// States of a MetaListener reported in Status.
+const (
+	StateServing      = "serving"
+	StateNoListeners  = "no-listeners"
+	StateShuttingDown = "shutting-down"
+	StateClosed       = "closed"
+)
+
+// Status is a snapshot of a MetaListener for dashboards and health checks,
+// served as JSON by StatusHandler.
+type Status struct {
+	// Healthy is true while State is StateServing.
+	Healthy bool `json:"healthy"`
+	// State is StateServing, StateNoListeners while no listener is up,
+	// StateShuttingDown once WaitForShutdown or ShutdownHTTP was called,
+	// or StateClosed.
+	State string `json:"state"`
+	// Listeners are the registered listeners, sorted by ID.
+	Listeners []ListenerStatus `json:"listeners"`
+	Stats     Stats            `json:"stats"`
+	Queue     QueueStats       `json:"queue"`
+}
+
+// ListenerStatus describes one listener in a Status.
+type ListenerStatus struct {
+	ID string `json:"id"`
+	// Network and Address are those of the listener's Addr, empty while it
+	// is down.
+	Network string `json:"network,omitempty"`
+	Address string `json:"address,omitempty"`
+	// Up is false for a listener added with AddListenerFactory that
+	// WatchInterfaces has not re-created yet.
+	Up bool `json:"up"`
+	// Expires is when the time to live set with SetListenerTTL runs out,
+	// if one is set.
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// Status returns a snapshot of the listener's state, listeners, and
+// counters.
+func (ml *MetaListener) Status() Status {
+	status := Status{
+		Listeners: ml.listenerStatuses(),
+		Stats:     ml.Stats(),
+		Queue:     ml.Queue(),
+	}
+	up := 0
+	for _, listener := range status.Listeners {
+		if listener.Up {
+			up++
+		}
+	}
+	switch {
+	case atomic.LoadInt64(&ml.isClosed) != 0:
+		status.State = StateClosed
+	case atomic.LoadInt64(&ml.isShuttingDown) != 0:
+		status.State = StateShuttingDown
+	case up == 0:
+		status.State = StateNoListeners
+	default:
+		status.State = StateServing
+	}
+	status.Healthy = status.State == StateServing
+	return status
+}
+
+// listenerStatuses describes the registered listeners, and those waiting
+// to be re-created by WatchInterfaces, sorted by ID.
+func (ml *MetaListener) listenerStatuses() []ListenerStatus {
+	ml.mu.RLock()
+	defer ml.mu.RUnlock()
+
+	statuses := make([]ListenerStatus, 0, len(ml.listeners))
+	for id, listener := range ml.listeners {
+		addr := listener.Addr()
+		statuses = append(statuses, ListenerStatus{ID: id, Network: addr.Network(), Address: addr.String(), Up: true})
+	}
+	for id := range ml.factories {
+		if _, up := ml.listeners[id]; !up {
+			statuses = append(statuses, ListenerStatus{ID: id})
+		}
+	}
+	for i := range statuses {
+		if entry, ok := ml.ttls[statuses[i].ID]; ok {
+			expires := entry.deadline
+			statuses[i].Expires = &expires
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	return statuses
+}
+
+// StatusHandler returns an http.Handler serving the Status of ml as JSON,
+// so an application can expose it on its admin mux with one line:
+//
+//	mux.Handle("/status/listeners", meta.StatusHandler(ml))
+//
+// Unhealthy listeners are answered with 503 Service Unavailable, so the
+// endpoint doubles as a health check for load balancers and orchestrators.
+func StatusHandler(ml *MetaListener) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		status := ml.Status()
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if !status.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if r.Method == http.MethodHead {
+			return
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(status); err != nil {
+			log.Printf("Error writing listener status: %v", err)
+		}
+	})
+}
@@ -0,0 +1,78 @@
+package meta
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestStatusHandler verifies that the status document lists the listeners
+// with their addresses and TTLs, and that an unhealthy MetaListener is
+// answered with 503.
+func TestStatusHandler(t *testing.T) {
+	ml := NewMetaListener()
+	handler := StatusHandler(ml)
+
+	get := func(method string) (*httptest.ResponseRecorder, Status) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, "/status", nil))
+		var status Status
+		if method == http.MethodGet {
+			if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+				t.Fatalf("Invalid status document %q: %v", rec.Body, err)
+			}
+		}
+		return rec, status
+	}
+
+	if rec, status := get(http.MethodGet); rec.Code != http.StatusServiceUnavailable || status.Healthy || status.State != StateNoListeners {
+		t.Errorf("Without listeners: %d, %+v", rec.Code, status)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ml.AddListener("tcp", listener); err != nil {
+		t.Fatal(err)
+	}
+	if err := ml.SetListenerTTL("tcp", time.Hour, nil); err != nil {
+		t.Fatal(err)
+	}
+	rec, status := get(http.MethodGet)
+	if rec.Code != http.StatusOK || !status.Healthy || status.State != StateServing {
+		t.Errorf("With a listener: %d, %+v", rec.Code, status)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	if len(status.Listeners) != 1 {
+		t.Fatalf("Listed %d listeners, want 1", len(status.Listeners))
+	}
+	got := status.Listeners[0]
+	if got.ID != "tcp" || got.Network != "tcp" || got.Address != listener.Addr().String() || !got.Up {
+		t.Errorf("Listener status %+v", got)
+	}
+	if got.Expires == nil || time.Until(*got.Expires) <= 59*time.Minute {
+		t.Errorf("Listener expires %v, want in an hour", got.Expires)
+	}
+	if status.Stats.Listeners != 1 || status.Queue.Capacity == 0 {
+		t.Errorf("Stats %+v, queue %+v", status.Stats, status.Queue)
+	}
+
+	if rec, _ := get(http.MethodHead); rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+		t.Errorf("HEAD: %d with %d bytes", rec.Code, rec.Body.Len())
+	}
+	if rec, _ := get(http.MethodPost); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: %d, want 405", rec.Code)
+	}
+
+	ml.Close()
+	if rec, status := get(http.MethodGet); rec.Code != http.StatusServiceUnavailable || status.State != StateClosed {
+		t.Errorf("After Close: %d, %+v", rec.Code, status)
+	}
+}
@@ -26,10 +26,31 @@
 //		}
 //		go handleConnection(conn)
 //	}
+//
+// Listen creates a hardened listener directly, and takes options such as
+// WithControl to set further socket options while the socket is created:
+//
+//	listener, err := tcp.Listen("tcp", ":8080", tcp.WithControl(setReusePort))
+//
+// WithAcceptTimeout bounds each Accept, so a single-listener server can
+// check for shutdown between accepts:
+//
+//	listener, err := tcp.Listen("tcp", ":8080", tcp.WithAcceptTimeout(time.Second))
+//	for {
+//		conn, err := listener.Accept()
+//		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+//			if shuttingDown() {
+//				return
+//			}
+//			continue
+//		}
+//		...
+//	}
 package tcp
 
 import (
 	"net"
+	"os"
 	"time"
 )
 
@@ -46,6 +67,8 @@ const (
 // hardenedListener wraps net.TCPListener with production hardening features.
 type hardenedListener struct {
 	listener net.TCPListener
+	// acceptTimeout bounds each Accept, set by WithAcceptTimeout
+	acceptTimeout time.Duration
 }
 
 // Config wraps a net.TCPListener with production hardening features.
@@ -65,13 +88,18 @@ func Config(listener net.TCPListener) (net.Listener, error) {
 
 // Accept waits for and returns the next connection with hardening applied.
 func (hl *hardenedListener) Accept() (net.Conn, error) {
+	if hl.acceptTimeout > 0 {
+		if err := hl.listener.SetDeadline(time.Now().Add(hl.acceptTimeout)); err != nil {
+			return nil, err
+		}
+	}
 	conn, err := hl.listener.AcceptTCP()
 	if err != nil {
 		return nil, err
 	}
 
 	// Apply TCP hardening settings
-	if err := hl.hardenConnection(conn); err != nil {
+	if err := hardenConnection(conn); err != nil {
 		conn.Close()
 		return nil, err
 	}
@@ -80,16 +108,17 @@ func (hl *hardenedListener) Accept() (net.Conn, error) {
 }
 
 // hardenConnection applies security and performance settings to a TCP connection.
-func (hl *hardenedListener) hardenConnection(conn *net.TCPConn) error {
-	if err := hl.configureKeepAlive(conn); err != nil {
+// It is shared by accepted and dialed connections.
+func hardenConnection(conn *net.TCPConn) error {
+	if err := configureKeepAlive(conn); err != nil {
 		return err
 	}
 
-	if err := hl.configureLatencyOptimization(conn); err != nil {
+	if err := configureLatencyOptimization(conn); err != nil {
 		return err
 	}
 
-	if err := hl.configureBufferSizes(conn); err != nil {
+	if err := configureBufferSizes(conn); err != nil {
 		return err
 	}
 
@@ -97,7 +126,7 @@ func (hl *hardenedListener) hardenConnection(conn *net.TCPConn) error {
 }
 
 // configureKeepAlive enables TCP keep-alive functionality to detect dead connections.
-func (hl *hardenedListener) configureKeepAlive(conn *net.TCPConn) error {
+func configureKeepAlive(conn *net.TCPConn) error {
 	if err := conn.SetKeepAlive(true); err != nil {
 		return err
 	}
@@ -110,12 +139,12 @@ func (hl *hardenedListener) configureKeepAlive(conn *net.TCPConn) error {
 }
 
 // configureLatencyOptimization disables Nagle's algorithm for reduced latency.
-func (hl *hardenedListener) configureLatencyOptimization(conn *net.TCPConn) error {
+func configureLatencyOptimization(conn *net.TCPConn) error {
 	return conn.SetNoDelay(true)
 }
 
 // configureBufferSizes sets socket buffer sizes for optimal throughput.
-func (hl *hardenedListener) configureBufferSizes(conn *net.TCPConn) error {
+func configureBufferSizes(conn *net.TCPConn) error {
 	if err := conn.SetReadBuffer(socketBufferSize); err != nil {
 		return err
 	}
@@ -136,3 +165,9 @@ func (hl *hardenedListener) Close() error {
 func (hl *hardenedListener) Addr() net.Addr {
 	return hl.listener.Addr()
 }
+
+// File returns a duplicate of the listener's file descriptor, so the socket
+// can be handed to another process.
+func (hl *hardenedListener) File() (*os.File, error) {
+	return hl.listener.File()
+}
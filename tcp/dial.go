@@ -0,0 +1,30 @@
+package tcp
+
+import (
+	"context"
+	"net"
+)
+
+// DialContext connects to address like net.Dialer.DialContext and applies
+// the same hardening as Config to the resulting TCP connection: keep-alive
+// probes every 15 seconds, TCP_NODELAY, and 64KB socket buffers.
+func DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := net.Dialer{KeepAlive: keepAliveInterval}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if err := hardenConnection(tcpConn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Dial is DialContext with a background context.
+func Dial(network, address string) (net.Conn, error) {
+	return DialContext(context.Background(), network, address)
+}
@@ -0,0 +1,86 @@
+package tcp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// ControlFunc sets socket options on the raw connection of a listener
+// before it is bound, like net.ListenConfig.Control.
+type ControlFunc func(network, address string, c syscall.RawConn) error
+
+// Option configures the listeners created by Listen and ListenContext.
+type Option func(*listenOptions)
+
+// listenOptions holds the settings of Options.
+type listenOptions struct {
+	controls      []ControlFunc
+	acceptTimeout time.Duration
+}
+
+// WithControl runs fn on the socket of the listener before it is bound, so
+// callers can set any platform-specific option, such as SO_REUSEPORT,
+// IP_FREEBIND, or TCP_FASTOPEN, without the package needing a flag for
+// each. Functions of several WithControl options run in order; the first
+// error aborts the listen.
+func WithControl(fn func(network, address string, c syscall.RawConn) error) Option {
+	return func(o *listenOptions) {
+		o.controls = append(o.controls, fn)
+	}
+}
+
+// WithAcceptTimeout makes Accept return a net.Error whose Timeout method
+// reports true when no connection arrives within d, instead of blocking
+// until one does, so a server with a single listener can poll for shutdown
+// between accepts. The listener stays open after a timeout. Zero, the
+// default, waits forever.
+func WithAcceptTimeout(d time.Duration) Option {
+	return func(o *listenOptions) {
+		o.acceptTimeout = d
+	}
+}
+
+// control returns the Control function running the options' functions, or
+// nil when there are none.
+func (o *listenOptions) control() func(network, address string, c syscall.RawConn) error {
+	if len(o.controls) == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		for _, fn := range o.controls {
+			if err := fn(network, address, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// ListenContext listens on the TCP network address like
+// net.ListenConfig.Listen, applying opts while the socket is created, and
+// returns the listener with the hardening of Config.
+func ListenContext(ctx context.Context, network, address string, opts ...Option) (net.Listener, error) {
+	var o listenOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	lc := net.ListenConfig{Control: o.control()}
+	listener, err := lc.Listen(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	tcpListener, ok := listener.(*net.TCPListener)
+	if !ok {
+		listener.Close()
+		return nil, fmt.Errorf("%s is not a TCP network", network)
+	}
+	return &hardenedListener{listener: *tcpListener, acceptTimeout: o.acceptTimeout}, nil
+}
+
+// Listen is ListenContext with a background context.
+func Listen(network, address string, opts ...Option) (net.Listener, error) {
+	return ListenContext(context.Background(), network, address, opts...)
+}
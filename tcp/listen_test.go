@@ -0,0 +1,41 @@
+package tcp
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestAcceptTimeout verifies that Accept gives up with a timeout error
+// after the configured duration, and that the listener accepts connections
+// afterwards because each Accept sets a new deadline.
+func TestAcceptTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	listener, err := Listen("tcp", "127.0.0.1:0", WithAcceptTimeout(timeout))
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+
+	start := time.Now()
+	_, err = listener.Accept()
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("Accept without a client returned %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed < timeout {
+		t.Errorf("Accept timed out after %s, before %s", elapsed, timeout)
+	}
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer client.Close()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept after a timeout failed: %v", err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,84 @@
+package meta
+
+import (
+	"fmt"
+	"time"
+)
+
+// ListenerExpiry reports that a listener was closed and removed because
+// the time to live set with SetListenerTTL ran out.
+type ListenerExpiry struct {
+	ID string
+	// TTL is the time to live the listener was given
+	TTL time.Duration
+	// Err is the error closing the listener returned, if any
+	Err error
+}
+
+// SetListenerTTL closes and removes the listener with the specified ID once
+// ttl has passed, for temporary listeners such as debugging endpoints,
+// short-lived share links, or rendezvous listeners that should not outlive
+// a session. fn, if not nil, is called with the expiry from a background
+// goroutine and must not block for long. Setting the TTL again restarts
+// it, and a ttl of zero or less cancels it. Removing the listener cancels
+// its TTL; a listener re-created by WatchInterfaces keeps it.
+// Returns an error if no listener with that ID exists.
+func (ml *MetaListener) SetListenerTTL(id string, ttl time.Duration, fn func(ListenerExpiry)) error {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	_, exists := ml.listeners[id]
+	_, pending := ml.factories[id]
+	if !exists && !pending {
+		return fmt.Errorf("no listener with ID '%s' exists", id)
+	}
+	ml.stopTTLLocked(id)
+	if ttl <= 0 {
+		return nil
+	}
+	if ml.ttls == nil {
+		ml.ttls = make(map[string]*listenerTTL)
+	}
+	entry := &listenerTTL{deadline: time.Now().Add(ttl)}
+	entry.timer = time.AfterFunc(ttl, func() { ml.expire(id, entry, ttl, fn) })
+	ml.ttls[id] = entry
+	return nil
+}
+
+// listenerTTL is the timer of a TTL set with SetListenerTTL.
+type listenerTTL struct {
+	timer *time.Timer
+	// deadline is when the timer fires
+	deadline time.Time
+}
+
+// expire removes the listener whose TTL ran out, unless the TTL was
+// restarted or cancelled meanwhile.
+func (ml *MetaListener) expire(id string, entry *listenerTTL, ttl time.Duration, fn func(ListenerExpiry)) {
+	ml.mu.Lock()
+	if ml.ttls[id] != entry {
+		ml.mu.Unlock()
+		return
+	}
+	delete(ml.ttls, id)
+	event := ListenerExpiry{ID: id, TTL: ttl}
+	if listener, exists := ml.listeners[id]; exists {
+		event.Err = listener.Close()
+		delete(ml.listeners, id)
+	}
+	delete(ml.factories, id)
+	ml.mu.Unlock()
+
+	log.Printf("Listener %s removed after its %s time to live", id, ttl)
+	if fn != nil {
+		fn(event)
+	}
+}
+
+// stopTTLLocked cancels the TTL of id, if any. ml.mu must be held.
+func (ml *MetaListener) stopTTLLocked(id string) {
+	if entry, ok := ml.ttls[id]; ok {
+		entry.timer.Stop()
+		delete(ml.ttls, id)
+	}
+}
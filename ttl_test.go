@@ -0,0 +1,58 @@
+package meta
+
+import (
+	"testing"
+	"time"
+)
+
+// TestListenerTTL verifies that a listener is closed and removed with an
+// event once its TTL runs out, and that restarting, cancelling, or removing
+// the listener keeps it from expiring.
+func TestListenerTTL(t *testing.T) {
+	ml := NewMetaListener()
+	defer ml.Close()
+
+	for _, id := range []string{"debug", "share", "kept", "removed"} {
+		if err := ml.AddListener(id, newMockListener(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ml.SetListenerTTL("missing", time.Second, nil); err == nil {
+		t.Error("SetListenerTTL succeeded for a missing listener")
+	}
+
+	expired := make(chan ListenerExpiry, 4)
+	onExpire := func(e ListenerExpiry) { expired <- e }
+	for _, id := range []string{"debug", "share", "kept", "removed"} {
+		if err := ml.SetListenerTTL(id, 50*time.Millisecond, onExpire); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Restart one TTL, cancel another, and remove a listener
+	ml.SetListenerTTL("share", time.Hour, onExpire)
+	ml.SetListenerTTL("kept", 0, onExpire)
+	ml.RemoveListener("removed")
+
+	select {
+	case e := <-expired:
+		if e.ID != "debug" || e.TTL != 50*time.Millisecond || e.Err != nil {
+			t.Errorf("expiry = %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("listener did not expire")
+	}
+	select {
+	case e := <-expired:
+		t.Errorf("unexpected expiry of %s", e.ID)
+	case <-time.After(200 * time.Millisecond):
+	}
+	ids := ml.ListenerIDs()
+	if len(ids) != 2 {
+		t.Errorf("ListenerIDs() = %v, want share and kept", ids)
+	}
+	for _, id := range ids {
+		if id == "debug" {
+			t.Error("expired listener is still listed")
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package meta
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// defaultInterfacePoll is how often WatchInterfaces checks the interfaces
+// when not told otherwise.
+const defaultInterfacePoll = 5 * time.Second
+
+// ListenerFactory creates a listener, such as a TCP listener bound to one
+// address, which AddListenerFactory registers and WatchInterfaces
+// re-creates after network changes.
+type ListenerFactory func() (net.Listener, error)
+
+// interfaceAddrs lists the addresses of the host's interfaces. Tests
+// replace it.
+var interfaceAddrs = net.InterfaceAddrs
+
+// AddListenerFactory creates a listener with factory and adds it with the
+// specified ID, like AddListener. Once WatchInterfaces is running, the
+// listener is closed when the address it is bound to disappears, and
+// created again with factory when it is missing, so the ID survives
+// network changes such as a VPN coming up or a laptop changing networks.
+func (ml *MetaListener) AddListenerFactory(id string, factory ListenerFactory) error {
+	if factory == nil {
+		return errors.New("cannot add nil listener factory")
+	}
+	ml.mu.RLock()
+	_, taken := ml.factories[id]
+	ml.mu.RUnlock()
+	if taken {
+		return fmt.Errorf("listener with ID '%s' already exists", id)
+	}
+
+	listener, err := factory()
+	if err != nil {
+		return err
+	}
+	if err := ml.AddListener(id, listener); err != nil {
+		listener.Close()
+		return err
+	}
+	ml.mu.Lock()
+	if ml.factories == nil {
+		ml.factories = make(map[string]ListenerFactory)
+	}
+	ml.factories[id] = factory
+	ml.mu.Unlock()
+	return nil
+}
+
+// WatchInterfaces starts keeping the listeners added with
+// AddListenerFactory bound to the addresses the host has: it closes those
+// whose address disappeared and re-creates the missing ones, including
+// those removed after a permanent accept error. On Linux it reacts to
+// netlink notifications of address and link changes, and otherwise checks
+// every poll, which defaults to 5 seconds; missing listeners are retried
+// every poll in both cases. The watcher stops when ml is closed.
+func (ml *MetaListener) WatchInterfaces(poll time.Duration) error {
+	if poll <= 0 {
+		poll = defaultInterfacePoll
+	}
+
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	if atomic.LoadInt64(&ml.isClosed) != 0 {
+		return ErrListenerClosed
+	}
+	if !ml.watching.CompareAndSwap(false, true) {
+		return errors.New("interfaces are already watched")
+	}
+
+	events, err := interfaceEvents(ml.closeCh)
+	if err != nil {
+		log.Printf("Interface change notifications unavailable, polling every %s: %v", poll, err)
+	}
+	ml.listenerWg.Add(1)
+	go ml.watchInterfaces(events, poll)
+	return nil
+}
+
+// watchInterfaces reconciles the factory listeners on every interface
+// event and poll until ml is closed.
+func (ml *MetaListener) watchInterfaces(events <-chan struct{}, poll time.Duration) {
+	defer ml.listenerWg.Done()
+
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ml.closeCh:
+			return
+		case <-events:
+		case <-ticker.C:
+		}
+		ml.reconcileInterfaces()
+	}
+}
+
+// reconcileInterfaces closes the factory listeners bound to addresses the
+// host no longer has, and re-creates those not registered.
+func (ml *MetaListener) reconcileInterfaces() {
+	addrs, err := interfaceAddrs()
+	if err != nil {
+		log.Printf("Failed to list interface addresses: %v", err)
+		return
+	}
+	present := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			present[ipNet.IP.String()] = true
+		}
+	}
+
+	ml.mu.Lock()
+	missing := make(map[string]ListenerFactory)
+	for id, factory := range ml.factories {
+		listener, registered := ml.listeners[id]
+		if !registered {
+			missing[id] = factory
+			continue
+		}
+		tcpAddr, ok := listener.Addr().(*net.TCPAddr)
+		if !ok || tcpAddr.IP.IsUnspecified() || present[tcpAddr.IP.String()] {
+			continue
+		}
+		log.Printf("Address %s of listener %s disappeared, closing it", tcpAddr.IP, id)
+		delete(ml.listeners, id)
+		listener.Close()
+		missing[id] = factory
+	}
+	ml.mu.Unlock()
+
+	for id, factory := range missing {
+		listener, err := factory()
+		if err != nil {
+			log.Printf("Listener %s not re-created yet: %v", id, err)
+			continue
+		}
+		if err := ml.readdListener(id, listener); err != nil {
+			log.Printf("Failed to re-add listener %s: %v", id, err)
+			listener.Close()
+			continue
+		}
+		log.Printf("Listener %s re-created on %s", id, listener.Addr())
+	}
+}
+
+// readdListener adds listener, re-created for id, unless the ID was
+// removed or taken meanwhile.
+func (ml *MetaListener) readdListener(id string, listener net.Listener) error {
+	ml.mu.RLock()
+	_, wanted := ml.factories[id]
+	ml.mu.RUnlock()
+	if !wanted {
+		return fmt.Errorf("listener %s was removed", id)
+	}
+	return ml.AddListener(id, listener)
+}
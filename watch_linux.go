@@ -0,0 +1,53 @@
+package meta
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// interfaceEvents subscribes to the netlink notifications of link and
+// address changes, and signals the returned channel after each batch until
+// done is closed.
+func interfaceEvents(done <-chan struct{}) (<-chan struct{}, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	groups := uint32(unix.RTMGRP_LINK | unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: groups}); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	// Wake up regularly to notice done
+	timeout := unix.NsecToTimeval(time.Second.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	events := make(chan struct{}, 1)
+	go func() {
+		defer unix.Close(fd)
+		buf := make([]byte, 1<<16)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if _, err := unix.Read(fd, buf); err != nil {
+				if err == unix.EAGAIN || err == unix.EINTR || err == unix.ENOBUFS {
+					continue
+				}
+				log.Printf("Interface change notifications stopped: %v", err)
+				return
+			}
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return events, nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package meta
+
+import "errors"
+
+// interfaceEvents is only implemented on Linux; elsewhere WatchInterfaces
+// polls.
+func interfaceEvents(done <-chan struct{}) (<-chan struct{}, error) {
+	return nil, errors.New("not supported on this platform")
+}
@@ -0,0 +1,105 @@
+package meta
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestReconcileInterfaces verifies that factory listeners are closed when
+// their address disappears and re-created when it comes back.
+func TestReconcileInterfaces(t *testing.T) {
+	defer func(orig func() ([]net.Addr, error)) { interfaceAddrs = orig }(interfaceAddrs)
+	loopback := []net.Addr{&net.IPNet{IP: net.IPv4(127, 0, 0, 1), Mask: net.CIDRMask(8, 32)}}
+	interfaceAddrs = func() ([]net.Addr, error) { return loopback, nil }
+
+	ml := NewMetaListener()
+	defer ml.Close()
+	// Binding fails while the address is gone, as it would on a real host
+	var created atomic.Int32
+	var up atomic.Bool
+	up.Store(true)
+	factory := func() (net.Listener, error) {
+		if !up.Load() {
+			return nil, errors.New("cannot assign requested address")
+		}
+		created.Add(1)
+		return net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err := ml.AddListenerFactory("tcp", factory); err != nil {
+		t.Fatal(err)
+	}
+	if err := ml.AddListenerFactory("tcp", factory); err == nil {
+		t.Error("AddListenerFactory accepted a duplicate ID")
+	}
+
+	ml.reconcileInterfaces()
+	if n := created.Load(); n != 1 {
+		t.Errorf("Listener created %d times while its address is present", n)
+	}
+
+	up.Store(false)
+	interfaceAddrs = func() ([]net.Addr, error) { return nil, nil }
+	ml.reconcileInterfaces()
+	if ml.Count() != 0 {
+		t.Errorf("Listener kept after its address disappeared: %v", ml.ListenerIDs())
+	}
+
+	up.Store(true)
+	interfaceAddrs = func() ([]net.Addr, error) { return loopback, nil }
+	ml.reconcileInterfaces()
+	if ml.Count() != 1 || created.Load() != 2 {
+		t.Fatalf("Listener not re-created: %v, %d creations", ml.ListenerIDs(), created.Load())
+	}
+
+	// The re-created listener serves connections
+	conn, err := net.Dial("tcp", ml.Addr().(*MetaAddr).addresses[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	accepted := make(chan error, 1)
+	go func() {
+		c, err := ml.Accept()
+		if err == nil {
+			c.Close()
+		}
+		accepted <- err
+	}()
+	select {
+	case err := <-accepted:
+		if err != nil {
+			t.Errorf("Accept: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Re-created listener accepted nothing")
+	}
+
+	// Removed listeners stay removed
+	if err := ml.RemoveListener("tcp"); err != nil {
+		t.Fatal(err)
+	}
+	ml.reconcileInterfaces()
+	if ml.Count() != 0 {
+		t.Errorf("Removed listener re-created: %v", ml.ListenerIDs())
+	}
+}
+
+// TestWatchInterfaces verifies that the watcher starts once and stops with
+// the MetaListener.
+func TestWatchInterfaces(t *testing.T) {
+	ml := NewMetaListener()
+	if err := ml.WatchInterfaces(10 * time.Millisecond); err != nil {
+		t.Fatalf("WatchInterfaces: %v", err)
+	}
+	if err := ml.WatchInterfaces(0); err == nil {
+		t.Error("Second WatchInterfaces succeeded")
+	}
+	time.Sleep(50 * time.Millisecond)
+	ml.Close()
+	if err := ml.WatchInterfaces(0); err == nil {
+		t.Error("WatchInterfaces succeeded after Close")
+	}
+}